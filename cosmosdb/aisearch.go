@@ -0,0 +1,370 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const (
+	searchAPIVersion = "2024-07-01"
+	searchScope      = "https://search.azure.com/.default"
+	// maximum number of documents in an indexing request of Azure AI Search
+	maxSearchBatch = 1000
+)
+
+// SearchDocument is a message mirrored into a search index with WithSearchIndex.
+type SearchDocument struct {
+	// ID is the ID of the message, the key of the index.
+	ID        string    `json:"id"`
+	SessionID string    `json:"sessionId"`
+	UserID    string    `json:"userId"`
+	Type      string    `json:"type"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Embedding is the embedding of the message, if it has one.
+	Embedding []float32 `json:"embedding,omitempty"`
+}
+
+// SearchIndexQuery is a query of a SearchIndex.
+type SearchIndexQuery struct {
+	// Text is searched in the message contents.
+	Text string
+	// Vector (optional) is compared with the message embeddings, combined with Text if both are set.
+	Vector []float32
+	// UserID limits the results to the messages of the user.
+	UserID string
+	// SessionID (optional) limits the results to the messages of the session.
+	SessionID string
+	// Top is the maximum number of results.
+	Top int
+}
+
+// SearchIndexResult is a message found by a SearchIndex.
+type SearchIndexResult struct {
+	SearchDocument
+	// Score is the relevance of the message as computed by the index, higher is more relevant.
+	Score float64
+}
+
+// SearchIndex is an external search index the messages are mirrored into, e.g. Azure AI Search.
+type SearchIndex interface {
+	// Upload adds or replaces the documents.
+	Upload(ctx context.Context, documents []SearchDocument) error
+	// DeleteSession removes the documents of the session.
+	DeleteSession(ctx context.Context, userID, sessionID string) error
+	// Search returns the documents matching the query, most relevant first.
+	Search(ctx context.Context, query SearchIndexQuery) ([]SearchIndexResult, error)
+}
+
+// SearchIndexedMessages searches the messages of the user mirrored into the search index set with
+// WithSearchIndex, most relevant first. With an embedder (see WithEmbedder), the query is embedded and
+// the index combines keyword and vector search. Messages are searchable once the index processed them,
+// usually within seconds.
+func (h *CosmosDBChatMessageHistory) SearchIndexedMessages(ctx context.Context, query string, k int) ([]SearchIndexResult, error) {
+	if h.searchIndex == nil {
+		return nil, fmt.Errorf("searching indexed messages requires a search index, see WithSearchIndex")
+	}
+	if k <= 0 {
+		return []SearchIndexResult{}, nil
+	}
+
+	indexQuery := SearchIndexQuery{Text: query, UserID: h.userID, Top: k}
+	if h.embedder != nil {
+		vector, err := h.embedder.EmbedQuery(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to embed query: %w", err)
+		}
+		indexQuery.Vector = vector
+	}
+
+	results, err := h.searchIndex.Search(ctx, indexQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search indexed messages: %w", err)
+	}
+	return results, nil
+}
+
+// indexMessages mirrors messages of the session into the search index set with WithSearchIndex.
+func (h *CosmosDBChatMessageHistory) indexMessages(ctx context.Context, messages ...llms.ChatMessage) error {
+	if h.searchIndex == nil {
+		return nil
+	}
+
+	documents := make([]SearchDocument, 0, len(messages))
+	for _, message := range messages {
+		cached, ok := message.(cachedMessage)
+		// messages written by earlier versions have no ID to key the document
+		if !ok || cached.id == "" {
+			continue
+		}
+		document := SearchDocument{
+			ID:        cached.id,
+			SessionID: h.sessionID,
+			UserID:    h.userID,
+			Type:      string(cached.GetType()),
+			Content:   cached.GetContent(),
+			Embedding: cached.embedding,
+		}
+		if cached.createdAt != nil {
+			document.CreatedAt = *cached.createdAt
+		}
+		documents = append(documents, document)
+	}
+	if len(documents) == 0 {
+		return nil
+	}
+
+	if err := h.searchIndex.Upload(ctx, documents); err != nil {
+		return fmt.Errorf("failed to index messages: %w", err)
+	}
+	return nil
+}
+
+// reindexSession replaces the documents of the session in the search index with the stored messages.
+func (h *CosmosDBChatMessageHistory) reindexSession(ctx context.Context, messages []llms.ChatMessage) error {
+	if h.searchIndex == nil {
+		return nil
+	}
+	if err := h.searchIndex.DeleteSession(ctx, h.userID, h.sessionID); err != nil {
+		return fmt.Errorf("failed to remove messages from the search index: %w", err)
+	}
+	return h.indexMessages(ctx, messages...)
+}
+
+// AzureSearchIndex is a SearchIndex backed by an index of Azure AI Search, e.g. created with CreateIndex.
+type AzureSearchIndex struct {
+	endpoint  string
+	indexName string
+	pipeline  runtime.Pipeline
+}
+
+var _ SearchIndex = &AzureSearchIndex{}
+
+// NewAzureSearchIndex creates a search index client for the index of the Azure AI Search service at
+// endpoint (e.g. https://<service>.search.windows.net) that authenticates with Microsoft Entra ID.
+// The identity needs the Search Index Data Contributor role, and Search Service Contributor for CreateIndex.
+func NewAzureSearchIndex(endpoint, indexName string, cred azcore.TokenCredential, clientOptions *azcore.ClientOptions) (*AzureSearchIndex, error) {
+	if cred == nil {
+		return nil, fmt.Errorf("azure AI Search credential cannot be nil")
+	}
+	return newAzureSearchIndex(endpoint, indexName, runtime.NewBearerTokenPolicy(cred, []string{searchScope}, nil), clientOptions)
+}
+
+// NewAzureSearchIndexWithKey creates a search index client that authenticates with an admin API key.
+func NewAzureSearchIndexWithKey(endpoint, indexName, apiKey string, clientOptions *azcore.ClientOptions) (*AzureSearchIndex, error) {
+	if apiKey == "" {
+		return nil, fmt.Errorf("azure AI Search API key cannot be empty")
+	}
+	return newAzureSearchIndex(endpoint, indexName, apiKeyPolicy(apiKey), clientOptions)
+}
+
+func newAzureSearchIndex(endpoint, indexName string, auth policy.Policy, clientOptions *azcore.ClientOptions) (*AzureSearchIndex, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("azure AI Search endpoint cannot be empty")
+	}
+	if indexName == "" {
+		return nil, fmt.Errorf("azure AI Search index name cannot be empty")
+	}
+
+	pipeline := runtime.NewPipeline("cosmosdb-chat-history", "", runtime.PipelineOptions{PerRetry: []policy.Policy{auth}}, clientOptions)
+	return &AzureSearchIndex{endpoint: strings.TrimSuffix(endpoint, "/"), indexName: indexName, pipeline: pipeline}, nil
+}
+
+// apiKeyPolicy sets the api-key header of the requests.
+type apiKeyPolicy string
+
+func (p apiKeyPolicy) Do(req *policy.Request) (*http.Response, error) {
+	req.Raw().Header.Set("api-key", string(p))
+	return req.Next()
+}
+
+// CreateIndex creates or updates the index with the fields of SearchDocument. With dimensions > 0, the
+// embedding field is a vector field of that many dimensions searched with HNSW and cosine similarity.
+func (s *AzureSearchIndex) CreateIndex(ctx context.Context, dimensions int) error {
+	type field struct {
+		Name          string `json:"name"`
+		Type          string `json:"type"`
+		Key           bool   `json:"key,omitempty"`
+		Searchable    bool   `json:"searchable"`
+		Filterable    bool   `json:"filterable"`
+		Sortable      bool   `json:"sortable"`
+		Dimensions    int    `json:"dimensions,omitempty"`
+		VectorProfile string `json:"vectorSearchProfile,omitempty"`
+	}
+	fields := []field{
+		{Name: "id", Type: "Edm.String", Key: true, Filterable: true},
+		{Name: "sessionId", Type: "Edm.String", Filterable: true},
+		{Name: "userId", Type: "Edm.String", Filterable: true},
+		{Name: "type", Type: "Edm.String", Filterable: true},
+		{Name: "content", Type: "Edm.String", Searchable: true},
+		{Name: "createdAt", Type: "Edm.DateTimeOffset", Filterable: true, Sortable: true},
+	}
+	definition := map[string]any{"name": s.indexName}
+	if dimensions > 0 {
+		fields = append(fields, field{Name: "embedding", Type: "Collection(Edm.Single)", Searchable: true, Dimensions: dimensions, VectorProfile: "messages"})
+		definition["vectorSearch"] = map[string]any{
+			"algorithms": []any{map[string]any{"name": "hnsw", "kind": "hnsw", "hnswParameters": map[string]any{"metric": "cosine"}}},
+			"profiles":   []any{map[string]any{"name": "messages", "algorithm": "hnsw"}},
+		}
+	}
+	definition["fields"] = fields
+
+	return s.do(ctx, http.MethodPut, s.indexPath(), definition, nil, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+}
+
+// Upload merges or uploads the documents in batches.
+func (s *AzureSearchIndex) Upload(ctx context.Context, documents []SearchDocument) error {
+	actions := make([]map[string]any, 0, len(documents))
+	for _, document := range documents {
+		action := map[string]any{
+			"@search.action": "mergeOrUpload",
+			"id":             document.ID,
+			"sessionId":      document.SessionID,
+			"userId":         document.UserID,
+			"type":           document.Type,
+			"content":        document.Content,
+			"createdAt":      document.CreatedAt,
+		}
+		if document.Embedding != nil {
+			action["embedding"] = document.Embedding
+		}
+		actions = append(actions, action)
+	}
+	return s.index(ctx, actions)
+}
+
+// DeleteSession looks up the documents of the session and deletes them.
+func (s *AzureSearchIndex) DeleteSession(ctx context.Context, userID, sessionID string) error {
+	for {
+		var found struct {
+			Value []struct {
+				ID string `json:"id"`
+			} `json:"value"`
+		}
+		query := map[string]any{
+			"filter": "userId eq " + searchLiteral(userID) + " and sessionId eq " + searchLiteral(sessionID),
+			"select": "id",
+			"top":    maxSearchBatch,
+		}
+		if err := s.do(ctx, http.MethodPost, s.indexPath()+"/docs/search", query, &found, http.StatusOK); err != nil {
+			return err
+		}
+		if len(found.Value) == 0 {
+			return nil
+		}
+
+		actions := make([]map[string]any, 0, len(found.Value))
+		for _, document := range found.Value {
+			actions = append(actions, map[string]any{"@search.action": "delete", "id": document.ID})
+		}
+		if err := s.index(ctx, actions); err != nil {
+			return err
+		}
+		if len(found.Value) < maxSearchBatch {
+			return nil
+		}
+	}
+}
+
+// Search runs a keyword, vector or hybrid query filtered by user and session.
+func (s *AzureSearchIndex) Search(ctx context.Context, query SearchIndexQuery) ([]SearchIndexResult, error) {
+	filters := []string{"userId eq " + searchLiteral(query.UserID)}
+	if query.SessionID != "" {
+		filters = append(filters, "sessionId eq "+searchLiteral(query.SessionID))
+	}
+	request := map[string]any{
+		"filter": strings.Join(filters, " and "),
+		"select": "id,sessionId,userId,type,content,createdAt",
+		"top":    query.Top,
+	}
+	if query.Text != "" {
+		request["search"] = query.Text
+	}
+	if len(query.Vector) > 0 {
+		request["vectorQueries"] = []any{map[string]any{"kind": "vector", "vector": query.Vector, "fields": "embedding", "k": query.Top}}
+	}
+
+	var found struct {
+		Value []struct {
+			SearchDocument
+			Score float64 `json:"@search.score"`
+		} `json:"value"`
+	}
+	if err := s.do(ctx, http.MethodPost, s.indexPath()+"/docs/search", request, &found, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	results := make([]SearchIndexResult, 0, len(found.Value))
+	for _, document := range found.Value {
+		results = append(results, SearchIndexResult{SearchDocument: document.SearchDocument, Score: document.Score})
+	}
+	return results, nil
+}
+
+// index sends the document actions in batches and fails if any of them failed.
+func (s *AzureSearchIndex) index(ctx context.Context, actions []map[string]any) error {
+	for start := 0; start < len(actions); start += maxSearchBatch {
+		batch := actions[start:min(start+maxSearchBatch, len(actions))]
+		var result struct {
+			Value []struct {
+				Key          string `json:"key"`
+				Status       bool   `json:"status"`
+				ErrorMessage string `json:"errorMessage"`
+			} `json:"value"`
+		}
+		// 207 reports that some of the actions failed
+		err := s.do(ctx, http.MethodPost, s.indexPath()+"/docs/index", map[string]any{"value": batch}, &result, http.StatusOK, http.StatusMultiStatus)
+		if err != nil {
+			return err
+		}
+		for _, item := range result.Value {
+			if !item.Status {
+				return fmt.Errorf("failed to index document %s: %s", item.Key, item.ErrorMessage)
+			}
+		}
+	}
+	return nil
+}
+
+// do sends a JSON request to the service and decodes the response into result, if not nil.
+func (s *AzureSearchIndex) do(ctx context.Context, method, path string, body, result any, statusCodes ...int) error {
+	req, err := runtime.NewRequest(ctx, method, s.endpoint+path+"?api-version="+searchAPIVersion)
+	if err != nil {
+		return err
+	}
+	req.Raw().Header.Set("Accept", "application/json")
+	if err := runtime.MarshalAsJSON(req, body); err != nil {
+		return err
+	}
+
+	resp, err := s.pipeline.Do(req)
+	if err != nil {
+		return err
+	}
+	if !runtime.HasStatusCode(resp, statusCodes...) {
+		return runtime.NewResponseError(resp)
+	}
+	if result == nil {
+		return nil
+	}
+	return runtime.UnmarshalAsJSON(resp, result)
+}
+
+// indexPath returns the path of the index.
+func (s *AzureSearchIndex) indexPath() string {
+	return "/indexes/" + url.PathEscape(s.indexName)
+}
+
+// searchLiteral quotes a string for an OData filter of Azure AI Search.
+func searchLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,95 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Attachment describes a file attached to a message. The file itself is stored elsewhere, e.g. in Azure Blob Storage.
+type Attachment struct {
+	Name     string `json:"name"`
+	MIMEType string `json:"mimeType,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	URL      string `json:"url,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+// MessageAttachment is an attachment along with the ID of the message it is attached to.
+type MessageAttachment struct {
+	MessageID string
+	Attachment
+}
+
+// AddMessageWithAttachments adds a message along with the files attached to it, so that the
+// attachments are kept with the transcript instead of a separate table. They are returned by
+// StoredMessages and ListAttachments.
+func (h *CosmosDBChatMessageHistory) AddMessageWithAttachments(ctx context.Context, message llms.ChatMessage, attachments ...Attachment) error {
+	if message == nil {
+		return fmt.Errorf("cannot add nil message")
+	}
+	for _, attachment := range attachments {
+		if attachment.Name == "" {
+			return fmt.Errorf("attachment name is mandatory")
+		}
+	}
+	return h.AddMessage(ctx, cachedMessage{ChatMessage: message, attachments: attachments})
+}
+
+// ListAttachments returns the attachments of all messages of the session, oldest first. The
+// attachments are selected server side unless the document is compressed or chunked.
+func (h *CosmosDBChatMessageHistory) ListAttachments(ctx context.Context) ([]MessageAttachment, error) {
+	ctx = h.readContext(ctx)
+	query := "SELECT ARRAY(SELECT m.id, m.attachments FROM m IN c.messages WHERE IS_DEFINED(m.attachments)) AS messages, " +
+		"c.chunks, c.compression FROM c WHERE c.id = @id"
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@id", Value: h.sessionID}},
+	}
+
+	var session *struct {
+		Messages    []Message `json:"messages"`
+		Chunks      []string  `json:"chunks"`
+		Compression string    `json:"compression"`
+	}
+
+	pager := h.readContainer(ctx).NewQueryItemsPager(h.mapQuery(query), h.partitionKey(), h.withSessionToken(ctx, &queryOptions))
+	for pager.More() && session == nil {
+		page, err := pager.NextPage(h.requestContext(ctx))
+		err = h.recordCharge(OperationQuery, page.RequestCharge, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query attachments of sessionID %s: %w", h.sessionID, err)
+		}
+		if len(page.Items) > 0 {
+			if err := json.Unmarshal(page.Items[0], &session); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal attachments: %w", err)
+			}
+		}
+	}
+
+	attachments := []MessageAttachment{}
+	if session == nil {
+		return attachments, nil
+	}
+
+	messages := session.Messages
+	if session.Compression != "" || len(session.Chunks) > 0 {
+		history, _, err := h.readHistory(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if history == nil {
+			return attachments, nil
+		}
+		messages = history.ChatMessages
+	}
+
+	for _, message := range messages {
+		for _, attachment := range message.Attachments {
+			attachments = append(attachments, MessageAttachment{MessageID: message.ID, Attachment: attachment})
+		}
+	}
+	return attachments, nil
+}
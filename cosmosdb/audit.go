@@ -0,0 +1,127 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// AuditAction is the kind of modification recorded in an AuditEvent.
+type AuditAction string
+
+const (
+	// AuditAdd is recorded by AddMessage (including the Add* helpers) and AddMessageIfLast.
+	AuditAdd AuditAction = "add"
+	// AuditSet is recorded by SetMessages and SetSystemMessage.
+	AuditSet AuditAction = "set"
+	// AuditClear is recorded by Clear.
+	AuditClear AuditAction = "clear"
+	// AuditDelete is recorded by DeleteMessage.
+	AuditDelete AuditAction = "delete"
+	// AuditUpdate is recorded by UpdateMessage.
+	AuditUpdate AuditAction = "update"
+	// AuditRedact is recorded by RedactMessage.
+	AuditRedact AuditAction = "redact"
+	// AuditTrim is recorded by TrimToLastN and TrimBefore.
+	AuditTrim AuditAction = "trim"
+	// AuditPurge is recorded by HistoryFactory.DeleteUserData.
+	AuditPurge AuditAction = "purge"
+)
+
+// AuditEvent records who modified a conversation, how and when.
+type AuditEvent struct {
+	ID     string      `json:"id"`
+	Action AuditAction `json:"action"`
+	// SessionID is empty for AuditPurge events, which cover all sessions of the user.
+	SessionID string `json:"sessionId,omitempty"`
+	UserID    string `json:"userid"`
+	// Actor is the actor set with WithAuditLog, e.g. the operator or service that made the change.
+	Actor string `json:"actor,omitempty"`
+	// MessageIDs are the IDs of the added, edited or removed messages, or the stored messages after AuditSet.
+	MessageIDs []string `json:"messageIds,omitempty"`
+	// CorrelationID is the correlation ID of the request, see WithCorrelationID.
+	CorrelationID string    `json:"correlationId,omitempty"`
+	Time          time.Time `json:"time"`
+}
+
+// AuditLog records the modifications of conversations, e.g. so that regulated deployments can prove
+// when transcripts were modified or purged. Implementations must be safe for concurrent use.
+type AuditLog interface {
+	Record(ctx context.Context, event AuditEvent) error
+}
+
+// AuditFunc is an AuditLog calling a function for every event, e.g. to publish it to an event stream.
+type AuditFunc func(ctx context.Context, event AuditEvent) error
+
+// Record calls f(ctx, event).
+func (f AuditFunc) Record(ctx context.Context, event AuditEvent) error {
+	return f(ctx, event)
+}
+
+// ContainerAuditLog is an AuditLog that creates one item per event in a Cosmos DB container, separate
+// from the conversations. Items are only ever created, never replaced or deleted, so the container
+// holds an append-only trail; restrict the write permissions accordingly.
+type ContainerAuditLog struct {
+	container *azcosmos.ContainerClient
+}
+
+var _ AuditLog = &ContainerAuditLog{}
+
+// NewContainerAuditLog creates an audit log writing to the given container, which must be partitioned on /userid.
+func NewContainerAuditLog(container *azcosmos.ContainerClient) (*ContainerAuditLog, error) {
+	if container == nil {
+		return nil, fmt.Errorf("audit container client cannot be nil")
+	}
+	return &ContainerAuditLog{container: container}, nil
+}
+
+func (l *ContainerAuditLog) Record(ctx context.Context, event AuditEvent) error {
+	item, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+	_, err = l.container.CreateItem(ctx, azcosmos.NewPartitionKeyString(event.UserID), item, nil)
+	return err
+}
+
+// audit records a successful modification in the audit log set with WithAuditLog. The modification
+// is already stored, so a failure is returned as such.
+func (h *CosmosDBChatMessageHistory) audit(ctx context.Context, action AuditAction, messageIDs ...string) error {
+	if h.auditLog == nil {
+		return nil
+	}
+
+	event := AuditEvent{
+		ID:         uuid.NewString(),
+		Action:     action,
+		SessionID:  h.sessionID,
+		UserID:     h.userID,
+		Actor:      h.auditActor,
+		MessageIDs: messageIDs,
+		Time:       time.Now().UTC(),
+	}
+	if id, ok := CorrelationIDFromContext(h.requestContext(ctx)); ok {
+		event.CorrelationID = id.String()
+	}
+
+	if err := h.auditLog.Record(ctx, event); err != nil {
+		return fmt.Errorf("chat history was modified but recording the audit event failed: %w", err)
+	}
+	return nil
+}
+
+// messageIDs returns the IDs of the messages that have one.
+func messageIDs(messages []llms.ChatMessage) []string {
+	var ids []string
+	for _, message := range messages {
+		if id := MessageID(message); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,156 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BackfillCheckpoint stores the progress of HistoryFactory.BackfillEmbeddings, so that an interrupted
+// backfill resumes where it stopped. The progress is an opaque token, empty before the first and after
+// the last page of sessions.
+type BackfillCheckpoint interface {
+	Load(ctx context.Context) (string, error)
+	Save(ctx context.Context, token string) error
+}
+
+// FileCheckpoint is a BackfillCheckpoint keeping the token in a local file.
+type FileCheckpoint struct {
+	path string
+}
+
+var _ BackfillCheckpoint = &FileCheckpoint{}
+
+// NewFileCheckpoint returns a checkpoint stored at path. The file is created on the first Save.
+func NewFileCheckpoint(path string) *FileCheckpoint {
+	return &FileCheckpoint{path: path}
+}
+
+// Load returns the saved token, or an empty token if nothing was saved yet.
+func (c *FileCheckpoint) Load(ctx context.Context) (string, error) {
+	token, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	return string(token), nil
+}
+
+// Save replaces the saved token. The file is replaced atomically, so that a crash doesn't leave a
+// partial token behind.
+func (c *FileCheckpoint) Save(ctx context.Context, token string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(token); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
+
+// EmbeddingBackfillOptions selects the sessions embedded by HistoryFactory.BackfillEmbeddings.
+type EmbeddingBackfillOptions struct {
+	// UserID limits the backfill to the sessions of the user. If empty, the sessions of all users are
+	// embedded with a cross-partition query.
+	UserID string
+	// Tags limits the backfill to sessions having all of the tags.
+	Tags []string
+	// CreatedSince and CreatedBefore limit the backfill to sessions created in [CreatedSince, CreatedBefore).
+	// Zero values are ignored. Sessions created by earlier versions have no creation time and are excluded.
+	CreatedSince  time.Time
+	CreatedBefore time.Time
+	// Checkpoint (optional) stores the progress after every page of sessions. A backfill started with the
+	// checkpoint of an interrupted one skips the pages that were completed. Use a new checkpoint, or the
+	// same one once the backfill completed, to start from the beginning.
+	Checkpoint BackfillCheckpoint
+	// OnError (optional) is called with the sessions that could not be embedded, which are then skipped.
+	// Without it, the backfill stops at the first failed session. Sessions that are closed are always skipped.
+	OnError func(sessionID, userID string, err error)
+	// OnSession (optional) is called with the number of messages embedded in each session, e.g. to report progress.
+	OnSession func(sessionID, userID string, embedded int)
+}
+
+// EmbeddingBackfillResult is the outcome of HistoryFactory.BackfillEmbeddings.
+type EmbeddingBackfillResult struct {
+	// Sessions is the number of sessions visited.
+	Sessions int
+	// Messages is the number of messages embedded.
+	Messages int
+	// Failed is the number of sessions passed to OnError.
+	Failed int
+}
+
+// BackfillEmbeddings walks the selected sessions and embeds their messages that have no embedding yet
+// (see CosmosDBChatMessageHistory.BackfillEmbeddings), e.g. when vector search is enabled on a container
+// with existing conversations. The embedder is the one set with WithEmbedder in the factory options.
+// Sessions are embedded one after the other, and messages embedded by an earlier run are not embedded
+// again, so the backfill can be run repeatedly. With a Checkpoint, the progress is saved after every page
+// of sessions and an interrupted backfill resumes after the last completed page. opts may be nil.
+func (f *HistoryFactory) BackfillEmbeddings(ctx context.Context, opts *EmbeddingBackfillOptions) (EmbeddingBackfillResult, error) {
+	if opts == nil {
+		opts = &EmbeddingBackfillOptions{}
+	}
+	if f.userSettings(opts.UserID).embedder == nil {
+		return EmbeddingBackfillResult{}, fmt.Errorf("backfilling embeddings requires an embedder, see WithEmbedder")
+	}
+
+	var continuation string
+	if opts.Checkpoint != nil {
+		token, err := opts.Checkpoint.Load(ctx)
+		if err != nil {
+			return EmbeddingBackfillResult{}, err
+		}
+		continuation = token
+	}
+
+	var result EmbeddingBackfillResult
+	selection := &ListSessionsOptions{Tags: opts.Tags, CreatedSince: opts.CreatedSince, CreatedBefore: opts.CreatedBefore}
+	embed := func(h *CosmosDBChatMessageHistory) error {
+		result.Sessions++
+		embedded, err := h.BackfillEmbeddings(ctx)
+		result.Messages += embedded
+		switch {
+		case err == nil, errors.Is(err, ErrSessionClosed):
+		case opts.OnError != nil && ctx.Err() == nil:
+			result.Failed++
+			opts.OnError(h.sessionID, h.userID, err)
+		default:
+			return fmt.Errorf("failed to backfill embeddings of session %s: %w", h.sessionID, err)
+		}
+		if opts.OnSession != nil {
+			opts.OnSession(h.sessionID, h.userID, embedded)
+		}
+		return nil
+	}
+	var pageDone func(string) error
+	if opts.Checkpoint != nil {
+		pageDone = func(next string) error {
+			if err := opts.Checkpoint.Save(ctx, next); err != nil {
+				return fmt.Errorf("failed to save backfill checkpoint: %w", err)
+			}
+			return nil
+		}
+	}
+
+	err := f.forEachSessionPage(ctx, opts.UserID, selection, continuation, embed, pageDone)
+	return result, err
+}
@@ -0,0 +1,137 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultCoolDown         = 30 * time.Second
+)
+
+// CircuitBreakerOptions configures a CircuitBreaker.
+type CircuitBreakerOptions struct {
+	// FailureThreshold is the number of consecutive failed requests that opens the circuit, 5 by default.
+	// Network errors, timeouts and 408 and 5xx responses are failures; cancelled requests are ignored.
+	FailureThreshold int
+	// CoolDown is how long an open circuit fails requests right away before letting a trial request
+	// through, 30 seconds by default.
+	CoolDown time.Duration
+	// OnStateChange is called when the circuit opens or closes again, e.g. to alert on a degraded region.
+	OnStateChange func(open bool)
+}
+
+// CircuitBreaker is an azcore pipeline policy that fails requests fast with a *CircuitOpenError once
+// Cosmos DB failed FailureThreshold consecutive times, so that a degraded region doesn't stall every
+// chat request with long timeouts. After the cool-down a single trial request is let through: the
+// circuit closes if it succeeds, and stays open for another cool-down otherwise.
+//
+// Add it to the PerCallPolicies of the azcosmos.ClientOptions (e.g. passed to NewHistoryFactoryWithKey
+// or set in Config.ClientOptions), so that it sees the outcome of a request after its retries.
+type CircuitBreaker struct {
+	opts CircuitBreakerOptions
+
+	mu sync.Mutex
+	// consecutive failures while closed
+	failures int
+	open     bool
+	openedAt time.Time
+	// a trial request of an open circuit is in flight
+	probing bool
+}
+
+var _ policy.Policy = &CircuitBreaker{}
+
+// NewCircuitBreaker creates a circuit breaker with the given options.
+func NewCircuitBreaker(opts CircuitBreakerOptions) (*CircuitBreaker, error) {
+	if opts.FailureThreshold < 0 {
+		return nil, fmt.Errorf("circuit breaker failure threshold cannot be negative")
+	}
+	if opts.CoolDown < 0 {
+		return nil, fmt.Errorf("circuit breaker cool-down cannot be negative")
+	}
+	if opts.FailureThreshold == 0 {
+		opts.FailureThreshold = defaultFailureThreshold
+	}
+	if opts.CoolDown == 0 {
+		opts.CoolDown = defaultCoolDown
+	}
+	return &CircuitBreaker{opts: opts}, nil
+}
+
+// Open reports whether the circuit is open, i.e. requests fail fast.
+func (b *CircuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+func (b *CircuitBreaker) Do(req *policy.Request) (*http.Response, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+
+	resp, err := req.Next()
+	switch {
+	case errors.Is(err, context.Canceled):
+		b.release()
+	case err != nil || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode >= http.StatusInternalServerError:
+		b.report(false)
+	default:
+		b.report(true)
+	}
+	return resp, err
+}
+
+// allow returns a *CircuitOpenError if the circuit is open, unless the cool-down passed and no other
+// trial request is in flight.
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return nil
+	}
+	retryAt := b.openedAt.Add(b.opts.CoolDown)
+	if b.probing || time.Now().Before(retryAt) {
+		return &CircuitOpenError{RetryAt: retryAt}
+	}
+	b.probing = true
+	return nil
+}
+
+// report records the outcome of a request, opening or closing the circuit.
+func (b *CircuitBreaker) report(success bool) {
+	b.mu.Lock()
+	wasOpen := b.open
+	b.probing = false
+	if success {
+		b.failures = 0
+		b.open = false
+	} else if b.failures++; b.open || b.failures >= b.opts.FailureThreshold {
+		b.failures = 0
+		b.open = true
+		b.openedAt = time.Now()
+	}
+	changed := b.open != wasOpen
+	open := b.open
+	b.mu.Unlock()
+
+	if changed && b.opts.OnStateChange != nil {
+		b.opts.OnStateChange(open)
+	}
+}
+
+// release ends a trial request without an outcome, so that the next request is tried instead.
+func (b *CircuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
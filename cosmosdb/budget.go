@@ -0,0 +1,153 @@
+package cosmosdb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BudgetScope is the key a RUBudget tracks the request units by.
+type BudgetScope string
+
+const (
+	// BudgetPerUser limits the request units of all sessions of a user.
+	BudgetPerUser BudgetScope = "user"
+	// BudgetPerSession limits the request units of each session.
+	BudgetPerSession BudgetScope = "session"
+)
+
+// RUBudgetOptions configures a RUBudget.
+type RUBudgetOptions struct {
+	// Limit is the number of request units a user or session may consume per window.
+	Limit float64
+	// Window is the length of the period the limit applies to, e.g. an hour.
+	Window time.Duration
+	// Scope selects whether the limit applies per user (default) or per session.
+	Scope BudgetScope
+	// OnExceeded is called once per window when a user or session exceeds the limit, with the
+	// user or session ID and the request units spent. If set, operations are not rejected.
+	OnExceeded func(key string, spent float64)
+}
+
+// RUBudget tracks the request units consumed by users or sessions and rejects further operations
+// once a limit is hit, protecting a shared container from a single runaway conversation. Charges are
+// tracked in memory, so share one budget between the histories of a process, e.g. by passing
+// WithRUBudget to NewHistoryFactory.
+type RUBudget struct {
+	opts RUBudgetOptions
+
+	mu    sync.Mutex
+	spent map[string]*budgetWindow
+	// time the expired windows were last removed
+	pruned time.Time
+}
+
+// budgetWindow holds the request units spent since start.
+type budgetWindow struct {
+	start    time.Time
+	spent    float64
+	notified bool
+}
+
+// NewRUBudget creates a budget with the given options.
+func NewRUBudget(opts RUBudgetOptions) (*RUBudget, error) {
+	if opts.Limit <= 0 {
+		return nil, fmt.Errorf("RU budget limit must be positive")
+	}
+	if opts.Window <= 0 {
+		return nil, fmt.Errorf("RU budget window must be positive")
+	}
+	switch opts.Scope {
+	case "":
+		opts.Scope = BudgetPerUser
+	case BudgetPerUser, BudgetPerSession:
+	default:
+		return nil, fmt.Errorf("invalid RU budget scope %q", opts.Scope)
+	}
+
+	return &RUBudget{opts: opts, spent: map[string]*budgetWindow{}, pruned: time.Now()}, nil
+}
+
+// Spent returns the request units spent by the user or session (depending on the scope) in the current window.
+func (b *RUBudget) Spent(key string) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if w := b.current(key, time.Now()); w != nil {
+		return w.spent
+	}
+	return 0
+}
+
+// add records request units spent by key and calls OnExceeded when the limit is crossed.
+func (b *RUBudget) add(key string, charge float64) {
+	b.mu.Lock()
+	now := time.Now()
+	w := b.current(key, now)
+	if w == nil {
+		w = &budgetWindow{start: now}
+		b.spent[key] = w
+	}
+	w.spent += charge
+
+	notify := b.opts.OnExceeded != nil && !w.notified && w.spent >= b.opts.Limit
+	if notify {
+		w.notified = true
+	}
+	spent := w.spent
+	b.mu.Unlock()
+
+	if notify {
+		b.opts.OnExceeded(key, spent)
+	}
+}
+
+// check returns ErrBudgetExceeded if key spent its budget and operations are rejected.
+func (b *RUBudget) check(key string) error {
+	if b.opts.OnExceeded != nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if w := b.current(key, time.Now()); w != nil && w.spent >= b.opts.Limit {
+		return fmt.Errorf("%w: %s spent %.2f of %.2f RU, the budget resets at %s", ErrBudgetExceeded, key, w.spent, b.opts.Limit, w.start.Add(b.opts.Window).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// current returns the window of key that contains now, or nil if there is none. Expired windows
+// are removed once per window length. The caller must hold b.mu.
+func (b *RUBudget) current(key string, now time.Time) *budgetWindow {
+	if now.Sub(b.pruned) >= b.opts.Window {
+		for k, w := range b.spent {
+			if now.Sub(w.start) >= b.opts.Window {
+				delete(b.spent, k)
+			}
+		}
+		b.pruned = now
+	}
+
+	w, ok := b.spent[key]
+	if !ok || now.Sub(w.start) >= b.opts.Window {
+		return nil
+	}
+	return w
+}
+
+// budgetKey returns the user or session ID the budget of the history is tracked by.
+func (h *CosmosDBChatMessageHistory) budgetKey() string {
+	if h.budget.opts.Scope == BudgetPerSession {
+		return h.sessionID
+	}
+	return h.userID
+}
+
+// checkBudget returns ErrBudgetExceeded if the user or session spent the budget set with WithRUBudget.
+func (h *CosmosDBChatMessageHistory) checkBudget() error {
+	if h.budget == nil {
+		return nil
+	}
+	return h.budget.check(h.budgetKey())
+}
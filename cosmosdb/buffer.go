@@ -0,0 +1,143 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// BufferEvent is reported when messages of a history configured with WithWriteBuffer are only held in
+// memory, where they are lost if the process exits before they are flushed.
+type BufferEvent struct {
+	SessionID string
+	UserID    string
+	// Buffered is the number of messages waiting to be written.
+	Buffered int
+	// Full is set if the buffer is full and the message was not added.
+	Full bool
+	// Err is the error of the failed write.
+	Err error
+}
+
+// BufferRiskFunc is called with a BufferEvent, e.g. to alert or to persist the messages elsewhere.
+type BufferRiskFunc func(BufferEvent)
+
+// Flush writes the messages queued by WithWriteBehind and buffered by WithWriteBuffer, in the order
+// they were added. It returns the error of the first failed write since the last Flush; buffered
+// messages that were not written stay buffered. Call it (or Close) before the process exits to
+// avoid losing messages.
+func (h *CosmosDBChatMessageHistory) Flush(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// a failed write is kept in writeBehindErr
+	_ = h.drain(ctx)
+	err := h.writeBehindErr
+	h.writeBehindErr = nil
+
+	return errors.Join(err, h.flush(ctx))
+}
+
+// flush writes the buffered messages. The caller must hold h.mu.
+func (h *CosmosDBChatMessageHistory) flush(ctx context.Context) error {
+	for len(h.pending) > 0 {
+		message := h.pending[0]
+		if err := h.addMessage(ctx, message); err != nil {
+			h.dropFromCache(message)
+			return fmt.Errorf("failed to flush buffered messages: %w", err)
+		}
+		h.pending = h.pending[1:]
+
+		if err := h.audit(ctx, AuditAdd, MessageID(message)); err != nil {
+			return err
+		}
+		if err := h.afterAdd(ctx, message); err != nil {
+			return err
+		}
+	}
+	h.pending = nil
+	return nil
+}
+
+// buffer holds message in memory if cause is a transient failure and the buffer set with
+// WithWriteBuffer has room for it, and returns cause otherwise.
+func (h *CosmosDBChatMessageHistory) buffer(message llms.ChatMessage, cause error) error {
+	if h.bufferSize == 0 || !isTransientError(cause) {
+		return cause
+	}
+	// a failed append may have left the message in the cache
+	h.dropFromCache(message)
+
+	event := BufferEvent{SessionID: h.sessionID, UserID: h.userID, Buffered: len(h.pending), Err: cause}
+	if len(h.pending) >= h.bufferSize {
+		event.Full = true
+		if h.onBufferRisk != nil {
+			h.onBufferRisk(event)
+		}
+		return fmt.Errorf("write buffer of %d messages is full: %w", h.bufferSize, cause)
+	}
+
+	h.pending = append(h.pending, message)
+	event.Buffered++
+	if h.onBufferRisk != nil {
+		h.onBufferRisk(event)
+	}
+	return nil
+}
+
+// dropFromCache removes message from the in-memory cache if it was added to it.
+func (h *CosmosDBChatMessageHistory) dropFromCache(message llms.ChatMessage) {
+	id := MessageID(message)
+	for i := len(h.messages) - 1; i >= 0; i-- {
+		if MessageID(h.messages[i]) == id {
+			h.messages = append(h.messages[:i:i], h.messages[i+1:]...)
+			return
+		}
+	}
+}
+
+// bufferedMessages returns the stored conversation followed by the buffered messages, after trying to
+// flush them. If Cosmos DB is unavailable, the last known conversation is returned instead.
+func (h *CosmosDBChatMessageHistory) bufferedMessages(ctx context.Context) ([]llms.ChatMessage, error) {
+	if len(h.pending) > 0 {
+		// still buffered on failure
+		_ = h.flush(ctx)
+	}
+
+	messages, err := h.loadMessages(ctx)
+	if err != nil {
+		if !isTransientError(err) {
+			return nil, err
+		}
+		messages = h.messages
+	}
+
+	all := make([]llms.ChatMessage, 0, len(messages)+len(h.pending))
+	all = append(all, messages...)
+	all = append(all, h.pending...)
+	return h.withPinned(plainMessages(all)), nil
+}
+
+// isTransientError reports whether err is a failure of Cosmos DB or the network that may go away
+// on its own, as opposed to a rejected operation.
+func isTransientError(err error) bool {
+	if errors.Is(err, ErrThrottled) || errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) {
+		code := responseErr.StatusCode
+		return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
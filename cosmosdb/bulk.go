@@ -0,0 +1,272 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+const (
+	defaultBulkConcurrency = 8
+	// throttled sessions are retried this many times before their result reports ErrThrottled
+	bulkThrottledRetries = 5
+	// wait before retrying a throttled session if Cosmos DB didn't ask for a delay
+	defaultBulkRetryDelay = time.Second
+)
+
+// BulkSession is a conversation to write with a BulkWriter.
+type BulkSession struct {
+	SessionID string
+	UserID    string
+	Messages  []llms.ChatMessage
+}
+
+// BulkResult is the outcome of writing a BulkSession.
+type BulkResult struct {
+	SessionID string
+	UserID    string
+	// Written is the number of messages written.
+	Written int
+	// RequestCharge is the number of request units consumed by the session.
+	RequestCharge float64
+	Err           error
+}
+
+// BulkWriterOptions configures a BulkWriter.
+type BulkWriterOptions struct {
+	// Concurrency is the number of partitions written in parallel, 8 by default. The sessions of a
+	// partition are written one after the other, so that a single user doesn't exhaust the throughput
+	// of its physical partition.
+	Concurrency int
+	// MaxRUPerSecond limits the request units consumed per second by all writes, leaving throughput for
+	// the live traffic. 0 disables the limit.
+	MaxRUPerSecond float64
+	// Append adds the messages to the stored conversations instead of replacing them. Replacing makes an
+	// interrupted import safe to run again.
+	Append bool
+	// OnResult (optional) is called with the result of every session as soon as it is written, e.g. to
+	// report progress. It is called concurrently.
+	OnResult func(BulkResult)
+}
+
+// BulkWriter writes large numbers of conversations, e.g. when importing historical transcripts, with
+// parallel writes across partitions and a request unit rate limit. Each session is written with a
+// single request where possible, instead of one request per message as with AddMessage. It is safe
+// for concurrent use, and concurrent Write calls share the rate limit.
+type BulkWriter struct {
+	factory *HistoryFactory
+	opts    BulkWriterOptions
+	limiter *ruLimiter
+}
+
+// NewBulkWriter creates a bulk writer for the container of the factory. The histories it writes are
+// created with the options of the factory.
+func (f *HistoryFactory) NewBulkWriter(opts BulkWriterOptions) (*BulkWriter, error) {
+	if opts.Concurrency < 0 {
+		return nil, fmt.Errorf("bulk writer concurrency cannot be negative")
+	}
+	if opts.MaxRUPerSecond < 0 {
+		return nil, fmt.Errorf("bulk writer request unit limit cannot be negative")
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = defaultBulkConcurrency
+	}
+
+	w := &BulkWriter{factory: f, opts: opts}
+	if opts.MaxRUPerSecond > 0 {
+		w.limiter = &ruLimiter{rate: opts.MaxRUPerSecond, last: time.Now()}
+	}
+	return w, nil
+}
+
+// Write writes the sessions and returns their results in the same order. The messages of each session
+// are written in order. The error reports how many sessions failed, wrapping the error of the first
+// one; the results of the other sessions are valid regardless.
+func (w *BulkWriter) Write(ctx context.Context, sessions []BulkSession) ([]BulkResult, error) {
+	results := make([]BulkResult, len(sessions))
+	histories := make([]*CosmosDBChatMessageHistory, len(sessions))
+
+	// Group the sessions by partition, in the order the partitions first appear
+	var partitions [][]int
+	partitionIndex := make(map[string]int)
+	for i, session := range sessions {
+		results[i] = BulkResult{SessionID: session.SessionID, UserID: session.UserID}
+		h, err := w.factory.New(session.SessionID, session.UserID)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		histories[i] = h
+
+		p, ok := partitionIndex[h.partitionKeyValue]
+		if !ok {
+			p = len(partitions)
+			partitionIndex[h.partitionKeyValue] = p
+			partitions = append(partitions, nil)
+		}
+		partitions[p] = append(partitions[p], i)
+	}
+
+	work := make(chan []int)
+	var wg sync.WaitGroup
+	for n := 0; n < min(w.opts.Concurrency, len(partitions)); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partition := range work {
+				for _, i := range partition {
+					results[i] = w.writeSession(ctx, histories[i], sessions[i].Messages, results[i])
+					if w.opts.OnResult != nil {
+						w.opts.OnResult(results[i])
+					}
+				}
+			}
+		}()
+	}
+	for _, partition := range partitions {
+		work <- partition
+	}
+	close(work)
+	wg.Wait()
+
+	var failed int
+	var firstErr error
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = result.Err
+			}
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("failed to write %d of %d sessions: %w", failed, len(sessions), firstErr)
+	}
+	return results, nil
+}
+
+// writeSession writes the messages of a session, retrying after the delay Cosmos DB asks for if the
+// session was throttled.
+func (w *BulkWriter) writeSession(ctx context.Context, h *CosmosDBChatMessageHistory, messages []llms.ChatMessage, result BulkResult) BulkResult {
+	onRequestCharge := h.onRequestCharge
+	h.onRequestCharge = func(operation Operation, charge float64) {
+		if onRequestCharge != nil {
+			onRequestCharge(operation, charge)
+		}
+		w.limiter.spend(charge)
+		result.RequestCharge += charge
+	}
+
+	// the messages keep their IDs when a write is retried
+	remaining := stampMessages(messages)
+	for attempt := 0; ; attempt++ {
+		if err := w.limiter.wait(ctx); err != nil {
+			result.Err = err
+			break
+		}
+
+		written, err := w.write(ctx, h, remaining)
+		result.Written += written
+		remaining = remaining[written:]
+
+		var throttledErr *ThrottledError
+		if !errors.As(err, &throttledErr) || attempt >= bulkThrottledRetries {
+			result.Err = err
+			break
+		}
+		delay := throttledErr.RetryAfter
+		if delay <= 0 {
+			delay = defaultBulkRetryDelay
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			result.Err = errors.Join(err, ctx.Err())
+			return result
+		}
+	}
+	return result
+}
+
+// write replaces the stored conversation with messages, or appends them if Append is set, and returns
+// the number of messages written.
+func (w *BulkWriter) write(ctx context.Context, h *CosmosDBChatMessageHistory, messages []llms.ChatMessage) (int, error) {
+	if !w.opts.Append {
+		if err := h.SetMessages(ctx, messages); err != nil {
+			return 0, err
+		}
+		return len(messages), nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.readOnly {
+		return 0, ErrReadOnly
+	}
+	written, err := h.addMessages(ctx, messages)
+	if written > 0 {
+		if aerr := h.audit(ctx, AuditAdd, messageIDs(messages[:written])...); aerr != nil {
+			return written, errors.Join(err, aerr)
+		}
+		if merr := h.mirrorMessages(ctx, messages[:written]...); merr != nil {
+			return written, errors.Join(err, fmt.Errorf("messages were added but %w", merr))
+		}
+	}
+	return written, err
+}
+
+// ruLimiter limits the request units consumed per second. A request may start once the request units
+// of the earlier requests were paid off at the configured rate. A nil limiter doesn't limit anything.
+type ruLimiter struct {
+	rate float64
+
+	mu sync.Mutex
+	// request units consumed but not paid off yet
+	debt float64
+	last time.Time
+}
+
+// wait blocks until the consumed request units are paid off or ctx is done.
+func (l *ruLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		l.mu.Lock()
+		l.payOff()
+		delay := time.Duration(l.debt / l.rate * float64(time.Second))
+		l.mu.Unlock()
+		if delay <= 0 {
+			return nil
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// spend records request units consumed by a request.
+func (l *ruLimiter) spend(charge float64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.payOff()
+	l.debt += charge
+}
+
+// payOff reduces the debt by the request units available since the last call. The caller must hold l.mu.
+func (l *ruLimiter) payOff() {
+	now := time.Now()
+	l.debt = max(0, l.debt-now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
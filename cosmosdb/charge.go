@@ -0,0 +1,48 @@
+package cosmosdb
+
+import (
+	"math"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// RequestChargeFunc is called with the request units consumed by each Cosmos DB request of a history.
+type RequestChargeFunc func(operation Operation, charge float64)
+
+// LastRequestCharge returns the request units consumed by the last successful Cosmos DB request of
+// this history, e.g. to log the cost of an AddMessage call.
+func (h *CosmosDBChatMessageHistory) LastRequestCharge() float64 {
+	return math.Float64frombits(h.lastRequestCharge.Load())
+}
+
+// record returns a function that records the session token and request charge of an item
+// response to an operation and passes err through (see recordCharge), to be applied to the
+// results of the request.
+func (h *CosmosDBChatMessageHistory) record(operation Operation) func(azcosmos.ItemResponse, error) error {
+	return func(resp azcosmos.ItemResponse, err error) error {
+		if err != nil {
+			return throttled(err)
+		}
+		if resp.SessionToken != nil && *resp.SessionToken != "" {
+			h.sessionToken.Store(resp.SessionToken)
+		}
+		return h.recordCharge(operation, resp.RequestCharge, nil)
+	}
+}
+
+// recordCharge records the request charge of a successful request, reports it to the callback set
+// with WithRequestChargeCallback and charges it to the budget set with WithRUBudget. It returns the
+// error of the request, as a *ThrottledError if the request was throttled.
+func (h *CosmosDBChatMessageHistory) recordCharge(operation Operation, charge float32, err error) error {
+	if err != nil {
+		return throttled(err)
+	}
+	h.lastRequestCharge.Store(math.Float64bits(float64(charge)))
+	if h.onRequestCharge != nil {
+		h.onRequestCharge(operation, float64(charge))
+	}
+	if h.budget != nil {
+		h.budget.add(h.budgetKey(), float64(charge))
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/google/uuid"
+)
+
+// Chunking keeps the history document below the Cosmos DB item size limit (2 MB).
+// The document with the session id (the head) holds the most recent messages. Once adding a message
+// would grow the head beyond the configured size, its messages are moved to a new chunk item and the
+// head keeps the chunk ids (oldest first). Chunk items are immutable and live in the same partition.
+
+const defaultMaxChunkBytes = 1024 * 1024
+
+// appendMessageChunked appends the message to the head document as long as it stays below the
+// chunk size, rolling the current head messages over into a new chunk otherwise.
+func (h *CosmosDBChatMessageHistory) appendMessageChunked(ctx context.Context, message Message, patch azcosmos.PatchOperations) error {
+	size, err := messageSize(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	patch.AppendIncrement("/size", int64(size))
+	// an empty head always accepts the message, even if it is larger than the chunk size on its own
+	patch.SetCondition(fmt.Sprintf("FROM c WHERE %s AND (c.size = 0 OR c.size + %d <= %d)", activeCondition, size, h.maxChunkBytes))
+
+	for attempt := 0; ; attempt++ {
+		err := h.record(OperationPatch)(h.container.PatchItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, patch, h.writeOptions()))
+		if !isPreconditionFailedError(err) {
+			return err
+		}
+		if attempt >= h.maxConflictRetries {
+			return fmt.Errorf("%w: giving up after %d retries", ErrConflict, attempt)
+		}
+		countRetry(ctx)
+
+		err = h.rolloverChunk(ctx, size)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rolloverChunk makes room for a message of the given size in the head document, moving the
+// head messages into a new chunk item if needed. It also initializes the size of documents
+// that were written without chunking.
+func (h *CosmosDBChatMessageHistory) rolloverChunk(ctx context.Context, incoming int) error {
+	item, err := h.container.ReadItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, h.readOptions(ctx))
+	err = h.recordCharge(OperationRead, item.RequestCharge, err)
+	if err != nil {
+		return err
+	}
+
+	head, err := h.unmarshalItem(item.Value)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal history data: %w", err)
+	}
+	if head.Metadata != nil && head.Metadata.Status != "" && head.Metadata.Status != SessionActive {
+		return ErrSessionClosed
+	}
+
+	size := messagesSize(head.ChatMessages)
+
+	var chunkIDs []string
+	if len(head.ChatMessages) > 0 && size+incoming > h.maxChunkBytes {
+		chunkIDs, err = h.createChunks(ctx, [][]Message{head.ChatMessages}, len(head.Chunks))
+		if err != nil {
+			return err
+		}
+		head.Chunks = append(head.Chunks, chunkIDs...)
+		head.ChatMessages = make([]Message, 0)
+		size = 0
+	}
+	head.Size = &size
+	if h.ttl != nil {
+		head.TTL = h.ttl
+	}
+
+	headItem, err := h.marshalHistory(head)
+	if err != nil {
+		_ = h.deleteChunks(ctx, chunkIDs)
+		return fmt.Errorf("failed to marshal chat history: %w", err)
+	}
+
+	err = h.record(OperationReplace)(h.container.ReplaceItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, headItem, h.conditionalWriteOptions(item.ETag)))
+	if err != nil {
+		_ = h.deleteChunks(ctx, chunkIDs)
+		if isConflictError(err) {
+			// somebody else changed the head, the caller retries the append
+			return nil
+		}
+		return fmt.Errorf("failed to roll over chat history chunk: %w", err)
+	}
+
+	return nil
+}
+
+// createChunks writes one chunk item per message group and returns their ids in order. The chunks
+// are numbered from first, the number of chunks the session already has.
+func (h *CosmosDBChatMessageHistory) createChunks(ctx context.Context, chunks [][]Message, first int) ([]string, error) {
+	var ids []string
+	for _, messages := range chunks {
+		// the random suffix keeps chunks of concurrent writers apart
+		id := fmt.Sprintf("%s_chunk_%d_%s", h.sessionID, first+len(ids), uuid.NewString())
+
+		chunk := History{
+			SessionId:    id,
+			UserID:       h.userID,
+			ChatMessages: messages,
+			TTL:          h.ttl,
+			ChunkOf:      h.sessionID,
+		}
+
+		chunkItem, err := h.marshalHistory(chunk)
+		if err != nil {
+			_ = h.deleteChunks(ctx, ids)
+			return nil, fmt.Errorf("failed to marshal chat history chunk: %w", err)
+		}
+		if err := h.checkDocumentSize(len(chunkItem)); err != nil {
+			_ = h.deleteChunks(ctx, ids)
+			return nil, err
+		}
+
+		err = h.record(OperationCreate)(h.container.CreateItem(h.requestContext(ctx), h.partitionKey(), chunkItem, h.writeOptions()))
+		if err != nil {
+			_ = h.deleteChunks(ctx, ids)
+			return nil, fmt.Errorf("failed to create chat history chunk: %w", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// readChunks reads the messages of the given chunk items in order.
+// Chunks that no longer exist (e.g. expired through TTL) are skipped.
+func (h *CosmosDBChatMessageHistory) readChunks(ctx context.Context, ids []string) ([]Message, error) {
+	var messages []Message
+	for _, id := range ids {
+		item, err := h.readContainer(ctx).ReadItem(h.requestContext(ctx), h.partitionKey(), id, h.readOptions(ctx))
+		err = h.recordCharge(OperationRead, item.RequestCharge, err)
+		if err != nil {
+			if isNotFoundError(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read chat history chunk %s: %w", id, err)
+		}
+
+		chunk, err := h.unmarshalItem(item.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal chat history chunk %s: %w", id, err)
+		}
+		messages = append(messages, chunk.ChatMessages...)
+	}
+
+	return messages, nil
+}
+
+// deleteChunks deletes the given chunk items, ignoring the ones that don't exist.
+func (h *CosmosDBChatMessageHistory) deleteChunks(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		err := h.record(OperationDelete)(h.container.DeleteItem(h.requestContext(ctx), h.partitionKey(), id, h.writeOptions()))
+		if err != nil && !isNotFoundError(err) {
+			return fmt.Errorf("failed to delete chat history chunk %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// deleteAllChunks looks up and deletes every chunk item of the session,
+// including chunks that are unknown to this instance.
+func (h *CosmosDBChatMessageHistory) deleteAllChunks(ctx context.Context) error {
+	query := "SELECT c.id FROM c WHERE c.chunkOf = @sessionId"
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@sessionId", Value: h.sessionID}},
+	}
+
+	var ids []string
+	pager := h.container.NewQueryItemsPager(h.mapQuery(query), h.partitionKey(), h.withSessionToken(ctx, &queryOptions))
+	for pager.More() {
+		page, err := pager.NextPage(h.requestContext(ctx))
+		err = h.recordCharge(OperationQuery, page.RequestCharge, err)
+		if err != nil {
+			return fmt.Errorf("failed to query chat history chunks: %w", err)
+		}
+		for _, item := range page.Items {
+			var chunk struct {
+				ID string `json:"id"`
+			}
+			if err := json.Unmarshal(item, &chunk); err != nil {
+				return fmt.Errorf("failed to unmarshal chat history chunk: %w", err)
+			}
+			ids = append(ids, chunk.ID)
+		}
+	}
+
+	return h.deleteChunks(ctx, ids)
+}
+
+// clearChunks removes the chunk items of a cleared session.
+func (h *CosmosDBChatMessageHistory) clearChunks(ctx context.Context, known []string) error {
+	if h.maxChunkBytes > 0 {
+		return h.deleteAllChunks(ctx)
+	}
+	return h.deleteChunks(ctx, known)
+}
+
+// splitChunks groups messages into chunks of at most maxBytes. The last group is returned
+// separately as it is stored in the head document.
+func splitChunks(messages []Message, maxBytes int) ([][]Message, []Message, error) {
+	var (
+		chunks  [][]Message
+		current = make([]Message, 0)
+		size    int
+	)
+
+	for _, message := range messages {
+		n, err := messageSize(message)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal message: %w", err)
+		}
+		if len(current) > 0 && size+n > maxBytes {
+			chunks = append(chunks, current)
+			current = make([]Message, 0)
+			size = 0
+		}
+		current = append(current, message)
+		size += n
+	}
+
+	return chunks, current, nil
+}
+
+func messageSize(message Message) (int, error) {
+	b, err := json.Marshal(message)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func messagesSize(messages []Message) int {
+	var size int
+	for _, message := range messages {
+		n, _ := messageSize(message)
+		size += n
+	}
+	return size
+}
+
+func isPreconditionFailedError(err error) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusPreconditionFailed
+}
@@ -0,0 +1,87 @@
+package cosmosdb
+
+import (
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// NewCosmosDBChatMessageHistoryWithAAD creates a chat history that authenticates to the Cosmos DB
+// account at endpoint using Microsoft Entra ID instead of account keys.
+// If cred is nil, azidentity.DefaultAzureCredential is used (managed identity, workload identity, Azure CLI, etc.).
+// The identity needs a Cosmos DB data plane role (e.g. Cosmos DB Built-in Data Contributor) on the account.
+func NewCosmosDBChatMessageHistoryWithAAD(endpoint string, cred azcore.TokenCredential, databaseID, containerID, sessionID, userID string, opts ...Option) (*CosmosDBChatMessageHistory, error) {
+	client, err := newAADClient(endpoint, cred, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCosmosDBChatMessageHistory(client, databaseID, containerID, sessionID, userID, opts...)
+}
+
+func newAADClient(endpoint string, cred azcore.TokenCredential, clientOptions *azcosmos.ClientOptions) (*azcosmos.Client, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("cosmos DB endpoint cannot be empty")
+	}
+
+	if cred == nil {
+		defaultCred, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create default azure credential: %w", err)
+		}
+		cred = defaultCred
+	}
+
+	client, err := azcosmos.NewClient(endpoint, cred, clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cosmos DB client: %w", err)
+	}
+
+	return client, nil
+}
+
+// NewFromConnectionString creates a chat history from a Cosmos DB connection string
+// of the form "AccountEndpoint=https://<account>.documents.azure.com:443/;AccountKey=<key>;".
+// The underlying client, database and container clients are wired up in one call.
+func NewFromConnectionString(connectionString, databaseID, containerID, sessionID, userID string, opts ...Option) (*CosmosDBChatMessageHistory, error) {
+	client, err := newConnectionStringClient(connectionString, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCosmosDBChatMessageHistory(client, databaseID, containerID, sessionID, userID, opts...)
+}
+
+func newConnectionStringClient(connectionString string, clientOptions *azcosmos.ClientOptions) (*azcosmos.Client, error) {
+	if connectionString == "" {
+		return nil, fmt.Errorf("connection string cannot be empty")
+	}
+
+	client, err := azcosmos.NewClientFromConnectionString(connectionString, clientOptions)
+	if err != nil {
+		// the connection string contains the account key, so it must not end up in the error message
+		return nil, fmt.Errorf("failed to create cosmos DB client from connection string: %w", err)
+	}
+
+	return client, nil
+}
+
+func newKeyClient(endpoint, key string, clientOptions *azcosmos.ClientOptions) (*azcosmos.Client, error) {
+	if endpoint == "" || key == "" {
+		return nil, fmt.Errorf("cosmos DB endpoint and key cannot be empty")
+	}
+
+	cred, err := azcosmos.NewKeyCredential(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key credential: %w", err)
+	}
+
+	client, err := azcosmos.NewClientWithKey(endpoint, cred, clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cosmos DB client: %w", err)
+	}
+
+	return client, nil
+}
@@ -0,0 +1,74 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// CloneOptions controls which part of the conversation CloneSession copies.
+type CloneOptions struct {
+	// UpTo is the number of leading messages to copy, e.g. i+1 to branch from the message at index i.
+	// 0 copies the whole conversation.
+	UpTo int
+}
+
+// CloneSession copies the conversation into a new session in the same partition and returns a history
+// for it with the same options, e.g. to branch a conversation without changing the original transcript.
+// The rolling summary, title and tags are copied as well; the new session is active and gets its own
+// creation time. The copied messages keep their IDs, so they can be matched with the original messages. It fails if newSessionID already exists. opts may be nil.
+func (h *CosmosDBChatMessageHistory) CloneSession(ctx context.Context, newSessionID string, opts *CloneOptions) (*CosmosDBChatMessageHistory, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.readOnly {
+		return nil, ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return nil, err
+	}
+	if newSessionID == "" || newSessionID == h.sessionID {
+		return nil, fmt.Errorf("a new sessionID is required to clone the session")
+	}
+	if opts == nil {
+		opts = &CloneOptions{}
+	}
+	if opts.UpTo < 0 {
+		return nil, fmt.Errorf("number of messages to clone cannot be negative")
+	}
+
+	messages, err := h.loadMessages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if opts.UpTo > 0 && opts.UpTo < len(messages) {
+		messages = messages[:opts.UpTo]
+	}
+
+	clone, err := newHistory(h.container, h.databaseID, newSessionID, h.userID, h.opts...)
+	if err != nil {
+		return nil, err
+	}
+	clone.summary = h.summary
+	if h.metadata != nil {
+		clone.metadata = &SessionMetadata{Title: h.metadata.Title, Tags: h.metadata.Tags}
+	}
+
+	etag, chunkIDs, err := clone.writeHistory(ctx, messages, "")
+	if err != nil {
+		var responseErr *azcore.ResponseError
+		if errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusConflict {
+			return nil, fmt.Errorf("session %s already exists: %w", newSessionID, err)
+		}
+		return nil, fmt.Errorf("failed to clone chat history: %w", err)
+	}
+
+	clone.messages = append(clone.messages, messages...)
+	clone.etag = etag
+	clone.chunkIDs = chunkIDs
+
+	return clone, nil
+}
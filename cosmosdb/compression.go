@@ -0,0 +1,97 @@
+package cosmosdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+const compressionGzip = "gzip"
+
+// compressMessages gzips the JSON encoded messages and returns them base64 encoded.
+func compressMessages(messages []Message) (string, error) {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return "", fmt.Errorf("failed to compress messages: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return "", fmt.Errorf("failed to compress messages: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decompressMessages reverses compressMessages.
+func decompressMessages(compression, encoded string) ([]Message, error) {
+	if compression != compressionGzip {
+		return nil, fmt.Errorf("unsupported message compression %q", compression)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode compressed messages: %w", err)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress messages: %w", err)
+	}
+	defer zr.Close()
+
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress messages: %w", err)
+	}
+
+	var messages []Message
+	if err := json.Unmarshal(raw, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// rewriteWithMessages adds messages by rewriting the whole document, which is needed when the
+// messages are stored compressed. The write is guarded by the ETag of the last read. If another
+// writer modified the session in the meantime, the messages are appended to the current version.
+func (h *CosmosDBChatMessageHistory) rewriteWithMessages(ctx context.Context, added ...llms.ChatMessage) error {
+	added = stampMessages(added)
+
+	for attempt := 0; ; attempt++ {
+		// a session closed according to the cache may have been reopened, so check the current version
+		if h.etag == "" || h.checkActive() != nil {
+			if _, err := h.loadMessages(ctx); err != nil {
+				return err
+			}
+		}
+		if err := h.checkActive(); err != nil {
+			return err
+		}
+
+		messages := make([]llms.ChatMessage, 0, len(h.messages)+len(added))
+		messages = append(messages, h.messages...)
+		messages = append(messages, added...)
+
+		err := h.writeMessages(ctx, h.applyWindow(messages))
+		if err == nil || !isConflictError(err) {
+			return err
+		}
+		if attempt >= h.maxConflictRetries {
+			return fmt.Errorf("%w: giving up after %d retries", ErrConflict, attempt)
+		}
+		countRetry(ctx)
+		h.etag = ""
+	}
+}
@@ -0,0 +1,122 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const defaultMaxConflictRetries = 3
+
+// MergeFunc merges the conversation being written (ours) with the conversation stored by another
+// writer in the meantime (theirs), e.g. to interleave both by creation time. The result is written,
+// conditioned on the version theirs was read from. Messages keep their IDs and creation times, see
+// MessageID and MessageCreatedAt.
+type MergeFunc func(ours, theirs []llms.ChatMessage) []llms.ChatMessage
+
+// replaceMessages replaces the stored conversation with messages. The write is conditioned on the
+// ETag of the last read. If another writer modified the session in the meantime, the document is
+// re-read, messages appended concurrently are merged into messages (or the merge set with
+// WithMergeFunc is applied) and the write is retried.
+func (h *CosmosDBChatMessageHistory) replaceMessages(ctx context.Context, messages []llms.ChatMessage) error {
+	messages = stampMessages(messages)
+	base := h.messages
+	// a session closed according to the cache may have been reopened, so check the current version
+	if h.etag == "" || h.checkActive() != nil {
+		current, err := h.loadMessages(ctx)
+		if err != nil {
+			return err
+		}
+		base = current
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := h.checkActive(); err != nil {
+			return err
+		}
+
+		messages = h.applyWindow(messages)
+		err := h.writeMessages(ctx, messages)
+		if err == nil || !isConflictError(err) {
+			return err
+		}
+		if attempt >= h.maxConflictRetries {
+			return fmt.Errorf("%w: giving up after %d retries", ErrConflict, attempt)
+		}
+		countRetry(ctx)
+
+		theirs, err := h.loadMessages(ctx)
+		if err != nil {
+			return err
+		}
+		if h.mergeFunc != nil {
+			messages = stampMessages(h.mergeFunc(messages, theirs))
+		} else {
+			messages = mergeConcurrentMessages(base, messages, theirs)
+		}
+		base = theirs
+	}
+}
+
+// writeMessages writes messages, conditioned on the ETag of the cached version, and updates the cache.
+func (h *CosmosDBChatMessageHistory) writeMessages(ctx context.Context, messages []llms.ChatMessage) error {
+	etag, chunkIDs, err := h.writeHistory(ctx, messages, h.etag)
+	if err != nil {
+		return err
+	}
+
+	h.messages = make([]llms.ChatMessage, len(messages))
+	copy(h.messages, messages)
+	h.etag = etag
+	h.chunkIDs = chunkIDs
+	return nil
+}
+
+// mergeConcurrentMessages applies our change on top of theirs. base is the conversation our
+// change was derived from. If theirs only appended messages to base, those are kept after ours.
+// Otherwise the other writer rewrote the conversation as well and ours wins.
+func mergeConcurrentMessages(base, ours, theirs []llms.ChatMessage) []llms.ChatMessage {
+	if len(theirs) < len(base) || !sameMessages(base, theirs[:len(base)]) {
+		return ours
+	}
+
+	merged := make([]llms.ChatMessage, 0, len(ours)+len(theirs)-len(base))
+	merged = append(merged, ours...)
+	return append(merged, theirs[len(base):]...)
+}
+
+func sameMessages(a, b []llms.ChatMessage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] == nil || b[i] == nil {
+			if a[i] != b[i] {
+				return false
+			}
+			continue
+		}
+		if a[i].GetType() != b[i].GetType() || a[i].GetContent() != b[i].GetContent() {
+			return false
+		}
+	}
+	return true
+}
+
+// isConflictError reports whether a conditional write failed because the document changed:
+// the ETag no longer matches (412), it was created (409) or deleted (404) by another writer.
+func isConflictError(err error) bool {
+	var responseErr *azcore.ResponseError
+	if !errors.As(err, &responseErr) {
+		return false
+	}
+	switch responseErr.StatusCode {
+	case http.StatusPreconditionFailed, http.StatusConflict, http.StatusNotFound:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// AddMessageIfLast adds the message only if the last stored message has the ID expectedLastMessageID
+// (see StoredMessages), or if the session has no messages when expectedLastMessageID is empty. If the
+// conversation advanced in the meantime, e.g. a message was sent from another browser tab, it returns
+// a *ConversationAdvancedError (matching ErrConflict) and nothing is written.
+// The check and the write are atomic: the message is appended with a patch conditioned on the last
+// message, or, in storage modes that rewrite the document, with a write conditioned on its ETag.
+func (h *CosmosDBChatMessageHistory) AddMessageIfLast(ctx context.Context, message llms.ChatMessage, expectedLastMessageID string) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, finish := h.startOperation(ctx, HistoryWrite)
+	defer func() { finish(err) }()
+
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return err
+	}
+	if message == nil {
+		return fmt.Errorf("cannot add nil message")
+	}
+
+	cached := stampMessage(message)
+	for attempt := 0; ; attempt++ {
+		messages, err := h.loadMessages(ctx)
+		if err != nil {
+			return err
+		}
+		if last := lastMessageID(messages); last != expectedLastMessageID || (last == "" && len(messages) > 0) {
+			return &ConversationAdvancedError{ExpectedLastMessageID: expectedLastMessageID, LastMessageID: last}
+		}
+		if err := h.checkActive(); err != nil {
+			return err
+		}
+
+		appended := make([]llms.ChatMessage, 0, len(messages)+1)
+		appended = append(appended, messages...)
+		appended = append(appended, cached)
+
+		etag := h.etag
+		if etag == "" || h.rewriteOnAdd() || h.maxMessages > 0 || h.maxChunkBytes > 0 || len(h.chunkIDs) > 0 {
+			// create the session, or rewrite it guarded by the ETag of the read
+			err = h.writeMessages(ctx, h.applyWindow(appended))
+		} else {
+			err = h.appendIfLast(ctx, cached, len(messages), expectedLastMessageID)
+			if err == nil {
+				h.messages = appended
+				h.etag = ""
+			} else if isPreconditionFailedError(err) {
+				// the session was changed or closed, unless it is laid out differently (e.g. compressed by another writer)
+				if _, err := h.loadMessages(ctx); err != nil {
+					return err
+				}
+				if h.etag == etag {
+					err = h.writeMessages(ctx, h.applyWindow(appended))
+				}
+			}
+		}
+		if err == nil {
+			if err := h.audit(ctx, AuditAdd, MessageID(cached)); err != nil {
+				return err
+			}
+			return h.afterAdd(ctx, cached)
+		}
+		if !isConflictError(err) {
+			return fmt.Errorf("failed to add message to chat history in Cosmos DB: %w", err)
+		}
+		if attempt >= h.maxConflictRetries {
+			return fmt.Errorf("%w: giving up after %d retries", ErrConflict, attempt)
+		}
+		countRetry(ctx)
+	}
+}
+
+// appendIfLast appends message with a patch conditioned on the stored messages array having
+// count messages, the last one with the given ID.
+func (h *CosmosDBChatMessageHistory) appendIfLast(ctx context.Context, message llms.ChatMessage, count int, lastID string) error {
+	stored, err := h.newMessage(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	condition := fmt.Sprintf("FROM c WHERE %s AND ARRAY_LENGTH(c.messages) = %d", activeCondition, count)
+	if count > 0 {
+		id, err := json.Marshal(lastID)
+		if err != nil {
+			return err
+		}
+		condition += fmt.Sprintf(" AND c.messages[%d].id = %s", count-1, id)
+	}
+
+	patch := h.newAppendPatch(stored)
+	patch.SetCondition(h.mapQuery(condition))
+
+	err = h.record(OperationPatch)(h.container.PatchItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, patch, h.writeOptions()))
+	return err
+}
+
+// lastMessageID returns the ID of the last message, empty if there are no messages or the last
+// message was written by an earlier version of this package, which didn't assign IDs.
+func lastMessageID(messages []llms.ChatMessage) string {
+	if len(messages) == 0 {
+		return ""
+	}
+	if cached, ok := messages[len(messages)-1].(cachedMessage); ok {
+		return cached.id
+	}
+	return ""
+}
@@ -0,0 +1,185 @@
+package cosmosdb
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// CredentialMode selects how the Cosmos DB client authenticates.
+type CredentialMode string
+
+const (
+	// CredentialModeKey uses the account endpoint and account key.
+	CredentialModeKey CredentialMode = "key"
+	// CredentialModeConnectionString uses a connection string containing the endpoint and key.
+	CredentialModeConnectionString CredentialMode = "connection_string"
+	// CredentialModeAAD uses Microsoft Entra ID via DefaultAzureCredential.
+	CredentialModeAAD CredentialMode = "aad"
+)
+
+// Environment variables read by ConfigFromEnv.
+const (
+	EnvEndpoint         = "COSMOSDB_ENDPOINT"
+	EnvCredentialMode   = "COSMOSDB_CREDENTIAL_MODE"
+	EnvKey              = "COSMOSDB_KEY"
+	EnvConnectionString = "COSMOSDB_CONNECTION_STRING"
+	EnvDatabase         = "COSMOSDB_DATABASE"
+	EnvContainer        = "COSMOSDB_CONTAINER"
+	EnvDefaultTTL       = "COSMOSDB_DEFAULT_TTL"
+	// EnvPreferredRegions is a comma separated list of regions, e.g. "West US 2,East US".
+	EnvPreferredRegions = "COSMOSDB_PREFERRED_REGIONS"
+)
+
+// Config holds everything needed to connect to the chat history container.
+type Config struct {
+	Endpoint         string
+	CredentialMode   CredentialMode
+	Key              string
+	ConnectionString string
+	DatabaseID       string
+	ContainerID      string
+	// DefaultTTL is the item level TTL (in seconds) written to every history document.
+	// Zero means the container default applies, -1 means the items never expire.
+	DefaultTTL int
+	// PreferredRegions are the regions of a geo-replicated account the client uses, in order of
+	// preference, e.g. the region the application runs in first. They take precedence over the
+	// PreferredRegions of ClientOptions. See the README for the failover behavior.
+	PreferredRegions []string
+	// ClientOptions are passed to the azcosmos client. May be nil.
+	ClientOptions *azcosmos.ClientOptions
+}
+
+// Validate checks that the config is complete for the selected credential mode.
+func (c Config) Validate() error {
+	if c.DatabaseID == "" || c.ContainerID == "" {
+		return fmt.Errorf("database and container are mandatory")
+	}
+	if c.DefaultTTL < -1 {
+		return fmt.Errorf("invalid default TTL %d: must be -1, 0 or a positive number of seconds", c.DefaultTTL)
+	}
+	for _, region := range c.PreferredRegions {
+		if strings.TrimSpace(region) == "" {
+			return fmt.Errorf("preferred regions cannot be empty")
+		}
+	}
+
+	switch c.CredentialMode {
+	case CredentialModeKey:
+		if c.Endpoint == "" || c.Key == "" {
+			return fmt.Errorf("endpoint and key are mandatory for credential mode %q", c.CredentialMode)
+		}
+	case CredentialModeConnectionString:
+		if c.ConnectionString == "" {
+			return fmt.Errorf("connection string is mandatory for credential mode %q", c.CredentialMode)
+		}
+	case CredentialModeAAD:
+		if c.Endpoint == "" {
+			return fmt.Errorf("endpoint is mandatory for credential mode %q", c.CredentialMode)
+		}
+	default:
+		return fmt.Errorf("unsupported credential mode %q", c.CredentialMode)
+	}
+
+	return nil
+}
+
+// ConfigFromEnv builds a Config from the COSMOSDB_* environment variables.
+// If COSMOSDB_CREDENTIAL_MODE is not set, the mode is inferred: a connection string wins,
+// then a key, otherwise Entra ID is used.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Endpoint:         os.Getenv(EnvEndpoint),
+		CredentialMode:   CredentialMode(os.Getenv(EnvCredentialMode)),
+		Key:              os.Getenv(EnvKey),
+		ConnectionString: os.Getenv(EnvConnectionString),
+		DatabaseID:       os.Getenv(EnvDatabase),
+		ContainerID:      os.Getenv(EnvContainer),
+	}
+
+	if cfg.CredentialMode == "" {
+		switch {
+		case cfg.ConnectionString != "":
+			cfg.CredentialMode = CredentialModeConnectionString
+		case cfg.Key != "":
+			cfg.CredentialMode = CredentialModeKey
+		default:
+			cfg.CredentialMode = CredentialModeAAD
+		}
+	}
+
+	if ttl := os.Getenv(EnvDefaultTTL); ttl != "" {
+		value, err := strconv.Atoi(ttl)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid %s value %q: %w", EnvDefaultTTL, ttl, err)
+		}
+		cfg.DefaultTTL = value
+	}
+
+	if regions := os.Getenv(EnvPreferredRegions); regions != "" {
+		for _, region := range strings.Split(regions, ",") {
+			cfg.PreferredRegions = append(cfg.PreferredRegions, strings.TrimSpace(region))
+		}
+	}
+
+	return cfg, nil
+}
+
+// clientOptions returns the options of the azcosmos client, with the preferred regions applied to a
+// copy of ClientOptions.
+func (c Config) clientOptions() *azcosmos.ClientOptions {
+	if len(c.PreferredRegions) == 0 {
+		return c.ClientOptions
+	}
+
+	var options azcosmos.ClientOptions
+	if c.ClientOptions != nil {
+		options = *c.ClientOptions
+	}
+	options.PreferredRegions = c.PreferredRegions
+	return &options
+}
+
+// NewFromConfig validates the config, creates the Cosmos DB client and returns a factory for per-session histories.
+func NewFromConfig(cfg Config, opts ...Option) (*HistoryFactory, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	var (
+		client *azcosmos.Client
+		err    error
+	)
+
+	clientOptions := cfg.clientOptions()
+	switch cfg.CredentialMode {
+	case CredentialModeKey:
+		client, err = newKeyClient(cfg.Endpoint, cfg.Key, clientOptions)
+	case CredentialModeConnectionString:
+		client, err = newConnectionStringClient(cfg.ConnectionString, clientOptions)
+	case CredentialModeAAD:
+		client, err = newAADClient(cfg.Endpoint, nil, clientOptions)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.DefaultTTL != 0 {
+		opts = append([]Option{WithSessionTTL(cfg.DefaultTTL)}, opts...)
+	}
+
+	return NewHistoryFactory(client, cfg.DatabaseID, cfg.ContainerID, opts...)
+}
+
+// NewFromEnv is a shorthand for ConfigFromEnv followed by NewFromConfig.
+func NewFromEnv(opts ...Option) (*HistoryFactory, error) {
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFromConfig(cfg, opts...)
+}
@@ -0,0 +1,55 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+type readConsistencyKey struct{}
+
+// ContextWithReadConsistency returns a context that reads with the given consistency level instead of
+// the account default, e.g. azcosmos.ConsistencyLevelEventual for a latency-sensitive read path that
+// can tolerate missing the latest messages. It takes precedence over the level set with
+// WithReadConsistency. Only levels weaker than the account default are accepted by Cosmos DB. Pass it
+// to read methods such as Messages; writes are not affected by the consistency level.
+func ContextWithReadConsistency(ctx context.Context, level azcosmos.ConsistencyLevel) context.Context {
+	return context.WithValue(ctx, readConsistencyKey{}, level)
+}
+
+// readConsistencyFromContext returns the level set with ContextWithReadConsistency or readContext.
+func readConsistencyFromContext(ctx context.Context) (azcosmos.ConsistencyLevel, bool) {
+	level, ok := ctx.Value(readConsistencyKey{}).(azcosmos.ConsistencyLevel)
+	return level, ok && level != ""
+}
+
+// readContext returns the context for the reads of a read method, routed to the client set with
+// WithReadClient and with the consistency level set with WithReadConsistency unless ctx carries one already.
+func (h *CosmosDBChatMessageHistory) readContext(ctx context.Context) context.Context {
+	if h.readReplica != nil {
+		ctx = context.WithValue(ctx, readMethodKey{}, true)
+	}
+	if h.readConsistency == "" {
+		return ctx
+	}
+	if _, ok := readConsistencyFromContext(ctx); ok {
+		return ctx
+	}
+	return ContextWithReadConsistency(ctx, h.readConsistency)
+}
+
+// usesSessionToken reports whether reads with the consistency level honor a session token. Eventual
+// and consistent prefix reads don't wait for the replica to catch up with the token.
+func usesSessionToken(level *azcosmos.ConsistencyLevel) bool {
+	return level == nil || (*level != azcosmos.ConsistencyLevelEventual && *level != azcosmos.ConsistencyLevelConsistentPrefix)
+}
+
+// validateConsistencyLevel checks that level is one of the levels supported by Cosmos DB.
+func validateConsistencyLevel(level azcosmos.ConsistencyLevel) error {
+	if !slices.Contains(azcosmos.ConsistencyLevelValues(), level) {
+		return fmt.Errorf("unsupported consistency level %q", level)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CopySessionsOptions selects the sessions copied by CopySessions and how they are written.
+type CopySessionsOptions struct {
+	// UserID limits the copy to the sessions of the user, e.g. to offboard a tenant. If empty, the
+	// sessions of all users are copied with a cross-partition query.
+	UserID string
+	// SessionIDs (optional) limits the copy to the given sessions.
+	SessionIDs []string
+	// Tags limits the copy to sessions having all of the tags.
+	Tags []string
+	// CreatedSince and CreatedBefore limit the copy to sessions created in [CreatedSince, CreatedBefore).
+	// Zero values are ignored. Sessions created by earlier versions have no creation time and are excluded.
+	CreatedSince  time.Time
+	CreatedBefore time.Time
+	// MapSession (optional) returns the session and user ID of a session in the destination, e.g. to
+	// move the sessions to another user. The IDs are kept by default.
+	MapSession func(sessionID, userID string) (string, string)
+	// SessionOptions (optional) returns options for the destination history of a session, applied after
+	// the options of the destination factory, e.g. WithPartitionKey("/sessionId", sessionID) if the
+	// destination container is partitioned differently. It is called with the destination IDs.
+	SessionOptions func(sessionID, userID string) []Option
+	// Transform (optional) modifies a session before it is written, e.g. to scrub personal data when copying
+	// production sessions to a staging environment. Changes of its session and user ID are ignored.
+	Transform func(*SessionExport) error
+	// Overwrite replaces sessions that already exist in the destination. By default they are skipped,
+	// which makes an interrupted copy safe to run again.
+	Overwrite bool
+	// MaxRUPerSecond limits the request units consumed per second by reading and writing the sessions,
+	// leaving throughput for the live traffic. 0 disables the limit.
+	MaxRUPerSecond float64
+}
+
+// CopySessionsResult is the outcome of CopySessions.
+type CopySessionsResult struct {
+	// Copied is the number of sessions written to the destination.
+	Copied int
+	// Skipped is the number of sessions that already existed in the destination.
+	Skipped int
+	// RequestCharge is the number of request units consumed by reading and writing the sessions.
+	RequestCharge float64
+}
+
+// CopySessions copies the selected sessions into the container of dst, which may be in another account
+// and use another partition key or document layout (see the options of dst and SessionOptions). The
+// messages keep their IDs and creation times, and the metadata and rolling summary of the sessions are
+// copied as well. Offloaded contents are loaded and offloaded again if dst has a content store. Sessions
+// throttled by Cosmos DB are retried after the delay it asks for. The copy stops at the first session that
+// fails, the result reports the sessions copied so far. opts may be nil.
+func (f *HistoryFactory) CopySessions(ctx context.Context, dst *HistoryFactory, opts *CopySessionsOptions) (CopySessionsResult, error) {
+	if dst == nil {
+		return CopySessionsResult{}, fmt.Errorf("destination factory cannot be nil")
+	}
+	if opts == nil {
+		opts = &CopySessionsOptions{}
+	}
+	if opts.MaxRUPerSecond < 0 {
+		return CopySessionsResult{}, fmt.Errorf("copy request unit limit cannot be negative")
+	}
+
+	var limiter *ruLimiter
+	if opts.MaxRUPerSecond > 0 {
+		limiter = &ruLimiter{rate: opts.MaxRUPerSecond, last: time.Now()}
+	}
+	var result CopySessionsResult
+	selection := &ListSessionsOptions{SessionIDs: opts.SessionIDs, Tags: opts.Tags, CreatedSince: opts.CreatedSince, CreatedBefore: opts.CreatedBefore}
+	err := f.forEachSession(ctx, opts.UserID, selection, func(src *CosmosDBChatMessageHistory) error {
+		trackCopyCharge(src, limiter, &result.RequestCharge)
+
+		for attempt := 0; ; attempt++ {
+			if err := limiter.wait(ctx); err != nil {
+				return err
+			}
+
+			copied, err := copySession(ctx, src, dst, opts, limiter, &result.RequestCharge)
+			if err == nil {
+				if copied {
+					result.Copied++
+				} else {
+					result.Skipped++
+				}
+				return nil
+			}
+
+			var throttledErr *ThrottledError
+			if !errors.As(err, &throttledErr) || attempt >= bulkThrottledRetries {
+				return fmt.Errorf("failed to copy session %s: %w", src.sessionID, err)
+			}
+			delay := throttledErr.RetryAfter
+			if delay <= 0 {
+				delay = defaultBulkRetryDelay
+			}
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return errors.Join(err, ctx.Err())
+			}
+		}
+	})
+	return result, err
+}
+
+// copySession writes the session of src into the destination. It returns false if the session
+// already exists and is not overwritten.
+func copySession(ctx context.Context, src *CosmosDBChatMessageHistory, dst *HistoryFactory, opts *CopySessionsOptions, limiter *ruLimiter, charge *float64) (bool, error) {
+	sessionID, userID := src.sessionID, src.userID
+	if opts.MapSession != nil {
+		sessionID, userID = opts.MapSession(sessionID, userID)
+	}
+	var sessionOpts []Option
+	if opts.SessionOptions != nil {
+		sessionOpts = opts.SessionOptions(sessionID, userID)
+	}
+	target, err := dst.New(sessionID, userID, sessionOpts...)
+	if err != nil {
+		return false, err
+	}
+	trackCopyCharge(target, limiter, charge)
+
+	src.mu.Lock()
+	export, err := src.exportSession(ctx)
+	src.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if opts.Transform != nil {
+		if err := opts.Transform(&export); err != nil {
+			return false, err
+		}
+	}
+
+	if opts.Overwrite {
+		if err := target.Clear(ctx); err != nil {
+			return false, err
+		}
+	}
+
+	target.mu.Lock()
+	defer target.mu.Unlock()
+
+	err = target.importSession(ctx, export)
+	if isAlreadyExistsError(err) && !opts.Overwrite {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// trackCopyCharge adds the request charges of h to charge and to the rate limit.
+func trackCopyCharge(h *CosmosDBChatMessageHistory, limiter *ruLimiter, charge *float64) {
+	onRequestCharge := h.onRequestCharge
+	h.onRequestCharge = func(operation Operation, requestCharge float64) {
+		if onRequestCharge != nil {
+			onRequestCharge(operation, requestCharge)
+		}
+		limiter.spend(requestCharge)
+		*charge += requestCharge
+	}
+}
@@ -0,0 +1,55 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/google/uuid"
+)
+
+// activityIDHeader is the Cosmos DB header identifying an operation. A value sent by the client
+// is echoed in the response and recorded in the service logs.
+const activityIDHeader = "x-ms-activity-id"
+
+type correlationIDKey struct{}
+
+// ContextWithCorrelationID returns a context that sends id as the activity ID of the Cosmos DB requests
+// made with it, so that failing chat operations can be correlated with the service logs, e.g. in a
+// support ticket. It takes precedence over an ID set with WithCorrelationID. The context replaces
+// headers set with policy.WithHTTPHeader on ctx.
+func ContextWithCorrelationID(ctx context.Context, id uuid.UUID) context.Context {
+	ctx = context.WithValue(ctx, correlationIDKey{}, id)
+	return policy.WithHTTPHeader(ctx, http.Header{activityIDHeader: []string{id.String()}})
+}
+
+// CorrelationIDFromContext returns the correlation ID set with ContextWithCorrelationID.
+func CorrelationIDFromContext(ctx context.Context) (uuid.UUID, bool) {
+	id, ok := ctx.Value(correlationIDKey{}).(uuid.UUID)
+	return id, ok
+}
+
+// ActivityID returns the activity ID of the failed Cosmos DB request in err's chain, which identifies
+// the request in the service logs. It is empty if err was not returned by Cosmos DB.
+func ActivityID(err error) string {
+	var responseErr *azcore.ResponseError
+	if !errors.As(err, &responseErr) || responseErr.RawResponse == nil {
+		return ""
+	}
+	return responseErr.RawResponse.Header.Get(activityIDHeader)
+}
+
+// requestContext returns the context for a Cosmos DB request, with the correlation ID set with
+// WithCorrelationID unless ctx carries one already, and the retry options set with WithThrottlingRetry.
+func (h *CosmosDBChatMessageHistory) requestContext(ctx context.Context) context.Context {
+	ctx = h.withRetryOptions(ctx)
+	if h.correlationID == uuid.Nil {
+		return ctx
+	}
+	if _, ok := CorrelationIDFromContext(ctx); ok {
+		return ctx
+	}
+	return ContextWithCorrelationID(ctx, h.correlationID)
+}
@@ -3,14 +3,23 @@ package cosmosdb
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/google/uuid"
 	"github.com/tmc/langchaingo/llms"
 	"github.com/tmc/langchaingo/schema"
 )
 
+// CosmosDBChatMessageHistory is safe for concurrent use, e.g. by the requests of an HTTP handler
+// sharing one instance per session. Operations on the in-memory cache are serialized.
 type CosmosDBChatMessageHistory struct {
 	databaseID   string
 	containerID  string
@@ -18,14 +27,147 @@ type CosmosDBChatMessageHistory struct {
 	userID       string
 	container    *azcosmos.ContainerClient
 	messages     []llms.ChatMessage
+	// whether messages holds the stored conversation, i.e. it was read at least once (see conversation)
+	loaded bool
+
+	partitionKeyPath  string
+	partitionKeyValue string
+	ttl               *int
+	readOnly          bool
+
+	// etag of the stored document the in-memory messages were loaded from (empty if unknown)
+	etag               azcore.ETag
+	maxConflictRetries int
+	// merges our conversation with the stored one after a conflict (nil for mergeConcurrentMessages)
+	mergeFunc MergeFunc
+
+	maxChunkBytes int
+	compression   bool
+	maxMessages   int
+	maxTokens     int
+	tokenCounter  TokenCounter
+
+	summarizer             llms.Model
+	summarizationThreshold int
+	summarizationKeep      int
+	summaryMaxTokens       int
+	summaryTokenCounter    TokenCounter
+	// rolling summary of the messages folded out of the raw buffer
+	summary string
+	// metadata of the stored session (nil if unknown)
+	metadata *SessionMetadata
+
+	titleModel llms.Model
+
+	// consecutive identical messages added within this window are dropped (0 to disable)
+	dedupeWindow time.Duration
+
+	contentResponseOnWrite bool
+
+	// content of the system message kept at position 0 (empty if none)
+	pinnedSystemMessage string
+
+	contentStore     ContentStore
+	offloadThreshold int
+	// references of contents already in the content store, by content hash
+	offloaded map[string]*ContentRef
+	// ids of the chunk items referenced by the document version in etag
+	chunkIDs []string
+
+	// options the history was created with, applied again to the clones of the session
+	opts []Option
+	// mu guards the in-memory cache (messages, summary, metadata, etag and chunkIDs) and is held
+	// for the whole operation by the methods reading or writing it
+	mu sync.Mutex
+	// offloadMu guards offloaded, which is also used by methods that don't lock mu
+	offloadMu sync.Mutex
+
+	// Cosmos DB session token of the last write (or the one passed with WithSessionToken)
+	sessionToken atomic.Pointer[string]
+
+	// called with the request units of each request (nil if not set)
+	onRequestCharge RequestChargeFunc
+	// request units of the last successful request, as float64 bits
+	lastRequestCharge atomic.Uint64
+	// budget the request units are charged to (nil if not set)
+	budget *RUBudget
+	// receives the messages of failed writes (nil if not set)
+	deadLetterSink DeadLetter
+
+	// messages not written yet because of a transient failure, see WithWriteBuffer
+	pending      []llms.ChatMessage
+	bufferSize   int
+	onBufferRisk BufferRiskFunc
+
+	// messages added but not written yet, see WithWriteBehind (guarded by queueMu)
+	queue     []llms.ChatMessage
+	queueSize int
+	queueMu   sync.Mutex
+	// a write-behind worker is running (guarded by queueMu)
+	writing bool
+	// set by Close (guarded by queueMu)
+	closed bool
+	// set while the queued messages are written
+	draining           bool
+	onWriteBehindError func(error)
+	// first failed write-behind since the last Flush
+	writeBehindErr error
+
+	// receives the timings of read, write and clear operations (nil if not set)
+	operationObserver OperationObserver
+
+	// called when the history document crosses one of the thresholds (nil if not set)
+	onSizeWarning         SizeWarningFunc
+	sizeWarningThresholds []int
+	// last known size of the history document in bytes, -1 if unknown
+	documentSize int
+
+	// activity ID sent with the requests unless the context has one (uuid.Nil if not set)
+	correlationID uuid.UUID
+
+	// records the modifications of the session (nil if not set)
+	auditLog   AuditLog
+	auditActor string
+
+	// retry policy of the requests set with WithRetryPolicy or WithThrottlingRetry (nil to use the client's)
+	retryPolicy *RetryPolicy
+
+	// consistency level of the read methods (empty for the account default)
+	readConsistency azcosmos.ConsistencyLevel
+	// SearchMessages uses FullTextContainsAll instead of CONTAINS
+	fullTextSearch bool
+
+	// dimensions and distance function of the message embeddings set with WithVectorSearch (0 and empty if not set)
+	vectorDimensions int
+	vectorDistance   VectorDistanceFunction
+	// embeds the query of RelevantMessages (nil if not set)
+	embedder Embedder
+	// embeds added messages in the background (nil to embed them in AddMessage)
+	embeddingPipeline *EmbeddingPipeline
+	// mirror of the messages set with WithSearchIndex (nil if not set)
+	searchIndex SearchIndex
+	// RelevantMessages fuses the vector ranking with a keyword ranking
+	hybridSearch bool
+	// encoding of the written messages, set with WithPythonCompatibility or WithSemanticKernelCompatibility
+	messageSchema messageSchema
+	// property names of the session documents, set with WithFieldMapping
+	fields FieldMapping
+	// second container written by WithDualWrite, its history (nil if not set) and whether it missed a write
+	dualWrite       *DualWriteTarget
+	dualWriteTarget *CosmosDBChatMessageHistory
+	dualWriteStale  bool
+
+	// client of the read methods set with WithReadClient, and its container (nil to use container)
+	readClient  *azcosmos.Client
+	readReplica *azcosmos.ContainerClient
 }
 
 // Pre-reqs: 
 // - database and container should be created in advance
-// - container should have partition key as /userid
+// - container should have partition key as /userid (or the path configured with WithPartitionKey)
 // - (optional) container should have TTL set on either the container or item level
 
-func NewCosmosDBChatMessageHistory(client *azcosmos.Client, databaseID, containerID, sessionID, userID string) (*CosmosDBChatMessageHistory, error) {
+func NewCosmosDBChatMessageHistory(client *azcosmos.Client, databaseID, containerID, sessionID, userID string, opts ...Option) (*CosmosDBChatMessageHistory, error) {
 	// Input validation
 	if client == nil {
 		return nil, fmt.Errorf("cosmos DB client cannot be nil")
@@ -34,14 +176,6 @@ func NewCosmosDBChatMessageHistory(client *azcosmos.Client, databaseID, containe
 		return nil, fmt.Errorf("databaseID, containerID, sessionID and userID are mandatory")
 	}
 
-	history := &CosmosDBChatMessageHistory{
-		databaseID:  databaseID,
-		containerID: containerID,
-		sessionID:   sessionID,
-		userID:      userID,
-		messages:   []llms.ChatMessage{},
-	}
-
 	database, err := client.NewDatabase(databaseID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create database client: %w", err)
@@ -52,47 +186,403 @@ func NewCosmosDBChatMessageHistory(client *azcosmos.Client, databaseID, containe
 		return nil, fmt.Errorf("failed to create container client: %w", err)
 	}
 
-	history.container = container
+	return newHistory(container, databaseID, sessionID, userID, opts...)
+}
+
+// newHistory creates a history on top of an existing container client, so that
+// callers like HistoryFactory can share one container client across sessions.
+func newHistory(container *azcosmos.ContainerClient, databaseID, sessionID, userID string, opts ...Option) (*CosmosDBChatMessageHistory, error) {
+	if sessionID == "" || userID == "" {
+		return nil, fmt.Errorf("sessionID and userID are mandatory")
+	}
+	if strings.HasSuffix(sessionID, lockIDSuffix) {
+		return nil, fmt.Errorf("invalid sessionID %q: the suffix %q is reserved for session locks", sessionID, lockIDSuffix)
+	}
+
+	history := &CosmosDBChatMessageHistory{
+		databaseID:  databaseID,
+		containerID: container.ID(),
+		sessionID:   sessionID,
+		userID:      userID,
+		container:   container,
+		messages:   []llms.ChatMessage{},
+
+		partitionKeyPath:  defaultPartitionKeyPath,
+		partitionKeyValue: userID,
+
+		maxConflictRetries: defaultMaxConflictRetries,
+		offloaded:          map[string]*ContentRef{},
+		opts:               opts,
+		documentSize:       -1,
+	}
+
+	for _, opt := range opts {
+		opt(history)
+	}
+
+	if err := validatePartitionKeyPath(history.partitionKeyPath); err != nil {
+		return nil, err
+	}
+	if err := history.fields.validate(); err != nil {
+		return nil, err
+	}
+	if history.partitionKeyValue == "" {
+		return nil, fmt.Errorf("partition key value cannot be empty")
+	}
+	if history.ttl != nil && (*history.ttl == 0 || *history.ttl < -1) {
+		return nil, fmt.Errorf("invalid session TTL %d: must be -1 or a positive number of seconds", *history.ttl)
+	}
+	if history.maxMessages < 0 {
+		return nil, fmt.Errorf("max messages cannot be negative")
+	}
+	if history.maxTokens < 0 {
+		return nil, fmt.Errorf("max tokens cannot be negative")
+	}
+	if history.maxTokens > 0 && history.tokenCounter == nil {
+		return nil, fmt.Errorf("a token counter is required with max tokens")
+	}
+	if history.summaryMaxTokens < 0 {
+		return nil, fmt.Errorf("summary buffer max tokens cannot be negative")
+	}
+	if history.summaryMaxTokens > 0 {
+		if history.summarizationThreshold != 0 {
+			return nil, fmt.Errorf("summary buffer cannot be combined with summarization")
+		}
+		if history.summarizer == nil || history.summaryTokenCounter == nil {
+			return nil, fmt.Errorf("a model and a token counter are required with the summary buffer")
+		}
+	} else if history.summarizer != nil && (history.summarizationThreshold <= 0 || history.summarizationKeep < 0 || history.summarizationKeep >= history.summarizationThreshold) {
+		return nil, fmt.Errorf("summarization threshold must be positive and greater than the number of recent messages to keep")
+	}
+	if history.maxChunkBytes < 0 {
+		return nil, fmt.Errorf("max chunk size cannot be negative")
+	}
+	if history.dedupeWindow < 0 {
+		return nil, fmt.Errorf("dedupe window cannot be negative")
+	}
+	if history.offloadThreshold < 0 {
+		return nil, fmt.Errorf("content offload threshold cannot be negative")
+	}
+	if history.maxConflictRetries < 0 {
+		return nil, fmt.Errorf("max conflict retries cannot be negative")
+	}
+	if history.bufferSize < 0 {
+		return nil, fmt.Errorf("write buffer size cannot be negative")
+	}
+	if history.queueSize < 0 {
+		return nil, fmt.Errorf("write-behind queue size cannot be negative")
+	}
+	if history.readConsistency != "" {
+		if err := validateConsistencyLevel(history.readConsistency); err != nil {
+			return nil, err
+		}
+	}
+	if history.vectorDistance != "" || history.vectorDimensions != 0 {
+		if history.vectorDimensions <= 0 {
+			return nil, fmt.Errorf("vector dimensions must be positive")
+		}
+		if err := validateVectorDistance(history.vectorDistance); err != nil {
+			return nil, err
+		}
+		if history.fields.Messages != "" {
+			return nil, fmt.Errorf("vector search requires the default %s property", defaultMessagesField)
+		}
+	}
+	if history.embeddingPipeline != nil && history.embedder == nil {
+		return nil, fmt.Errorf("the embedding pipeline requires an embedder, see WithEmbedder")
+	}
+	if history.messageSchema != schemaDefault && (history.compression || history.maxChunkBytes > 0 || history.contentStore != nil) {
+		return nil, fmt.Errorf("%s compatibility cannot be combined with compression, chunking or content offloading", history.messageSchema)
+	}
+	if history.readClient != nil {
+		readReplica, err := history.readClient.NewContainer(databaseID, history.containerID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create read container client: %w", err)
+		}
+		history.readReplica = readReplica
+	}
+	if history.dualWrite != nil {
+		target, err := history.newDualWriteTarget(databaseID)
+		if err != nil {
+			return nil, err
+		}
+		history.dualWriteTarget = target
+	}
+	if history.retryPolicy != nil {
+		if err := history.retryPolicy.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, threshold := range history.sizeWarningThresholds {
+		if threshold <= 0 || threshold > maxDocumentBytes {
+			return nil, fmt.Errorf("size warning threshold %d must be positive and at most %d bytes", threshold, maxDocumentBytes)
+		}
+	}
 
 	return history, nil
 }
 
 var _ schema.ChatMessageHistory = &CosmosDBChatMessageHistory{}
 
-func (h *CosmosDBChatMessageHistory) AddMessage(ctx context.Context, message llms.ChatMessage) error {
+// AddMessage appends the message to the stored conversation. The message is added with a patch, or,
+// in storage modes that rewrite the document (compression, token limits), with a write conditioned
+// on the ETag of the last read that is retried on top of the current version. The in-memory cache
+// may be stale, so messages added by other instances of the session are never overwritten.
+func (h *CosmosDBChatMessageHistory) AddMessage(ctx context.Context, message llms.ChatMessage) (err error) {
+	if h.queueSize > 0 {
+		return h.enqueue(ctx, message)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, finish := h.startOperation(ctx, HistoryWrite)
+	defer func() { finish(err) }()
+
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return err
+	}
 	if message == nil {
 		return fmt.Errorf("cannot add nil message")
 	}
 
-	// Add to in-memory cache
-	h.messages = append(h.messages, message)
+	// Drop a message that was already added, e.g. by a retried request
+	if h.dedupeWindow > 0 {
+		duplicate, err := h.isDuplicate(ctx, message)
+		if err != nil && (h.bufferSize == 0 || !isTransientError(err)) {
+			return err
+		}
+		if duplicate {
+			return nil
+		}
+	}
+
+	message, err = h.embedMessage(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	// Messages buffered during an outage are written first to keep the order
+	message = stampMessage(message)
+	if len(h.pending) > 0 {
+		if err := h.flush(ctx); err != nil {
+			return h.deadLetter(ctx, h.buffer(message, err), false, message)
+		}
+	}
+
+	err = h.addMessage(ctx, message)
+	if err != nil {
+		return h.deadLetter(ctx, h.buffer(message, err), false, message)
+	}
+	err = h.audit(ctx, AuditAdd, MessageID(message))
+	if err != nil {
+		return err
+	}
+
+	return h.afterAdd(ctx, message)
+}
+
+// afterAdd maintains the session once a message was added: it generates the title and
+// summarizes older messages if configured.
+func (h *CosmosDBChatMessageHistory) afterAdd(ctx context.Context, message llms.ChatMessage) error {
+	var err error
 
-	var chatMessages []llms.ChatMessageModel
-	for _, msg := range h.messages {
-		chatMessages = append(chatMessages, llms.ConvertChatMessageToModel(msg))
+	// Embed the message in the background
+	if cached, ok := message.(cachedMessage); ok && h.embeddingPipeline != nil && needsEmbedding(cached) {
+		h.embeddingPipeline.submit(h)
 	}
 
-	// Create history document
-	history := History{
-		SessionId:    h.sessionID,
-		UserID:       h.userID,
-		ChatMessages: chatMessages,
+	// Mirror the message into the search index and the dual write target
+	err = h.indexMessages(ctx, message)
+	if err != nil {
+		return fmt.Errorf("message was added but %w", err)
+	}
+	err = h.mirrorMessages(ctx, message)
+	if err != nil {
+		return fmt.Errorf("message was added but %w", err)
+	}
+
+	// Give the session a title once the first exchange is complete
+	if h.titleModel != nil && message.GetType() == llms.ChatMessageTypeAI {
+		err = h.generateTitle(ctx)
+		if err != nil {
+			return fmt.Errorf("message was added but generating the session title failed: %w", err)
+		}
+	}
+
+	// Summarize older messages once the stored conversation grew beyond the threshold
+	if h.summarizationThreshold > 0 {
+		messages, err := h.conversation(ctx)
+		if err != nil {
+			return fmt.Errorf("message was added but reading the chat history failed: %w", err)
+		}
+		if len(messages) > h.summarizationThreshold {
+			err = h.compact(ctx)
+			if err != nil {
+				return fmt.Errorf("message was added but summarizing the chat history failed: %w", err)
+			}
+		}
 	}
 
-	historyItem, err := json.Marshal(history)
+	// Fold the oldest messages into the rolling summary once the stored buffer exceeds its token budget
+	if h.summaryMaxTokens > 0 {
+		messages, err := h.conversation(ctx)
+		if err != nil {
+			return fmt.Errorf("message was added but reading the chat history failed: %w", err)
+		}
+		if len(tokenSuffix(messages, h.summaryMaxTokens, h.summaryTokenCounter)) < len(messages) {
+			err = h.compactBuffer(ctx)
+			if err != nil {
+				return fmt.Errorf("message was added but summarizing the chat history failed: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// afterModify maintains the session once the stored conversation was replaced, edited or trimmed: the
+// search index and the dual write target get the stored messages. The conversation is read again, so
+// that messages appended concurrently are kept in both.
+func (h *CosmosDBChatMessageHistory) afterModify(ctx context.Context) error {
+	if h.searchIndex == nil && h.dualWriteTarget == nil {
+		return nil
+	}
+
+	messages, err := h.loadMessages(ctx)
+	if err != nil {
+		// the dual write target is copied as a whole on the next write
+		h.dualWriteStale = true
+		return fmt.Errorf("chat history was modified but reading it failed: %w", err)
+	}
+	err = h.reindexSession(ctx, messages)
+	if err != nil {
+		return fmt.Errorf("chat history was modified but %w", err)
+	}
+	err = h.mirrorSession(ctx, messages)
+	if err != nil {
+		return fmt.Errorf("chat history was modified but %w", err)
+	}
+	return nil
+}
+
+// addMessage persists a single message using the cheapest write the storage mode allows.
+func (h *CosmosDBChatMessageHistory) addMessage(ctx context.Context, message llms.ChatMessage) error {
+	// Compressed or token limited documents can't be patched, rewrite the whole conversation instead
+	if h.rewriteOnAdd() {
+		err := h.rewriteWithMessages(ctx, message)
+		if err != nil {
+			return fmt.Errorf("failed to add message to chat history in Cosmos DB: %w", err)
+		}
+		return nil
+	}
+
+	// Add to in-memory cache, with the ID and creation time it is stored with
+	cached := stampMessage(message)
+
+	stored, err := h.newMessage(ctx, cached)
+	if err != nil {
+		return err
+	}
+	// A message that doesn't fit into an item on its own can't be appended in any storage mode
+	if size, _ := messageSize(stored); size > maxDocumentBytes {
+		return h.documentTooLarge(size)
+	}
+	h.messages = append(h.messages, cached)
+
+	// Append only the new message to the stored document
+	err = h.appendMessage(ctx, stored)
+	if isNotFoundError(err) {
+		// The document doesn't exist yet, create it with the full conversation
+		messages := h.applyWindow(h.messages)
+		etag, chunkIDs, werr := h.writeHistory(ctx, messages, "")
+		if werr == nil {
+			h.messages = messages
+			h.etag = etag
+			h.chunkIDs = chunkIDs
+			return nil
+		}
+		if !isConflictError(werr) {
+			return fmt.Errorf("failed to create chat history in Cosmos DB: %w", werr)
+		}
+
+		// Another writer created the document in the meantime, append to it instead
+		err = h.appendMessage(ctx, stored)
+	}
+	if errors.Is(err, ErrSessionClosed) {
+		h.messages = h.messages[:len(h.messages)-1]
+		return err
+	}
+	if errors.Is(err, errWindowExceeded) {
+		// The stored conversation is longer than the window, trim it with a full rewrite
+		h.messages = h.messages[:len(h.messages)-1]
+		h.etag = ""
+		err = h.rewriteWithMessages(ctx, cached)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to marshal chat history: %w", err)
+		return fmt.Errorf("failed to append message to chat history in Cosmos DB: %w", err)
 	}
 
-	// Save to Cosmos DB
-	_, err = h.container.UpsertItem(ctx, azcosmos.NewPartitionKeyString(h.userID), historyItem, nil)
+	return nil
+}
+
+// appendMessage adds a single message to the end of the stored messages array using the
+// Patch API, so the request size and RU charge don't grow with the conversation length.
+func (h *CosmosDBChatMessageHistory) appendMessage(ctx context.Context, message Message) error {
+	var err error
+	switch {
+	case h.maxChunkBytes > 0:
+		err = h.appendMessageChunked(ctx, message, h.newAppendPatch(message))
+	case h.maxMessages > 0:
+		err = h.appendMessageWindowed(ctx, message)
+	default:
+		patch := h.newAppendPatch(message)
+		patch.SetCondition("FROM c WHERE " + activeCondition)
+		err = h.record(OperationPatch)(h.container.PatchItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, patch, h.writeOptions()))
+		if isPreconditionFailedError(err) {
+			err = ErrSessionClosed
+		}
+		if err == nil && h.documentSize >= 0 {
+			size, _ := messageSize(message)
+			h.setDocumentSize(h.documentSize + size)
+		}
+	}
+	if isTooLargeError(err) {
+		return h.documentTooLarge(h.estimatedSize())
+	}
 	if err != nil {
-		return fmt.Errorf("failed to upsert chat history to Cosmos DB: %w", err)
+		return err
 	}
+	if h.maxChunkBytes > 0 || h.maxMessages > 0 {
+		// the patch may have rolled over or removed messages
+		h.documentSize = -1
+	}
+
+	// The document may contain messages from other writers that are not in the cache,
+	// so the cache no longer corresponds to a known version of the document.
+	h.etag = ""
 
 	return nil
 }
 
+// newAppendPatch returns the patch operations appending message to the stored messages.
+func (h *CosmosDBChatMessageHistory) newAppendPatch(message Message) azcosmos.PatchOperations {
+	patch := azcosmos.PatchOperations{}
+	patch.AppendAdd(h.messagesPath("/-"), message)
+	if h.ttl != nil {
+		patch.AppendSet("/ttl", *h.ttl)
+	}
+	return patch
+}
+
+// rewriteOnAdd reports whether the configured storage mode requires rewriting
+// the whole document to add a message.
+func (h *CosmosDBChatMessageHistory) rewriteOnAdd() bool {
+	return h.compression || h.maxTokens > 0 || (h.maxMessages > 0 && h.maxChunkBytes > 0)
+}
+
 func (h *CosmosDBChatMessageHistory) AddUserMessage(ctx context.Context, text string) error {
 	return h.AddMessage(ctx, llms.HumanChatMessage{Content: text})
 }
@@ -101,107 +591,356 @@ func (h *CosmosDBChatMessageHistory) AddAIMessage(ctx context.Context, text stri
 	return h.AddMessage(ctx, llms.AIChatMessage{Content: text})
 }
 
-func (h *CosmosDBChatMessageHistory) Clear(ctx context.Context) error {
+// AddAIMessageWithGenerationInfo adds an AI message along with information about the model and
+// configuration that produced it, which is returned by StoredMessages, e.g. for debugging answers.
+func (h *CosmosDBChatMessageHistory) AddAIMessageWithGenerationInfo(ctx context.Context, message llms.AIChatMessage, info GenerationInfo) error {
+	return h.AddMessage(ctx, cachedMessage{ChatMessage: message, generationInfo: &info})
+}
+
+// AddContentChoice adds a choice returned by llms.Model.GenerateContent as an AI message, keeping its
+// tool calls, stop reason, generation info and the token usage reported in it. model is the name of
+// the model that was called.
+func (h *CosmosDBChatMessageHistory) AddContentChoice(ctx context.Context, choice *llms.ContentChoice, model string) error {
+	if choice == nil {
+		return fmt.Errorf("cannot add nil content choice")
+	}
+
+	message := llms.AIChatMessage{Content: choice.Content, ToolCalls: choice.ToolCalls, FunctionCall: choice.FuncCall}
+	info := GenerationInfo{Model: model, FinishReason: choice.StopReason, Extra: choice.GenerationInfo}
+	return h.AddMessage(ctx, cachedMessage{ChatMessage: message, generationInfo: &info, usage: usageFromGenerationInfo(choice.GenerationInfo)})
+}
+
+// AddSystemMessage appends a system message to the conversation. Use SetSystemMessage to keep a
+// system message at the start of the conversation instead.
+func (h *CosmosDBChatMessageHistory) AddSystemMessage(ctx context.Context, text string) error {
+	return h.AddMessage(ctx, llms.SystemChatMessage{Content: text})
+}
+
+// SetSystemMessage stores a system message as the first message of the conversation, replacing
+// the first message if it is a system message already. The conversation is rewritten, guarded by
+// its ETag, so messages added concurrently are kept. Unlike a message pinned with
+// WithPinnedSystemMessage it is stored, and window trimming or summarization may remove it.
+func (h *CosmosDBChatMessageHistory) SetSystemMessage(ctx context.Context, text string) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, finish := h.startOperation(ctx, HistoryWrite)
+	defer func() { finish(err) }()
+
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return err
+	}
+
+	messages, err := h.loadMessages(ctx)
+	if err != nil {
+		return err
+	}
+
+	updated := make([]llms.ChatMessage, 0, len(messages)+1)
+	updated = append(updated, llms.SystemChatMessage{Content: text})
+	if len(messages) > 0 && messages[0] != nil && messages[0].GetType() == llms.ChatMessageTypeSystem {
+		messages = messages[1:]
+	}
+	updated = append(updated, messages...)
+
+	err = h.replaceMessages(ctx, updated)
+	if err != nil {
+		return fmt.Errorf("failed to set system message: %w", err)
+	}
+	if err := h.afterModify(ctx); err != nil {
+		return err
+	}
+	return h.audit(ctx, AuditSet, messageIDs(h.messages)...)
+}
+
+// AddGenericMessage adds a message with a custom role and speaker name, e.g. from a named agent in a
+// multi-agent system. It is read back as an llms.GenericChatMessage with the role and name.
+func (h *CosmosDBChatMessageHistory) AddGenericMessage(ctx context.Context, role, name, content string) error {
+	if role == "" {
+		return fmt.Errorf("role is mandatory")
+	}
+	return h.AddMessage(ctx, llms.GenericChatMessage{Role: role, Name: name, Content: content})
+}
+
+// AddToolMessage adds the output of a tool call, e.g. for agent executors that persist tool outputs
+// between steps. It is read back as an llms.ToolChatMessage with the tool call ID.
+func (h *CosmosDBChatMessageHistory) AddToolMessage(ctx context.Context, toolCallID, content string) error {
+	if toolCallID == "" {
+		return fmt.Errorf("tool call ID is mandatory")
+	}
+	return h.AddMessage(ctx, llms.ToolChatMessage{ID: toolCallID, Content: content})
+}
+
+// AddFunctionMessage adds the output of a function call. It is read back as an llms.FunctionChatMessage with the function name.
+func (h *CosmosDBChatMessageHistory) AddFunctionMessage(ctx context.Context, name, content string) error {
+	if name == "" {
+		return fmt.Errorf("function name is mandatory")
+	}
+	return h.AddMessage(ctx, llms.FunctionChatMessage{Name: name, Content: content})
+}
+
+// AddMessageWithMetadata adds a message along with application metadata (e.g. the channel, a trace ID
+// or the model name), which is stored with the message and returned by StoredMessages.
+func (h *CosmosDBChatMessageHistory) AddMessageWithMetadata(ctx context.Context, message llms.ChatMessage, metadata map[string]any) error {
+	if message == nil {
+		return fmt.Errorf("cannot add nil message")
+	}
+	return h.AddMessage(ctx, cachedMessage{ChatMessage: message, metadata: metadata})
+}
+
+func (h *CosmosDBChatMessageHistory) Clear(ctx context.Context) (err error) {
+	if h.readOnly {
+		return ErrReadOnly
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, finish := h.startOperation(ctx, HistoryClear)
+	defer func() { finish(err) }()
+
+	err = h.clear(ctx)
+	if err != nil {
+		return err
+	}
+	if err := h.afterModify(ctx); err != nil {
+		return err
+	}
+	return h.audit(ctx, AuditClear)
+}
+
+// clear deletes the stored conversation and resets the in-memory cache. The caller must hold h.mu.
+func (h *CosmosDBChatMessageHistory) clear(ctx context.Context) error {
 	// Reset in-memory messages
+	chunkIDs := h.chunkIDs
 	h.messages = make([]llms.ChatMessage, 0)
+	h.summary = ""
+	h.metadata = nil
+	h.etag = ""
+	h.chunkIDs = nil
+	h.documentSize = 0
+	h.pending = nil
+	h.discardQueue()
 	
 	// Try to delete from the database
-	_, err := h.container.DeleteItem(ctx, azcosmos.NewPartitionKeyString(h.userID), h.sessionID, nil)
+	err := h.record(OperationDelete)(h.container.DeleteItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, h.writeOptions()))
 	
 	// If the error is a 404 Not Found, it's not really an error in this context
 	if err != nil {
 		if cosmosErr, ok := err.(*azcore.ResponseError); ok && cosmosErr.StatusCode == 404 {
 			// Item didn't exist, which is fine for a Clear operation
-			return nil
+			return h.clearChunks(ctx, chunkIDs)
 		}
 		return fmt.Errorf("failed to clear chat history: %w", err)
 	}
 	
-	return nil
+	return h.clearChunks(ctx, chunkIDs)
 }
 
-func (h *CosmosDBChatMessageHistory) SetMessages(ctx context.Context, messages []llms.ChatMessage) error {
+func (h *CosmosDBChatMessageHistory) SetMessages(ctx context.Context, messages []llms.ChatMessage) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, finish := h.startOperation(ctx, HistoryWrite)
+	defer func() { finish(err) }()
+
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return err
+	}
+
 	// Validate input
 	if messages == nil {
 		messages = make([]llms.ChatMessage, 0)
 	}
 
-	// Clear existing messages first
-	err := h.Clear(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to clear existing messages: %w", err)
-	}
+	// The pinned system message is not stored, e.g. when writing back the result of Messages
+	messages = h.withoutPinned(messages)
 
-	// If we have no messages to add, we're done
+	// An empty conversation is stored as no document at all
 	if len(messages) == 0 {
-		return nil
+		err := h.clear(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to clear existing messages: %w", err)
+		}
+		if err := h.afterModify(ctx); err != nil {
+			return err
+		}
+		return h.audit(ctx, AuditSet)
+	}
+
+	// Replace the stored conversation, guarded by the ETag of the last read
+	err = h.replaceMessages(ctx, messages)
+	if err != nil {
+		return h.deadLetter(ctx, fmt.Errorf("failed to replace chat history: %w", err), true, messages...)
 	}
+	// buffered and queued messages are replaced as well, e.g. when writing back the result of Messages
+	h.pending = nil
+	h.discardQueue()
 
-	// Convert messages to model format
-	var chatMessages []llms.ChatMessageModel
-	for _, message := range messages {
-		chatMessages = append(chatMessages, llms.ConvertChatMessageToModel(message))
+	if err := h.afterModify(ctx); err != nil {
+		return err
 	}
+	return h.audit(ctx, AuditSet, messageIDs(h.messages)...)
+}
+
+func (h *CosmosDBChatMessageHistory) Messages(ctx context.Context) (_ []llms.ChatMessage, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, finish := h.startOperation(ctx, HistoryRead)
+	defer func() { finish(err) }()
+	ctx = h.readContext(ctx)
 
-	// Create history document
-	history := History{
-		UserID:       h.userID,
-		SessionId:    h.sessionID,
-		ChatMessages: chatMessages,
+	if err := h.checkBudget(); err != nil {
+		return nil, err
 	}
 
-	// Marshal to JSON
-	historyItem, err := json.Marshal(history)
-	if err != nil {
-		return fmt.Errorf("failed to marshal chat history: %w", err)
+	if h.bufferSize > 0 {
+		return h.bufferedMessages(ctx)
 	}
 
-	// Save to Cosmos DB
-	_, err = h.container.UpsertItem(ctx, azcosmos.NewPartitionKeyString(h.userID), historyItem, nil)
+	messages, err := h.loadMessages(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to upsert chat history: %w", err)
+		return nil, err
 	}
 
-	// Update in-memory cache
-	h.messages = make([]llms.ChatMessage, len(messages))
-	copy(h.messages, messages)
-	
-	return nil
+	return h.withPinned(plainMessages(messages)), nil
 }
 
-func (h *CosmosDBChatMessageHistory) Messages(ctx context.Context) ([]llms.ChatMessage, error) {
-	// Attempt to read the item from Cosmos DB
-	item, err := h.container.ReadItem(ctx, azcosmos.NewPartitionKeyString(h.userID), h.sessionID, nil)
-	if err != nil {
-		if cosmosErr, ok := err.(*azcore.ResponseError); ok && cosmosErr.StatusCode == 404 {
-			// Return an empty slice if the item is not found
-			h.messages = make([]llms.ChatMessage, 0)
-			return h.messages, nil
-		}
-		return nil, fmt.Errorf("failed to read item with sessionID %s: %w", h.sessionID, err)
-	}
+// loadMessages reads the stored conversation (without the pinned system message) and updates the in-memory cache.
+// The returned messages keep their creation time, so that rewriting them doesn't reset it.
+func (h *CosmosDBChatMessageHistory) loadMessages(ctx context.Context) ([]llms.ChatMessage, error) {
+	// Write the messages queued by WithWriteBehind first, a failure is reported by Flush
+	_ = h.drain(ctx)
 
-	// Parse the retrieved JSON item
-	var history History
-	err = json.Unmarshal(item.Value, &history)
+	// Attempt to read the item (and its chunks) from Cosmos DB
+	history, etag, err := h.readHistory(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal history data: %w", err)
+		return nil, err
+	}
+	h.loaded = true
+	if history == nil {
+		// Return an empty slice if the item is not found
+		h.messages = make([]llms.ChatMessage, 0)
+		h.summary = ""
+		h.metadata = nil
+		h.etag = ""
+		h.chunkIDs = nil
+		h.documentSize = 0
+		return h.messages, nil
 	}
 
 	// Convert message models back to chat messages
 	var messages []llms.ChatMessage
 	for _, message := range history.ChatMessages {
-		messages = append(messages, message.ToChatMessage())
+		messages = append(messages, message.toCachedMessage())
 	}
 
 	// Update the in-memory cache
 	h.messages = messages
+	h.summary = history.Summary
+	h.metadata = history.Metadata
+	h.etag = etag
+	h.chunkIDs = history.Chunks
+	h.documentSize = history.itemSize
 
 	return messages, nil
 }
 
+// conversation returns the cached messages, reading the stored conversation first if it wasn't read
+// yet, e.g. by a history created per request that only appended messages.
+func (h *CosmosDBChatMessageHistory) conversation(ctx context.Context) ([]llms.ChatMessage, error) {
+	if h.loaded {
+		return h.messages, nil
+	}
+	return h.loadMessages(ctx)
+}
+
 type History struct {
 	SessionId   string `json:"id"` //unique id
 	UserID      string `json:"userid"` //partition key
-	ChatMessages []llms.ChatMessageModel `json:"messages"`
+	ChatMessages []Message `json:"messages"`
+	TTL         *int   `json:"ttl,omitempty"` //item level TTL in seconds, requires TTL to be enabled on the container
+	Compression        string `json:"compression,omitempty"` //encoding of compressedMessages, only "gzip" is supported
+	CompressedMessages string `json:"compressedMessages,omitempty"` //base64 encoded compressed JSON array of messages, read before messages
+	Chunks      []string `json:"chunks,omitempty"` //ids of the items holding older messages, oldest first
+	Size        *int     `json:"size,omitempty"` //approximate size of messages in bytes, maintained when chunking is enabled
+	ChunkOf     string   `json:"chunkOf,omitempty"` //set on chunk items to the session they belong to
+	Summary     string   `json:"summary,omitempty"` //rolling summary of the messages no longer stored, maintained by WithSummaryBuffer
+	Metadata    *SessionMetadata `json:"metadata,omitempty"` //title, tags and creation time of the session
+	SchemaVersion int `json:"schemaVersion,omitempty"` //layout version of the document, see SchemaVersion
+	itemSize    int //serialized size of the item as read, not stored
+}
+
+const defaultPartitionKeyPath = "/userid"
+
+// partitionKey returns the partition key value used for all item operations of this session.
+func (h *CosmosDBChatMessageHistory) partitionKey() azcosmos.PartitionKey {
+	return azcosmos.NewPartitionKeyString(h.partitionKeyValue)
+}
+
+// partitionKeyField returns the top-level JSON property backing the configured partition key path.
+func (h *CosmosDBChatMessageHistory) partitionKeyField() string {
+	return strings.TrimPrefix(h.partitionKeyPath, "/")
+}
+
+// marshalHistory serializes the history document, compressing the messages if configured and
+// adding the partition key property when the container is not partitioned on /userid.
+func (h *CosmosDBChatMessageHistory) marshalHistory(history History) ([]byte, error) {
+	if h.compression {
+		compressed, err := compressMessages(history.ChatMessages)
+		if err != nil {
+			return nil, err
+		}
+		history.Compression = compressionGzip
+		history.CompressedMessages = compressed
+		// keep an (empty) array, so that writers without compression can still append to it
+		history.ChatMessages = make([]Message, 0)
+	}
+	history.SchemaVersion = SchemaVersion
+
+	item, err := json.Marshal(history)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.mapFields(item)
+}
+
+// withPartitionKeyField adds the partition key property to a serialized item when the container
+// is not partitioned on /userid.
+func (h *CosmosDBChatMessageHistory) withPartitionKeyField(item []byte) ([]byte, error) {
+	if h.partitionKeyPath == defaultPartitionKeyPath {
+		return item, nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(item, &doc); err != nil {
+		return nil, err
+	}
+
+	value, err := json.Marshal(h.partitionKeyValue)
+	if err != nil {
+		return nil, err
+	}
+	doc[h.partitionKeyField()] = value
+
+	return json.Marshal(doc)
+}
+
+func validatePartitionKeyPath(path string) error {
+	if !strings.HasPrefix(path, "/") || len(path) < 2 {
+		return fmt.Errorf("invalid partition key path %q: must start with '/'", path)
+	}
+	if strings.Contains(path[1:], "/") {
+		return fmt.Errorf("invalid partition key path %q: only top-level properties are supported", path)
+	}
+	return nil
+}
+
+func isNotFoundError(err error) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusNotFound
 }
@@ -1,11 +1,20 @@
 package cosmosdb
 
 import (
+	"bytes"
 	"context"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,11 +22,14 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
 	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
 	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/memory"
+	"github.com/tmc/langchaingo/schema"
 )
 
 const (
@@ -1089,3 +1101,4747 @@ func TestOperation_MessageOrderConsistency(t *testing.T) {
 		assert.Equal(t, expected.content, allMessages[i+len(messages)].GetContent())
 	}
 }
+
+func TestOperation_CustomPartitionKey(t *testing.T) {
+	ctx := context.Background()
+
+	database, err := client.NewDatabase(testOperationDBName)
+	require.NoError(t, err)
+
+	containerName := "tenantContainer"
+	_, err = database.CreateContainer(ctx, azcosmos.ContainerProperties{
+		ID: containerName,
+		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
+			Paths: []string{"/tenantId"},
+		},
+	}, nil)
+	if err != nil && !isResourceExistsError(err) {
+		require.NoError(t, err)
+	}
+
+	tenantID := fmt.Sprintf("tenant_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, containerName, sessionID, "user", WithPartitionKey("/tenantId", tenantID))
+	require.NoError(t, err)
+
+	err = history.AddUserMessage(ctx, "Hello from a tenant")
+	require.NoError(t, err)
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello from a tenant"}, []llms.ChatMessageType{llms.ChatMessageTypeHuman})
+
+	require.NoError(t, history.Clear(ctx))
+
+	t.Run("Invalid partition key path", func(t *testing.T) {
+		_, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, containerName, sessionID, "user", WithPartitionKey("tenantId", tenantID))
+		assert.Error(t, err)
+
+		_, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, containerName, sessionID, "user", WithPartitionKey("/tenant/id", tenantID))
+		assert.Error(t, err)
+	})
+
+	t.Run("Empty partition key value", func(t *testing.T) {
+		_, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, containerName, sessionID, "user", WithPartitionKey("/tenantId", ""))
+		assert.Error(t, err)
+	})
+}
+
+func TestOperation_NewFromConnectionString(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	connectionString := fmt.Sprintf("AccountEndpoint=%s;AccountKey=%s;", emulatorEndpoint, emulatorKey)
+
+	history, err := NewFromConnectionString(connectionString, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+
+	err = history.AddUserMessage(ctx, "Hello")
+	require.NoError(t, err)
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello"}, []llms.ChatMessageType{llms.ChatMessageTypeHuman})
+
+	_, err = NewFromConnectionString("", testOperationDBName, testOperationContainerName, sessionID, userID)
+	assert.Error(t, err)
+
+	_, err = NewFromConnectionString("AccountEndpoint", testOperationDBName, testOperationContainerName, sessionID, userID)
+	assert.Error(t, err)
+}
+
+func TestOperation_NewFromEnv(t *testing.T) {
+	ctx := context.Background()
+
+	t.Setenv(EnvEndpoint, emulatorEndpoint)
+	t.Setenv(EnvKey, emulatorKey)
+	t.Setenv(EnvDatabase, testOperationDBName)
+	t.Setenv(EnvContainer, testOperationContainerName)
+	t.Setenv(EnvDefaultTTL, "30")
+
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, CredentialModeKey, cfg.CredentialMode)
+	assert.Equal(t, 30, cfg.DefaultTTL)
+
+	factory, err := NewFromEnv()
+	require.NoError(t, err)
+
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := factory.New(sessionID, userID)
+	require.NoError(t, err)
+
+	err = history.AddUserMessage(ctx, "Hello")
+	require.NoError(t, err)
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(messages))
+
+	t.Run("Invalid config", func(t *testing.T) {
+		_, err := NewFromConfig(Config{CredentialMode: CredentialModeKey, DatabaseID: testOperationDBName, ContainerID: testOperationContainerName})
+		assert.Error(t, err, "Should error without endpoint and key")
+
+		_, err = NewFromConfig(Config{CredentialMode: "unknown", DatabaseID: testOperationDBName, ContainerID: testOperationContainerName})
+		assert.Error(t, err, "Should error with unknown credential mode")
+
+		t.Setenv(EnvDefaultTTL, "one hour")
+		_, err = ConfigFromEnv()
+		assert.Error(t, err, "Should error with a non numeric TTL")
+	})
+}
+
+func TestOperation_HistoryFactory(t *testing.T) {
+	ctx := context.Background()
+
+	clientOptions := &azcosmos.ClientOptions{}
+	clientOptions.Retry.MaxRetries = 5
+
+	factory, err := NewHistoryFactoryWithKey(emulatorEndpoint, emulatorKey, clientOptions, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID1 := fmt.Sprintf("session_%d_1", time.Now().UnixNano())
+	sessionID2 := fmt.Sprintf("session_%d_2", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID1)
+	defer cleanupTestData(ctx, t, client, userID, sessionID2)
+
+	history1, err := factory.New(sessionID1, userID)
+	require.NoError(t, err)
+	history2, err := factory.New(sessionID2, userID)
+	require.NoError(t, err)
+
+	require.NoError(t, history1.AddUserMessage(ctx, "First session"))
+	require.NoError(t, history2.AddUserMessage(ctx, "Second session"))
+
+	messages, err := history1.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"First session"}, nil)
+
+	messages, err = history2.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Second session"}, nil)
+
+	_, err = factory.New("", userID)
+	assert.Error(t, err)
+
+	_, err = NewHistoryFactory(nil, testOperationDBName, testOperationContainerName)
+	assert.Error(t, err)
+}
+
+func TestOperation_SessionTTL(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSessionTTL(3600))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+
+	container, err := client.NewContainer(testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	item, err := container.ReadItem(ctx, azcosmos.NewPartitionKeyString(userID), sessionID, nil)
+	require.NoError(t, err)
+
+	var stored History
+	require.NoError(t, json.Unmarshal(item.Value, &stored))
+	require.NotNil(t, stored.TTL)
+	assert.Equal(t, 3600, *stored.TTL)
+
+	_, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSessionTTL(0))
+	assert.Error(t, err)
+}
+
+func TestOperation_ReadOnly(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+
+	readOnly, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithReadOnly())
+	require.NoError(t, err)
+
+	messages, err := readOnly.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello"}, nil)
+
+	assert.ErrorIs(t, readOnly.AddUserMessage(ctx, "Should not be written"), ErrReadOnly)
+	assert.ErrorIs(t, readOnly.SetMessages(ctx, nil), ErrReadOnly)
+	assert.ErrorIs(t, readOnly.Clear(ctx), ErrReadOnly)
+
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello"}, nil)
+}
+
+func TestOperation_SetMessages_ConcurrentAppend(t *testing.T) {
+	ctx := context.Background()
+	history1, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history1.AddUserMessage(ctx, "Question 1"))
+	require.NoError(t, history1.AddAIMessage(ctx, "Answer 1"))
+
+	// history1 loads the conversation (and its ETag)
+	_, err := history1.Messages(ctx)
+	require.NoError(t, err)
+
+	// another instance appends a message in the meantime
+	history2, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, history2.AddUserMessage(ctx, "Question 2"))
+
+	// history1 replaces the conversation based on its stale view
+	err = history1.SetMessages(ctx, []llms.ChatMessage{
+		llms.AIChatMessage{Content: "Summary of question 1"},
+	})
+	require.NoError(t, err)
+
+	// the concurrently appended message must not be lost
+	messages, err := history2.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Summary of question 1", "Question 2"}, []llms.ChatMessageType{llms.ChatMessageTypeAI, llms.ChatMessageTypeHuman})
+}
+
+func TestOperation_AddMessage_StaleInstances(t *testing.T) {
+	ctx := context.Background()
+
+	for name, opts := range map[string][]Option{"patch": nil, "rewrite": {WithCompression()}} {
+		t.Run(name, func(t *testing.T) {
+			userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+			sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+			defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+			history1, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, opts...)
+			require.NoError(t, err)
+			history2, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, opts...)
+			require.NoError(t, err)
+
+			// both instances add messages without reading the other's messages first
+			require.NoError(t, history1.AddUserMessage(ctx, "Message 1"))
+			require.NoError(t, history2.AddUserMessage(ctx, "Message 2"))
+			require.NoError(t, history1.AddAIMessage(ctx, "Message 3"))
+			require.NoError(t, history2.AddAIMessage(ctx, "Message 4"))
+
+			messages, err := history1.Messages(ctx)
+			require.NoError(t, err)
+			verifyMessages(t, messages, []string{"Message 1", "Message 2", "Message 3", "Message 4"}, nil)
+		})
+	}
+}
+
+func TestOperation_PatchAppend(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	compressedID := sessionID + "_compressed"
+	chunkedID := sessionID + "_chunked"
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	defer cleanupTestData(ctx, t, client, userID, compressedID)
+	defer cleanupTestData(ctx, t, client, userID, chunkedID)
+
+	var operations []Operation
+	recordOperations := WithRequestChargeCallback(func(operation Operation, _ float64) {
+		operations = append(operations, operation)
+	})
+	storedCount := func(id string) int {
+		container, err := client.NewContainer(testOperationDBName, testOperationContainerName)
+		require.NoError(t, err)
+		item, err := container.ReadItem(ctx, azcosmos.NewPartitionKeyString(userID), id, nil)
+		require.NoError(t, err)
+		var stored History
+		require.NoError(t, json.Unmarshal(item.Value, &stored))
+		return len(stored.ChatMessages)
+	}
+
+	// the first write creates the document, the failed patch is not charged
+	first, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, recordOperations)
+	require.NoError(t, err)
+	require.NoError(t, first.AddUserMessage(ctx, "Hello"))
+	assert.Contains(t, operations, OperationCreate)
+	assert.NotContains(t, operations, OperationPatch)
+	assert.Equal(t, 1, storedCount(sessionID))
+
+	// later writes patch the existing document, keeping the messages of other writers
+	operations = nil
+	second, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, recordOperations)
+	require.NoError(t, err)
+	require.NoError(t, second.AddAIMessage(ctx, "Hi there"))
+	require.NoError(t, first.AddUserMessage(ctx, "How are you?"))
+	assert.Equal(t, []Operation{OperationPatch, OperationPatch}, operations)
+	assert.Equal(t, 3, storedCount(sessionID))
+
+	messages, err := second.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello", "Hi there", "How are you?"}, nil)
+
+	// compressed documents are rewritten instead
+	operations = nil
+	compressed, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, compressedID, userID, recordOperations, WithCompression())
+	require.NoError(t, err)
+	require.NoError(t, compressed.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, compressed.AddAIMessage(ctx, "Hi there"))
+	assert.NotContains(t, operations, OperationPatch)
+	assert.Zero(t, storedCount(compressedID), "The messages should only be stored compressed")
+
+	messages, err = compressed.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello", "Hi there"}, nil)
+
+	// chunked documents are patched until the head is full, then rolled over into a chunk
+	operations = nil
+	chunked, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, chunkedID, userID, recordOperations, WithChunking(200))
+	require.NoError(t, err)
+	var expected []string
+	for i := 0; i < 5; i++ {
+		content := fmt.Sprintf("Message %d with some padding to fill up the chunk", i)
+		expected = append(expected, content)
+		require.NoError(t, chunked.AddUserMessage(ctx, content))
+	}
+	assert.Contains(t, operations, OperationPatch)
+	assert.Contains(t, operations, OperationReplace, "The head should be rolled over")
+	assert.Less(t, storedCount(chunkedID), 5)
+
+	messages, err = chunked.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, expected, nil)
+	assert.NotEmpty(t, chunked.chunkIDs)
+}
+
+func TestOperation_Chunking(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	// a small chunk size to force a few chunks
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithChunking(200))
+	require.NoError(t, err)
+
+	var expected []string
+	for i := 0; i < 10; i++ {
+		content := fmt.Sprintf("Message %d with some padding to fill up the chunk", i)
+		expected = append(expected, content)
+		require.NoError(t, history.AddUserMessage(ctx, content))
+	}
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, expected, nil)
+	assert.NotEmpty(t, history.chunkIDs, "Conversation should be split into chunks")
+	require.Greater(t, len(history.chunkIDs), 1)
+	for i, id := range history.chunkIDs {
+		assert.True(t, strings.HasPrefix(id, fmt.Sprintf("%s_chunk_%d_", sessionID, i)), "Chunks should be numbered in order, got %s", id)
+	}
+
+	// a reader without chunking configured still reassembles the conversation
+	reader, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	messages, err = reader.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, expected, nil)
+
+	// replacing the conversation rewrites the chunks
+	err = history.SetMessages(ctx, []llms.ChatMessage{llms.HumanChatMessage{Content: "Only message"}})
+	require.NoError(t, err)
+	messages, err = reader.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Only message"}, nil)
+
+	// clearing removes the chunks as well
+	require.NoError(t, history.Clear(ctx))
+	pager := history.container.NewQueryItemsPager("SELECT * FROM c WHERE c.chunkOf = @sessionId", azcosmos.NewPartitionKeyString(userID), &azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@sessionId", Value: sessionID}},
+	})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, page.Items, "All chunks should be deleted")
+	}
+}
+
+func TestOperation_Compression(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	// start with an uncompressed conversation
+	plain, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, plain.AddUserMessage(ctx, "Uncompressed question"))
+
+	compressed, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithCompression())
+	require.NoError(t, err)
+	require.NoError(t, compressed.AddAIMessage(ctx, "Compressed answer"))
+
+	item, err := compressed.container.ReadItem(ctx, azcosmos.NewPartitionKeyString(userID), sessionID, nil)
+	require.NoError(t, err)
+	var stored History
+	require.NoError(t, json.Unmarshal(item.Value, &stored))
+	assert.Equal(t, "gzip", stored.Compression)
+	assert.NotEmpty(t, stored.CompressedMessages)
+	assert.Empty(t, stored.ChatMessages)
+
+	// writers without compression can still append
+	require.NoError(t, plain.AddUserMessage(ctx, "Another question"))
+
+	expected := []string{"Uncompressed question", "Compressed answer", "Another question"}
+	for _, history := range []*CosmosDBChatMessageHistory{plain, compressed} {
+		messages, err := history.Messages(ctx)
+		require.NoError(t, err)
+		verifyMessages(t, messages, expected, []llms.ChatMessageType{llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI, llms.ChatMessageTypeHuman})
+	}
+}
+
+// memoryContentStore is an in-memory ContentStore for tests
+type memoryContentStore struct {
+	contents map[string][]byte
+}
+
+func (s *memoryContentStore) Put(_ context.Context, key string, content []byte) (string, error) {
+	s.contents[key] = content
+	return key, nil
+}
+
+func (s *memoryContentStore) Get(_ context.Context, ref string) ([]byte, error) {
+	content, ok := s.contents[ref]
+	if !ok {
+		return nil, fmt.Errorf("content %s not found", ref)
+	}
+	return content, nil
+}
+
+func (s *memoryContentStore) Delete(_ context.Context, ref string) error {
+	delete(s.contents, ref)
+	return nil
+}
+
+func TestOperation_ContentOffloading(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	store := &memoryContentStore{contents: map[string][]byte{}}
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithContentStore(store, 100))
+	require.NoError(t, err)
+
+	largeContent := strings.Repeat("log line\n", 100)
+	require.NoError(t, history.AddUserMessage(ctx, "Small message"))
+	require.NoError(t, history.AddUserMessage(ctx, largeContent))
+	assert.Len(t, store.contents, 1, "Only the large message should be offloaded")
+
+	item, err := history.container.ReadItem(ctx, azcosmos.NewPartitionKeyString(userID), sessionID, nil)
+	require.NoError(t, err)
+	var stored History
+	require.NoError(t, json.Unmarshal(item.Value, &stored))
+	require.Len(t, stored.ChatMessages, 2)
+	assert.Empty(t, stored.ChatMessages[1].Data.Content)
+	require.NotNil(t, stored.ChatMessages[1].ContentRef)
+	assert.Equal(t, len(largeContent), stored.ChatMessages[1].ContentRef.Size)
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Small message", largeContent}, nil)
+
+	// without a content store the offloaded content can't be loaded
+	reader, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	_, err = reader.Messages(ctx)
+	assert.Error(t, err)
+}
+
+func TestOperation_MessagesTail(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	messages, err := history.MessagesTail(ctx, 3)
+	require.NoError(t, err)
+	assert.Empty(t, messages, "A new session should have no messages")
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, history.AddUserMessage(ctx, "Question "+strconv.Itoa(i)))
+		require.NoError(t, history.AddAIMessage(ctx, "Answer "+strconv.Itoa(i)))
+	}
+
+	messages, err = history.MessagesTail(ctx, 3)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Answer 3", "Question 4", "Answer 4"}, []llms.ChatMessageType{llms.ChatMessageTypeAI, llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI})
+
+	messages, err = history.MessagesTail(ctx, 100)
+	require.NoError(t, err)
+	assert.Len(t, messages, 10)
+
+	messages, err = history.MessagesTail(ctx, 0)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestOperation_MessagesIter(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithChunking(200))
+	require.NoError(t, err)
+
+	for range history.MessagesIter(ctx) {
+		t.Fatal("A new session should have no messages")
+	}
+
+	var expected []string
+	for i := 0; i < 8; i++ {
+		content := fmt.Sprintf("Message %d with some padding to fill up the chunk", i)
+		expected = append(expected, content)
+		require.NoError(t, history.AddUserMessage(ctx, content))
+	}
+
+	var contents []string
+	for message, err := range history.MessagesIter(ctx) {
+		require.NoError(t, err)
+		contents = append(contents, message.GetContent())
+	}
+	assert.Equal(t, expected, contents)
+
+	// stop early
+	contents = nil
+	for message, err := range history.MessagesIter(ctx) {
+		require.NoError(t, err)
+		contents = append(contents, message.GetContent())
+		if len(contents) == 3 {
+			break
+		}
+	}
+	assert.Equal(t, expected[:3], contents)
+}
+
+func TestOperation_MaxMessages(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithMaxMessages(4))
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, history.AddUserMessage(ctx, "Question "+strconv.Itoa(i)))
+		require.NoError(t, history.AddAIMessage(ctx, "Answer "+strconv.Itoa(i)))
+	}
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Question 3", "Answer 3", "Question 4", "Answer 4"}, nil)
+
+	// SetMessages is trimmed as well
+	require.NoError(t, history.SetMessages(ctx, []llms.ChatMessage{
+		llms.HumanChatMessage{Content: "1"},
+		llms.AIChatMessage{Content: "2"},
+		llms.HumanChatMessage{Content: "3"},
+		llms.AIChatMessage{Content: "4"},
+		llms.HumanChatMessage{Content: "5"},
+	}))
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"2", "3", "4", "5"}, nil)
+
+	// lowering the window trims the stored conversation on the next write
+	smaller, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithMaxMessages(2))
+	require.NoError(t, err)
+	require.NoError(t, smaller.AddUserMessage(ctx, "6"))
+
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"5", "6"}, nil)
+}
+
+func TestOperation_MaxTokens(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	// one token per word
+	counter := TokenCounterFunc(func(text string) int {
+		return len(strings.Fields(text))
+	})
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithMaxTokens(5, counter))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "one two three"))
+	require.NoError(t, history.AddAIMessage(ctx, "four five"))
+	require.NoError(t, history.AddUserMessage(ctx, "six"))
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"four five", "six"}, nil)
+
+	// the latest message is kept even if it exceeds the budget on its own
+	require.NoError(t, history.AddAIMessage(ctx, "a very long answer with many words"))
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"a very long answer with many words"}, nil)
+
+	_, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithMaxTokens(5, nil))
+	assert.Error(t, err)
+}
+
+// fakeModel is an llms.Model returning a fixed response and recording the prompts it received
+type fakeModel struct {
+	response string
+	prompts  []string
+}
+
+func (m *fakeModel) GenerateContent(_ context.Context, messages []llms.MessageContent, _ ...llms.CallOption) (*llms.ContentResponse, error) {
+	for _, message := range messages {
+		for _, part := range message.Parts {
+			if text, ok := part.(llms.TextContent); ok {
+				m.prompts = append(m.prompts, text.Text)
+			}
+		}
+	}
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{{Content: m.response}}}, nil
+}
+
+func (m *fakeModel) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
+}
+
+func TestOperation_Summarization(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	model := &fakeModel{response: "The user asked two questions."}
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSummarization(model, 4, 2))
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, history.AddUserMessage(ctx, "Question "+strconv.Itoa(i)))
+		require.NoError(t, history.AddAIMessage(ctx, "Answer "+strconv.Itoa(i)))
+	}
+	assert.Empty(t, model.prompts, "No summarization below the threshold")
+
+	require.NoError(t, history.AddUserMessage(ctx, "Question 2"))
+	require.Len(t, model.prompts, 1)
+	assert.Contains(t, model.prompts[0], "Human: Question 0")
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages,
+		[]string{SummaryPrefix + "The user asked two questions.", "Answer 1", "Question 2"},
+		[]llms.ChatMessageType{llms.ChatMessageTypeSystem, llms.ChatMessageTypeAI, llms.ChatMessageTypeHuman})
+
+	_, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSummarization(model, 2, 2))
+	assert.Error(t, err, "Should error when keeping as many messages as the threshold")
+}
+
+func TestOperation_SummarizationPerRequest(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	// every request adds a message through a new history, which never reads the conversation itself
+	model := &fakeModel{response: "The user asked two questions."}
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName, WithSummarization(model, 4, 2))
+	require.NoError(t, err)
+	add := func(message llms.ChatMessage) {
+		history, err := factory.New(sessionID, userID)
+		require.NoError(t, err)
+		require.NoError(t, history.AddMessage(ctx, message))
+	}
+
+	for i := 0; i < 2; i++ {
+		add(llms.HumanChatMessage{Content: "Question " + strconv.Itoa(i)})
+		add(llms.AIChatMessage{Content: "Answer " + strconv.Itoa(i)})
+	}
+	assert.Empty(t, model.prompts, "No summarization below the threshold")
+
+	add(llms.HumanChatMessage{Content: "Question 2"})
+	require.Len(t, model.prompts, 1)
+
+	history, err := factory.New(sessionID, userID)
+	require.NoError(t, err)
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages,
+		[]string{SummaryPrefix + "The user asked two questions.", "Answer 1", "Question 2"},
+		[]llms.ChatMessageType{llms.ChatMessageTypeSystem, llms.ChatMessageTypeAI, llms.ChatMessageTypeHuman})
+}
+
+func TestOperation_SummaryBuffer(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	// every message counts as one token
+	counter := TokenCounterFunc(func(string) int { return 1 })
+	model := &fakeModel{response: "The user asked a question."}
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSummaryBuffer(model, 2, counter))
+	require.NoError(t, err)
+
+	summary, messages, err := history.SummaryAndMessages(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, summary)
+	assert.Empty(t, messages)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Question 0"))
+	require.NoError(t, history.AddAIMessage(ctx, "Answer 0"))
+	assert.Empty(t, model.prompts, "No summarization within the token budget")
+
+	require.NoError(t, history.AddUserMessage(ctx, "Question 1"))
+	require.Len(t, model.prompts, 1)
+	assert.Contains(t, model.prompts[0], "Human: Question 0")
+	assert.NotContains(t, model.prompts[0], "Answer 0")
+
+	// the summary is stored next to the messages, a new instance sees both
+	other, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSummaryBuffer(model, 2, counter))
+	require.NoError(t, err)
+	summary, messages, err = other.SummaryAndMessages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "The user asked a question.", summary)
+	verifyMessages(t, messages, []string{"Answer 0", "Question 1"}, []llms.ChatMessageType{llms.ChatMessageTypeAI, llms.ChatMessageTypeHuman})
+
+	// the previous summary is extended
+	model.response = "The user asked two questions."
+	require.NoError(t, other.AddAIMessage(ctx, "Answer 1"))
+	require.Len(t, model.prompts, 2)
+	assert.Contains(t, model.prompts[1], "The user asked a question.")
+
+	summary, messages, err = history.SummaryAndMessages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "The user asked two questions.", summary)
+	verifyMessages(t, messages, []string{"Question 1", "Answer 1"}, []llms.ChatMessageType{llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI})
+
+	require.NoError(t, history.Clear(ctx))
+	summary, _, err = other.SummaryAndMessages(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, summary, "Clear should remove the summary")
+
+	_, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSummaryBuffer(model, 2, nil))
+	assert.Error(t, err, "Should error without token counter")
+
+	_, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSummaryBuffer(model, 2, counter), WithSummarization(model, 4, 2))
+	assert.Error(t, err, "Should error when combined with summarization")
+}
+
+func TestOperation_SummaryBufferPerRequest(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	// every message counts as one token, every request adds a message through a new history
+	counter := TokenCounterFunc(func(string) int { return 1 })
+	model := &fakeModel{response: "The user asked a question."}
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName, WithSummaryBuffer(model, 2, counter))
+	require.NoError(t, err)
+	add := func(message llms.ChatMessage) {
+		history, err := factory.New(sessionID, userID)
+		require.NoError(t, err)
+		require.NoError(t, history.AddMessage(ctx, message))
+	}
+
+	add(llms.HumanChatMessage{Content: "Question 0"})
+	add(llms.AIChatMessage{Content: "Answer 0"})
+	assert.Empty(t, model.prompts, "No summarization within the token budget")
+	add(llms.HumanChatMessage{Content: "Question 1"})
+	require.Len(t, model.prompts, 1)
+
+	history, err := factory.New(sessionID, userID)
+	require.NoError(t, err)
+	summary, messages, err := history.SummaryAndMessages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "The user asked a question.", summary)
+	verifyMessages(t, messages, []string{"Answer 0", "Question 1"}, []llms.ChatMessageType{llms.ChatMessageTypeAI, llms.ChatMessageTypeHuman})
+
+	// a session closed by another writer is not rewritten
+	add(llms.AIChatMessage{Content: "Answer 1"})
+	add(llms.HumanChatMessage{Content: "Question 2"})
+	require.NoError(t, history.SetSessionStatus(ctx, SessionClosed))
+	prompts := len(model.prompts)
+	stale, err := factory.New(sessionID, userID)
+	require.NoError(t, err)
+	assert.ErrorIs(t, stale.compactBuffer(ctx), ErrSessionClosed)
+	assert.Len(t, model.prompts, prompts)
+}
+
+func TestOperation_PinnedSystemMessage(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	const prompt = "You are a helpful assistant."
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithPinnedSystemMessage(prompt), WithMaxMessages(2))
+	require.NoError(t, err)
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{prompt}, []llms.ChatMessageType{llms.ChatMessageTypeSystem})
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, history.AddUserMessage(ctx, "Question "+strconv.Itoa(i)))
+	}
+
+	// trimming keeps the pinned message in front of the window
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages,
+		[]string{prompt, "Question 1", "Question 2"},
+		[]llms.ChatMessageType{llms.ChatMessageTypeSystem, llms.ChatMessageTypeHuman, llms.ChatMessageTypeHuman})
+
+	tail, err := history.MessagesTail(ctx, 1)
+	require.NoError(t, err)
+	verifyMessages(t, tail, []string{prompt, "Question 2"}, []llms.ChatMessageType{llms.ChatMessageTypeSystem, llms.ChatMessageTypeHuman})
+
+	// writing back the result of Messages doesn't store the pinned message
+	require.NoError(t, history.SetMessages(ctx, messages))
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	assert.Len(t, messages, 3)
+
+	require.NoError(t, history.Clear(ctx))
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{prompt}, []llms.ChatMessageType{llms.ChatMessageTypeSystem})
+}
+
+func TestOperation_Trim(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, history.AddUserMessage(ctx, "Question "+strconv.Itoa(i)))
+	}
+
+	require.NoError(t, history.TrimToLastN(ctx, 3))
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Question 1", "Question 2", "Question 3"}, nil)
+
+	// trimming keeps the creation time of the remaining messages
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, history.AddUserMessage(ctx, "Question 4"))
+
+	require.NoError(t, history.TrimBefore(ctx, cutoff))
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Question 4"}, []llms.ChatMessageType{llms.ChatMessageTypeHuman})
+
+	require.NoError(t, history.TrimBefore(ctx, cutoff))
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	assert.Len(t, messages, 1, "Nothing to trim")
+
+	require.NoError(t, history.TrimToLastN(ctx, 0))
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+
+	assert.Error(t, history.TrimToLastN(ctx, -1))
+}
+
+func TestOperation_MessagesWithinBudget(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	// every word counts as one token
+	counter := TokenCounterFunc(func(text string) int { return len(strings.Fields(text)) })
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithPinnedSystemMessage("Be brief"))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "one two three"))
+	require.NoError(t, history.AddAIMessage(ctx, "four five"))
+	require.NoError(t, history.AddUserMessage(ctx, "six"))
+
+	messages, err := history.MessagesWithinBudget(ctx, 5, counter)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Be brief", "four five", "six"},
+		[]llms.ChatMessageType{llms.ChatMessageTypeSystem, llms.ChatMessageTypeAI, llms.ChatMessageTypeHuman})
+
+	messages, err = history.MessagesWithinBudget(ctx, 8, counter)
+	require.NoError(t, err)
+	assert.Len(t, messages, 4)
+
+	messages, err = history.MessagesWithinBudget(ctx, 1, counter)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Be brief"}, nil)
+
+	_, err = history.MessagesWithinBudget(ctx, 5, nil)
+	assert.Error(t, err)
+}
+
+func TestOperation_ToMessageContent(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithPinnedSystemMessage("Be brief"))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.AddAIMessage(ctx, "Hi"))
+	require.NoError(t, history.AddMessage(ctx, llms.GenericChatMessage{Content: "Generic", Role: "custom"}))
+
+	contents, err := history.ToMessageContent(ctx, MessageContentOptions{})
+	require.NoError(t, err)
+	require.Len(t, contents, 4)
+	assert.Equal(t, llms.TextParts(llms.ChatMessageTypeSystem, "Be brief"), contents[0])
+	assert.Equal(t, llms.TextParts(llms.ChatMessageTypeHuman, "Hello"), contents[1])
+	assert.Equal(t, llms.TextParts(llms.ChatMessageTypeAI, "Hi"), contents[2])
+	assert.Equal(t, llms.TextParts(llms.ChatMessageTypeHuman, "Generic"), contents[3], "Generic messages use the human role")
+
+	contents, err = history.ToMessageContent(ctx, MessageContentOptions{LastN: 1})
+	require.NoError(t, err)
+	require.Len(t, contents, 2)
+	assert.Equal(t, llms.ChatMessageTypeSystem, contents[0].Role)
+
+	// every message counts as one token
+	counter := TokenCounterFunc(func(string) int { return 1 })
+	contents, err = history.ToMessageContent(ctx, MessageContentOptions{MaxTokens: 3, TokenCounter: counter})
+	require.NoError(t, err)
+	require.Len(t, contents, 3)
+	assert.Equal(t, llms.TextParts(llms.ChatMessageTypeAI, "Hi"), contents[1])
+
+	_, err = history.ToMessageContent(ctx, MessageContentOptions{MaxTokens: 3})
+	assert.Error(t, err)
+}
+
+func TestOperation_ConversationBuffer(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+
+	buffer := NewConversationBuffer(history, memory.WithReturnMessages(true))
+	require.NoError(t, buffer.SaveContext(ctx, map[string]any{"input": "Hello"}, map[string]any{"output": "Hi there"}))
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello", "Hi there"}, []llms.ChatMessageType{llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI})
+
+	variables, err := buffer.LoadMemoryVariables(ctx, map[string]any{})
+	require.NoError(t, err)
+	assert.Len(t, variables[buffer.GetMemoryKey(ctx)], 2)
+}
+
+func TestOperation_RecallExchanges(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	pastSessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	sessionID := pastSessionID + "_current"
+	defer cleanupTestData(ctx, t, client, userID, pastSessionID)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	past, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, pastSessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, past.AddUserMessage(ctx, "What is the capital of France?"))
+	require.NoError(t, past.AddAIMessage(ctx, "Paris"))
+	require.NoError(t, past.AddUserMessage(ctx, "And the capital of Italy?"))
+	require.NoError(t, past.AddAIMessage(ctx, "Rome"))
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "Tell me about France"))
+
+	exchanges, err := history.RecallExchanges(ctx, "france", 5)
+	require.NoError(t, err)
+	require.Len(t, exchanges, 1, "The current session should not be searched")
+	assert.Equal(t, pastSessionID, exchanges[0].SessionID)
+	assert.Equal(t, 1, exchanges[0].Score)
+	verifyMessages(t, exchanges[0].Messages, []string{"What is the capital of France?", "Paris"}, nil)
+
+	exchanges, err = history.RecallExchanges(ctx, "", 1)
+	require.NoError(t, err)
+	require.Len(t, exchanges, 1)
+	verifyMessages(t, exchanges[0].Messages, []string{"And the capital of Italy?", "Rome"}, nil)
+
+	exchanges, err = history.RecallExchanges(ctx, "Germany", 5)
+	require.NoError(t, err)
+	assert.Empty(t, exchanges)
+}
+
+func TestOperation_ListSessions(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	var sessionIDs []string
+	for i := 0; i < 3; i++ {
+		sessionID := fmt.Sprintf("session_%d_%d", time.Now().UnixNano(), i)
+		sessionIDs = append(sessionIDs, sessionID)
+		defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+		history, err := factory.New(sessionID, userID)
+		require.NoError(t, err)
+		for j := 0; j <= i; j++ {
+			require.NoError(t, history.AddUserMessage(ctx, "Message "+strconv.Itoa(j)))
+		}
+	}
+
+	page, err := factory.ListSessions(ctx, userID, nil)
+	require.NoError(t, err)
+	require.Len(t, page.Sessions, 3)
+	counts := map[string]int{}
+	for _, session := range page.Sessions {
+		counts[session.SessionID] = session.MessageCount
+		assert.False(t, session.LastActivity.IsZero())
+	}
+	assert.Equal(t, map[string]int{sessionIDs[0]: 1, sessionIDs[1]: 2, sessionIDs[2]: 3}, counts)
+
+	// paging
+	var listed []string
+	opts := &ListSessionsOptions{PageSize: 2}
+	for {
+		page, err := factory.ListSessions(ctx, userID, opts)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(page.Sessions), 2)
+		for _, session := range page.Sessions {
+			listed = append(listed, session.SessionID)
+		}
+		if page.ContinuationToken == "" {
+			break
+		}
+		opts.ContinuationToken = page.ContinuationToken
+	}
+	assert.ElementsMatch(t, sessionIDs, listed)
+
+	page, err = factory.ListSessions(ctx, "unknown_user", nil)
+	require.NoError(t, err)
+	assert.Empty(t, page.Sessions)
+
+	_, err = factory.ListSessions(ctx, "", nil)
+	assert.Error(t, err)
+}
+
+func TestOperation_DeleteUserData(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	otherUserID := userID + "_other"
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, otherUserID, sessionID)
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName, WithChunking(200))
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		history, err := factory.New(sessionID+"_"+strconv.Itoa(i), userID)
+		require.NoError(t, err)
+		for j := 0; j < 5; j++ {
+			require.NoError(t, history.AddUserMessage(ctx, strings.Repeat("x", 100)))
+		}
+	}
+	other, err := factory.New(sessionID, otherUserID)
+	require.NoError(t, err)
+	require.NoError(t, other.AddUserMessage(ctx, "Keep me"))
+
+	require.NoError(t, factory.DeleteUserData(ctx, userID))
+
+	container, err := client.NewContainer(testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+	pager := container.NewQueryItemsPager("SELECT c.id FROM c", azcosmos.NewPartitionKeyString(userID), nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, page.Items, "All items of the user should be deleted, including chunks")
+	}
+
+	messages, err := other.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Keep me"}, nil)
+
+	require.NoError(t, factory.DeleteUserData(ctx, userID), "Deleting again should not fail")
+	assert.Error(t, factory.DeleteUserData(ctx, ""))
+}
+
+func TestOperation_SessionMetadata(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+
+	metadata, err := history.GetSessionMetadata(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, metadata.Title)
+	assert.Nil(t, metadata.CreatedAt)
+
+	// the session is created with the first message
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	metadata, err = history.GetSessionMetadata(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, metadata.CreatedAt)
+	createdAt := *metadata.CreatedAt
+	assert.False(t, metadata.UpdatedAt.IsZero())
+
+	require.NoError(t, history.SetSessionMetadata(ctx, SessionMetadata{Title: "Greetings", Tags: []string{"support"}}))
+	require.NoError(t, history.AddAIMessage(ctx, "Hi"))
+
+	other, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	metadata, err = other.GetSessionMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Greetings", metadata.Title)
+	assert.Equal(t, []string{"support"}, metadata.Tags)
+	require.NotNil(t, metadata.CreatedAt)
+	assert.True(t, createdAt.Equal(*metadata.CreatedAt), "Creation time should be kept")
+
+	// rewriting the conversation keeps the metadata
+	require.NoError(t, other.SetMessages(ctx, []llms.ChatMessage{llms.HumanChatMessage{Content: "Rewritten"}}))
+	metadata, err = history.GetSessionMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Greetings", metadata.Title)
+
+	// metadata can be set before the first message
+	require.NoError(t, history.Clear(ctx))
+	require.NoError(t, history.SetSessionMetadata(ctx, SessionMetadata{Title: "New chat"}))
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+	require.NoError(t, history.AddUserMessage(ctx, "First"))
+	metadata, err = other.GetSessionMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "New chat", metadata.Title)
+	assert.NotNil(t, metadata.CreatedAt)
+
+	readOnly, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithReadOnly())
+	require.NoError(t, err)
+	assert.ErrorIs(t, readOnly.SetSessionMetadata(ctx, SessionMetadata{Title: "Nope"}), ErrReadOnly)
+}
+
+func TestOperation_TitleGeneration(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	model := &fakeModel{response: ` "Capital of France" `}
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithTitleGeneration(model))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "What is the capital of France?"))
+	assert.Empty(t, model.prompts, "No title before the first exchange is complete")
+
+	require.NoError(t, history.AddAIMessage(ctx, "Paris"))
+	require.Len(t, model.prompts, 1)
+	assert.Contains(t, model.prompts[0], "Human: What is the capital of France?")
+	assert.Contains(t, model.prompts[0], "AI: Paris")
+
+	metadata, err := history.GetSessionMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Capital of France", metadata.Title)
+
+	// a new instance (e.g. per request) doesn't generate the title again
+	other, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithTitleGeneration(model))
+	require.NoError(t, err)
+	require.NoError(t, other.AddUserMessage(ctx, "And Italy?"))
+	require.NoError(t, other.AddAIMessage(ctx, "Rome"))
+	assert.Len(t, model.prompts, 1)
+}
+
+func TestOperation_SessionTitle(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+
+	// the session is created if needed
+	require.NoError(t, history.SetSessionTitle(ctx, "First title"))
+	title, err := history.GetSessionTitle(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "First title", title)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.SetSessionMetadata(ctx, SessionMetadata{Title: "First title", Tags: []string{"greeting"}}))
+
+	// renaming keeps the messages and the other metadata
+	require.NoError(t, history.SetSessionTitle(ctx, "Renamed"))
+	metadata, err := history.GetSessionMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Renamed", metadata.Title)
+	assert.Equal(t, []string{"greeting"}, metadata.Tags)
+	assert.NotNil(t, metadata.CreatedAt)
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello"}, nil)
+
+	// sessions written without a metadata block get one
+	container, err := client.NewContainer(testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+	legacy, err := json.Marshal(map[string]any{"id": sessionID, "userid": userID, "messages": []any{}})
+	require.NoError(t, err)
+	_, err = container.UpsertItem(ctx, azcosmos.NewPartitionKeyString(userID), legacy, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, history.SetSessionTitle(ctx, "Legacy"))
+	title, err = history.GetSessionTitle(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Legacy", title)
+
+	readOnly, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithReadOnly())
+	require.NoError(t, err)
+	assert.ErrorIs(t, readOnly.SetSessionTitle(ctx, "Nope"), ErrReadOnly)
+}
+
+func TestOperation_ListSessionsSorted(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	titles := []string{"Banana", "Cherry", "Apple"}
+	var sessionIDs []string
+	for i, title := range titles {
+		sessionID := fmt.Sprintf("session_%d_%d", time.Now().UnixNano(), i)
+		sessionIDs = append(sessionIDs, sessionID)
+		defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+		history, err := factory.New(sessionID, userID)
+		require.NoError(t, err)
+		require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+		require.NoError(t, history.SetSessionTitle(ctx, title))
+		// creation times have second precision
+		time.Sleep(1100 * time.Millisecond)
+	}
+
+	listTitles := func(opts *ListSessionsOptions) []string {
+		page, err := factory.ListSessions(ctx, userID, opts)
+		require.NoError(t, err)
+		var listed []string
+		for _, session := range page.Sessions {
+			listed = append(listed, session.Metadata.Title)
+		}
+		return listed
+	}
+
+	assert.Equal(t, []string{"Apple", "Banana", "Cherry"}, listTitles(&ListSessionsOptions{SortBy: SortByTitle, Ascending: true}))
+	assert.Equal(t, []string{"Cherry", "Banana", "Apple"}, listTitles(&ListSessionsOptions{SortBy: SortByTitle}))
+	assert.Equal(t, []string{"Banana", "Cherry", "Apple"}, listTitles(&ListSessionsOptions{SortBy: SortByCreatedAt, Ascending: true}))
+
+	// paging keeps the sort order
+	var listed []string
+	opts := &ListSessionsOptions{SortBy: SortByTitle, Ascending: true, PageSize: 1}
+	for {
+		page, err := factory.ListSessions(ctx, userID, opts)
+		require.NoError(t, err)
+		for _, session := range page.Sessions {
+			listed = append(listed, session.Metadata.Title)
+		}
+		if page.ContinuationToken == "" {
+			break
+		}
+		opts.ContinuationToken = page.ContinuationToken
+	}
+	assert.Equal(t, []string{"Apple", "Banana", "Cherry"}, listed)
+
+	_, err = factory.ListSessions(ctx, userID, &ListSessionsOptions{SortBy: "size"})
+	assert.Error(t, err)
+}
+
+func TestOperation_ListSessionsFiltered(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	start := time.Now().Add(-time.Second)
+	tags := [][]string{{"support"}, {"support", "billing"}, {"sales"}}
+	var sessionIDs []string
+	for i := range tags {
+		sessionID := fmt.Sprintf("session_%d_%d", time.Now().UnixNano(), i)
+		sessionIDs = append(sessionIDs, sessionID)
+		defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+		history, err := factory.New(sessionID, userID)
+		require.NoError(t, err)
+		require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+		require.NoError(t, history.SetSessionMetadata(ctx, SessionMetadata{Title: "Session " + strconv.Itoa(i), Tags: tags[i]}))
+	}
+
+	listIDs := func(opts *ListSessionsOptions) []string {
+		page, err := factory.ListSessions(ctx, userID, opts)
+		require.NoError(t, err)
+		var listed []string
+		for _, session := range page.Sessions {
+			listed = append(listed, session.SessionID)
+		}
+		return listed
+	}
+
+	assert.ElementsMatch(t, sessionIDs[:2], listIDs(&ListSessionsOptions{Tags: []string{"support"}}))
+	assert.ElementsMatch(t, sessionIDs[1:2], listIDs(&ListSessionsOptions{Tags: []string{"support", "billing"}}))
+	assert.Empty(t, listIDs(&ListSessionsOptions{Tags: []string{"unknown"}}))
+	assert.ElementsMatch(t, sessionIDs[1:2], listIDs(&ListSessionsOptions{SessionIDs: []string{sessionIDs[1], "unknown"}}))
+	assert.ElementsMatch(t, sessionIDs[1:2], listIDs(&ListSessionsOptions{SessionIDs: sessionIDs[1:], Tags: []string{"support"}}))
+
+	assert.ElementsMatch(t, sessionIDs, listIDs(&ListSessionsOptions{CreatedSince: start, ActiveSince: start}))
+	assert.Empty(t, listIDs(&ListSessionsOptions{CreatedBefore: start}))
+	assert.Empty(t, listIDs(&ListSessionsOptions{ActiveSince: time.Now().Add(time.Hour)}))
+	assert.ElementsMatch(t, sessionIDs[:2], listIDs(&ListSessionsOptions{Tags: []string{"support"}, ActiveBefore: time.Now().Add(time.Hour)}))
+}
+
+func TestOperation_SessionStatus(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	for _, opts := range [][]Option{nil, {WithMaxMessages(5)}, {WithChunking(0)}, {WithCompression()}} {
+		history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, opts...)
+		require.NoError(t, err)
+		require.NoError(t, history.Clear(ctx))
+
+		status, err := history.GetSessionStatus(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, SessionActive, status)
+
+		require.NoError(t, history.AddUserMessage(ctx, "My order is late"))
+
+		// another instance closes the session, the check doesn't rely on the cache
+		other, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, opts...)
+		require.NoError(t, err)
+		require.NoError(t, other.SetSessionStatus(ctx, SessionClosed))
+
+		err = history.AddAIMessage(ctx, "Stray reply")
+		assert.ErrorIs(t, err, ErrSessionClosed)
+		assert.ErrorIs(t, other.AddUserMessage(ctx, "Another one"), ErrSessionClosed)
+		assert.ErrorIs(t, other.SetMessages(ctx, []llms.ChatMessage{llms.HumanChatMessage{Content: "Rewritten"}}), ErrSessionClosed)
+
+		messages, err := other.Messages(ctx)
+		require.NoError(t, err)
+		verifyMessages(t, messages, []string{"My order is late"}, nil)
+
+		status, err = history.GetSessionStatus(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, SessionClosed, status)
+
+		// reopening accepts messages again
+		require.NoError(t, other.SetSessionStatus(ctx, SessionActive))
+		require.NoError(t, history.AddAIMessage(ctx, "Sorry about that"))
+	}
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	assert.Error(t, history.SetSessionStatus(ctx, "deleted"))
+}
+
+func TestOperation_CloneSession(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	branchID := sessionID + "_branch"
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	defer cleanupTestData(ctx, t, client, userID, branchID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "Question 0"))
+	require.NoError(t, history.AddAIMessage(ctx, "Answer 0"))
+	require.NoError(t, history.AddUserMessage(ctx, "Question 1"))
+	require.NoError(t, history.SetSessionMetadata(ctx, SessionMetadata{Title: "Original", Tags: []string{"experiment"}}))
+
+	branch, err := history.CloneSession(ctx, branchID, &CloneOptions{UpTo: 2})
+	require.NoError(t, err)
+
+	require.NoError(t, branch.AddUserMessage(ctx, "Another question"))
+	messages, err := branch.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Question 0", "Answer 0", "Another question"}, nil)
+
+	metadata, err := branch.GetSessionMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Original", metadata.Title)
+	assert.Equal(t, []string{"experiment"}, metadata.Tags)
+
+	// the original is unchanged
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Question 0", "Answer 0", "Question 1"}, nil)
+
+	_, err = history.CloneSession(ctx, branchID, nil)
+	assert.Error(t, err, "Should error if the session already exists")
+	_, err = history.CloneSession(ctx, sessionID, nil)
+	assert.Error(t, err)
+	_, err = history.CloneSession(ctx, "", nil)
+	assert.Error(t, err)
+}
+
+func TestOperation_ExistsAndMessageCount(t *testing.T) {
+	ctx := context.Background()
+
+	for name, opts := range map[string][]Option{
+		"default":    nil,
+		"chunked":    {WithChunking(300)},
+		"compressed": {WithCompression()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+			sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+			defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+			history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, opts...)
+			require.NoError(t, err)
+
+			exists, err := history.Exists(ctx)
+			require.NoError(t, err)
+			assert.False(t, exists)
+			count, err := history.MessageCount(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 0, count)
+
+			for i := 0; i < 5; i++ {
+				require.NoError(t, history.AddUserMessage(ctx, "Question "+strconv.Itoa(i)+strings.Repeat(".", 50)))
+				require.NoError(t, history.AddAIMessage(ctx, "Answer "+strconv.Itoa(i)+strings.Repeat(".", 50)))
+			}
+
+			exists, err = history.Exists(ctx)
+			require.NoError(t, err)
+			assert.True(t, exists)
+			count, err = history.MessageCount(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 10, count)
+
+			require.NoError(t, history.Clear(ctx))
+			exists, err = history.Exists(ctx)
+			require.NoError(t, err)
+			assert.False(t, exists)
+		})
+	}
+}
+
+func TestOperation_MessageIDs(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Question 0"))
+	require.NoError(t, history.AddAIMessage(ctx, "Answer 0"))
+	require.NoError(t, history.AddUserMessage(ctx, "Question 1"))
+
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 3)
+	ids := map[string]bool{}
+	for _, message := range stored {
+		require.NotEmpty(t, message.ID)
+		assert.NotNil(t, message.CreatedAt)
+		ids[message.ID] = true
+	}
+	assert.Len(t, ids, 3, "Message IDs should be unique")
+	assert.Equal(t, "Answer 0", stored[1].Data.Content)
+
+	// IDs are kept when the conversation is rewritten
+	require.NoError(t, history.TrimToLastN(ctx, 2))
+	trimmed, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, trimmed, 2)
+	assert.Equal(t, stored[1].ID, trimmed[0].ID)
+	assert.Equal(t, stored[2].ID, trimmed[1].ID)
+}
+
+func TestOperation_DeleteMessage(t *testing.T) {
+	ctx := context.Background()
+
+	for name, opts := range map[string][]Option{
+		"default":    nil,
+		"compressed": {WithCompression()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+			sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+			defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+			history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, opts...)
+			require.NoError(t, err)
+			require.NoError(t, history.AddUserMessage(ctx, "Question 0"))
+			require.NoError(t, history.AddAIMessage(ctx, "Offending answer"))
+			require.NoError(t, history.AddUserMessage(ctx, "Question 1"))
+
+			stored, err := history.StoredMessages(ctx)
+			require.NoError(t, err)
+			require.Len(t, stored, 3)
+
+			// another writer appends a message after the read
+			other, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, opts...)
+			require.NoError(t, err)
+			require.NoError(t, other.AddAIMessage(ctx, "Answer 1"))
+
+			require.NoError(t, history.DeleteMessage(ctx, stored[1].ID))
+
+			messages, err := history.Messages(ctx)
+			require.NoError(t, err)
+			verifyMessages(t, messages, []string{"Question 0", "Question 1", "Answer 1"}, nil)
+
+			err = history.DeleteMessage(ctx, stored[1].ID)
+			assert.ErrorIs(t, err, ErrMessageNotFound)
+		})
+	}
+}
+
+func TestOperation_UpdateMessage(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Whta is Cosmos DB?"))
+	require.NoError(t, history.AddAIMessage(ctx, "A database"))
+
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+
+	require.NoError(t, history.UpdateMessage(ctx, stored[0].ID, "What is Cosmos DB?"))
+	require.NoError(t, history.AddUserMessage(ctx, "Tell me more"))
+	require.NoError(t, history.UpdateMessage(ctx, stored[1].ID, "A globally distributed database"))
+
+	updated, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, updated, 3)
+	assert.Equal(t, stored[0].ID, updated[0].ID)
+	assert.Equal(t, stored[1].CreatedAt.Unix(), updated[1].CreatedAt.Unix())
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"What is Cosmos DB?", "A globally distributed database", "Tell me more"},
+		[]llms.ChatMessageType{llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI, llms.ChatMessageTypeHuman})
+
+	err = history.UpdateMessage(ctx, "unknown", "content")
+	assert.ErrorIs(t, err, ErrMessageNotFound)
+}
+
+func TestOperation_MessagesDesc(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	messages, err := history.MessagesDesc(ctx, 0, 3)
+	require.NoError(t, err)
+	assert.Empty(t, messages, "A new session should have no messages")
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, history.AddUserMessage(ctx, "Question "+strconv.Itoa(i)))
+		require.NoError(t, history.AddAIMessage(ctx, "Answer "+strconv.Itoa(i)))
+	}
+
+	messages, err = history.MessagesDesc(ctx, 0, 4)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Answer 2", "Question 2", "Answer 1", "Question 1"}, nil)
+
+	messages, err = history.MessagesDesc(ctx, 4, 4)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Answer 0", "Question 0"}, nil)
+
+	messages, err = history.MessagesDesc(ctx, 6, 4)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+
+	_, err = history.MessagesDesc(ctx, -1, 4)
+	assert.Error(t, err)
+}
+
+func TestOperation_MessagesSince(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	start := time.Now()
+	messages, err := history.MessagesSince(ctx, start)
+	require.NoError(t, err)
+	assert.Empty(t, messages, "A new session should have no messages")
+
+	require.NoError(t, history.AddUserMessage(ctx, "Question 0"))
+	require.NoError(t, history.AddAIMessage(ctx, "Answer 0"))
+
+	messages, err = history.MessagesSince(ctx, start)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Question 0", "Answer 0"}, nil)
+
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	lastSeen := *stored[1].CreatedAt
+
+	// messages added within the same second are distinguished
+	require.NoError(t, history.AddUserMessage(ctx, "Question 1"))
+	messages, err = history.MessagesSince(ctx, lastSeen)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Question 1"}, nil)
+
+	messages, err = history.MessagesSince(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestOperation_MessagesByType(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithPinnedSystemMessage("You are a helpful assistant"))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "What's the weather?"))
+	require.NoError(t, history.AddMessage(ctx, llms.ToolChatMessage{ID: "call_1", Content: "sunny"}))
+	require.NoError(t, history.AddAIMessage(ctx, "It's sunny"))
+
+	messages, err := history.MessagesByType(ctx, llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"What's the weather?", "It's sunny"}, []llms.ChatMessageType{llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI})
+
+	messages, err = history.MessagesByType(ctx, llms.ChatMessageTypeTool, llms.ChatMessageTypeSystem)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"You are a helpful assistant", "sunny"}, []llms.ChatMessageType{llms.ChatMessageTypeSystem, llms.ChatMessageTypeTool})
+
+	messages, err = history.MessagesByType(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestOperation_MessageMetadata(t *testing.T) {
+	ctx := context.Background()
+
+	for name, opts := range map[string][]Option{
+		"default":    nil,
+		"compressed": {WithCompression()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+			sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+			defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+			history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, opts...)
+			require.NoError(t, err)
+
+			require.NoError(t, history.AddMessageWithMetadata(ctx, llms.HumanChatMessage{Content: "Hello"}, map[string]any{"channel": "web", "traceId": "abc"}))
+			require.NoError(t, history.AddMessageWithMetadata(ctx, llms.AIChatMessage{Content: "Hi"}, map[string]any{"model": "gpt-4o"}))
+			// rewrites (e.g. for compression) keep the ID and metadata of earlier messages
+			require.NoError(t, history.AddUserMessage(ctx, "How are you?"))
+
+			stored, err := history.StoredMessages(ctx)
+			require.NoError(t, err)
+			require.Len(t, stored, 3)
+			assert.Equal(t, map[string]any{"channel": "web", "traceId": "abc"}, stored[0].Metadata)
+			assert.Equal(t, map[string]any{"model": "gpt-4o"}, stored[1].Metadata)
+			assert.Nil(t, stored[2].Metadata)
+
+			require.NoError(t, history.AddAIMessage(ctx, "Fine"))
+			again, err := history.StoredMessages(ctx)
+			require.NoError(t, err)
+			require.Len(t, again, 4)
+			assert.Equal(t, stored[0].ID, again[0].ID)
+			assert.Equal(t, stored[0].Metadata, again[0].Metadata)
+
+			messages, err := history.Messages(ctx)
+			require.NoError(t, err)
+			verifyMessages(t, messages, []string{"Hello", "Hi", "How are you?", "Fine"}, nil)
+		})
+	}
+}
+
+func TestOperation_RedactMessage(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	store := &memoryContentStore{contents: map[string][]byte{}}
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithContentStore(store, 100))
+	require.NoError(t, err)
+
+	largeContent := "My card number is 4111 1111 1111 1111" + strings.Repeat(".", 100)
+	require.NoError(t, history.AddMessageWithMetadata(ctx, llms.HumanChatMessage{Content: largeContent}, map[string]any{"clientIp": "10.0.0.1"}))
+	require.NoError(t, history.AddAIMessage(ctx, "Thanks"))
+	require.Len(t, store.contents, 1)
+
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+
+	require.NoError(t, history.RedactMessage(ctx, stored[0].ID, "moderator"))
+	assert.Empty(t, store.contents, "Offloaded content should be deleted")
+
+	redacted, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, redacted, 2)
+	assert.Equal(t, stored[0].ID, redacted[0].ID)
+	assert.Equal(t, RedactedContent, redacted[0].Data.Content)
+	assert.Equal(t, string(llms.ChatMessageTypeHuman), redacted[0].Type)
+	assert.Equal(t, stored[0].CreatedAt.Unix(), redacted[0].CreatedAt.Unix())
+	assert.Nil(t, redacted[0].Metadata)
+	require.NotNil(t, redacted[0].Redaction)
+	assert.Equal(t, "moderator", redacted[0].Redaction.RedactedBy)
+	assert.Nil(t, redacted[1].Redaction)
+
+	err = history.RedactMessage(ctx, "unknown", "moderator")
+	assert.ErrorIs(t, err, ErrMessageNotFound)
+}
+
+func TestOperation_DedupeConsecutive(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithDedupeConsecutive(time.Minute))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"), "A retried message should be dropped without error")
+	require.NoError(t, history.AddAIMessage(ctx, "Hello"), "A message of another type is not a duplicate")
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"), "Only consecutive messages are deduplicated")
+
+	// another instance retrying the same request
+	retry, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithDedupeConsecutive(time.Minute))
+	require.NoError(t, err)
+	require.NoError(t, retry.AddUserMessage(ctx, "Hello"))
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello", "Hello", "Hello"}, []llms.ChatMessageType{llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI, llms.ChatMessageTypeHuman})
+
+	_, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithDedupeConsecutive(-time.Second))
+	assert.Error(t, err)
+}
+
+func TestOperation_ToolCallRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	for name, opts := range map[string][]Option{
+		"default":    nil,
+		"compressed": {WithCompression()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+			sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+			defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+			history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, opts...)
+			require.NoError(t, err)
+
+			conversation := []llms.ChatMessage{
+				llms.HumanChatMessage{Content: "What's the weather in Paris?"},
+				llms.AIChatMessage{ToolCalls: []llms.ToolCall{{
+					ID:           "call_1",
+					Type:         "function",
+					FunctionCall: &llms.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris","unit":"celsius"}`},
+				}}},
+				llms.ToolChatMessage{ID: "call_1", Content: `{"temperature":21}`},
+				llms.FunctionChatMessage{Name: "get_time", Content: "12:00"},
+				llms.GenericChatMessage{Role: "critic", Name: "reviewer", Content: "Looks good"},
+				llms.AIChatMessage{Content: "It's 21°C in Paris."},
+			}
+			for _, message := range conversation {
+				require.NoError(t, history.AddMessage(ctx, message))
+			}
+
+			reader, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, opts...)
+			require.NoError(t, err)
+			messages, err := reader.Messages(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, conversation, messages)
+		})
+	}
+}
+
+func TestOperation_AddToolMessage(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "What time is it?"))
+	require.NoError(t, history.AddMessage(ctx, llms.AIChatMessage{ToolCalls: []llms.ToolCall{{
+		ID:           "call_1",
+		Type:         "function",
+		FunctionCall: &llms.FunctionCall{Name: "get_time", Arguments: "{}"},
+	}}}))
+	require.NoError(t, history.AddToolMessage(ctx, "call_1", "12:00"))
+	require.NoError(t, history.AddFunctionMessage(ctx, "get_date", "2025-01-01"))
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	require.Len(t, messages, 4)
+	assert.Equal(t, llms.ToolChatMessage{ID: "call_1", Content: "12:00"}, messages[2])
+	assert.Equal(t, llms.FunctionChatMessage{Name: "get_date", Content: "2025-01-01"}, messages[3])
+
+	assert.Error(t, history.AddToolMessage(ctx, "", "12:00"))
+	assert.Error(t, history.AddFunctionMessage(ctx, "", "2025-01-01"))
+}
+
+func TestOperation_MultimodalMessages(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	store := &memoryContentStore{contents: map[string][]byte{}}
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithContentStore(store, 100))
+	require.NoError(t, err)
+
+	thumbnail := []byte("small image")
+	photo := bytes.Repeat([]byte{0xff, 0xd8}, 100)
+	prompt := llms.MessageContent{
+		Role: llms.ChatMessageTypeHuman,
+		Parts: []llms.ContentPart{
+			llms.TextPart("What's in these pictures?"),
+			llms.ImageURLPart("https://example.com/cat.png"),
+			llms.BinaryPart("image/png", thumbnail),
+			llms.BinaryPart("image/jpeg", photo),
+		},
+	}
+	require.NoError(t, history.AddMessageContent(ctx, prompt))
+	require.NoError(t, history.AddAIMessage(ctx, "A cat"))
+	assert.Len(t, store.contents, 1, "Only the large binary part should be offloaded")
+
+	reader, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithContentStore(store, 100))
+	require.NoError(t, err)
+	messages, err := reader.Messages(ctx)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.Equal(t, MultimodalMessage{Type: llms.ChatMessageTypeHuman, Parts: prompt.Parts}, messages[0])
+	assert.Equal(t, "What's in these pictures?", messages[0].GetContent())
+
+	contents, err := reader.ToMessageContent(ctx, MessageContentOptions{})
+	require.NoError(t, err)
+	require.Len(t, contents, 2)
+	assert.Equal(t, prompt, contents[0])
+
+	err = history.AddMessageContent(ctx, llms.MessageContent{
+		Role:  llms.ChatMessageTypeAI,
+		Parts: []llms.ContentPart{llms.ToolCallResponse{ToolCallID: "call_1"}},
+	})
+	assert.Error(t, err, "Unsupported parts should be rejected")
+}
+
+func TestOperation_SystemMessages(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.AddSystemMessage(ctx, "The user is logged in"))
+
+	require.NoError(t, history.SetSystemMessage(ctx, "You are a helpful assistant"))
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"You are a helpful assistant", "Hello", "The user is logged in"},
+		[]llms.ChatMessageType{llms.ChatMessageTypeSystem, llms.ChatMessageTypeHuman, llms.ChatMessageTypeSystem})
+
+	// setting it again replaces the first system message
+	require.NoError(t, history.SetSystemMessage(ctx, "You are a pirate"))
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"You are a pirate", "Hello", "The user is logged in"}, nil)
+}
+
+func TestOperation_AddGenericMessage(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Write a haiku"))
+	require.NoError(t, history.AddGenericMessage(ctx, "agent", "writer", "An old silent pond"))
+	require.NoError(t, history.AddGenericMessage(ctx, "agent", "critic", "Too short"))
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+	assert.Equal(t, llms.GenericChatMessage{Role: "agent", Name: "writer", Content: "An old silent pond"}, messages[1])
+	assert.Equal(t, llms.GenericChatMessage{Role: "agent", Name: "critic", Content: "Too short"}, messages[2])
+
+	assert.Error(t, history.AddGenericMessage(ctx, "", "writer", "content"))
+}
+
+func TestOperation_GenerationInfo(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.AddAIMessageWithGenerationInfo(ctx, llms.AIChatMessage{Content: "Hi"}, GenerationInfo{
+		Model:         "gpt-4o",
+		FinishReason:  "stop",
+		StopSequences: []string{"\n\n"},
+	}))
+	require.NoError(t, history.AddUserMessage(ctx, "Tell me a joke"))
+	require.NoError(t, history.AddContentChoice(ctx, &llms.ContentChoice{
+		Content:        "Why did the chicken cross the road?",
+		StopReason:     "length",
+		GenerationInfo: map[string]any{"TotalTokens": 42},
+	}, "gpt-4o-mini"))
+
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 4)
+	assert.Nil(t, stored[0].GenerationInfo)
+	require.NotNil(t, stored[1].GenerationInfo)
+	assert.Equal(t, GenerationInfo{Model: "gpt-4o", FinishReason: "stop", StopSequences: []string{"\n\n"}}, *stored[1].GenerationInfo)
+	require.NotNil(t, stored[3].GenerationInfo)
+	assert.Equal(t, "gpt-4o-mini", stored[3].GenerationInfo.Model)
+	assert.Equal(t, "length", stored[3].GenerationInfo.FinishReason)
+	assert.EqualValues(t, 42, stored[3].GenerationInfo.Extra["TotalTokens"])
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello", "Hi", "Tell me a joke", "Why did the chicken cross the road?"}, nil)
+}
+
+func TestOperation_TokenUsage(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	usage, err := history.SessionTokenUsage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, TokenUsage{}, usage, "A new session should have no usage")
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.AddMessageWithUsage(ctx, llms.AIChatMessage{Content: "Hi"}, TokenUsage{PromptTokens: 10, CompletionTokens: 2}))
+	require.NoError(t, history.AddUserMessage(ctx, "Tell me a joke"))
+	require.NoError(t, history.AddContentChoice(ctx, &llms.ContentChoice{
+		Content:        "Knock knock",
+		GenerationInfo: map[string]any{"PromptTokens": 20, "CompletionTokens": 5, "TotalTokens": 25},
+	}, "gpt-4o"))
+
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 4)
+	assert.Nil(t, stored[0].Usage)
+	require.NotNil(t, stored[1].Usage)
+	assert.Equal(t, TokenUsage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12}, *stored[1].Usage)
+
+	usage, err = history.SessionTokenUsage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, TokenUsage{PromptTokens: 30, CompletionTokens: 7, TotalTokens: 37}, usage)
+}
+
+func TestOperation_SessionCost(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	prices := PriceTable{
+		"gpt-4o":      {PromptPerMillion: 2.5, CompletionPerMillion: 10},
+		"gpt-4o-mini": {PromptPerMillion: 0.15, CompletionPerMillion: 0.6},
+	}
+
+	cost, err := history.SessionCost(ctx, prices)
+	require.NoError(t, err)
+	assert.Zero(t, cost.Total, "A new session should have no cost")
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.AddContentChoice(ctx, &llms.ContentChoice{
+		Content:        "Hi",
+		GenerationInfo: map[string]any{"PromptTokens": 1000, "CompletionTokens": 100},
+	}, "gpt-4o"))
+	require.NoError(t, history.AddContentChoice(ctx, &llms.ContentChoice{
+		Content:        "Hi again",
+		GenerationInfo: map[string]any{"InputTokens": 2000, "OutputTokens": 1000},
+	}, "gpt-4o-mini"))
+	require.NoError(t, history.AddMessageWithUsage(ctx, llms.AIChatMessage{Content: "Unknown model"}, TokenUsage{PromptTokens: 5, CompletionTokens: 5}))
+
+	cost, err = history.SessionCost(ctx, prices)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.0035, cost.ByModel["gpt-4o"], 1e-9)
+	assert.InDelta(t, 0.0009, cost.ByModel["gpt-4o-mini"], 1e-9)
+	assert.InDelta(t, 0.0044, cost.Total, 1e-9)
+	assert.Equal(t, TokenUsage{PromptTokens: 5, CompletionTokens: 5, TotalTokens: 10}, cost.Unpriced)
+}
+
+func TestOperation_Attachments(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	attachments, err := history.ListAttachments(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, attachments)
+
+	report := Attachment{Name: "report.pdf", MIMEType: "application/pdf", Size: 1024, URL: "https://example.blob.core.windows.net/files/report.pdf", SHA256: "abc"}
+	chart := Attachment{Name: "chart.png", MIMEType: "image/png", Size: 512, URL: "https://example.blob.core.windows.net/files/chart.png"}
+
+	require.NoError(t, history.AddMessageWithAttachments(ctx, llms.HumanChatMessage{Content: "Summarize these"}, report, chart))
+	require.NoError(t, history.AddAIMessage(ctx, "The report shows growth"))
+
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	assert.Equal(t, []Attachment{report, chart}, stored[0].Attachments)
+	assert.Empty(t, stored[1].Attachments)
+
+	attachments, err = history.ListAttachments(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []MessageAttachment{
+		{MessageID: stored[0].ID, Attachment: report},
+		{MessageID: stored[0].ID, Attachment: chart},
+	}, attachments)
+
+	assert.Error(t, history.AddMessageWithAttachments(ctx, llms.HumanChatMessage{Content: "No name"}, Attachment{URL: "https://example.com"}))
+}
+
+// TestOperation_ConcurrentUse shares one instance between goroutines, run it with -race.
+func TestOperation_ConcurrentUse(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	const writers, perWriter = 4, 5
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*perWriter*2)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				errs <- history.AddUserMessage(ctx, fmt.Sprintf("Message %d from writer %d", i, w))
+				_, err := history.Messages(ctx)
+				errs <- err
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	assert.Len(t, messages, writers*perWriter, "No concurrently added message should be lost")
+
+	count, err := history.MessageCount(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, writers*perWriter, count)
+}
+
+func TestOperation_AddMessageIfLast(t *testing.T) {
+	ctx := context.Background()
+	tab1, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	tab2, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+
+	require.NoError(t, tab1.AddMessageIfLast(ctx, llms.HumanChatMessage{Content: "Hello"}, ""))
+
+	stored, err := tab2.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	first := stored[0].ID
+
+	// both tabs answer based on the same last message, only the first one wins
+	require.NoError(t, tab1.AddMessageIfLast(ctx, llms.HumanChatMessage{Content: "From tab 1"}, first))
+	err = tab2.AddMessageIfLast(ctx, llms.HumanChatMessage{Content: "From tab 2"}, first)
+	require.ErrorIs(t, err, ErrConflict)
+
+	var advanced *ConversationAdvancedError
+	require.ErrorAs(t, err, &advanced)
+	assert.Equal(t, first, advanced.ExpectedLastMessageID)
+
+	stored, err = tab2.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	assert.Equal(t, "From tab 1", stored[1].Data.Content)
+	assert.Equal(t, stored[1].ID, advanced.LastMessageID)
+
+	// an empty ID only matches an empty session
+	assert.ErrorIs(t, tab1.AddMessageIfLast(ctx, llms.HumanChatMessage{Content: "Again"}, ""), ErrConflict)
+
+	require.NoError(t, tab2.AddMessageIfLast(ctx, llms.AIChatMessage{Content: "Answer"}, stored[1].ID))
+	messages, err := tab1.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello", "From tab 1", "Answer"}, nil)
+}
+
+func TestOperation_SessionToken(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	assert.Empty(t, history.SessionToken(), "No token is known before the first write")
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	token := history.SessionToken()
+	require.NotEmpty(t, token)
+
+	// the instance serving the next request reads with the token of the previous one
+	next, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSessionToken(token))
+	require.NoError(t, err)
+	assert.Equal(t, token, next.SessionToken())
+
+	messages, err := next.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello"}, nil)
+
+	require.NoError(t, next.AddAIMessage(ctx, "Hi"))
+	assert.NotEmpty(t, next.SessionToken())
+
+	ignored, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSessionToken(""))
+	require.NoError(t, err)
+	assert.Empty(t, ignored.SessionToken())
+}
+
+func TestOperation_SessionLock(t *testing.T) {
+	ctx := context.Background()
+	worker1, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	worker2, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+
+	// the ID of the lease item can't be used as a session ID
+	_, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID+"_lock", userID)
+	assert.Error(t, err)
+
+	lock, err := worker1.AcquireSessionLock(ctx, 3*time.Second)
+	require.NoError(t, err)
+
+	_, err = worker2.AcquireSessionLock(ctx, 3*time.Second)
+	require.ErrorIs(t, err, ErrSessionLocked)
+
+	// the lease is renewed in the background, so it doesn't expire
+	time.Sleep(5 * time.Second)
+	_, err = worker2.AcquireSessionLock(ctx, 3*time.Second)
+	require.ErrorIs(t, err, ErrSessionLocked)
+
+	// the lease item is not listed as a session
+	require.NoError(t, worker1.AddUserMessage(ctx, "Hello"))
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+	page, err := factory.ListSessions(ctx, userID, nil)
+	require.NoError(t, err)
+	assert.Len(t, page.Sessions, 1)
+
+	require.NoError(t, lock.Release(ctx))
+	require.NoError(t, lock.Release(ctx), "Releasing twice is not an error")
+
+	lock2, err := worker2.AcquireSessionLock(ctx, 3*time.Second)
+	require.NoError(t, err)
+	select {
+	case <-lock2.Lost():
+		t.Fatal("The lease should not be lost")
+	default:
+	}
+	require.NoError(t, lock2.Release(ctx))
+
+	// an expired lease (here: no longer renewed) can be taken over
+	expiring, cancel := context.WithCancel(ctx)
+	_, err = worker1.AcquireSessionLock(expiring, time.Second)
+	require.NoError(t, err)
+	cancel()
+	time.Sleep(1500 * time.Millisecond)
+	lock3, err := worker2.AcquireSessionLock(ctx, 3*time.Second)
+	require.NoError(t, err)
+	require.NoError(t, lock3.Release(ctx))
+}
+
+func TestOperation_MergeFunc(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	// union of both conversations, ordered by creation time
+	byTime := func(ours, theirs []llms.ChatMessage) []llms.ChatMessage {
+		seen := map[string]bool{}
+		var merged []llms.ChatMessage
+		for _, message := range append(append([]llms.ChatMessage{}, theirs...), ours...) {
+			// messages written back from Messages get new IDs, so compare them by content
+			key := string(message.GetType()) + ":" + message.GetContent()
+			if !seen[key] {
+				assert.NotEmpty(t, MessageID(message))
+				seen[key] = true
+				merged = append(merged, message)
+			}
+		}
+		sort.SliceStable(merged, func(i, j int) bool {
+			a, _ := MessageCreatedAt(merged[i])
+			b, _ := MessageCreatedAt(merged[j])
+			return a.Before(b)
+		})
+		return merged
+	}
+
+	history1, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithMergeFunc(byTime))
+	require.NoError(t, err)
+	require.NoError(t, history1.AddUserMessage(ctx, "Question 1"))
+	require.NoError(t, history1.AddAIMessage(ctx, "Answer 1"))
+
+	messages, err := history1.Messages(ctx)
+	require.NoError(t, err)
+
+	// another instance appends a message before history1 writes its change
+	history2, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, history2.AddUserMessage(ctx, "Question 2"))
+
+	require.NoError(t, history1.SetMessages(ctx, append(messages, llms.AIChatMessage{Content: "Answer 2"})))
+
+	messages, err = history2.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Question 1", "Answer 1", "Question 2", "Answer 2"}, nil)
+}
+
+func TestOperation_DocumentTooLarge(t *testing.T) {
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+
+	// a single message larger than an item
+	err := history.AddUserMessage(ctx, strings.Repeat("x", 3*1024*1024))
+	require.ErrorIs(t, err, ErrDocumentTooLarge)
+
+	var tooLarge *DocumentTooLargeError
+	require.ErrorAs(t, err, &tooLarge)
+	assert.Greater(t, tooLarge.Size, tooLarge.Limit)
+	assert.Equal(t, 2*1024*1024, tooLarge.Limit)
+	assert.Contains(t, tooLarge.Suggestion, "WithChunking")
+	assert.Contains(t, tooLarge.Suggestion, "WithContentStore")
+
+	// messages that only exceed the limit together
+	large := strings.Repeat("y", 800*1024)
+	err = history.SetMessages(ctx, []llms.ChatMessage{
+		llms.HumanChatMessage{Content: large},
+		llms.AIChatMessage{Content: large},
+		llms.HumanChatMessage{Content: large},
+	})
+	require.ErrorAs(t, err, &tooLarge)
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello"}, nil)
+
+	// with chunking, the same conversation is split across items
+	chunked, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithChunking(0))
+	require.NoError(t, err)
+	require.NoError(t, chunked.SetMessages(ctx, []llms.ChatMessage{
+		llms.HumanChatMessage{Content: large},
+		llms.AIChatMessage{Content: large},
+		llms.HumanChatMessage{Content: large},
+	}))
+	require.NoError(t, chunked.Clear(ctx))
+}
+
+// recordingMetrics collects the observed requests.
+type recordingMetrics struct {
+	mu       sync.Mutex
+	requests []RequestMetrics
+}
+
+func (m *recordingMetrics) ObserveRequest(r RequestMetrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = append(m.requests, r)
+}
+
+func TestOperation_Metrics(t *testing.T) {
+	ctx := context.Background()
+
+	metrics := &recordingMetrics{}
+	clientOptions := &azcosmos.ClientOptions{}
+	clientOptions.PerRetryPolicies = append(clientOptions.PerRetryPolicies, NewMetricsPolicy(metrics))
+
+	factory, err := NewHistoryFactoryWithKey(emulatorEndpoint, emulatorKey, clientOptions, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := factory.New(sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	_, err = history.Messages(ctx)
+	require.NoError(t, err)
+	_, err = history.MessageCount(ctx)
+	require.NoError(t, err)
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	byOperation := map[Operation][]RequestMetrics{}
+	for _, r := range metrics.requests {
+		byOperation[r.Operation] = append(byOperation[r.Operation], r)
+	}
+
+	// the first append doesn't find the document and creates it
+	require.NotEmpty(t, byOperation[OperationPatch])
+	assert.Equal(t, 404, byOperation[OperationPatch][0].StatusCode)
+	require.NotEmpty(t, byOperation[OperationCreate])
+	assert.Equal(t, 201, byOperation[OperationCreate][0].StatusCode)
+	assert.Positive(t, byOperation[OperationCreate][0].RequestBytes)
+	assert.Positive(t, byOperation[OperationCreate][0].RequestCharge)
+
+	require.NotEmpty(t, byOperation[OperationRead])
+	assert.Equal(t, 200, byOperation[OperationRead][0].StatusCode)
+	assert.NotEmpty(t, byOperation[OperationQuery])
+
+	for _, r := range metrics.requests {
+		assert.Positive(t, r.Latency)
+		assert.NoError(t, r.Err)
+	}
+}
+
+func TestOperation_RequestCharge(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	var (
+		mu      sync.Mutex
+		charges = map[Operation]float64{}
+	)
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID,
+		WithRequestChargeCallback(func(operation Operation, charge float64) {
+			mu.Lock()
+			defer mu.Unlock()
+			charges[operation] += charge
+		}))
+	require.NoError(t, err)
+	assert.Zero(t, history.LastRequestCharge())
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	assert.Positive(t, history.LastRequestCharge())
+
+	_, err = history.Messages(ctx)
+	require.NoError(t, err)
+	_, err = history.MessageCount(ctx)
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Positive(t, charges[OperationCreate], "The first message creates the document")
+	assert.Positive(t, charges[OperationRead])
+	assert.Positive(t, charges[OperationQuery])
+}
+
+func TestOperation_RUBudget(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	otherSessionID := sessionID + "_other"
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	defer cleanupTestData(ctx, t, client, userID, otherSessionID)
+
+	_, err := NewRUBudget(RUBudgetOptions{Limit: 0, Window: time.Hour})
+	assert.Error(t, err, "Limit must be positive")
+
+	t.Run("Reject", func(t *testing.T) {
+		budget, err := NewRUBudget(RUBudgetOptions{Limit: 1, Window: time.Hour, Scope: BudgetPerSession})
+		require.NoError(t, err)
+
+		history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithRUBudget(budget))
+		require.NoError(t, err)
+
+		// the first write is allowed and spends more than the limit
+		require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+		assert.GreaterOrEqual(t, budget.Spent(sessionID), 1.0)
+
+		err = history.AddAIMessage(ctx, "Hi")
+		assert.ErrorIs(t, err, ErrBudgetExceeded)
+		_, err = history.Messages(ctx)
+		assert.ErrorIs(t, err, ErrBudgetExceeded)
+		_, err = history.MessagesTail(ctx, 1)
+		assert.ErrorIs(t, err, ErrBudgetExceeded)
+		_, err = history.SearchMessages(ctx, "Hello")
+		assert.ErrorIs(t, err, ErrBudgetExceeded)
+		assert.ErrorIs(t, history.TrimToLastN(ctx, 0), ErrBudgetExceeded)
+		assert.ErrorIs(t, history.SetSessionTitle(ctx, "Greeting"), ErrBudgetExceeded)
+		assert.ErrorIs(t, history.DeleteMessage(ctx, "unknown"), ErrBudgetExceeded)
+		_, err = history.CloneSession(ctx, otherSessionID, nil)
+		assert.ErrorIs(t, err, ErrBudgetExceeded)
+		require.NoError(t, history.Clear(ctx), "Clearing is never rejected")
+
+		// other sessions have their own budget
+		other, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, otherSessionID, userID, WithRUBudget(budget))
+		require.NoError(t, err)
+		require.NoError(t, other.AddUserMessage(ctx, "Hello"))
+	})
+
+	t.Run("Callback", func(t *testing.T) {
+		var exceeded []string
+		budget, err := NewRUBudget(RUBudgetOptions{Limit: 1, Window: time.Hour, OnExceeded: func(key string, spent float64) {
+			exceeded = append(exceeded, key)
+		}})
+		require.NoError(t, err)
+
+		history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithRUBudget(budget))
+		require.NoError(t, err)
+
+		require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+		require.NoError(t, history.AddAIMessage(ctx, "Hi"), "Operations are not rejected with a callback")
+		assert.Equal(t, []string{userID}, exceeded, "The callback is called once per window")
+	})
+}
+
+// recordingObserver collects the observed operations.
+type recordingObserver struct {
+	mu         sync.Mutex
+	operations []OperationMetrics
+}
+
+func (o *recordingObserver) ObserveOperation(m OperationMetrics) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.operations = append(o.operations, m)
+}
+
+func TestOperation_OperationObserver(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	observer := &recordingObserver{}
+	history1, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithCompression(), WithOperationObserver(observer))
+	require.NoError(t, err)
+	history2, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithCompression())
+	require.NoError(t, err)
+
+	require.NoError(t, history1.AddUserMessage(ctx, "Message 1"))
+	require.NoError(t, history2.AddUserMessage(ctx, "Message 2"))
+	// history1 has a stale ETag, so the write is retried on top of history2's message
+	require.NoError(t, history1.AddAIMessage(ctx, "Message 3"))
+	_, err = history1.Messages(ctx)
+	require.NoError(t, err)
+	// partial reads, edits and metadata writes are timed too
+	_, err = history1.MessagesTail(ctx, 1)
+	require.NoError(t, err)
+	require.NoError(t, history1.TrimToLastN(ctx, 2))
+	require.NoError(t, history1.SetSessionTitle(ctx, "Observed"))
+	require.NoError(t, history1.Clear(ctx))
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	require.Len(t, observer.operations, 7)
+
+	var operations []HistoryOperation
+	for _, o := range observer.operations {
+		operations = append(operations, o.Operation)
+		assert.Equal(t, sessionID, o.SessionID)
+		assert.Equal(t, userID, o.UserID)
+		assert.Positive(t, o.Latency)
+		assert.NoError(t, o.Err)
+	}
+	assert.Equal(t, []HistoryOperation{HistoryWrite, HistoryWrite, HistoryRead, HistoryRead, HistoryWrite, HistoryWrite, HistoryClear}, operations)
+	assert.Zero(t, observer.operations[0].ConflictRetries)
+	assert.Equal(t, 1, observer.operations[1].ConflictRetries)
+}
+
+func TestOperation_SizeWarnings(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	_, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSizeWarnings(func(SizeWarning) {}, 3*1024*1024))
+	assert.Error(t, err, "Thresholds above the item size limit are rejected")
+
+	var warnings []SizeWarning
+	onWarning := func(w SizeWarning) { warnings = append(warnings, w) }
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSizeWarnings(onWarning, 2500, 4000))
+	require.NoError(t, err)
+
+	content := strings.Repeat("a", 900)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, history.AddUserMessage(ctx, content))
+	}
+
+	require.Len(t, warnings, 2, "Each threshold is reported once")
+	for i, threshold := range []int{2500, 4000} {
+		assert.Equal(t, threshold, warnings[i].Threshold)
+		assert.GreaterOrEqual(t, warnings[i].Size, threshold)
+		assert.Equal(t, sessionID, warnings[i].SessionID)
+		assert.Equal(t, maxDocumentBytes, warnings[i].Limit)
+	}
+
+	// a new instance reads the current size and doesn't report the crossed thresholds again
+	history, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSizeWarnings(onWarning, 2500, 4000))
+	require.NoError(t, err)
+	_, err = history.Messages(ctx)
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, content))
+	assert.Len(t, warnings, 2)
+}
+
+// headerRecorder is a transport recording the activity IDs of the sent requests.
+type headerRecorder struct {
+	mu          sync.Mutex
+	activityIDs []string
+	// headers of the item requests
+	itemHeaders []http.Header
+}
+
+func (r *headerRecorder) Do(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	r.activityIDs = append(r.activityIDs, req.Header.Get("x-ms-activity-id"))
+	if strings.Contains(req.URL.Path, "/docs") {
+		r.itemHeaders = append(r.itemHeaders, req.Header.Clone())
+	}
+	r.mu.Unlock()
+	return http.DefaultClient.Do(req)
+}
+
+func (r *headerRecorder) headers() []http.Header {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]http.Header(nil), r.itemHeaders...)
+}
+
+func (r *headerRecorder) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.activityIDs = nil
+	r.itemHeaders = nil
+}
+
+func TestOperation_CorrelationID(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	recorder := &headerRecorder{}
+	cred, err := azcosmos.NewKeyCredential(emulatorKey)
+	require.NoError(t, err)
+	recordingClient, err := azcosmos.NewClientWithKey(emulatorEndpoint, cred, &azcosmos.ClientOptions{ClientOptions: azcore.ClientOptions{Transport: recorder}})
+	require.NoError(t, err)
+
+	optionID := uuid.New()
+	history, err := NewCosmosDBChatMessageHistory(recordingClient, testOperationDBName, testOperationContainerName, sessionID, userID, WithCorrelationID(optionID))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	contextID := uuid.New()
+	_, err = history.Messages(ContextWithCorrelationID(ctx, contextID))
+	require.NoError(t, err)
+
+	recorder.mu.Lock()
+	assert.Contains(t, recorder.activityIDs, optionID.String())
+	assert.Contains(t, recorder.activityIDs, contextID.String(), "The context ID takes precedence")
+	assert.Equal(t, contextID.String(), recorder.activityIDs[len(recorder.activityIDs)-1])
+	recorder.mu.Unlock()
+
+	// errors returned by Cosmos DB expose the activity ID of the failed request
+	missing, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, "missing_container", sessionID, userID)
+	require.NoError(t, err)
+	err = missing.AddUserMessage(ctx, "Hello")
+	require.Error(t, err)
+	assert.NotEmpty(t, ActivityID(err))
+	assert.Empty(t, ActivityID(ErrConflict))
+}
+
+func TestOperation_AuditLog(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	var events []AuditEvent
+	auditLog := AuditFunc(func(ctx context.Context, event AuditEvent) error {
+		events = append(events, event)
+		return nil
+	})
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithAuditLog(auditLog, "support-agent"))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Message 1"))
+	require.NoError(t, history.AddAIMessage(ctx, "Message 2"))
+	require.NoError(t, history.AddUserMessage(ctx, "Message 3"))
+
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 3)
+
+	require.NoError(t, history.UpdateMessage(ctx, stored[1].ID, "Message 2 updated"))
+	require.NoError(t, history.DeleteMessage(ctx, stored[2].ID))
+	require.NoError(t, history.TrimToLastN(ctx, 1))
+	require.NoError(t, history.Clear(ctx))
+
+	var actions []AuditAction
+	for _, event := range events {
+		actions = append(actions, event.Action)
+		assert.NotEmpty(t, event.ID)
+		assert.Equal(t, sessionID, event.SessionID)
+		assert.Equal(t, userID, event.UserID)
+		assert.Equal(t, "support-agent", event.Actor)
+		assert.False(t, event.Time.IsZero())
+	}
+	assert.Equal(t, []AuditAction{AuditAdd, AuditAdd, AuditAdd, AuditUpdate, AuditDelete, AuditTrim, AuditClear}, actions)
+	assert.Equal(t, []string{stored[0].ID}, events[0].MessageIDs)
+	assert.Equal(t, []string{stored[1].ID}, events[3].MessageIDs)
+	assert.Equal(t, []string{stored[2].ID}, events[4].MessageIDs)
+	assert.Equal(t, []string{stored[0].ID}, events[5].MessageIDs, "Trimming records the removed messages")
+
+	// a failing audit log is reported after the modification was stored
+	failing, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID,
+		WithAuditLog(AuditFunc(func(context.Context, AuditEvent) error { return errors.New("audit log unavailable") }), ""))
+	require.NoError(t, err)
+	assert.Error(t, failing.AddUserMessage(ctx, "Message 4"))
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Message 4"}, nil)
+}
+
+// throttlingTransport rejects the item requests with 429, asking to retry after retryAfterMs,
+// and passes the other requests to the emulator.
+type throttlingTransport struct {
+	retryAfterMs string
+	mu           sync.Mutex
+	attempts     int
+}
+
+func (tt *throttlingTransport) Do(req *http.Request) (*http.Response, error) {
+	if !strings.Contains(req.URL.Path, "/docs") {
+		return http.DefaultClient.Do(req)
+	}
+
+	tt.mu.Lock()
+	tt.attempts++
+	tt.mu.Unlock()
+
+	header := http.Header{}
+	header.Set("x-ms-retry-after-ms", tt.retryAfterMs)
+	header.Set("Content-Type", "application/json")
+	return &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(`{"code":"TooManyRequests","message":"Request rate is large"}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestOperation_ThrottlingRetry(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+
+	newThrottledHistory := func(transport *throttlingTransport) *CosmosDBChatMessageHistory {
+		cred, err := azcosmos.NewKeyCredential(emulatorKey)
+		require.NoError(t, err)
+		throttledClient, err := azcosmos.NewClientWithKey(emulatorEndpoint, cred, &azcosmos.ClientOptions{ClientOptions: azcore.ClientOptions{Transport: transport}})
+		require.NoError(t, err)
+
+		history, err := NewCosmosDBChatMessageHistory(throttledClient, testOperationDBName, testOperationContainerName, sessionID, userID, WithThrottlingRetry(2, time.Second))
+		require.NoError(t, err)
+		return history
+	}
+
+	_, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithThrottlingRetry(-2, time.Second))
+	assert.Error(t, err)
+
+	t.Run("Exhausted", func(t *testing.T) {
+		transport := &throttlingTransport{retryAfterMs: "10"}
+		history := newThrottledHistory(transport)
+
+		_, err := history.Messages(ctx)
+		require.ErrorIs(t, err, ErrThrottled)
+
+		var throttledErr *ThrottledError
+		require.ErrorAs(t, err, &throttledErr)
+		assert.Equal(t, 10*time.Millisecond, throttledErr.RetryAfter)
+
+		var responseErr *azcore.ResponseError
+		assert.ErrorAs(t, err, &responseErr)
+		assert.Equal(t, 3, transport.attempts, "The request is retried twice")
+	})
+
+	t.Run("RetryAfterAboveCap", func(t *testing.T) {
+		transport := &throttlingTransport{retryAfterMs: "5000"}
+		history := newThrottledHistory(transport)
+
+		err := history.AddUserMessage(ctx, "Hello")
+		require.ErrorIs(t, err, ErrThrottled)
+		assert.Equal(t, 1, transport.attempts, "A delay above the cap is not waited for")
+	})
+}
+
+// unavailableTransport rejects the item requests with 503 and passes the other requests to the emulator.
+type unavailableTransport struct {
+	mu       sync.Mutex
+	attempts int
+	// healthy passes the item requests to the emulator as well
+	healthy bool
+}
+
+func (ut *unavailableTransport) Do(req *http.Request) (*http.Response, error) {
+	if !strings.Contains(req.URL.Path, "/docs") {
+		return http.DefaultClient.Do(req)
+	}
+
+	ut.mu.Lock()
+	ut.attempts++
+	healthy := ut.healthy
+	ut.mu.Unlock()
+	if healthy {
+		return http.DefaultClient.Do(req)
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"code":"ServiceUnavailable","message":"Service is currently unavailable"}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestOperation_RetryPolicy(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+
+	for _, invalid := range []RetryPolicy{
+		{MaxAttempts: -1},
+		{BaseDelay: time.Second, MaxDelay: time.Millisecond},
+		{Jitter: 1.5},
+	} {
+		_, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithRetryPolicy(invalid))
+		assert.Error(t, err, "%+v is invalid", invalid)
+	}
+
+	for name, tc := range map[string]struct {
+		retryPolicy RetryPolicy
+		attempts    int
+	}{
+		"Backoff":   {RetryPolicy{MaxAttempts: 4, BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond, Jitter: 0.5}, 4},
+		"NoRetries": {RetryPolicy{MaxAttempts: 1}, 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			transport := &unavailableTransport{}
+			cred, err := azcosmos.NewKeyCredential(emulatorKey)
+			require.NoError(t, err)
+			unavailableClient, err := azcosmos.NewClientWithKey(emulatorEndpoint, cred, &azcosmos.ClientOptions{ClientOptions: azcore.ClientOptions{Transport: transport}})
+			require.NoError(t, err)
+
+			history, err := NewCosmosDBChatMessageHistory(unavailableClient, testOperationDBName, testOperationContainerName, sessionID, userID, WithRetryPolicy(tc.retryPolicy))
+			require.NoError(t, err)
+
+			_, err = history.Messages(ctx)
+			require.Error(t, err)
+			assert.NotErrorIs(t, err, ErrThrottled)
+			assert.Equal(t, tc.attempts, transport.attempts)
+		})
+	}
+}
+
+func TestOperation_CircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	var (
+		mu     sync.Mutex
+		states []bool
+	)
+	breaker, err := NewCircuitBreaker(CircuitBreakerOptions{FailureThreshold: 2, CoolDown: 200 * time.Millisecond, OnStateChange: func(open bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, open)
+	}})
+	require.NoError(t, err)
+
+	transport := &unavailableTransport{}
+	clientOptions := &azcosmos.ClientOptions{ClientOptions: azcore.ClientOptions{Transport: transport}}
+	clientOptions.PerCallPolicies = append(clientOptions.PerCallPolicies, breaker)
+	cred, err := azcosmos.NewKeyCredential(emulatorKey)
+	require.NoError(t, err)
+	breakerClient, err := azcosmos.NewClientWithKey(emulatorEndpoint, cred, clientOptions)
+	require.NoError(t, err)
+
+	history, err := NewCosmosDBChatMessageHistory(breakerClient, testOperationDBName, testOperationContainerName, sessionID, userID, WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	require.NoError(t, err)
+
+	// the circuit opens after two consecutive failures
+	for i := 0; i < 2; i++ {
+		_, err = history.Messages(ctx)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrCircuitOpen)
+	}
+	assert.True(t, breaker.Open())
+
+	_, err = history.Messages(ctx)
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	var openErr *CircuitOpenError
+	require.ErrorAs(t, err, &openErr)
+	assert.True(t, openErr.RetryAt.After(time.Now()))
+	assert.Equal(t, 2, transport.attempts, "Requests fail fast without reaching Cosmos DB")
+
+	// a failing trial request after the cool-down keeps the circuit open
+	time.Sleep(250 * time.Millisecond)
+	_, err = history.Messages(ctx)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrCircuitOpen)
+	assert.True(t, breaker.Open())
+
+	// a successful trial request closes it
+	transport.mu.Lock()
+	transport.healthy = true
+	transport.mu.Unlock()
+	time.Sleep(250 * time.Millisecond)
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	assert.False(t, breaker.Open())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []bool{true, false}, states)
+}
+
+func TestOperation_WriteBuffer(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	transport := &unavailableTransport{healthy: true}
+	cred, err := azcosmos.NewKeyCredential(emulatorKey)
+	require.NoError(t, err)
+	unreliableClient, err := azcosmos.NewClientWithKey(emulatorEndpoint, cred, &azcosmos.ClientOptions{ClientOptions: azcore.ClientOptions{Transport: transport}})
+	require.NoError(t, err)
+
+	var events []BufferEvent
+	history, err := NewCosmosDBChatMessageHistory(unreliableClient, testOperationDBName, testOperationContainerName, sessionID, userID,
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}), WithWriteBuffer(2, func(event BufferEvent) { events = append(events, event) }))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Message 1"))
+
+	setHealthy := func(healthy bool) {
+		transport.mu.Lock()
+		defer transport.mu.Unlock()
+		transport.healthy = healthy
+	}
+
+	// Cosmos DB is unavailable: messages are buffered until the buffer is full
+	setHealthy(false)
+	require.NoError(t, history.AddAIMessage(ctx, "Message 2"))
+	require.NoError(t, history.AddUserMessage(ctx, "Message 3"))
+	err = history.AddAIMessage(ctx, "Message 4")
+	require.Error(t, err, "The buffer is full")
+
+	require.Len(t, events, 3)
+	assert.Equal(t, 1, events[0].Buffered)
+	assert.Equal(t, 2, events[1].Buffered)
+	assert.True(t, events[2].Full)
+	assert.Error(t, events[0].Err)
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err, "The last known conversation is returned during the outage")
+	verifyMessages(t, messages, []string{"Message 1", "Message 2", "Message 3"}, nil)
+
+	// Cosmos DB recovered: the buffered messages are written in order
+	setHealthy(true)
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Message 1", "Message 2", "Message 3"}, nil)
+	require.NoError(t, history.Flush(ctx))
+
+	other, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	messages, err = other.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Message 1", "Message 2", "Message 3"}, nil)
+}
+
+func TestOperation_DeadLetter(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	transport := &unavailableTransport{healthy: true}
+	cred, err := azcosmos.NewKeyCredential(emulatorKey)
+	require.NoError(t, err)
+	unreliableClient, err := azcosmos.NewClientWithKey(emulatorEndpoint, cred, &azcosmos.ClientOptions{ClientOptions: azcore.ClientOptions{Transport: transport}})
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "deadletter.jsonl")
+	sink, err := NewFileDeadLetter(path)
+	require.NoError(t, err)
+	defer sink.Close()
+
+	history, err := NewCosmosDBChatMessageHistory(unreliableClient, testOperationDBName, testOperationContainerName, sessionID, userID,
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}), WithDeadLetter(sink))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Message 1"))
+
+	transport.mu.Lock()
+	transport.healthy = false
+	transport.mu.Unlock()
+
+	// the failed write is still reported, and its message dead-lettered
+	err = history.AddAIMessage(ctx, "Message 2")
+	require.Error(t, err)
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	entries, err := ReadDeadLetters(file)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, sessionID, entries[0].SessionID)
+	assert.Equal(t, userID, entries[0].UserID)
+	assert.False(t, entries[0].Replace)
+	assert.NotEmpty(t, entries[0].Error)
+
+	// replay the dead-lettered messages once Cosmos DB recovered
+	transport.mu.Lock()
+	transport.healthy = true
+	transport.mu.Unlock()
+
+	replay, err := entries[0].Messages()
+	require.NoError(t, err)
+	require.Len(t, replay, 1)
+	for _, message := range replay {
+		require.NoError(t, history.AddMessage(ctx, message))
+	}
+
+	other, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	messages, err := other.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Message 1", "Message 2"}, nil)
+	assert.Equal(t, MessageID(replay[0]), MessageID(messages[1]), "The replayed message keeps its ID")
+}
+
+func TestOperation_WriteBehind(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	var errs []error
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID,
+		WithWriteBehind(100, func(err error) { errs = append(errs, err) }))
+	require.NoError(t, err)
+
+	for i := 1; i <= 25; i++ {
+		require.NoError(t, history.AddUserMessage(ctx, fmt.Sprintf("Message %d", i)))
+	}
+
+	// reading the conversation writes the queued messages first
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	require.Len(t, messages, 25)
+	assert.Equal(t, "Message 1", messages[0].GetContent())
+	assert.Equal(t, "Message 25", messages[24].GetContent())
+
+	require.NoError(t, history.AddAIMessage(ctx, "Message 26"))
+	require.NoError(t, history.Close(ctx))
+	assert.Empty(t, errs)
+
+	other, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	messages, err = other.Messages(ctx)
+	require.NoError(t, err)
+	require.Len(t, messages, 26)
+	assert.Equal(t, "Message 26", messages[25].GetContent())
+
+	err = history.AddUserMessage(ctx, "Message 27")
+	assert.ErrorIs(t, err, ErrHistoryClosed)
+
+	// messages are written by the caller once the queue is full
+	sessionID2 := sessionID + "_full"
+	defer cleanupTestData(ctx, t, client, userID, sessionID2)
+	full, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID2, userID, WithWriteBehind(1, nil))
+	require.NoError(t, err)
+	require.NoError(t, full.AddUserMessage(ctx, "Message 1"))
+
+	other, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID2, userID)
+	require.NoError(t, err)
+	messages, err = other.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Message 1"}, nil)
+}
+
+func TestOperation_BulkWriter(t *testing.T) {
+	ctx := context.Background()
+	userID1 := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	userID2 := userID1 + "_2"
+	sessionIDs := []string{
+		fmt.Sprintf("session_%d_1", time.Now().UnixNano()),
+		fmt.Sprintf("session_%d_2", time.Now().UnixNano()),
+		fmt.Sprintf("session_%d_3", time.Now().UnixNano()),
+	}
+	defer cleanupTestData(ctx, t, client, userID1, sessionIDs[0])
+	defer cleanupTestData(ctx, t, client, userID1, sessionIDs[1])
+	defer cleanupTestData(ctx, t, client, userID2, sessionIDs[2])
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	transcript := func(n int) []llms.ChatMessage {
+		var messages []llms.ChatMessage
+		for i := 1; i <= n; i++ {
+			messages = append(messages, llms.HumanChatMessage{Content: fmt.Sprintf("Message %d", i)})
+		}
+		return messages
+	}
+	sessions := []BulkSession{
+		{SessionID: sessionIDs[0], UserID: userID1, Messages: transcript(3)},
+		{SessionID: sessionIDs[1], UserID: userID1, Messages: transcript(25)},
+		{SessionID: sessionIDs[2], UserID: userID2, Messages: transcript(1)},
+	}
+
+	var mu sync.Mutex
+	var reported int
+	writer, err := factory.NewBulkWriter(BulkWriterOptions{
+		Concurrency:    2,
+		MaxRUPerSecond: 100,
+		OnResult: func(BulkResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported++
+		},
+	})
+	require.NoError(t, err)
+
+	results, err := writer.Write(ctx, sessions)
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	assert.Equal(t, 3, reported)
+	for i, result := range results {
+		assert.Equal(t, sessions[i].SessionID, result.SessionID)
+		assert.Equal(t, len(sessions[i].Messages), result.Written)
+		assert.Greater(t, result.RequestCharge, 0.0)
+		assert.NoError(t, result.Err)
+	}
+
+	// writing again replaces the conversations
+	_, err = writer.Write(ctx, sessions)
+	require.NoError(t, err)
+
+	for _, session := range sessions {
+		history, err := factory.New(session.SessionID, session.UserID)
+		require.NoError(t, err)
+		messages, err := history.Messages(ctx)
+		require.NoError(t, err)
+		require.Len(t, messages, len(session.Messages))
+		assert.Equal(t, "Message 1", messages[0].GetContent())
+	}
+
+	// appending adds to the stored conversations
+	appender, err := factory.NewBulkWriter(BulkWriterOptions{Append: true})
+	require.NoError(t, err)
+	_, err = appender.Write(ctx, []BulkSession{{SessionID: sessionIDs[1], UserID: userID1, Messages: transcript(12)}})
+	require.NoError(t, err)
+
+	history, err := factory.New(sessionIDs[1], userID1)
+	require.NoError(t, err)
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	require.Len(t, messages, 37)
+	assert.Equal(t, "Message 12", messages[36].GetContent())
+
+	// invalid sessions are reported without failing the others
+	results, err = writer.Write(ctx, []BulkSession{{SessionID: "", UserID: userID1}, sessions[2]})
+	require.Error(t, err)
+	assert.Error(t, results[0].Err)
+	assert.NoError(t, results[1].Err)
+}
+
+func TestOperation_PreferredRegions(t *testing.T) {
+	ctx := context.Background()
+
+	t.Setenv(EnvEndpoint, emulatorEndpoint)
+	t.Setenv(EnvKey, emulatorKey)
+	t.Setenv(EnvDatabase, testOperationDBName)
+	t.Setenv(EnvContainer, testOperationContainerName)
+	t.Setenv(EnvPreferredRegions, "West Europe, North Europe")
+
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"West Europe", "North Europe"}, cfg.PreferredRegions)
+
+	// the client options of the config are not modified
+	cfg.ClientOptions = &azcosmos.ClientOptions{PreferredRegions: []string{"East US"}}
+	options := cfg.clientOptions()
+	assert.Equal(t, []string{"West Europe", "North Europe"}, options.PreferredRegions)
+	assert.Equal(t, []string{"East US"}, cfg.ClientOptions.PreferredRegions)
+
+	// regions the account is not replicated to are skipped
+	factory, err := NewFromConfig(cfg)
+	require.NoError(t, err)
+
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := factory.New(sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello"}, nil)
+
+	cfg.PreferredRegions = []string{"West Europe", " "}
+	_, err = NewFromConfig(cfg)
+	assert.Error(t, err, "Should error with an empty region")
+}
+
+func TestOperation_ReadConsistency(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	recorder := &headerRecorder{}
+	cred, err := azcosmos.NewKeyCredential(emulatorKey)
+	require.NoError(t, err)
+	recordingClient, err := azcosmos.NewClientWithKey(emulatorEndpoint, cred, &azcosmos.ClientOptions{ClientOptions: azcore.ClientOptions{Transport: recorder}})
+	require.NoError(t, err)
+
+	history, err := NewCosmosDBChatMessageHistory(recordingClient, testOperationDBName, testOperationContainerName, sessionID, userID,
+		WithReadConsistency(azcosmos.ConsistencyLevelEventual))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	for _, header := range recorder.headers() {
+		assert.Empty(t, header.Get("x-ms-consistency-level"), "Writes use the account default")
+	}
+
+	recorder.reset()
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello"}, nil)
+	require.NotEmpty(t, recorder.headers())
+	for _, header := range recorder.headers() {
+		assert.Equal(t, "Eventual", header.Get("x-ms-consistency-level"))
+		assert.Empty(t, header.Get("x-ms-session-token"), "Eventual reads don't send the session token")
+	}
+
+	// the level of the context takes precedence
+	recorder.reset()
+	_, err = history.Messages(ContextWithReadConsistency(ctx, azcosmos.ConsistencyLevelSession))
+	require.NoError(t, err)
+	for _, header := range recorder.headers() {
+		assert.Equal(t, "Session", header.Get("x-ms-consistency-level"))
+	}
+
+	_, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID,
+		WithReadConsistency("Sometimes"))
+	assert.Error(t, err, "Should error with an unknown consistency level")
+}
+
+func TestOperation_ReadClient(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	recorder := &headerRecorder{}
+	cred, err := azcosmos.NewKeyCredential(emulatorKey)
+	require.NoError(t, err)
+	readClient, err := azcosmos.NewClientWithKey(emulatorEndpoint, cred, &azcosmos.ClientOptions{
+		ClientOptions:    azcore.ClientOptions{Transport: recorder},
+		PreferredRegions: []string{"South Central US"},
+	})
+	require.NoError(t, err)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithReadClient(readClient))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.AddAIMessage(ctx, "Hi there"))
+	assert.Empty(t, recorder.headers(), "Writes don't use the read client")
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello", "Hi there"}, nil)
+	assert.NotEmpty(t, recorder.headers(), "Messages reads through the read client")
+
+	recorder.reset()
+	count, err := history.MessageCount(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.NotEmpty(t, recorder.headers())
+
+	recorder.reset()
+	require.NoError(t, history.SetMessages(ctx, messages[:1]))
+	assert.Empty(t, recorder.headers(), "Writes and their reads don't use the read client")
+}
+
+func TestOperation_SearchMessages(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "How do I reset my password?"))
+	require.NoError(t, history.AddAIMessage(ctx, "Open the settings page and choose Reset Password."))
+	require.NoError(t, history.AddUserMessage(ctx, "Thanks, and how do I delete my account?"))
+
+	results, err := history.SearchMessages(ctx, "reset PASSWORD")
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, 0, results[0].Position)
+	assert.Equal(t, 1, results[1].Position)
+	assert.Equal(t, "Open the settings page and choose Reset Password.", results[1].Message.GetContent())
+	require.Len(t, results[1].Matches, 2)
+	content := results[1].Message.GetContent()
+	assert.Equal(t, "Reset", content[results[1].Matches[0].Start:results[1].Matches[0].End])
+	assert.Equal(t, "Password", content[results[1].Matches[1].Start:results[1].Matches[1].End])
+
+	results, err = history.SearchMessages(ctx, "account")
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, 2, results[0].Position)
+
+	results, err = history.SearchMessages(ctx, "refund")
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	// compressed conversations are searched client side
+	compressedID := sessionID + "_compressed"
+	defer cleanupTestData(ctx, t, client, userID, compressedID)
+	compressed, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, compressedID, userID, WithCompression())
+	require.NoError(t, err)
+	require.NoError(t, compressed.AddUserMessage(ctx, "How do I reset my password?"))
+	require.NoError(t, compressed.AddAIMessage(ctx, "Choose Reset Password in the settings."))
+
+	results, err = compressed.SearchMessages(ctx, "password reset")
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, 1, results[1].Position)
+}
+
+func TestOperation_QueryHistories(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	longID := fmt.Sprintf("session_%d_long", time.Now().UnixNano())
+	shortID := fmt.Sprintf("session_%d_short", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, longID)
+	defer cleanupTestData(ctx, t, client, userID, shortID)
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	long, err := factory.New(longID, userID, WithCompression())
+	require.NoError(t, err)
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, long.AddUserMessage(ctx, fmt.Sprintf("Message %d", i)))
+	}
+	short, err := factory.New(shortID, userID)
+	require.NoError(t, err)
+	require.NoError(t, short.AddUserMessage(ctx, "Hello"))
+	lock, err := short.AcquireSessionLock(ctx, time.Minute)
+	require.NoError(t, err)
+	defer lock.Release(ctx)
+
+	// all documents of the user, without the lock item
+	histories, err := factory.QueryHistories(ctx, "SELECT * FROM c", nil, azcosmos.NewPartitionKeyString(userID))
+	require.NoError(t, err)
+	require.Len(t, histories, 2)
+
+	// compressed messages are decoded
+	histories, err = factory.QueryHistories(ctx, "SELECT * FROM c WHERE c.id = @id",
+		[]azcosmos.QueryParameter{{Name: "@id", Value: longID}}, azcosmos.NewPartitionKeyString(userID))
+	require.NoError(t, err)
+	require.Len(t, histories, 1)
+	assert.Equal(t, longID, histories[0].SessionId)
+	require.Len(t, histories[0].ChatMessages, 5)
+	assert.Equal(t, "Message 5", histories[0].ChatMessages[4].Data.Content)
+
+	histories, err = factory.QueryHistories(ctx, "SELECT * FROM c WHERE ARRAY_LENGTH(c.messages) > @n",
+		[]azcosmos.QueryParameter{{Name: "@n", Value: 0}}, azcosmos.NewPartitionKeyString(userID))
+	require.NoError(t, err)
+	require.Len(t, histories, 1, "The compressed session has no plain messages")
+	assert.Equal(t, shortID, histories[0].SessionId)
+
+	_, err = factory.QueryHistories(ctx, "", nil, azcosmos.NewPartitionKeyString(userID))
+	assert.Error(t, err)
+}
+
+func TestOperation_SearchSessions(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	titleID := fmt.Sprintf("session_%d_title", time.Now().UnixNano())
+	messageID := fmt.Sprintf("session_%d_message", time.Now().UnixNano())
+	compressedID := fmt.Sprintf("session_%d_compressed", time.Now().UnixNano())
+	otherID := fmt.Sprintf("session_%d_other", time.Now().UnixNano())
+	for _, sessionID := range []string{titleID, messageID, compressedID, otherID} {
+		defer cleanupTestData(ctx, t, client, userID, sessionID)
+	}
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	title, err := factory.New(titleID, userID)
+	require.NoError(t, err)
+	require.NoError(t, title.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, title.SetSessionTitle(ctx, "Invoice refund request"))
+
+	message, err := factory.New(messageID, userID)
+	require.NoError(t, err)
+	require.NoError(t, message.AddUserMessage(ctx, "Where is my order?"))
+	require.NoError(t, message.AddUserMessage(ctx, "I would like a REFUND for the invoice of "+strings.Repeat("last month ", 10)))
+
+	compressed, err := factory.New(compressedID, userID, WithCompression())
+	require.NoError(t, err)
+	require.NoError(t, compressed.AddUserMessage(ctx, "Please send the invoice, I need the refund"))
+
+	other, err := factory.New(otherID, userID)
+	require.NoError(t, err)
+	require.NoError(t, other.AddUserMessage(ctx, "Tell me about the refund policy"))
+
+	results, err := factory.SearchSessions(ctx, userID, "refund invoice")
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	found := make(map[string]SessionSearchResult)
+	for _, result := range results {
+		found[result.SessionID] = result
+	}
+	assert.NotContains(t, found, otherID, "Sessions must contain all words of the query")
+
+	assert.True(t, found[titleID].TitleMatch)
+	assert.Equal(t, "Invoice refund request", found[titleID].Title)
+	assert.Zero(t, found[titleID].MessageMatches)
+	assert.Empty(t, found[titleID].Snippets)
+
+	assert.False(t, found[messageID].TitleMatch)
+	assert.Equal(t, 1, found[messageID].MessageMatches)
+	require.Len(t, found[messageID].Snippets, 1)
+	assert.True(t, strings.HasPrefix(found[messageID].Snippets[0], "I would like a REFUND"))
+	assert.True(t, strings.HasSuffix(found[messageID].Snippets[0], "…"), "Long messages are cut after the match")
+
+	// compressed sessions are searched client side
+	assert.Equal(t, 1, found[compressedID].MessageMatches)
+	assert.Equal(t, []string{"Please send the invoice, I need the refund"}, found[compressedID].Snippets)
+
+	// the query and the read of the compressed session are charged
+	var operations []Operation
+	var mu sync.Mutex
+	charged, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName, WithRequestChargeCallback(func(operation Operation, charge float64) {
+		mu.Lock()
+		defer mu.Unlock()
+		operations = append(operations, operation)
+	}))
+	require.NoError(t, err)
+	_, err = charged.SearchSessions(ctx, userID, "refund invoice")
+	require.NoError(t, err)
+	require.NotEmpty(t, operations)
+	assert.Equal(t, OperationQuery, operations[0])
+	reads := 0
+	for _, operation := range operations {
+		if operation == OperationRead {
+			reads++
+		}
+	}
+	assert.Equal(t, 1, reads, "Only the compressed session is read")
+
+	results, err = factory.SearchSessions(ctx, userID, "  ")
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	_, err = factory.SearchSessions(ctx, "", "refund")
+	assert.Error(t, err)
+}
+
+func TestOperation_SimilarMessages(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	firstID := fmt.Sprintf("session_%d_first", time.Now().UnixNano())
+	secondID := fmt.Sprintf("session_%d_second", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, firstID)
+	defer cleanupTestData(ctx, t, client, userID, secondID)
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	first, err := factory.New(firstID, userID, WithVectorSearch(3, VectorDistanceCosine))
+	require.NoError(t, err)
+	require.NoError(t, first.AddMessageWithEmbedding(ctx, llms.HumanChatMessage{Content: "I like cats"}, []float32{1, 0, 0}))
+	require.NoError(t, first.AddMessageWithEmbedding(ctx, llms.AIChatMessage{Content: "Cats are great"}, []float32{0.9, 0.1, 0}))
+	require.NoError(t, first.AddUserMessage(ctx, "No embedding"))
+
+	second, err := factory.New(secondID, userID, WithVectorSearch(3, VectorDistanceCosine))
+	require.NoError(t, err)
+	require.NoError(t, second.AddMessageWithEmbedding(ctx, llms.HumanChatMessage{Content: "What about the weather?"}, []float32{0, 0, 1}))
+	require.NoError(t, second.AddMessageWithEmbedding(ctx, llms.HumanChatMessage{Content: "Do you have a kitten?"}, []float32{0.8, 0.3, 0.1}))
+
+	// all sessions of the user are searched
+	similar, err := second.SimilarMessages(ctx, []float32{1, 0, 0}, 3)
+	require.NoError(t, err)
+	require.Len(t, similar, 3)
+	assert.Equal(t, "I like cats", similar[0].Message.GetContent())
+	assert.Equal(t, firstID, similar[0].SessionID)
+	assert.InDelta(t, 1, similar[0].Score, 0.0001)
+	assert.Equal(t, "Cats are great", similar[1].Message.GetContent())
+	assert.Equal(t, llms.ChatMessageTypeAI, similar[1].Message.GetType())
+	assert.Equal(t, "Do you have a kitten?", similar[2].Message.GetContent())
+	assert.Equal(t, secondID, similar[2].SessionID)
+	assert.NotEmpty(t, similar[2].MessageID)
+	assert.True(t, similar[0].Score >= similar[1].Score && similar[1].Score >= similar[2].Score)
+
+	// the embeddings are kept when the conversation is rewritten
+	stored, err := first.StoredMessages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []float32{1, 0, 0}, stored[0].Embedding)
+	assert.Nil(t, stored[2].Embedding)
+
+	similar, err = first.SimilarMessages(ctx, []float32{1, 0, 0}, 0)
+	require.NoError(t, err)
+	assert.Empty(t, similar)
+
+	_, err = first.SimilarMessages(ctx, []float32{1, 0}, 3)
+	assert.Error(t, err, "The query vector must have the configured dimensions")
+	assert.Error(t, first.AddMessageWithEmbedding(ctx, llms.HumanChatMessage{Content: "Hi"}, []float32{1, 0}))
+	assert.Error(t, first.AddMessageWithEmbedding(ctx, llms.HumanChatMessage{Content: "Hi"}, nil))
+
+	_, err = factory.New(firstID, userID, WithVectorSearch(0, VectorDistanceCosine))
+	assert.Error(t, err)
+	_, err = factory.New(firstID, userID, WithVectorSearch(3, "manhattan"))
+	assert.Error(t, err)
+
+	policy := MessageVectorIndexingPolicy(nil)
+	assert.Contains(t, policy.ExcludedPaths, azcosmos.ExcludedPath{Path: "/messages/[]/embedding/*"})
+	assert.Len(t, MessageVectorIndexingPolicy(policy).ExcludedPaths, 1)
+	assert.Equal(t, 3, MessageVectorEmbeddingPolicy(3, VectorDistanceCosine).VectorEmbeddings[0].Dimensions)
+}
+
+func TestOperation_RelevantMessages(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	otherID := fmt.Sprintf("session_%d_other", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	defer cleanupTestData(ctx, t, client, userID, otherID)
+
+	vectors := map[string][]float32{
+		"cats":    {1, 0, 0},
+		"kittens": {0.9, 0.1, 0},
+		"weather": {0, 0, 1},
+		"rain":    {0, 0.1, 0.9},
+	}
+	embedder := EmbedderFunc(func(ctx context.Context, text string) ([]float32, error) {
+		vector, ok := vectors[text]
+		if !ok {
+			return nil, fmt.Errorf("no embedding for %q", text)
+		}
+		return vector, nil
+	})
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+	history, err := factory.New(sessionID, userID, WithEmbedder(embedder), WithVectorSearch(3, VectorDistanceCosine))
+	require.NoError(t, err)
+	for _, content := range []string{"kittens", "weather", "cats", "rain"} {
+		require.NoError(t, history.AddMessageWithEmbedding(ctx, llms.HumanChatMessage{Content: content}, vectors[content]))
+	}
+	other, err := factory.New(otherID, userID)
+	require.NoError(t, err)
+	require.NoError(t, other.AddMessageWithEmbedding(ctx, llms.HumanChatMessage{Content: "cats"}, vectors["cats"]))
+
+	// the most relevant messages of the session, in conversation order
+	relevant, err := history.RelevantMessages(ctx, "cats", 2)
+	require.NoError(t, err)
+	require.Len(t, relevant, 2)
+	assert.Equal(t, "kittens", relevant[0].GetContent())
+	assert.Equal(t, "cats", relevant[1].GetContent())
+
+	relevant, err = history.RelevantMessages(ctx, "weather", 10)
+	require.NoError(t, err)
+	assert.Len(t, relevant, 4, "Other sessions are not searched")
+
+	_, err = history.RelevantMessages(ctx, "dogs", 2)
+	assert.Error(t, err)
+	_, err = other.RelevantMessages(ctx, "cats", 2)
+	assert.Error(t, err, "An embedder is required")
+}
+
+func TestOperation_HybridSearch(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	vectors := map[string][]float32{
+		"My order arrived damaged":               {1, 0, 0},
+		"Sorry to hear that, we will replace it": {0.9, 0.1, 0},
+		"The order number is ORD-4711":           {0, 1, 0},
+		"What is the status of ORD-4711?":        {0.8, 0.2, 0},
+	}
+	embedder := EmbedderFunc(func(ctx context.Context, text string) ([]float32, error) {
+		vector, ok := vectors[text]
+		if !ok {
+			return nil, fmt.Errorf("no embedding for %q", text)
+		}
+		return vector, nil
+	})
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+	history, err := factory.New(sessionID, userID, WithEmbedder(embedder), WithHybridSearch())
+	require.NoError(t, err)
+	for _, content := range []string{"My order arrived damaged", "Sorry to hear that, we will replace it", "The order number is ORD-4711"} {
+		require.NoError(t, history.AddMessageWithEmbedding(ctx, llms.HumanChatMessage{Content: content}, vectors[content]))
+	}
+	plain, err := factory.New(sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, plain.AddAIMessage(ctx, "Ticket ORD-4711 was escalated"))
+
+	// vector search alone misses the order number
+	vectorOnly, err := factory.New(sessionID, userID, WithEmbedder(embedder))
+	require.NoError(t, err)
+	relevant, err := vectorOnly.RelevantMessages(ctx, "What is the status of ORD-4711?", 2)
+	require.NoError(t, err)
+	require.Len(t, relevant, 2)
+	assert.Equal(t, "My order arrived damaged", relevant[0].GetContent())
+	assert.Equal(t, "Sorry to hear that, we will replace it", relevant[1].GetContent())
+
+	// the message containing the identifier is ranked up
+	relevant, err = history.RelevantMessages(ctx, "What is the status of ORD-4711?", 2)
+	require.NoError(t, err)
+	require.Len(t, relevant, 2)
+	assert.Equal(t, "Sorry to hear that, we will replace it", relevant[0].GetContent())
+	assert.Equal(t, "The order number is ORD-4711", relevant[1].GetContent())
+
+	// messages without an embedding are found by keyword
+	relevant, err = history.RelevantMessages(ctx, "What is the status of ORD-4711?", 10)
+	require.NoError(t, err)
+	require.Len(t, relevant, 4)
+	assert.Equal(t, "Ticket ORD-4711 was escalated", relevant[3].GetContent())
+
+	fused := fuseRankings(
+		[]SimilarMessage{{MessageID: "a"}, {MessageID: "b"}, {MessageID: "c"}},
+		[]SimilarMessage{{MessageID: "c"}, {MessageID: "b"}},
+	)
+	require.Len(t, fused, 3)
+	assert.Equal(t, "b", fused[0].MessageID, "Messages ranked by both rankings come first")
+	assert.InDelta(t, 1.0/62+1.0/62, fused[0].Score, 1e-9)
+}
+
+func TestOperation_Embedder(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	var embedded []string
+	embedder := EmbedderFunc(func(ctx context.Context, text string) ([]float32, error) {
+		if text == "fail" {
+			return nil, errors.New("embedding model unavailable")
+		}
+		embedded = append(embedded, text)
+		return []float32{float32(len(text)), 1}, nil
+	})
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+	history, err := factory.New(sessionID, userID, WithEmbedder(embedder), WithVectorSearch(2, VectorDistanceCosine))
+	require.NoError(t, err)
+
+	// added messages are embedded, unless they come with an embedding or have no content
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.AddMessageWithEmbedding(ctx, llms.AIChatMessage{Content: "Hi there"}, []float32{0, 1}))
+	require.NoError(t, history.AddMessageWithUsage(ctx, llms.AIChatMessage{Content: "How can I help?"}, TokenUsage{CompletionTokens: 5}))
+	require.NoError(t, history.AddMessage(ctx, llms.AIChatMessage{ToolCalls: []llms.ToolCall{{ID: "call_1", Type: "function"}}}))
+	assert.Equal(t, []string{"Hello", "How can I help?"}, embedded)
+
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 4)
+	assert.Equal(t, []float32{5, 1}, stored[0].Embedding)
+	assert.Equal(t, []float32{0, 1}, stored[1].Embedding)
+	assert.Equal(t, []float32{15, 1}, stored[2].Embedding)
+	assert.Equal(t, 5, stored[2].Usage.CompletionTokens)
+	assert.Nil(t, stored[3].Embedding)
+
+	// a message that can't be embedded isn't added
+	err = history.AddUserMessage(ctx, "fail")
+	assert.ErrorContains(t, err, "embedding model unavailable")
+	count, err := history.MessageCount(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 4, count)
+
+	var _ Embedder = embedder
+	embeddings, err := embedder.EmbedDocuments(ctx, []string{"a", "bb"})
+	require.NoError(t, err)
+	assert.Equal(t, [][]float32{{1, 1}, {2, 1}}, embeddings)
+}
+
+func TestOperation_EmbeddingPipeline(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	failingID := fmt.Sprintf("session_%d_failing", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	defer cleanupTestData(ctx, t, client, userID, failingID)
+
+	var mu sync.Mutex
+	var embedded []string
+	embedder := EmbedderFunc(func(ctx context.Context, text string) ([]float32, error) {
+		if strings.HasPrefix(text, "fail") {
+			return nil, errors.New("embedding model unavailable")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		embedded = append(embedded, text)
+		return []float32{float32(len(text)), 1}, nil
+	})
+
+	// messages written without an embedder are embedded by a backfill
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+	plain, err := factory.New(sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, plain.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, plain.AddAIMessage(ctx, "Hi there"))
+
+	withEmbedder, err := factory.New(sessionID, userID, WithEmbedder(embedder))
+	require.NoError(t, err)
+	n, err := withEmbedder.BackfillEmbeddings(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = withEmbedder.BackfillEmbeddings(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n, "Embedded messages are not embedded again")
+	_, err = plain.BackfillEmbeddings(ctx)
+	assert.Error(t, err, "An embedder is required")
+
+	// added messages are embedded in the background
+	var failed []string
+	pipeline, err := NewEmbeddingPipeline(EmbeddingPipelineOptions{
+		Workers:    2,
+		MaxRetries: 1,
+		RetryDelay: time.Millisecond,
+		OnError: func(sessionID string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			failed = append(failed, sessionID)
+		},
+	})
+	require.NoError(t, err)
+	history, err := factory.New(sessionID, userID, WithEmbedder(embedder), WithEmbeddingPipeline(pipeline))
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "How are you?"))
+	require.NoError(t, history.AddAIMessage(ctx, "Fine, thanks"))
+	require.NoError(t, pipeline.Wait(ctx))
+
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 4)
+	for _, message := range stored {
+		assert.Equal(t, []float32{float32(len(message.Data.Content)), 1}, message.Embedding)
+	}
+	assert.ElementsMatch(t, []string{"Hello", "Hi there", "How are you?", "Fine, thanks"}, embedded)
+
+	// edited messages are embedded again, redacted messages lose their embedding
+	require.NoError(t, history.UpdateMessage(ctx, stored[3].ID, "Great"))
+	require.NoError(t, history.RedactMessage(ctx, stored[2].ID, "support"))
+	require.NoError(t, pipeline.Wait(ctx))
+	stored, err = history.StoredMessages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []float32{5, 1}, stored[3].Embedding)
+	assert.Nil(t, stored[2].Embedding)
+	assert.Contains(t, embedded, "Great")
+	assert.NotContains(t, embedded, RedactedContent)
+
+	// failures are retried and reported, the message is kept
+	failing, err := factory.New(failingID, userID, WithEmbedder(embedder), WithEmbeddingPipeline(pipeline))
+	require.NoError(t, err)
+	require.NoError(t, failing.AddUserMessage(ctx, "fail me"))
+	require.NoError(t, pipeline.Close(ctx))
+	assert.Equal(t, []string{failingID}, failed)
+	count, err := failing.MessageCount(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	_, err = factory.New(sessionID, userID, WithEmbeddingPipeline(pipeline))
+	assert.Error(t, err, "The pipeline requires an embedder")
+	_, err = NewEmbeddingPipeline(EmbeddingPipelineOptions{Workers: -1})
+	assert.Error(t, err)
+}
+
+func TestOperation_Retriever(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	pastID := fmt.Sprintf("session_%d_past", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	defer cleanupTestData(ctx, t, client, userID, pastID)
+
+	vectors := map[string][]float32{
+		"refund":                       {1, 0},
+		"The refund was approved":      {0.9, 0.1},
+		"Shipping takes three days":    {0, 1},
+		"Your refund is on its way":    {0.95, 0.05},
+		"Thanks for contacting us":     {0.1, 0.9},
+		"I want a refund for my order": {0.8, 0.2},
+	}
+	embedder := EmbedderFunc(func(ctx context.Context, text string) ([]float32, error) {
+		vector, ok := vectors[text]
+		if !ok {
+			return nil, fmt.Errorf("no embedding for %q", text)
+		}
+		return vector, nil
+	})
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName, WithEmbedder(embedder))
+	require.NoError(t, err)
+	past, err := factory.New(pastID, userID)
+	require.NoError(t, err)
+	require.NoError(t, past.AddUserMessage(ctx, "I want a refund for my order"))
+	require.NoError(t, past.AddAIMessage(ctx, "The refund was approved"))
+	history, err := factory.New(sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "Shipping takes three days"))
+	require.NoError(t, history.AddAIMessage(ctx, "Your refund is on its way"))
+	require.NoError(t, history.AddAIMessage(ctx, "Thanks for contacting us"))
+
+	var retriever schema.Retriever
+	retriever, err = history.Retriever(RetrieverScopeSession, 1)
+	require.NoError(t, err)
+	docs, err := retriever.GetRelevantDocuments(ctx, "refund")
+	require.NoError(t, err)
+	require.Len(t, docs, 1)
+	assert.Equal(t, "Your refund is on its way", docs[0].PageContent)
+	assert.Equal(t, sessionID, docs[0].Metadata["sessionId"])
+	assert.Equal(t, "ai", docs[0].Metadata["type"])
+	assert.NotEmpty(t, docs[0].Metadata["messageId"])
+
+	retriever, err = history.Retriever(RetrieverScopeUser, 2)
+	require.NoError(t, err)
+	docs, err = retriever.GetRelevantDocuments(ctx, "refund")
+	require.NoError(t, err)
+	require.Len(t, docs, 2)
+	assert.Equal(t, "Your refund is on its way", docs[0].PageContent)
+	assert.Equal(t, "The refund was approved", docs[1].PageContent)
+	assert.Equal(t, pastID, docs[1].Metadata["sessionId"])
+
+	// without an embedder, keyword search
+	plain, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+	keyword, err := plain.New(sessionID, userID)
+	require.NoError(t, err)
+	retriever, err = keyword.Retriever(RetrieverScopeSession, 5)
+	require.NoError(t, err)
+	docs, err = retriever.GetRelevantDocuments(ctx, "refund")
+	require.NoError(t, err)
+	require.Len(t, docs, 1)
+	assert.Equal(t, "Your refund is on its way", docs[0].PageContent)
+
+	retriever, err = keyword.Retriever(RetrieverScopeUser, 5)
+	require.NoError(t, err)
+	docs, err = retriever.GetRelevantDocuments(ctx, "refund")
+	require.NoError(t, err)
+	require.Len(t, docs, 1)
+	assert.Equal(t, "Human: I want a refund for my order\nAI: The refund was approved", docs[0].PageContent)
+	assert.Equal(t, "exchange", docs[0].Metadata["type"])
+
+	_, err = history.Retriever("everything", 5)
+	assert.Error(t, err)
+	_, err = history.Retriever(RetrieverScopeSession, 0)
+	assert.Error(t, err)
+}
+
+// memorySearchIndex is an in-memory SearchIndex for tests, matching documents containing the query text
+type memorySearchIndex struct {
+	documents map[string]SearchDocument
+	queries   []SearchIndexQuery
+}
+
+func (s *memorySearchIndex) Upload(_ context.Context, documents []SearchDocument) error {
+	for _, document := range documents {
+		s.documents[document.ID] = document
+	}
+	return nil
+}
+
+func (s *memorySearchIndex) DeleteSession(_ context.Context, userID, sessionID string) error {
+	for id, document := range s.documents {
+		if document.UserID == userID && document.SessionID == sessionID {
+			delete(s.documents, id)
+		}
+	}
+	return nil
+}
+
+func (s *memorySearchIndex) Search(_ context.Context, query SearchIndexQuery) ([]SearchIndexResult, error) {
+	s.queries = append(s.queries, query)
+	var results []SearchIndexResult
+	for _, document := range s.documents {
+		if document.UserID == query.UserID && strings.Contains(document.Content, query.Text) && len(results) < query.Top {
+			results = append(results, SearchIndexResult{SearchDocument: document, Score: 1})
+		}
+	}
+	return results, nil
+}
+
+func TestOperation_SearchIndex(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	index := &memorySearchIndex{documents: map[string]SearchDocument{}}
+	embedder := EmbedderFunc(func(ctx context.Context, text string) ([]float32, error) {
+		return []float32{float32(len(text)), 1}, nil
+	})
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID,
+		WithSearchIndex(index), WithEmbedder(embedder))
+	require.NoError(t, err)
+
+	// added messages are mirrored with their embedding
+	require.NoError(t, history.AddUserMessage(ctx, "My app fails with error E1234"))
+	require.NoError(t, history.AddAIMessage(ctx, "Restart the service"))
+	require.Len(t, index.documents, 2)
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	document := index.documents[stored[0].ID]
+	assert.Equal(t, sessionID, document.SessionID)
+	assert.Equal(t, userID, document.UserID)
+	assert.Equal(t, "human", document.Type)
+	assert.Equal(t, "My app fails with error E1234", document.Content)
+	assert.Equal(t, *stored[0].CreatedAt, document.CreatedAt)
+	assert.Equal(t, []float32{29, 1}, document.Embedding)
+
+	results, err := history.SearchIndexedMessages(ctx, "E1234", 5)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, stored[0].ID, results[0].ID)
+	require.Len(t, index.queries, 1)
+	assert.Equal(t, SearchIndexQuery{Text: "E1234", Vector: []float32{5, 1}, UserID: userID, Top: 5}, index.queries[0])
+
+	// replacing the conversation replaces the documents, clearing removes them
+	require.NoError(t, history.SetMessages(ctx, []llms.ChatMessage{llms.HumanChatMessage{Content: "Start over"}}))
+	require.Len(t, index.documents, 1)
+	for _, document := range index.documents {
+		assert.Equal(t, "Start over", document.Content)
+	}
+	require.NoError(t, history.Clear(ctx))
+	assert.Empty(t, index.documents)
+
+	plain, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	_, err = plain.SearchIndexedMessages(ctx, "E1234", 5)
+	assert.Error(t, err, "A search index is required")
+
+	_, err = NewAzureSearchIndexWithKey("", "chat-messages", "key", nil)
+	assert.Error(t, err)
+	_, err = NewAzureSearchIndexWithKey("https://example.search.windows.net", "chat-messages", "", nil)
+	assert.Error(t, err)
+	assert.Equal(t, "'O''Brien'", searchLiteral("O'Brien"))
+}
+
+func TestOperation_SearchIndexEdits(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	index := &memorySearchIndex{documents: map[string]SearchDocument{}}
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName, WithSearchIndex(index))
+	require.NoError(t, err)
+	history, err := factory.New(sessionID, userID)
+	require.NoError(t, err)
+
+	for _, content := range []string{"First", "My card is 4111 1111 1111 1111", "Typo in teh prompt", "Offending message", "Last"} {
+		require.NoError(t, history.AddUserMessage(ctx, content))
+	}
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, index.documents, 5)
+
+	indexed := func() []string {
+		var contents []string
+		for _, message := range stored {
+			if document, ok := index.documents[message.ID]; ok {
+				contents = append(contents, document.Content)
+			}
+		}
+		return contents
+	}
+
+	require.NoError(t, history.RedactMessage(ctx, stored[1].ID, "support"))
+	require.NoError(t, history.UpdateMessage(ctx, stored[2].ID, "Typo in the prompt"))
+	require.NoError(t, history.DeleteMessage(ctx, stored[3].ID))
+	assert.Equal(t, []string{"First", RedactedContent, "Typo in the prompt", "Last"}, indexed())
+	results, err := history.SearchIndexedMessages(ctx, "4111", 5)
+	require.NoError(t, err)
+	assert.Empty(t, results, "Redacted content should not be searchable")
+
+	require.NoError(t, history.TrimToLastN(ctx, 2))
+	assert.Equal(t, []string{"Typo in the prompt", "Last"}, indexed())
+
+	// purging the user removes the documents of its sessions
+	other, err := factory.New(sessionID+"_other", userID)
+	require.NoError(t, err)
+	require.NoError(t, other.AddUserMessage(ctx, "Other session"))
+	require.Len(t, index.documents, 3)
+	require.NoError(t, factory.DeleteUserData(ctx, userID))
+	assert.Empty(t, index.documents)
+}
+
+func TestOperation_ExportImport(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	restoredID := sessionID + "_restored"
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	defer cleanupTestData(ctx, t, client, userID, restoredID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "Question"))
+	require.NoError(t, history.AddAIMessage(ctx, "Answer"))
+	require.NoError(t, history.SetSessionMetadata(ctx, SessionMetadata{Title: "Exported", Tags: []string{"backup"}}))
+
+	var buf bytes.Buffer
+	require.NoError(t, history.ExportSession(ctx, &buf))
+
+	var export SessionExport
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &export))
+	assert.Equal(t, ExportFormat, export.Format)
+	assert.Equal(t, ExportVersion, export.Version)
+	assert.Equal(t, sessionID, export.SessionID)
+	require.Len(t, export.Messages, 2)
+
+	restored, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, restoredID, userID)
+	require.NoError(t, err)
+	require.NoError(t, restored.ImportSession(ctx, bytes.NewReader(buf.Bytes())))
+
+	stored, err := restored.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	assert.Equal(t, export.Messages[0].ID, stored[0].ID)
+	assert.Equal(t, "Answer", stored[1].Data.Content)
+
+	metadata, err := restored.GetSessionMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Exported", metadata.Title)
+	assert.Equal(t, []string{"backup"}, metadata.Tags)
+
+	assert.Error(t, restored.ImportSession(ctx, bytes.NewReader(buf.Bytes())), "Should error if the session already exists")
+
+	export.Version = ExportVersion + 1
+	newer, err := json.Marshal(export)
+	require.NoError(t, err)
+	assert.Error(t, history.ImportSession(ctx, bytes.NewReader(newer)))
+	assert.Error(t, history.ImportSession(ctx, strings.NewReader(`{"format":"other","version":1}`)))
+}
+
+func TestOperation_TrainingData(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	otherID := sessionID + "_other"
+	shortID := sessionID + "_short"
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	defer cleanupTestData(ctx, t, client, userID, otherID)
+	defer cleanupTestData(ctx, t, client, userID, shortID)
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	history, err := factory.New(sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "How do I reset my password?"))
+	require.NoError(t, history.AddAIMessage(ctx, "Use the link on the sign-in page."))
+	require.NoError(t, history.SetSessionMetadata(ctx, SessionMetadata{Tags: []string{"support"}}))
+
+	other, err := factory.New(otherID, userID)
+	require.NoError(t, err)
+	require.NoError(t, other.AddUserMessage(ctx, "Tell me a joke"))
+	require.NoError(t, other.AddAIMessage(ctx, "No."))
+
+	short, err := factory.New(shortID, userID)
+	require.NoError(t, err)
+	require.NoError(t, short.AddUserMessage(ctx, "Hello?"))
+	require.NoError(t, short.SetSessionMetadata(ctx, SessionMetadata{Tags: []string{"support"}}))
+
+	var buf bytes.Buffer
+	result, err := factory.WriteTrainingData(ctx, &buf, &TrainingExportOptions{
+		UserID:       userID,
+		Tags:         []string{"support"},
+		SystemPrompt: "You are a support agent.",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, TrainingExportResult{Records: 1, Messages: 3, Skipped: 1}, result)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 1)
+	var record TrainingRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, []OpenAIMessage{
+		{Role: "system", Content: "You are a support agent."},
+		{Role: "user", Content: "How do I reset my password?"},
+		{Role: "assistant", Content: "Use the link on the sign-in page."},
+	}, record.Messages)
+
+	result, err = factory.WriteTrainingData(ctx, io.Discard, &TrainingExportOptions{UserID: userID})
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Records)
+}
+
+func TestOperation_ToOpenAIMessages(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID,
+		WithPinnedSystemMessage("You are a weather assistant."))
+	require.NoError(t, err)
+
+	toolCall := llms.ToolCall{ID: "call_1", Type: "function", FunctionCall: &llms.FunctionCall{Name: "weather", Arguments: `{"city":"Paris"}`}}
+	require.NoError(t, history.AddUserMessage(ctx, "Weather in Paris?"))
+	require.NoError(t, history.AddMessage(ctx, llms.AIChatMessage{ToolCalls: []llms.ToolCall{toolCall}}))
+	require.NoError(t, history.AddMessage(ctx, llms.ToolChatMessage{ID: "call_1", Content: "18°C"}))
+	require.NoError(t, history.AddAIMessage(ctx, "It is 18°C in Paris."))
+
+	messages, err := history.ToOpenAIMessages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []OpenAIMessage{
+		{Role: "system", Content: "You are a weather assistant."},
+		{Role: "user", Content: "Weather in Paris?"},
+		{Role: "assistant", ToolCalls: []llms.ToolCall{toolCall}},
+		{Role: "tool", Content: "18°C", ToolCallID: "call_1"},
+		{Role: "assistant", Content: "It is 18°C in Paris."},
+	}, messages)
+
+	data, err := json.Marshal(messages[3])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"role":"tool","content":"18°C","tool_call_id":"call_1"}`, string(data))
+
+	data, err = json.Marshal(toOpenAIMessage(MultimodalMessage{Type: llms.ChatMessageTypeHuman, Parts: []llms.ContentPart{
+		llms.TextContent{Text: "What is this?"},
+		llms.BinaryContent{MIMEType: "image/png", Data: []byte{1, 2}},
+	}}))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"role":"user","content":[{"type":"text","text":"What is this?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AQI="}}]}`, string(data))
+}
+
+func TestOperation_RenderMarkdown(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+
+	transcript, err := history.RenderMarkdown(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, transcript)
+
+	toolCall := llms.ToolCall{ID: "call_1", Type: "function", FunctionCall: &llms.FunctionCall{Name: "run", Arguments: `{"code":"print(1)"}`}}
+	require.NoError(t, history.AddUserMessage(ctx, "How do I print in Python?"))
+	require.NoError(t, history.AddMessage(ctx, llms.AIChatMessage{ToolCalls: []llms.ToolCall{toolCall}}))
+	require.NoError(t, history.AddMessage(ctx, llms.ToolChatMessage{ID: "call_1", Content: "1"}))
+	require.NoError(t, history.AddAIMessage(ctx, "Use print:\n\n```python\nprint(1)\n```"))
+	require.NoError(t, history.SetSessionMetadata(ctx, SessionMetadata{Title: "Python basics"}))
+
+	transcript, err = history.RenderMarkdown(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "# Python basics\n\n"+
+		"**User**\n\nHow do I print in Python?\n\n"+
+		"**Assistant**\n\nCalled `run`:\n\n```\n{\"code\":\"print(1)\"}\n```\n\n"+
+		"**Tool**\n\n```\n1\n```\n\n"+
+		"**Assistant**\n\nUse print:\n\n```python\nprint(1)\n```\n", transcript)
+
+	transcript, err = history.RenderMarkdown(ctx, &MarkdownOptions{
+		Title:            "Support ticket",
+		Labels:           map[llms.ChatMessageType]string{llms.ChatMessageTypeAI: "Bot"},
+		Timestamps:       true,
+		SkipToolMessages: true,
+	})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(transcript, "# Support ticket\n\n**User** _("), transcript)
+	assert.Contains(t, transcript, "**Bot** _(")
+	assert.NotContains(t, transcript, "**Tool**")
+	assert.NotContains(t, transcript, "Called `run`")
+
+	// fences longer than the code blocks in the content keep them intact
+	var sb strings.Builder
+	writeMarkdownCode(&sb, "```go\nfmt.Println()\n```")
+	assert.Equal(t, "````\n```go\nfmt.Println()\n```\n````\n\n", sb.String())
+}
+
+func TestOperation_WriteCSV(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+	history, err := factory.New(sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "Hello, \"world\""))
+	require.NoError(t, history.AddMessageWithUsage(ctx, llms.AIChatMessage{Content: "Hi,\nthere"}, TokenUsage{PromptTokens: 5, CompletionTokens: 3}))
+
+	var buf bytes.Buffer
+	rows, err := factory.WriteCSV(ctx, &buf, &CSVExportOptions{
+		UserID:       userID,
+		TokenCounter: TokenCounterFunc(func(text string) int { return len(strings.Fields(text)) }),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, rows)
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, []string{"session_id", "user_id", "message_id", "timestamp", "role", "content", "tokens"}, records[0])
+
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{sessionID, userID, stored[0].ID, stored[0].CreatedAt.UTC().Format(time.RFC3339), "human", "Hello, \"world\"", "2"}, records[1])
+	assert.Equal(t, "ai", records[2][4])
+	assert.Equal(t, "Hi,\nthere", records[2][5])
+	assert.Equal(t, "8", records[2][6])
+}
+
+func TestOperation_PythonCompatibility(t *testing.T) {
+	ctx := context.Background()
+
+	database, err := client.NewDatabase(testOperationDBName)
+	require.NoError(t, err)
+
+	// the container layout of LangChain Python's CosmosDBChatMessageHistory
+	containerName := "pythonContainer"
+	_, err = database.CreateContainer(ctx, azcosmos.ContainerProperties{
+		ID: containerName,
+		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
+			Paths: []string{"/user_id"},
+		},
+	}, nil)
+	if err != nil && !isResourceExistsError(err) {
+		require.NoError(t, err)
+	}
+	container, err := database.NewContainer(containerName)
+	require.NoError(t, err)
+
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	partitionKey := azcosmos.NewPartitionKeyString(userID)
+	defer func() {
+		_, _ = container.DeleteItem(ctx, partitionKey, sessionID, nil)
+	}()
+
+	// a session written by messages_to_dict
+	pythonItem := fmt.Sprintf(`{"id": %q, "user_id": %q, "messages": [
+		{"type": "human", "data": {"content": "Weather in Paris?", "additional_kwargs": {}, "type": "human", "name": null, "id": null, "example": false}},
+		{"type": "ai", "data": {"content": "", "type": "ai", "tool_calls": [{"name": "weather", "args": {"city": "Paris"}, "id": "call_1", "type": "tool_call"}]}},
+		{"type": "tool", "data": {"content": "18°C", "type": "tool", "tool_call_id": "call_1"}},
+		{"type": "chat", "data": {"content": "Noted.", "type": "chat", "role": "critic"}},
+		{"type": "ai", "data": {"content": [{"type": "text", "text": "It is 18°C."}], "type": "ai"}}
+	]}`, sessionID, userID)
+	_, err = container.CreateItem(ctx, partitionKey, []byte(pythonItem), nil)
+	require.NoError(t, err)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, containerName, sessionID, userID, WithPythonCompatibility())
+	require.NoError(t, err)
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	require.Len(t, messages, 5)
+	assert.Equal(t, llms.HumanChatMessage{Content: "Weather in Paris?"}, messages[0])
+	ai, ok := messages[1].(llms.AIChatMessage)
+	require.True(t, ok)
+	require.Len(t, ai.ToolCalls, 1)
+	assert.Equal(t, "call_1", ai.ToolCalls[0].ID)
+	assert.Equal(t, "weather", ai.ToolCalls[0].FunctionCall.Name)
+	assert.JSONEq(t, `{"city": "Paris"}`, ai.ToolCalls[0].FunctionCall.Arguments)
+	assert.Equal(t, llms.ToolChatMessage{ID: "call_1", Content: "18°C"}, messages[2])
+	assert.Equal(t, llms.GenericChatMessage{Role: "critic", Content: "Noted."}, messages[3])
+	assert.Equal(t, llms.AIChatMessage{Content: "It is 18°C."}, messages[4])
+
+	// messages written by Go are readable by Python
+	require.NoError(t, history.AddMessage(ctx, llms.GenericChatMessage{Role: "critic", Content: "Good answer."}))
+	require.NoError(t, history.AddMessage(ctx, llms.ToolChatMessage{ID: "call_2", Content: "19°C"}))
+
+	item, err := container.ReadItem(ctx, partitionKey, sessionID, nil)
+	require.NoError(t, err)
+	var stored struct {
+		Messages []struct {
+			Type string         `json:"type"`
+			Data map[string]any `json:"data"`
+		} `json:"messages"`
+	}
+	require.NoError(t, json.Unmarshal(item.Value, &stored))
+	require.Len(t, stored.Messages, 7)
+	assert.Equal(t, "chat", stored.Messages[5].Type)
+	assert.Equal(t, "critic", stored.Messages[5].Data["role"])
+	assert.Equal(t, "Good answer.", stored.Messages[5].Data["content"])
+	assert.Equal(t, "call_2", stored.Messages[6].Data["tool_call_id"])
+
+	_, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, containerName, sessionID, userID, WithPythonCompatibility(), WithCompression())
+	assert.Error(t, err)
+}
+
+func TestOperation_SemanticKernelCompatibility(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	container, err := client.NewContainer(testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	// a session whose messages were serialized from a ChatHistory by a .NET service
+	skItem := fmt.Sprintf(`{"id": %q, "userid": %q, "messages": [
+		{"Role": {"Label": "user"}, "Items": [{"$type": "TextContent", "Text": "Weather in Paris?"}]},
+		{"Role": {"Label": "assistant"}, "Items": [{"$type": "FunctionCallContent", "Id": "call_1", "PluginName": "Weather", "FunctionName": "Get", "Arguments": {"city": "Paris"}}], "ModelId": "gpt-4o"},
+		{"Role": {"Label": "tool"}, "Items": [{"$type": "FunctionResultContent", "CallId": "call_1", "FunctionName": "Get", "Result": "18°C"}]},
+		{"Role": {"Label": "assistant"}, "Items": [{"$type": "TextContent", "Text": "It is 18°C."}]}
+	]}`, sessionID, userID)
+	_, err = container.CreateItem(ctx, azcosmos.NewPartitionKeyString(userID), []byte(skItem), nil)
+	require.NoError(t, err)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSemanticKernelCompatibility())
+	require.NoError(t, err)
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	require.Len(t, messages, 4)
+	assert.Equal(t, llms.HumanChatMessage{Content: "Weather in Paris?"}, messages[0])
+	ai, ok := messages[1].(llms.AIChatMessage)
+	require.True(t, ok)
+	require.Len(t, ai.ToolCalls, 1)
+	assert.Equal(t, "call_1", ai.ToolCalls[0].ID)
+	assert.Equal(t, "Weather-Get", ai.ToolCalls[0].FunctionCall.Name)
+	assert.JSONEq(t, `{"city": "Paris"}`, ai.ToolCalls[0].FunctionCall.Arguments)
+	assert.Equal(t, llms.ToolChatMessage{ID: "call_1", Content: "18°C"}, messages[2])
+	assert.Equal(t, llms.AIChatMessage{Content: "It is 18°C."}, messages[3])
+
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "gpt-4o", stored[1].GenerationInfo.Model)
+
+	// messages written by Go deserialize into a ChatHistory
+	require.NoError(t, history.AddMessage(ctx, llms.GenericChatMessage{Role: "critic", Name: "reviewer", Content: "Good answer."}))
+	require.NoError(t, history.AddUserMessage(ctx, "Thanks"))
+
+	item, err := container.ReadItem(ctx, azcosmos.NewPartitionKeyString(userID), sessionID, nil)
+	require.NoError(t, err)
+	var raw struct {
+		Messages []json.RawMessage `json:"messages"`
+	}
+	require.NoError(t, json.Unmarshal(item.Value, &raw))
+	require.Len(t, raw.Messages, 6)
+	var critic map[string]any
+	require.NoError(t, json.Unmarshal(raw.Messages[4], &critic))
+	assert.Equal(t, map[string]any{"Label": "critic"}, critic["Role"])
+	assert.Equal(t, "reviewer", critic["AuthorName"])
+	assert.Equal(t, []any{map[string]any{"$type": "TextContent", "Text": "Good answer."}}, critic["Items"])
+	assert.NotContains(t, critic, "data")
+
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, llms.GenericChatMessage{Role: "critic", Name: "reviewer", Content: "Good answer."}, messages[4])
+	assert.Equal(t, llms.HumanChatMessage{Content: "Thanks"}, messages[5])
+
+	// the partial reads select the messages client side
+	messages, err = history.MessagesByType(ctx, llms.ChatMessageTypeTool)
+	require.NoError(t, err)
+	assert.Equal(t, []llms.ChatMessage{llms.ToolChatMessage{ID: "call_1", Content: "18°C"}}, messages)
+	messages, err = history.MessagesTail(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []llms.ChatMessage{llms.HumanChatMessage{Content: "Thanks"}}, messages)
+
+	_, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithSemanticKernelCompatibility(), WithChunking(1000))
+	assert.Error(t, err)
+}
+
+func TestOperation_FieldMapping(t *testing.T) {
+	ctx := context.Background()
+
+	database, err := client.NewDatabase(testOperationDBName)
+	require.NoError(t, err)
+
+	containerName := "mappedContainer"
+	_, err = database.CreateContainer(ctx, azcosmos.ContainerProperties{
+		ID: containerName,
+		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
+			Paths: []string{"/ownerId"},
+		},
+	}, nil)
+	if err != nil && !isResourceExistsError(err) {
+		require.NoError(t, err)
+	}
+	container, err := database.NewContainer(containerName)
+	require.NoError(t, err)
+
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	partitionKey := azcosmos.NewPartitionKeyString(userID)
+	defer func() {
+		_, _ = container.DeleteItem(ctx, partitionKey, sessionID, nil)
+	}()
+
+	mapping := FieldMapping{
+		UserID:    "ownerId",
+		Messages:  "turns",
+		SessionID: "sessionId",
+		Extra:     map[string]any{"docType": "chat", "docVersion": 2},
+	}
+
+	// schemaVersion was a valid Extra property before the document layout was versioned, it is now
+	// reserved for SchemaVersion and rejected
+	_, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, containerName, sessionID, userID, WithFieldMapping(FieldMapping{Extra: map[string]any{"schemaVersion": 2}}))
+	assert.ErrorContains(t, err, `"schemaVersion"`)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, containerName, sessionID, userID, WithFieldMapping(mapping))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "What is the capital of France?"))
+	require.NoError(t, history.AddAIMessage(ctx, "Paris."))
+
+	item, err := container.ReadItem(ctx, partitionKey, sessionID, nil)
+	require.NoError(t, err)
+	var stored map[string]any
+	require.NoError(t, json.Unmarshal(item.Value, &stored))
+	assert.Equal(t, userID, stored["ownerId"])
+	assert.Equal(t, sessionID, stored["sessionId"])
+	assert.Equal(t, "chat", stored["docType"])
+	assert.EqualValues(t, 2, stored["docVersion"])
+	assert.Len(t, stored["turns"], 2)
+	assert.NotContains(t, stored, "userid")
+	assert.NotContains(t, stored, "messages")
+
+	// a new instance reads the mapped document
+	history, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, containerName, sessionID, userID, WithFieldMapping(mapping))
+	require.NoError(t, err)
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []llms.ChatMessage{
+		llms.HumanChatMessage{Content: "What is the capital of France?"},
+		llms.AIChatMessage{Content: "Paris."},
+	}, messages)
+
+	count, err := history.MessageCount(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	messages, err = history.MessagesDesc(ctx, 0, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []llms.ChatMessage{llms.AIChatMessage{Content: "Paris."}}, messages)
+
+	results, err := history.SearchMessages(ctx, "paris")
+	require.NoError(t, err)
+	assert.Len(t, results, 1)
+
+	// names that collide with other properties are rejected
+	_, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, containerName, sessionID, userID, WithFieldMapping(FieldMapping{Messages: "summary"}))
+	assert.Error(t, err)
+	_, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, containerName, sessionID, userID, WithFieldMapping(FieldMapping{Messages: "my-messages"}))
+	assert.Error(t, err)
+}
+
+func TestOperation_SchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	newerID := sessionID + "_newer"
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	defer cleanupTestData(ctx, t, client, userID, newerID)
+
+	container, err := client.NewContainer(testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+	partitionKey := azcosmos.NewPartitionKeyString(userID)
+
+	readVersion := func(id string) float64 {
+		item, err := container.ReadItem(ctx, partitionKey, id, nil)
+		require.NoError(t, err)
+		var stored map[string]any
+		require.NoError(t, json.Unmarshal(item.Value, &stored))
+		version, _ := stored["schemaVersion"].(float64)
+		return version
+	}
+
+	// a session written before the schema was versioned, without messages
+	legacyItem := fmt.Sprintf(`{"id": %q, "userid": %q, "messages": null}`, sessionID, userID)
+	_, err = container.CreateItem(ctx, partitionKey, []byte(legacyItem), nil)
+	require.NoError(t, err)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+
+	var iterated int
+	for _, err := range history.MessagesIter(ctx) {
+		require.NoError(t, err)
+		iterated++
+	}
+	assert.Zero(t, iterated)
+
+	// rewriting the document stores the current version
+	require.NoError(t, history.SetMessages(ctx, []llms.ChatMessage{llms.HumanChatMessage{Content: "Hello"}}))
+	assert.Equal(t, float64(SchemaVersion), readVersion(sessionID))
+
+	history, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []llms.ChatMessage{llms.HumanChatMessage{Content: "Hello"}}, messages)
+
+	// documents written by a newer version of the package are not misread
+	newerItem := fmt.Sprintf(`{"id": %q, "userid": %q, "schemaVersion": %d, "messages": []}`, newerID, userID, SchemaVersion+1)
+	_, err = container.CreateItem(ctx, partitionKey, []byte(newerItem), nil)
+	require.NoError(t, err)
+
+	newer, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, newerID, userID)
+	require.NoError(t, err)
+	_, err = newer.Messages(ctx)
+	assert.ErrorIs(t, err, ErrUnsupportedSchemaVersion)
+}
+
+func TestOperation_DualWrite(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	database, err := client.NewDatabase(testOperationDBName)
+	require.NoError(t, err)
+
+	// the new layout is partitioned on the session
+	containerName := "dualWriteContainer"
+	_, err = database.CreateContainer(ctx, azcosmos.ContainerProperties{
+		ID: containerName,
+		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
+			Paths: []string{"/sessionId"},
+		},
+	}, nil)
+	if err != nil && !isResourceExistsError(err) {
+		require.NoError(t, err)
+	}
+	container, err := database.NewContainer(containerName)
+	require.NoError(t, err)
+	defer func() {
+		_, _ = container.DeleteItem(ctx, azcosmos.NewPartitionKeyString(sessionID), sessionID, nil)
+	}()
+
+	target := DualWriteTarget{Container: container, Options: []Option{WithPartitionKey("/sessionId", sessionID)}}
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithDualWrite(target))
+	require.NoError(t, err)
+
+	migrated, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, containerName, sessionID, userID, WithPartitionKey("/sessionId", sessionID))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.AddAIMessage(ctx, "Hi there"))
+
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	mirrored, err := migrated.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, mirrored, 2)
+	assert.Equal(t, stored[0].ID, mirrored[0].ID)
+	assert.Equal(t, "Hi there", mirrored[1].ToChatMessage().GetContent())
+
+	// other modifications copy the conversation
+	require.NoError(t, history.SetMessages(ctx, []llms.ChatMessage{llms.HumanChatMessage{Content: "Replaced"}}))
+	messages, err := migrated.Messages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []llms.ChatMessage{llms.HumanChatMessage{Content: "Replaced"}}, messages)
+
+	require.NoError(t, history.SetSystemMessage(ctx, "Be brief"))
+	messages, err = migrated.Messages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []llms.ChatMessage{llms.SystemChatMessage{Content: "Be brief"}, llms.HumanChatMessage{Content: "Replaced"}}, messages)
+
+	require.NoError(t, history.TrimToLastN(ctx, 1))
+	messages, err = migrated.Messages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []llms.ChatMessage{llms.HumanChatMessage{Content: "Replaced"}}, messages)
+
+	require.NoError(t, history.Clear(ctx))
+	messages, err = migrated.Messages(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+
+	// a target that can't be written
+	missing, err := database.NewContainer("missingContainer")
+	require.NoError(t, err)
+
+	var failures int
+	bestEffort := DualWriteTarget{Container: missing, Policy: DualWriteBestEffort, OnError: func(string, error) { failures++ }}
+	history, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithDualWrite(bestEffort))
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "Still works"))
+	assert.Equal(t, 1, failures)
+
+	history, err = NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithDualWrite(DualWriteTarget{Container: missing}))
+	require.NoError(t, err)
+	assert.Error(t, history.AddUserMessage(ctx, "Fails"))
+
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	assert.Len(t, messages, 2)
+
+	// purging the user purges the target, which is partitioned on the user as well
+	mappedName := "mappedContainer"
+	_, err = database.CreateContainer(ctx, azcosmos.ContainerProperties{
+		ID: mappedName,
+		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
+			Paths: []string{"/ownerId"},
+		},
+	}, nil)
+	if err != nil && !isResourceExistsError(err) {
+		require.NoError(t, err)
+	}
+	mapped, err := database.NewContainer(mappedName)
+	require.NoError(t, err)
+	mappedTarget := DualWriteTarget{Container: mapped, Options: []Option{WithFieldMapping(FieldMapping{UserID: "ownerId"})}}
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName, WithDualWrite(mappedTarget))
+	require.NoError(t, err)
+	history, err = factory.New(sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "Purge me"))
+
+	require.NoError(t, factory.DeleteUserData(ctx, userID))
+	_, err = mapped.ReadItem(ctx, azcosmos.NewPartitionKeyString(userID), sessionID, nil)
+	assert.True(t, isNotFoundError(err), "The session should be deleted from the target")
+
+	failures = 0
+	factory, err = NewHistoryFactory(client, testOperationDBName, testOperationContainerName, WithDualWrite(bestEffort))
+	require.NoError(t, err)
+	require.NoError(t, factory.DeleteUserData(ctx, userID))
+	assert.Equal(t, 1, failures)
+	factory, err = NewHistoryFactory(client, testOperationDBName, testOperationContainerName, WithDualWrite(DualWriteTarget{Container: missing}))
+	require.NoError(t, err)
+	assert.Error(t, factory.DeleteUserData(ctx, userID))
+}
+
+func TestOperation_CopySessions(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	otherID := sessionID + "_other"
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	defer cleanupTestData(ctx, t, client, userID, otherID)
+
+	database, err := client.NewDatabase(testOperationDBName)
+	require.NoError(t, err)
+
+	// the destination is partitioned on the session
+	containerName := "copyContainer"
+	_, err = database.CreateContainer(ctx, azcosmos.ContainerProperties{
+		ID: containerName,
+		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
+			Paths: []string{"/sessionId"},
+		},
+	}, nil)
+	if err != nil && !isResourceExistsError(err) {
+		require.NoError(t, err)
+	}
+	container, err := database.NewContainer(containerName)
+	require.NoError(t, err)
+	defer func() {
+		_, _ = container.DeleteItem(ctx, azcosmos.NewPartitionKeyString(sessionID), sessionID, nil)
+	}()
+
+	source, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+	destination, err := NewHistoryFactory(client, testOperationDBName, containerName)
+	require.NoError(t, err)
+
+	history, err := source.New(sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "My email is jane@example.com"))
+	require.NoError(t, history.AddAIMessage(ctx, "Noted"))
+	require.NoError(t, history.SetSessionTitle(ctx, "Contact details"))
+	other, err := source.New(otherID, userID)
+	require.NoError(t, err)
+	require.NoError(t, other.AddUserMessage(ctx, "Not copied"))
+
+	opts := &CopySessionsOptions{
+		UserID:     userID,
+		SessionIDs: []string{sessionID},
+		SessionOptions: func(sessionID, _ string) []Option {
+			return []Option{WithPartitionKey("/sessionId", sessionID)}
+		},
+		Transform: func(session *SessionExport) error {
+			for i := range session.Messages {
+				session.Messages[i].Data.Content = strings.ReplaceAll(session.Messages[i].Data.Content, "jane@example.com", "[email]")
+			}
+			return nil
+		},
+	}
+	result, err := source.CopySessions(ctx, destination, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Copied)
+	assert.Zero(t, result.Skipped)
+	assert.Positive(t, result.RequestCharge)
+
+	copied, err := destination.New(sessionID, userID, WithPartitionKey("/sessionId", sessionID))
+	require.NoError(t, err)
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	copiedMessages, err := copied.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, copiedMessages, 2)
+	assert.Equal(t, stored[0].ID, copiedMessages[0].ID)
+	assert.Equal(t, "My email is [email]", copiedMessages[0].Data.Content)
+	title, err := copied.GetSessionTitle(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Contact details", title)
+
+	// copying again skips the existing session, unless it is overwritten
+	result, err = source.CopySessions(ctx, destination, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 0, result.Copied)
+	assert.Equal(t, 1, result.Skipped)
+
+	require.NoError(t, history.AddUserMessage(ctx, "One more"))
+	opts.Overwrite = true
+	result, err = source.CopySessions(ctx, destination, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Copied)
+
+	messages, err := copied.Messages(ctx)
+	require.NoError(t, err)
+	assert.Len(t, messages, 3)
+}
+
+func TestOperation_BackfillAllEmbeddings(t *testing.T) {
+	ctx := context.Background()
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	failingID := sessionID + "_failing"
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	defer cleanupTestData(ctx, t, client, userID, failingID)
+
+	embedder := EmbedderFunc(func(ctx context.Context, text string) ([]float32, error) {
+		if strings.HasPrefix(text, "fail") {
+			return nil, errors.New("embedding model unavailable")
+		}
+		return []float32{float32(len(text)), 1}, nil
+	})
+
+	// sessions written before the embedder was configured
+	plain, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+	history, err := plain.New(sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.AddAIMessage(ctx, "Hi there"))
+	failing, err := plain.New(failingID, userID)
+	require.NoError(t, err)
+	require.NoError(t, failing.AddUserMessage(ctx, "fail to embed"))
+
+	_, err = plain.BackfillEmbeddings(ctx, &EmbeddingBackfillOptions{UserID: userID})
+	assert.Error(t, err, "An embedder is required")
+
+	factory, err := NewHistoryFactory(client, testOperationDBName, testOperationContainerName, WithEmbedder(embedder))
+	require.NoError(t, err)
+
+	// without OnError the backfill stops at the failing session
+	_, err = factory.BackfillEmbeddings(ctx, &EmbeddingBackfillOptions{UserID: userID})
+	assert.Error(t, err)
+
+	checkpoint := NewFileCheckpoint(filepath.Join(t.TempDir(), "backfill.checkpoint"))
+	var failed []string
+	opts := &EmbeddingBackfillOptions{
+		UserID:     userID,
+		Checkpoint: checkpoint,
+		OnError:    func(sessionID, _ string, _ error) { failed = append(failed, sessionID) },
+	}
+	result, err := factory.BackfillEmbeddings(ctx, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Sessions)
+	assert.Equal(t, 1, result.Failed)
+	assert.Equal(t, []string{failingID}, failed)
+
+	stored, err := history.StoredMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	for _, message := range stored {
+		assert.NotNil(t, message.Embedding)
+	}
+
+	// a completed backfill starts over and skips the embedded messages
+	token, err := checkpoint.Load(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, token)
+	result, err = factory.BackfillEmbeddings(ctx, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Sessions)
+	assert.Zero(t, result.Messages)
+
+	require.NoError(t, checkpoint.Save(ctx, "token"))
+	token, err = checkpoint.Load(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "token", token)
+}
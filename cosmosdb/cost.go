@@ -0,0 +1,47 @@
+package cosmosdb
+
+import "context"
+
+// ModelPrice is the price of a model in a currency of your choice per million tokens.
+type ModelPrice struct {
+	PromptPerMillion     float64
+	CompletionPerMillion float64
+}
+
+// PriceTable maps model names (as stored in GenerationInfo.Model) to their prices.
+type PriceTable map[string]ModelPrice
+
+// SessionCost is the aggregated spend of a conversation.
+type SessionCost struct {
+	// Total is the cost of all priced messages.
+	Total float64
+	// ByModel is the cost per model.
+	ByModel map[string]float64
+	// Unpriced is the token usage of messages without a model or whose model is not in the price table.
+	Unpriced TokenUsage
+}
+
+// SessionCost returns the spend of the session, computed from the token usage of the messages (see
+// AddMessageWithUsage and AddContentChoice) and the price of the model that generated them.
+// Like SessionTokenUsage, it doesn't include messages that are no longer stored.
+func (h *CosmosDBChatMessageHistory) SessionCost(ctx context.Context, prices PriceTable) (SessionCost, error) {
+	usages, err := h.messageUsages(ctx)
+	if err != nil {
+		return SessionCost{}, err
+	}
+
+	cost := SessionCost{ByModel: map[string]float64{}}
+	for _, usage := range usages {
+		price, ok := prices[usage.Model]
+		if usage.Model == "" || !ok {
+			cost.Unpriced.add(usage.Usage)
+			continue
+		}
+
+		amount := (float64(usage.Usage.PromptTokens)*price.PromptPerMillion + float64(usage.Usage.CompletionTokens)*price.CompletionPerMillion) / 1e6
+		cost.ByModel[usage.Model] += amount
+		cost.Total += amount
+	}
+
+	return cost, nil
+}
@@ -0,0 +1,116 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// messageCount is the projection used by MessageCount for history and chunk items.
+type messageCount struct {
+	Count       int      `json:"count"`
+	Chunks      []string `json:"chunks"`
+	Compression string   `json:"compression"`
+}
+
+// Exists reports whether the session is stored, without reading its messages.
+func (h *CosmosDBChatMessageHistory) Exists(ctx context.Context) (bool, error) {
+	ctx = h.readContext(ctx)
+	query := "SELECT VALUE COUNT(1) FROM c WHERE c.id = @id"
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@id", Value: h.sessionID}},
+	}
+
+	pager := h.readContainer(ctx).NewQueryItemsPager(h.mapQuery(query), h.partitionKey(), h.withSessionToken(ctx, &queryOptions))
+	for pager.More() {
+		page, err := pager.NextPage(h.requestContext(ctx))
+		err = h.recordCharge(OperationQuery, page.RequestCharge, err)
+		if err != nil {
+			return false, fmt.Errorf("failed to check sessionID %s: %w", h.sessionID, err)
+		}
+		for _, item := range page.Items {
+			var count int
+			if err := json.Unmarshal(item, &count); err != nil {
+				return false, fmt.Errorf("failed to unmarshal session count: %w", err)
+			}
+			if count > 0 {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// MessageCount returns the number of stored messages of the session, 0 if it doesn't exist.
+// The pinned system message is not counted. Only the lengths of the message arrays are queried,
+// compressed sessions are read in full. It doesn't update the in-memory cache.
+func (h *CosmosDBChatMessageHistory) MessageCount(ctx context.Context) (int, error) {
+	ctx = h.readContext(ctx)
+	query := "SELECT ARRAY_LENGTH(c.messages) AS count, c.chunks, c.compression FROM c WHERE c.id = @id"
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@id", Value: h.sessionID}},
+	}
+
+	head, err := h.queryMessageCounts(ctx, query, &queryOptions)
+	if err != nil {
+		return 0, err
+	}
+	if len(head) == 0 {
+		return 0, nil
+	}
+
+	counts := head[:1]
+	if len(head[0].Chunks) > 0 {
+		query = "SELECT ARRAY_LENGTH(c.messages) AS count, c.compression FROM c WHERE ARRAY_CONTAINS(@chunks, c.id)"
+		queryOptions = azcosmos.QueryOptions{
+			QueryParameters: []azcosmos.QueryParameter{{Name: "@chunks", Value: head[0].Chunks}},
+		}
+		chunks, err := h.queryMessageCounts(ctx, query, &queryOptions)
+		if err != nil {
+			return 0, err
+		}
+		counts = append(counts, chunks...)
+	}
+
+	var total int
+	for _, count := range counts {
+		if count.Compression != "" {
+			// the number of compressed messages is only known after decompressing them
+			history, _, err := h.readHistory(ctx)
+			if err != nil {
+				return 0, err
+			}
+			if history == nil {
+				return 0, nil
+			}
+			return len(history.ChatMessages), nil
+		}
+		total += count.Count
+	}
+
+	return total, nil
+}
+
+// queryMessageCounts runs a message count projection in the partition of the session.
+func (h *CosmosDBChatMessageHistory) queryMessageCounts(ctx context.Context, query string, queryOptions *azcosmos.QueryOptions) ([]messageCount, error) {
+	var counts []messageCount
+	pager := h.readContainer(ctx).NewQueryItemsPager(h.mapQuery(query), h.partitionKey(), h.withSessionToken(ctx, queryOptions))
+	for pager.More() {
+		page, err := pager.NextPage(h.requestContext(ctx))
+		err = h.recordCharge(OperationQuery, page.RequestCharge, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count messages of sessionID %s: %w", h.sessionID, err)
+		}
+		for _, item := range page.Items {
+			var count messageCount
+			if err := json.Unmarshal(item, &count); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal message count: %w", err)
+			}
+			counts = append(counts, count)
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,84 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// csvHeader is the header row written by WriteCSV.
+var csvHeader = []string{"session_id", "user_id", "message_id", "timestamp", "role", "content", "tokens"}
+
+// CSVExportOptions selects the sessions written by WriteCSV.
+type CSVExportOptions struct {
+	// UserID limits the export to the sessions of the user. If empty, the sessions of all users are
+	// exported with a cross-partition query.
+	UserID string
+	// Tags limits the export to sessions having all of the tags.
+	Tags []string
+	// CreatedSince and CreatedBefore limit the export to sessions created in [CreatedSince, CreatedBefore).
+	// Zero values are ignored. Sessions created by earlier versions have no creation time and are excluded.
+	CreatedSince  time.Time
+	CreatedBefore time.Time
+	// TokenCounter (optional) counts the tokens of messages without recorded token usage (see
+	// AddMessageWithUsage). Without it, their tokens column is empty.
+	TokenCounter TokenCounter
+}
+
+// WriteCSV writes the messages of the selected sessions to w as CSV with a header row and one row per
+// message: session_id, user_id, message_id, timestamp (RFC 3339, UTC), role, content and tokens, e.g. for
+// analysis in spreadsheets and BI tools. The role is the chat message type, e.g. "human" or "ai". The
+// tokens column holds the recorded total tokens of the message, if any. It returns the number of rows
+// written, not counting the header. opts may be nil.
+func (f *HistoryFactory) WriteCSV(ctx context.Context, w io.Writer, opts *CSVExportOptions) (int, error) {
+	if opts == nil {
+		opts = &CSVExportOptions{}
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return 0, fmt.Errorf("failed to write CSV header: %w", err)
+	}
+
+	rows := 0
+	selection := &ListSessionsOptions{Tags: opts.Tags, CreatedSince: opts.CreatedSince, CreatedBefore: opts.CreatedBefore}
+	err := f.forEachSession(ctx, opts.UserID, selection, func(h *CosmosDBChatMessageHistory) error {
+		messages, err := h.StoredMessages(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, message := range messages {
+			var timestamp, tokens string
+			if message.CreatedAt != nil {
+				timestamp = message.CreatedAt.UTC().Format(time.RFC3339)
+			}
+			if message.Usage != nil {
+				tokens = strconv.Itoa(message.Usage.TotalTokens)
+			} else if opts.TokenCounter != nil {
+				tokens = strconv.Itoa(opts.TokenCounter.CountTokens(message.Data.Content))
+			}
+
+			row := []string{h.sessionID, h.userID, message.ID, timestamp, message.Type, message.Data.Content, tokens}
+			if err := writer.Write(row); err != nil {
+				return fmt.Errorf("failed to write CSV row of session %s: %w", h.sessionID, err)
+			}
+			rows++
+		}
+		// keep memory bounded for large exports
+		writer.Flush()
+		return writer.Error()
+	})
+	if err != nil {
+		return rows, err
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return rows, fmt.Errorf("failed to write CSV: %w", err)
+	}
+	return rows, nil
+}
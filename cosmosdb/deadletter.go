@@ -0,0 +1,152 @@
+package cosmosdb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// DeadLetterEntry holds messages that could not be written, so that they can be replayed later.
+type DeadLetterEntry struct {
+	SessionID string `json:"sessionId"`
+	UserID    string `json:"userid"`
+	// Replace is set if the messages are the whole conversation passed to SetMessages, rather than
+	// messages to append.
+	Replace bool `json:"replace,omitempty"`
+	// Payload is the JSON array of the messages in their stored format, including their IDs.
+	Payload json.RawMessage `json:"messages"`
+	// Error is the error of the failed write.
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// Messages decodes the payload. The messages keep their IDs and creation times when they are added
+// again with AddMessage, or written with SetMessages if Replace is set.
+func (e DeadLetterEntry) Messages() ([]llms.ChatMessage, error) {
+	var stored []Message
+	if err := json.Unmarshal(e.Payload, &stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dead-lettered messages: %w", err)
+	}
+
+	messages := make([]llms.ChatMessage, 0, len(stored))
+	for _, message := range stored {
+		messages = append(messages, message.toCachedMessage())
+	}
+	return messages, nil
+}
+
+// DeadLetter receives the messages of writes that failed after the retries, e.g. to put them on a
+// queue, instead of losing them. Implementations must be safe for concurrent use.
+type DeadLetter interface {
+	Send(ctx context.Context, entry DeadLetterEntry) error
+}
+
+// DeadLetterFunc is a DeadLetter calling a function for every entry.
+type DeadLetterFunc func(ctx context.Context, entry DeadLetterEntry) error
+
+// Send calls f(ctx, entry).
+func (f DeadLetterFunc) Send(ctx context.Context, entry DeadLetterEntry) error {
+	return f(ctx, entry)
+}
+
+// FileDeadLetter is a DeadLetter appending the entries to a local file, one JSON object per line.
+// Read them back with ReadDeadLetters.
+type FileDeadLetter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+var _ DeadLetter = &FileDeadLetter{}
+
+// NewFileDeadLetter opens the file at path for appending, creating it if needed.
+func NewFileDeadLetter(path string) (*FileDeadLetter, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead letter file: %w", err)
+	}
+	return &FileDeadLetter{file: file}, nil
+}
+
+func (d *FileDeadLetter) Send(ctx context.Context, entry DeadLetterEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return d.file.Sync()
+}
+
+// Close closes the file.
+func (d *FileDeadLetter) Close() error {
+	return d.file.Close()
+}
+
+// ReadDeadLetters reads the entries written by a FileDeadLetter.
+func ReadDeadLetters(r io.Reader) ([]DeadLetterEntry, error) {
+	var entries []DeadLetterEntry
+	scanner := bufio.NewScanner(r)
+	// an entry holds up to a whole conversation
+	scanner.Buffer(nil, 4*maxDocumentBytes)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry DeadLetterEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal dead letter entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dead letter entries: %w", err)
+	}
+	return entries, nil
+}
+
+// deadLetter hands the messages of a write that failed with err to the DeadLetter set with
+// WithDeadLetter, if the write failed after the retries rather than being rejected. It returns err,
+// joined with the error of the dead letter if sending the messages failed as well.
+func (h *CosmosDBChatMessageHistory) deadLetter(ctx context.Context, err error, replace bool, messages ...llms.ChatMessage) error {
+	if err == nil || h.deadLetterSink == nil || !(isTransientError(err) || errors.Is(err, ErrConflict)) {
+		return err
+	}
+
+	stored := make([]Message, 0, len(messages))
+	for _, message := range messages {
+		if message != nil {
+			stored = append(stored, stampMessage(message).toMessage())
+		}
+	}
+	payload, merr := json.Marshal(stored)
+	if merr != nil {
+		return errors.Join(err, fmt.Errorf("failed to marshal dead-lettered messages: %w", merr))
+	}
+
+	entry := DeadLetterEntry{
+		SessionID: h.sessionID,
+		UserID:    h.userID,
+		Replace:   replace,
+		Payload:   payload,
+		Error:     err.Error(),
+		Time:      time.Now().UTC(),
+	}
+	// the write may have failed because ctx is done
+	if serr := h.deadLetterSink.Send(context.WithoutCancel(ctx), entry); serr != nil {
+		return errors.Join(err, fmt.Errorf("failed to dead-letter messages: %w", serr))
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package cosmosdb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// isDuplicate reports whether message has the same type and content as the last stored message
+// and that message was added within the dedupe window.
+func (h *CosmosDBChatMessageHistory) isDuplicate(ctx context.Context, message llms.ChatMessage) (bool, error) {
+	last, err := h.lastStoredMessage(ctx)
+	if err != nil || last == nil {
+		return false, err
+	}
+	return h.repeats(*last, message), nil
+}
+
+// repeats reports whether message has the same type and content as last and last was added
+// within the dedupe window.
+func (h *CosmosDBChatMessageHistory) repeats(last Message, message llms.ChatMessage) bool {
+	if last.CreatedAt == nil || time.Since(*last.CreatedAt) > h.dedupeWindow {
+		return false
+	}
+
+	if cached, ok := message.(cachedMessage); ok {
+		message = cached.ChatMessage
+	}
+	model := toMessage(message)
+	if last.Type != model.Type || len(last.Parts) > 0 || len(model.Parts) > 0 {
+		// multimodal messages are not compared
+		return false
+	}
+	if last.ContentRef != nil {
+		// the content was offloaded, compare its hash instead
+		sum := sha256.Sum256([]byte(model.Data.Content))
+		return last.ContentRef.SHA256 == hex.EncodeToString(sum[:])
+	}
+	return last.Data.Content == model.Data.Content
+}
+
+// lastStoredMessage returns the most recent stored message, or nil if there is none. Only the last
+// message is transferred unless the document is compressed or all its messages moved to chunks.
+func (h *CosmosDBChatMessageHistory) lastStoredMessage(ctx context.Context) (*Message, error) {
+	query := "SELECT ARRAY_SLICE(c.messages, -1) AS messages, c.chunks, c.compression FROM c WHERE c.id = @id"
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@id", Value: h.sessionID}},
+	}
+
+	var last *struct {
+		Messages    []Message `json:"messages"`
+		Chunks      []string  `json:"chunks"`
+		Compression string    `json:"compression"`
+	}
+
+	pager := h.container.NewQueryItemsPager(h.mapQuery(query), h.partitionKey(), h.withSessionToken(ctx, &queryOptions))
+	for pager.More() && last == nil {
+		page, err := pager.NextPage(h.requestContext(ctx))
+		err = h.recordCharge(OperationQuery, page.RequestCharge, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query last message of sessionID %s: %w", h.sessionID, err)
+		}
+		if len(page.Items) > 0 {
+			if err := json.Unmarshal(page.Items[0], &last); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal history data: %w", err)
+			}
+		}
+	}
+
+	if last == nil {
+		return nil, nil
+	}
+
+	messages := last.Messages
+	if last.Compression != "" || (len(messages) == 0 && len(last.Chunks) > 0) {
+		history, _, err := h.readHistory(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if history == nil {
+			return nil, nil
+		}
+		messages = history.ChatMessages
+	}
+
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	return &messages[len(messages)-1], nil
+}
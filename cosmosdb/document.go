@@ -0,0 +1,171 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// readHistory reads the history document of the session, including the messages stored in
+// chunk items. It returns a nil history if the session doesn't exist.
+func (h *CosmosDBChatMessageHistory) readHistory(ctx context.Context) (*History, azcore.ETag, error) {
+	item, err := h.readContainer(ctx).ReadItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, h.readOptions(ctx))
+	err = h.recordCharge(OperationRead, item.RequestCharge, err)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to read item with sessionID %s: %w", h.sessionID, err)
+	}
+
+	history, err := h.unmarshalItem(item.Value)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal history data: %w", err)
+	}
+	history.itemSize = len(item.Value)
+
+	if len(history.Chunks) > 0 {
+		older, err := h.readChunks(ctx, history.Chunks)
+		if err != nil {
+			return nil, "", err
+		}
+		history.ChatMessages = append(older, history.ChatMessages...)
+	}
+
+	err = h.loadOffloadedContent(ctx, history.ChatMessages)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &history, item.ETag, nil
+}
+
+// unmarshalHistory decodes a history (or chunk) item, upgrading older schema versions and decompressing
+// the messages if needed.
+func unmarshalHistory(data []byte) (History, error) {
+	data, err := upgradeDocument(data)
+	if err != nil {
+		return History{}, err
+	}
+
+	var history History
+	err = json.Unmarshal(data, &history)
+	if err != nil {
+		return History{}, err
+	}
+
+	if history.Compression != "" {
+		compressed, err := decompressMessages(history.Compression, history.CompressedMessages)
+		if err != nil {
+			return History{}, err
+		}
+		// messages appended by writers without compression come after the compressed ones
+		history.ChatMessages = append(compressed, history.ChatMessages...)
+		history.Compression = ""
+		history.CompressedMessages = ""
+	}
+
+	return history, nil
+}
+
+// writeHistory writes the full history document. Without an ETag the document is created
+// (failing if it already exists), otherwise it is replaced only if it still matches the ETag.
+// When chunking is enabled, older messages are written to chunk items first and their ids are returned.
+func (h *CosmosDBChatMessageHistory) writeHistory(ctx context.Context, messages []llms.ChatMessage, etag azcore.ETag) (azcore.ETag, []string, error) {
+	chatMessages := make([]Message, 0, len(messages))
+	for _, message := range messages {
+		stored, err := h.newMessage(ctx, message)
+		if err != nil {
+			return "", nil, err
+		}
+		chatMessages = append(chatMessages, stored)
+	}
+
+	history := History{
+		SessionId:    h.sessionID,
+		UserID:       h.userID,
+		ChatMessages: chatMessages,
+		TTL:          h.ttl,
+		Summary:      h.summary,
+	}
+
+	if etag == "" && (h.metadata == nil || h.metadata.CreatedAt == nil) {
+		// the document is created, stamp the creation time
+		metadata := SessionMetadata{}
+		if h.metadata != nil {
+			metadata = *h.metadata
+		}
+		// second precision keeps the stored value fixed width, so it can be compared as a string in queries
+		createdAt := time.Now().UTC().Truncate(time.Second)
+		metadata.CreatedAt = &createdAt
+		h.metadata = &metadata
+	}
+	history.Metadata = h.metadata
+
+	if h.maxChunkBytes > 0 {
+		chunks, head, err := splitChunks(chatMessages, h.maxChunkBytes)
+		if err != nil {
+			return "", nil, err
+		}
+		history.Chunks, err = h.createChunks(ctx, chunks, 0)
+		if err != nil {
+			return "", nil, err
+		}
+		size := messagesSize(head)
+		history.ChatMessages = head
+		history.Size = &size
+	}
+
+	historyItem, err := h.marshalHistory(history)
+	if err != nil {
+		_ = h.deleteChunks(ctx, history.Chunks)
+		return "", nil, fmt.Errorf("failed to marshal chat history: %w", err)
+	}
+	if err := h.checkDocumentSize(len(historyItem)); err != nil {
+		_ = h.deleteChunks(ctx, history.Chunks)
+		return "", nil, err
+	}
+
+	var resp azcosmos.ItemResponse
+	operation := OperationCreate
+	if etag == "" {
+		resp, err = h.container.CreateItem(h.requestContext(ctx), h.partitionKey(), historyItem, h.writeOptions())
+	} else {
+		operation = OperationReplace
+		resp, err = h.container.ReplaceItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, historyItem, h.conditionalWriteOptions(etag))
+	}
+	if err = h.record(operation)(resp, err); err != nil {
+		// the new chunks are not referenced by any document
+		_ = h.deleteChunks(ctx, history.Chunks)
+		return "", nil, err
+	}
+
+	if etag != "" {
+		// the replaced version referenced these chunks, they are no longer needed
+		_ = h.deleteChunks(ctx, h.chunkIDs)
+	} else {
+		h.documentSize = 0
+	}
+	h.setDocumentSize(len(historyItem))
+
+	return resp.ETag, history.Chunks, nil
+}
+
+// writeOptions returns the options for item write operations.
+func (h *CosmosDBChatMessageHistory) writeOptions() *azcosmos.ItemOptions {
+	return &azcosmos.ItemOptions{
+		EnableContentResponseOnWrite: h.contentResponseOnWrite,
+	}
+}
+
+// conditionalWriteOptions returns the options for a write that only succeeds if the item still matches etag.
+func (h *CosmosDBChatMessageHistory) conditionalWriteOptions(etag azcore.ETag) *azcosmos.ItemOptions {
+	o := h.writeOptions()
+	o.IfMatchEtag = &etag
+	return o
+}
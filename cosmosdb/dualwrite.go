@@ -0,0 +1,130 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// DualWritePolicy decides how a failed write to the target of WithDualWrite affects the operation.
+type DualWritePolicy int
+
+const (
+	// DualWriteRequired returns the error of a failed target write. The write to the history's own
+	// container is not rolled back.
+	DualWriteRequired DualWritePolicy = iota
+	// DualWriteBestEffort only reports a failed target write to OnError, the operation succeeds.
+	DualWriteBestEffort
+)
+
+// DualWriteTarget is the second container every write of the history goes to, see WithDualWrite.
+type DualWriteTarget struct {
+	// Container is the target container, e.g. a new container with another partition key or in another account.
+	Container *azcosmos.ContainerClient
+	// Options configure the history in the target container, e.g. WithPartitionKey or WithFieldMapping
+	// for a new document layout.
+	Options []Option
+	// Policy decides whether a failed target write fails the operation, DualWriteRequired by default.
+	Policy DualWritePolicy
+	// OnError (optional) is called with the session and the error of every failed target write.
+	OnError func(sessionID string, err error)
+}
+
+// newDualWriteTarget creates the history of the session in the target container. The history's own
+// container is the source of truth, so the target keeps the messages it is given on conflicts.
+func (h *CosmosDBChatMessageHistory) newDualWriteTarget(databaseID string) (*CosmosDBChatMessageHistory, error) {
+	if h.dualWrite.Container == nil {
+		return nil, fmt.Errorf("dual write target container cannot be nil")
+	}
+	if h.dualWrite.Policy != DualWriteRequired && h.dualWrite.Policy != DualWriteBestEffort {
+		return nil, fmt.Errorf("invalid dual write policy %d", h.dualWrite.Policy)
+	}
+
+	opts := append(h.dualWrite.Options[:len(h.dualWrite.Options):len(h.dualWrite.Options)],
+		WithMergeFunc(func(ours, _ []llms.ChatMessage) []llms.ChatMessage { return ours }))
+	target, err := newHistory(h.dualWrite.Container, databaseID, h.sessionID, h.userID, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dual write target: %w", err)
+	}
+	return target, nil
+}
+
+// mirrorMessages appends added messages to the dual write target. If an earlier target write failed,
+// the whole conversation is copied instead.
+func (h *CosmosDBChatMessageHistory) mirrorMessages(ctx context.Context, messages ...llms.ChatMessage) error {
+	if h.dualWriteTarget == nil {
+		return nil
+	}
+	if h.dualWriteStale {
+		stored, err := h.loadMessages(ctx)
+		if err != nil {
+			return h.dualWriteFailed(err)
+		}
+		return h.mirrorSession(ctx, stored)
+	}
+
+	for _, message := range messages {
+		// the target keeps the ID and creation time of the message
+		if err := h.dualWriteTarget.AddMessage(ctx, message); err != nil {
+			return h.dualWriteFailed(err)
+		}
+	}
+	return nil
+}
+
+// mirrorSession replaces the conversation in the dual write target with the stored messages,
+// e.g. after the conversation was replaced, edited or trimmed.
+func (h *CosmosDBChatMessageHistory) mirrorSession(ctx context.Context, messages []llms.ChatMessage) error {
+	if h.dualWriteTarget == nil {
+		return nil
+	}
+
+	if err := h.dualWriteTarget.SetMessages(ctx, messages); err != nil {
+		return h.dualWriteFailed(err)
+	}
+	h.dualWriteStale = false
+	return nil
+}
+
+// purgeDualWriteTarget deletes the sessions of the user from the target of WithDualWrite in the factory
+// options, following its policy. The target options must address the partition of the user, like the
+// options of the factory do for DeleteUserData.
+func (f *HistoryFactory) purgeDualWriteTarget(ctx context.Context, userID string, target *DualWriteTarget) error {
+	if target.Container == nil {
+		return fmt.Errorf("dual write target container cannot be nil")
+	}
+
+	targetFactory := &HistoryFactory{
+		client:      f.client,
+		databaseID:  f.databaseID,
+		containerID: target.Container.ID(),
+		container:   target.Container,
+		opts:        target.Options,
+	}
+	err := targetFactory.DeleteUserData(ctx, userID)
+	if err == nil {
+		return nil
+	}
+	if target.OnError != nil {
+		target.OnError("", err)
+	}
+	if target.Policy == DualWriteBestEffort {
+		return nil
+	}
+	return fmt.Errorf("purging the dual write target failed: %w", err)
+}
+
+// dualWriteFailed handles a failed target write according to the policy. The target is copied as a
+// whole on the next write, so that it doesn't miss the messages of the failed one.
+func (h *CosmosDBChatMessageHistory) dualWriteFailed(err error) error {
+	h.dualWriteStale = true
+	if h.dualWrite.OnError != nil {
+		h.dualWrite.OnError(h.sessionID, err)
+	}
+	if h.dualWrite.Policy == DualWriteBestEffort {
+		return nil
+	}
+	return fmt.Errorf("writing to the dual write target failed: %w", err)
+}
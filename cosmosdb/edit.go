@@ -0,0 +1,182 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// DeleteMessage removes the message with the given ID (see StoredMessages) from the stored
+// conversation, e.g. to take down an offending message. The message is removed with a patch that
+// only applies if it is still at the position it was read from, so messages appended concurrently
+// are kept. Compressed or chunked conversations are rewritten instead, guarded by their ETag.
+// It returns ErrMessageNotFound if the session doesn't contain the message.
+func (h *CosmosDBChatMessageHistory) DeleteMessage(ctx context.Context, messageID string) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, finish := h.startOperation(ctx, HistoryWrite)
+	defer func() { finish(err) }()
+
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return err
+	}
+
+	err = h.editMessage(ctx, messageID, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete message from chat history: %w", err)
+	}
+	if err := h.afterModify(ctx); err != nil {
+		return err
+	}
+	return h.audit(ctx, AuditDelete, messageID)
+}
+
+// UpdateMessage replaces the content of the message with the given ID (see StoredMessages), e.g. to
+// store a regenerated answer or fix a typo in a prompt. The message keeps its ID, type and creation
+// time; the image and binary parts of a MultimodalMessage are kept as well. Like DeleteMessage,
+// only the message is patched and messages appended concurrently are kept. The embedding of the
+// message is dropped and recomputed by the pipeline set with WithEmbeddingPipeline, or else by
+// BackfillEmbeddings.
+// It returns ErrMessageNotFound if the session doesn't contain the message.
+func (h *CosmosDBChatMessageHistory) UpdateMessage(ctx context.Context, messageID, content string) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, finish := h.startOperation(ctx, HistoryWrite)
+	defer func() { finish(err) }()
+
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return err
+	}
+
+	err = h.editMessage(ctx, messageID, func(message cachedMessage) cachedMessage {
+		stored := toMessage(message.ChatMessage)
+		stored.Data.Content = content
+		if len(stored.Parts) > 0 {
+			// the text parts are replaced by the new content, the other parts are kept
+			parts := []StoredPart{{Type: PartTypeText, Text: content}}
+			for _, part := range stored.Parts {
+				if part.Type != PartTypeText {
+					parts = append(parts, part)
+				}
+			}
+			stored.Parts = parts
+		}
+		message.ChatMessage = stored.ToChatMessage()
+		// the embedding of the old content would match the wrong queries
+		message.embedding = nil
+		return message
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update message in chat history: %w", err)
+	}
+	if h.embeddingPipeline != nil {
+		h.embeddingPipeline.submit(h)
+	}
+	if err := h.afterModify(ctx); err != nil {
+		return err
+	}
+	return h.audit(ctx, AuditUpdate, messageID)
+}
+
+// editMessage replaces the message with the given ID by the result of update, or removes it if update is nil.
+func (h *CosmosDBChatMessageHistory) editMessage(ctx context.Context, messageID string, update func(cachedMessage) cachedMessage) error {
+	if messageID == "" {
+		return fmt.Errorf("message ID is mandatory")
+	}
+
+	for attempt := 0; ; attempt++ {
+		messages, err := h.loadMessages(ctx)
+		if err != nil {
+			return err
+		}
+		index := messageIndex(messages, messageID)
+		if index < 0 {
+			return fmt.Errorf("%w: %s", ErrMessageNotFound, messageID)
+		}
+		if err := h.checkActive(); err != nil {
+			return err
+		}
+
+		edited := make([]llms.ChatMessage, 0, len(messages))
+		edited = append(edited, messages[:index]...)
+		if update != nil {
+			edited = append(edited, update(messages[index].(cachedMessage)))
+		}
+		edited = append(edited, messages[index+1:]...)
+
+		if h.compression || len(h.chunkIDs) > 0 {
+			return h.replaceMessages(ctx, edited)
+		}
+
+		patch := azcosmos.PatchOperations{}
+		if update != nil {
+			stored, err := h.newMessage(ctx, edited[index])
+			if err != nil {
+				return err
+			}
+			patch.AppendSet(h.messagesPath(fmt.Sprintf("/%d", index)), stored)
+		} else {
+			patch.AppendRemove(h.messagesPath(fmt.Sprintf("/%d", index)))
+		}
+
+		etag := h.etag
+		err = h.patchMessage(ctx, patch, index, messageID)
+		if err == nil {
+			h.messages = edited
+			// messages appended by other writers are not in the cache
+			h.etag = ""
+			return nil
+		}
+		if !isPreconditionFailedError(err) {
+			return err
+		}
+
+		// the message moved, was removed by another writer or the session was closed
+		if _, err := h.loadMessages(ctx); err != nil {
+			return err
+		}
+		if h.etag == etag {
+			// the document didn't change, so it is laid out differently (e.g. compressed by another writer)
+			return h.replaceMessages(ctx, edited)
+		}
+		if attempt >= h.maxConflictRetries {
+			return fmt.Errorf("%w: giving up after %d retries", ErrConflict, attempt)
+		}
+		countRetry(ctx)
+	}
+}
+
+// patchMessage applies patch to the session, conditioned on the stored message at index having the given ID.
+func (h *CosmosDBChatMessageHistory) patchMessage(ctx context.Context, patch azcosmos.PatchOperations, index int, messageID string) error {
+	id, err := json.Marshal(messageID)
+	if err != nil {
+		return err
+	}
+
+	if h.ttl != nil {
+		patch.AppendSet("/ttl", *h.ttl)
+	}
+	patch.SetCondition(h.mapQuery(fmt.Sprintf("FROM c WHERE %s AND c.messages[%d].id = %s", activeCondition, index, id)))
+
+	err = h.record(OperationPatch)(h.container.PatchItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, patch, h.writeOptions()))
+	return err
+}
+
+// messageIndex returns the position of the message with the given ID, or -1 if there is none.
+func messageIndex(messages []llms.ChatMessage, messageID string) int {
+	for i, message := range messages {
+		if cached, ok := message.(cachedMessage); ok && cached.id == messageID {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,300 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const (
+	defaultEmbeddingWorkers    = 4
+	defaultEmbeddingRetries    = 3
+	defaultEmbeddingRetryDelay = time.Second
+)
+
+// EmbeddingPipelineOptions configures an EmbeddingPipeline.
+type EmbeddingPipelineOptions struct {
+	// Workers is the number of sessions embedded in parallel, 4 by default.
+	Workers int
+	// MaxRetries is the number of times a failed embedding of a session is retried, 3 by default.
+	MaxRetries int
+	// RetryDelay is the delay before the first retry, doubled for every further retry, 1s by default.
+	RetryDelay time.Duration
+	// OnError (optional) is called when the messages of a session could not be embedded after all
+	// retries. They are embedded with the next message added to the session, or by BackfillEmbeddings.
+	OnError func(sessionID string, err error)
+}
+
+// EmbeddingPipeline embeds added messages in the background, so that AddMessage doesn't wait for the
+// embeddings model. Share one pipeline between the histories of a factory to bound the concurrent
+// calls to the model. Messages added while a session is waiting to be embedded are embedded together
+// with a single EmbedDocuments call.
+type EmbeddingPipeline struct {
+	opts    EmbeddingPipelineOptions
+	workers chan struct{}
+
+	mu sync.Mutex
+	// sessions waiting for a worker
+	queued  map[*CosmosDBChatMessageHistory]bool
+	pending sync.WaitGroup
+	closed  bool
+}
+
+// NewEmbeddingPipeline creates a pipeline to pass to WithEmbeddingPipeline.
+func NewEmbeddingPipeline(opts EmbeddingPipelineOptions) (*EmbeddingPipeline, error) {
+	if opts.Workers < 0 {
+		return nil, fmt.Errorf("embedding workers cannot be negative")
+	}
+	if opts.MaxRetries < 0 {
+		return nil, fmt.Errorf("embedding retries cannot be negative")
+	}
+	if opts.RetryDelay < 0 {
+		return nil, fmt.Errorf("embedding retry delay cannot be negative")
+	}
+	if opts.Workers == 0 {
+		opts.Workers = defaultEmbeddingWorkers
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultEmbeddingRetries
+	}
+	if opts.RetryDelay == 0 {
+		opts.RetryDelay = defaultEmbeddingRetryDelay
+	}
+
+	return &EmbeddingPipeline{
+		opts:    opts,
+		workers: make(chan struct{}, opts.Workers),
+		queued:  make(map[*CosmosDBChatMessageHistory]bool),
+	}, nil
+}
+
+// Wait blocks until the messages submitted so far are embedded, or ctx is done.
+func (p *EmbeddingPipeline) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting sessions and waits until the submitted ones are embedded, or ctx is done.
+// Messages added afterwards are not embedded until BackfillEmbeddings is called.
+func (p *EmbeddingPipeline) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	return p.Wait(ctx)
+}
+
+// submit queues the session to embed its messages without an embedding, unless it is queued already.
+func (p *EmbeddingPipeline) submit(h *CosmosDBChatMessageHistory) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || p.queued[h] {
+		return
+	}
+	p.queued[h] = true
+	p.pending.Add(1)
+
+	go func() {
+		defer p.pending.Done()
+		p.workers <- struct{}{}
+		defer func() { <-p.workers }()
+
+		// messages added from now on need another run
+		p.mu.Lock()
+		delete(p.queued, h)
+		p.mu.Unlock()
+
+		if err := p.embed(h); err != nil && p.opts.OnError != nil {
+			p.opts.OnError(h.sessionID, err)
+		}
+	}()
+}
+
+// embed embeds the messages of the session, retrying failures with exponential backoff. Closed
+// sessions are not retried.
+func (p *EmbeddingPipeline) embed(h *CosmosDBChatMessageHistory) error {
+	delay := p.opts.RetryDelay
+	for attempt := 0; ; attempt++ {
+		_, err := h.BackfillEmbeddings(context.Background())
+		if err == nil || attempt >= p.opts.MaxRetries || errors.Is(err, ErrSessionClosed) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// BackfillEmbeddings embeds the messages of the session that have text content but no embedding, e.g.
+// messages added before an embedder was configured or whose background embedding failed, and returns
+// the number of messages embedded. The messages are embedded with a single EmbedDocuments call of the
+// embedder set with WithEmbedder, without blocking writes to the session while the model is called.
+func (h *CosmosDBChatMessageHistory) BackfillEmbeddings(ctx context.Context) (int, error) {
+	if h.embedder == nil {
+		return 0, fmt.Errorf("backfilling embeddings requires an embedder, see WithEmbedder")
+	}
+	if h.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	h.mu.Lock()
+	messages, err := h.loadMessages(ctx)
+	h.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	var ids, texts []string
+	for _, message := range messages {
+		if cached, ok := message.(cachedMessage); ok && needsEmbedding(cached) {
+			ids = append(ids, cached.id)
+			texts = append(texts, cached.GetContent())
+		}
+	}
+	if len(texts) == 0 {
+		return 0, nil
+	}
+
+	vectors, err := h.embedder.EmbedDocuments(ctx, texts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to embed messages: %w", err)
+	}
+	if len(vectors) != len(texts) {
+		return 0, fmt.Errorf("embedder returned %d embeddings for %d messages", len(vectors), len(texts))
+	}
+	embeddings := make(map[string][]float32, len(ids))
+	for i, id := range ids {
+		if err := h.validateEmbedding(vectors[i]); err != nil {
+			return 0, err
+		}
+		embeddings[id] = vectors[i]
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	written, err := h.writeEmbeddings(ctx, embeddings)
+	if written == 0 {
+		return written, err
+	}
+
+	// the mirrored messages get their embeddings as well
+	var embedded []llms.ChatMessage
+	for _, message := range h.messages {
+		if cached, ok := message.(cachedMessage); ok && embeddings[cached.id] != nil {
+			embedded = append(embedded, message)
+		}
+	}
+	if ierr := h.indexMessages(ctx, embedded...); ierr != nil {
+		return written, errors.Join(err, fmt.Errorf("messages were embedded but %w", ierr))
+	}
+	return written, err
+}
+
+// needsEmbedding reports whether the message has text content but no embedding. Messages written by
+// earlier versions without an ID can't be matched when writing the embedding and are skipped, and
+// redacted messages have no content worth embedding.
+func needsEmbedding(message cachedMessage) bool {
+	return message.id != "" && message.embedding == nil && message.redaction == nil && message.GetContent() != ""
+}
+
+// writeEmbeddings sets the embeddings of the messages with the given IDs that have none yet, patching
+// them in place unless the document is compressed or chunked, and returns the number of messages
+// updated. Messages removed in the meantime are skipped. The caller must hold h.mu.
+func (h *CosmosDBChatMessageHistory) writeEmbeddings(ctx context.Context, embeddings map[string][]float32) (int, error) {
+	written, conflicts := 0, 0
+	for {
+		messages, err := h.loadMessages(ctx)
+		if err != nil {
+			return written, err
+		}
+		if err := h.checkActive(); err != nil {
+			return written, err
+		}
+
+		var indexes []int
+		edited := make([]llms.ChatMessage, len(messages))
+		copy(edited, messages)
+		for i, message := range messages {
+			cached, ok := message.(cachedMessage)
+			if !ok || cached.embedding != nil || embeddings[cached.id] == nil {
+				continue
+			}
+			cached.embedding = embeddings[cached.id]
+			edited[i] = cached
+			indexes = append(indexes, i)
+		}
+		if len(indexes) == 0 {
+			return written, nil
+		}
+
+		if h.compression || len(h.chunkIDs) > 0 {
+			if err := h.replaceMessages(ctx, edited); err != nil {
+				return written, fmt.Errorf("failed to write embeddings: %w", err)
+			}
+			return written + len(indexes), nil
+		}
+
+		// one patch per batch of messages, conditioned on the messages still being at their index
+		batchSize := maxPatchOperations
+		if h.ttl != nil {
+			batchSize--
+		}
+		batch := indexes[:min(batchSize, len(indexes))]
+		patch := azcosmos.PatchOperations{}
+		conditions := []string{activeCondition}
+		for _, i := range batch {
+			cached := edited[i].(cachedMessage)
+			id, err := json.Marshal(cached.id)
+			if err != nil {
+				return written, err
+			}
+			patch.AppendSet(h.messagesPath(fmt.Sprintf("/%d/embedding", i)), cached.embedding)
+			conditions = append(conditions, fmt.Sprintf("c.messages[%d].id = %s", i, id))
+		}
+		if h.ttl != nil {
+			patch.AppendSet("/ttl", *h.ttl)
+		}
+		patch.SetCondition(h.mapQuery("FROM c WHERE " + strings.Join(conditions, " AND ")))
+
+		err = h.record(OperationPatch)(h.container.PatchItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, patch, h.writeOptions()))
+		if err == nil {
+			written += len(batch)
+			for _, i := range batch {
+				h.messages[i] = edited[i]
+			}
+			// messages appended by other writers are not in the cache
+			h.etag = ""
+			if len(batch) == len(indexes) {
+				return written, nil
+			}
+			continue
+		}
+		if !isPreconditionFailedError(err) {
+			return written, fmt.Errorf("failed to write embeddings: %w", err)
+		}
+
+		// the messages moved, e.g. trimmed by another writer, or the session was closed
+		if conflicts >= h.maxConflictRetries {
+			return written, fmt.Errorf("%w: giving up after %d retries", ErrConflict, conflicts)
+		}
+		conflicts++
+		countRetry(ctx)
+	}
+}
@@ -0,0 +1,123 @@
+package cosmosdb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrReadOnly is returned by write operations on a history created with WithReadOnly.
+var ErrReadOnly = errors.New("chat history is read-only")
+
+// ErrSessionClosed is returned by write operations on a session whose status is not active.
+var ErrSessionClosed = errors.New("chat session is closed")
+
+// ErrConflict is returned when a write could not be applied because the session was
+// modified concurrently and the conflict could not be resolved within the configured retries.
+var ErrConflict = errors.New("chat history was modified concurrently")
+
+// ErrSessionLocked is returned by AcquireSessionLock if another worker holds the lock of the session.
+var ErrSessionLocked = errors.New("chat session is locked by another worker")
+
+// ErrHistoryClosed is returned by AddMessage on a history created with WithWriteBehind after Close.
+var ErrHistoryClosed = errors.New("chat history is closed")
+
+// ErrBudgetExceeded is returned when the user or session spent the request units of the budget set with WithRUBudget.
+var ErrBudgetExceeded = errors.New("request unit budget exceeded")
+
+// ErrUnsupportedSchemaVersion is returned when reading a document written with a newer SchemaVersion
+// than this version of the package supports.
+var ErrUnsupportedSchemaVersion = errors.New("unsupported chat history schema version")
+
+// ErrThrottled is returned when Cosmos DB kept rejecting a request with 429 (too many requests)
+// after the retries configured with WithThrottlingRetry.
+var ErrThrottled = errors.New("chat history request was throttled")
+
+// ThrottledError is returned when a throttled request was not retried anymore. It matches
+// ErrThrottled with errors.Is, and the Cosmos DB response error with errors.As.
+type ThrottledError struct {
+	// RetryAfter is the delay Cosmos DB asked for before the next attempt, 0 if unknown.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%s (retry after %v): %v", ErrThrottled, e.RetryAfter, e.Err)
+}
+
+// Is reports whether target is ErrThrottled.
+func (e *ThrottledError) Is(target error) bool {
+	return target == ErrThrottled
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return e.Err
+}
+
+// ErrCircuitOpen is returned when a CircuitBreaker fails a request because Cosmos DB failed repeatedly.
+var ErrCircuitOpen = errors.New("chat history circuit breaker is open")
+
+// CircuitOpenError is returned by requests failed fast by an open CircuitBreaker. It matches
+// ErrCircuitOpen with errors.Is.
+type CircuitOpenError struct {
+	// RetryAt is the time the circuit breaker lets a trial request through.
+	RetryAt time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s until %s", ErrCircuitOpen, e.RetryAt.Format(time.RFC3339))
+}
+
+// Is reports whether target is ErrCircuitOpen.
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// ErrMessageNotFound is returned when a message referenced by its ID is not part of the session.
+var ErrMessageNotFound = errors.New("chat message not found")
+
+// ConversationAdvancedError is returned by AddMessageIfLast if the last stored message is not the
+// expected one, i.e. another writer added or removed messages. It matches ErrConflict with errors.Is.
+type ConversationAdvancedError struct {
+	// ExpectedLastMessageID is the ID passed to AddMessageIfLast.
+	ExpectedLastMessageID string
+	// LastMessageID is the ID of the last stored message, empty if the session has no messages.
+	LastMessageID string
+}
+
+func (e *ConversationAdvancedError) Error() string {
+	return fmt.Sprintf("chat history advanced: last message is %q, expected %q", e.LastMessageID, e.ExpectedLastMessageID)
+}
+
+// Is reports whether target is ErrConflict.
+func (e *ConversationAdvancedError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// ErrDocumentTooLarge is returned when a write would exceed the Cosmos DB item size limit.
+var ErrDocumentTooLarge = errors.New("chat history document is too large")
+
+// DocumentTooLargeError is returned instead of writing a document that exceeds the Cosmos DB item
+// size limit. It matches ErrDocumentTooLarge with errors.Is.
+type DocumentTooLargeError struct {
+	// Size is the serialized size of the document in bytes. It is estimated from the in-memory cache
+	// if Cosmos DB rejected a patch.
+	Size int
+	// Limit is the item size limit in bytes.
+	Limit int
+	// Suggestion names the options that keep the conversation below the limit, empty if all of them are configured.
+	Suggestion string
+}
+
+func (e *DocumentTooLargeError) Error() string {
+	msg := fmt.Sprintf("chat history document of %d bytes exceeds the item size limit of %d bytes", e.Size, e.Limit)
+	if e.Suggestion != "" {
+		msg += ": " + e.Suggestion
+	}
+	return msg
+}
+
+// Is reports whether target is ErrDocumentTooLarge.
+func (e *DocumentTooLargeError) Is(target error) bool {
+	return target == ErrDocumentTooLarge
+}
@@ -0,0 +1,161 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const (
+	// ExportFormat identifies the JSON envelope written by ExportSession.
+	ExportFormat = "cosmosdb-chat-history"
+	// ExportVersion is the version of the envelope written by ExportSession. ImportSession reads the
+	// envelopes of all versions up to this one.
+	ExportVersion = 1
+)
+
+// SessionExport is the JSON envelope of an exported session. Messages hold the stored representation
+// of the messages (see StoredMessages) with their offloaded contents inlined, so that the envelope is
+// self-contained. Fields are only added in later versions, so older envelopes stay readable.
+type SessionExport struct {
+	Format     string           `json:"format"`
+	Version    int              `json:"version"`
+	ExportedAt time.Time        `json:"exportedAt"`
+	SessionID  string           `json:"sessionId"`
+	UserID     string           `json:"userId"`
+	Metadata   *SessionMetadata `json:"metadata,omitempty"`
+	Summary    string           `json:"summary,omitempty"`
+	Messages   []Message        `json:"messages"`
+}
+
+// ExportSession writes the session as a SessionExport to w, e.g. to let users download their
+// conversation or to move it to another environment. The pinned system message is not included, since
+// it isn't stored.
+func (h *CosmosDBChatMessageHistory) ExportSession(ctx context.Context, w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	export, err := h.exportSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(export); err != nil {
+		return fmt.Errorf("failed to write session export: %w", err)
+	}
+	return nil
+}
+
+// exportSession reads the session into a SessionExport. The caller must hold h.mu.
+func (h *CosmosDBChatMessageHistory) exportSession(ctx context.Context) (SessionExport, error) {
+	messages, err := h.loadMessages(ctx)
+	if err != nil {
+		return SessionExport{}, err
+	}
+
+	export := SessionExport{
+		Format:     ExportFormat,
+		Version:    ExportVersion,
+		ExportedAt: time.Now().UTC(),
+		SessionID:  h.sessionID,
+		UserID:     h.userID,
+		Metadata:   h.metadata,
+		Summary:    h.summary,
+		Messages:   make([]Message, 0, len(messages)),
+	}
+	for _, message := range messages {
+		cached, ok := message.(cachedMessage)
+		if !ok {
+			return SessionExport{}, fmt.Errorf("unexpected message type %T in chat history", message)
+		}
+		// the contents are loaded, so the export doesn't reference the content store
+		export.Messages = append(export.Messages, cached.toMessage())
+	}
+	return export, nil
+}
+
+// ImportSession reads a SessionExport from r and writes its conversation into the session of this
+// history, which may differ from the exported session, e.g. to restore a deleted session or to import
+// it into another environment. The messages keep their IDs, creation times and properties, and the
+// title, tags, status, creation time and rolling summary of the session are restored. Contents are
+// offloaded again if the history has a content store. It fails if the session already exists; Clear it
+// first to overwrite it.
+func (h *CosmosDBChatMessageHistory) ImportSession(ctx context.Context, r io.Reader) error {
+	var export SessionExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return fmt.Errorf("failed to read session export: %w", err)
+	}
+	if export.Format != ExportFormat {
+		return fmt.Errorf("unsupported session export format %q", export.Format)
+	}
+	if export.Version < 1 || export.Version > ExportVersion {
+		return fmt.Errorf("unsupported session export version %d", export.Version)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.importSession(ctx, export)
+}
+
+// importSession creates the session from a SessionExport. The caller must hold h.mu.
+func (h *CosmosDBChatMessageHistory) importSession(ctx context.Context, export SessionExport) error {
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return err
+	}
+
+	messages := make([]llms.ChatMessage, 0, len(export.Messages))
+	for _, message := range export.Messages {
+		offloaded := message.ContentRef != nil
+		for _, part := range message.Parts {
+			offloaded = offloaded || part.ContentRef != nil
+		}
+		if offloaded {
+			return fmt.Errorf("message %s of the session export references offloaded content", message.ID)
+		}
+		messages = append(messages, message.toCachedMessage())
+	}
+	messages = stampMessages(messages)
+
+	h.summary = export.Summary
+	h.metadata = nil
+	if export.Metadata != nil {
+		metadata := *export.Metadata
+		h.metadata = &metadata
+	}
+
+	etag, chunkIDs, err := h.writeHistory(ctx, messages, "")
+	if err != nil {
+		h.summary, h.metadata = "", nil
+		if isAlreadyExistsError(err) {
+			return fmt.Errorf("session %s already exists: %w", h.sessionID, err)
+		}
+		return fmt.Errorf("failed to import chat history: %w", err)
+	}
+	h.messages = messages
+	h.etag = etag
+	h.chunkIDs = chunkIDs
+
+	if err := h.afterModify(ctx); err != nil {
+		return err
+	}
+	return h.audit(ctx, AuditSet, messageIDs(messages)...)
+}
+
+// isAlreadyExistsError reports whether a create failed because the item already exists.
+func isAlreadyExistsError(err error) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusConflict
+}
@@ -0,0 +1,91 @@
+package cosmosdb
+
+import (
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// HistoryFactory creates CosmosDBChatMessageHistory instances for a single database and container.
+// The azcosmos.Client and the database/container clients are created once and shared by all
+// histories vended by the factory, which makes creating a history per request cheap.
+type HistoryFactory struct {
+	client      *azcosmos.Client
+	databaseID  string
+	containerID string
+	container   *azcosmos.ContainerClient
+	opts        []Option
+}
+
+// NewHistoryFactory creates a factory on top of an existing client.
+// The options are applied to every history created by the factory.
+func NewHistoryFactory(client *azcosmos.Client, databaseID, containerID string, opts ...Option) (*HistoryFactory, error) {
+	if client == nil {
+		return nil, fmt.Errorf("cosmos DB client cannot be nil")
+	}
+	if databaseID == "" || containerID == "" {
+		return nil, fmt.Errorf("databaseID and containerID are mandatory")
+	}
+
+	container, err := client.NewContainer(databaseID, containerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container client: %w", err)
+	}
+
+	return &HistoryFactory{
+		client:      client,
+		databaseID:  databaseID,
+		containerID: containerID,
+		container:   container,
+		opts:        opts,
+	}, nil
+}
+
+// NewHistoryFactoryWithKey creates a factory that owns a client authenticated with an account key.
+// clientOptions is passed as-is to the azcosmos client (retry policy, HTTP transport, telemetry, etc.) and may be nil.
+func NewHistoryFactoryWithKey(endpoint, key string, clientOptions *azcosmos.ClientOptions, databaseID, containerID string, opts ...Option) (*HistoryFactory, error) {
+	client, err := newKeyClient(endpoint, key, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewHistoryFactory(client, databaseID, containerID, opts...)
+}
+
+// NewHistoryFactoryWithAAD creates a factory that owns a client authenticated with Microsoft Entra ID.
+// If cred is nil, DefaultAzureCredential is used. clientOptions may be nil.
+func NewHistoryFactoryWithAAD(endpoint string, cred azcore.TokenCredential, clientOptions *azcosmos.ClientOptions, databaseID, containerID string, opts ...Option) (*HistoryFactory, error) {
+	client, err := newAADClient(endpoint, cred, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewHistoryFactory(client, databaseID, containerID, opts...)
+}
+
+// NewHistoryFactoryFromConnectionString creates a factory that owns a client built from a connection string.
+// clientOptions may be nil.
+func NewHistoryFactoryFromConnectionString(connectionString string, clientOptions *azcosmos.ClientOptions, databaseID, containerID string, opts ...Option) (*HistoryFactory, error) {
+	client, err := newConnectionStringClient(connectionString, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewHistoryFactory(client, databaseID, containerID, opts...)
+}
+
+// New returns a chat history for the given session and user.
+// Options passed here are applied after the options the factory was created with.
+func (f *HistoryFactory) New(sessionID, userID string, opts ...Option) (*CosmosDBChatMessageHistory, error) {
+	allOpts := make([]Option, 0, len(f.opts)+len(opts))
+	allOpts = append(allOpts, f.opts...)
+	allOpts = append(allOpts, opts...)
+
+	return newHistory(f.container, f.databaseID, sessionID, userID, allOpts...)
+}
+
+// Client returns the Cosmos DB client used by the factory.
+func (f *HistoryFactory) Client() *azcosmos.Client {
+	return f.client
+}
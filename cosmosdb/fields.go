@@ -0,0 +1,183 @@
+package cosmosdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultUserIDField   = "userid"
+	defaultMessagesField = "messages"
+)
+
+// fieldNamePattern matches the property names that can be used in queries and patch paths without quoting.
+var fieldNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedFields are the properties written by this package or by Cosmos DB, which a FieldMapping
+// cannot use.
+var reservedFields = map[string]bool{
+	"id": true, "ttl": true, "compression": true, "compressedMessages": true, "chunks": true, "size": true,
+	"chunkOf": true, "lockOf": true, "summary": true, "metadata": true, "schemaVersion": true,
+	"_rid": true, "_self": true, "_etag": true, "_attachments": true, "_ts": true,
+}
+
+// FieldMapping overrides the property names of the session documents, e.g. to write into a container
+// with an established schema. Empty names keep the defaults.
+type FieldMapping struct {
+	// UserID is the property holding the user ID, "userid" by default. If the container is partitioned
+	// on the default path, the partition key path follows it.
+	UserID string
+	// Messages is the property holding the messages, "messages" by default.
+	Messages string
+	// SessionID (optional) is a property the session ID is written to in addition to "id", which Cosmos
+	// DB requires for the item ID and which therefore can't be renamed.
+	SessionID string
+	// Extra are static properties written to every session document, e.g. a document type
+	// discriminator. Properties written by this package can't be used, including "schemaVersion",
+	// which holds the document layout version (see SchemaVersion); use another name for a version
+	// of your own schema.
+	Extra map[string]any
+}
+
+// validate checks that the names can be used in queries and don't collide with other properties.
+func (m FieldMapping) validate() error {
+	names := map[string]bool{}
+	check := func(name string) error {
+		if !fieldNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid field name %q: must be a top-level property name of letters, digits and underscores", name)
+		}
+		if reservedFields[name] || names[name] {
+			return fmt.Errorf("field name %q is already in use", name)
+		}
+		names[name] = true
+		return nil
+	}
+
+	for _, name := range []string{m.UserID, m.Messages, m.SessionID} {
+		if name == "" {
+			continue
+		}
+		if err := check(name); err != nil {
+			return err
+		}
+	}
+	for name := range m.Extra {
+		if name == defaultUserIDField || name == defaultMessagesField {
+			return fmt.Errorf("field name %q is already in use", name)
+		}
+		if err := check(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configured reports whether any property is renamed or added by the mapping.
+func (m FieldMapping) configured() bool {
+	return m.UserID != "" || m.Messages != "" || m.SessionID != "" || len(m.Extra) > 0
+}
+
+// userIDField returns the property holding the user ID.
+func (h *CosmosDBChatMessageHistory) userIDField() string {
+	if h.fields.UserID != "" {
+		return h.fields.UserID
+	}
+	return defaultUserIDField
+}
+
+// messagesField returns the property holding the messages.
+func (h *CosmosDBChatMessageHistory) messagesField() string {
+	if h.fields.Messages != "" {
+		return h.fields.Messages
+	}
+	return defaultMessagesField
+}
+
+// messagesPath returns the patch path of the messages followed by suffix, e.g. "/-".
+func (h *CosmosDBChatMessageHistory) messagesPath(suffix string) string {
+	return "/" + h.messagesField() + suffix
+}
+
+// mapQuery replaces the default property names in a query (c.userid and c.messages) with the mapped ones.
+func (h *CosmosDBChatMessageHistory) mapQuery(query string) string {
+	if h.fields.UserID != "" {
+		query = strings.ReplaceAll(query, "c."+defaultUserIDField, "c."+h.fields.UserID)
+	}
+	if h.fields.Messages != "" {
+		query = strings.ReplaceAll(query, "c."+defaultMessagesField, "c."+h.fields.Messages)
+	}
+	return query
+}
+
+// mapFields renames the properties of a serialized history or chunk item to the mapped names and adds
+// the session ID, extra and partition key properties.
+func (h *CosmosDBChatMessageHistory) mapFields(item []byte) ([]byte, error) {
+	if !h.fields.configured() {
+		return h.withPartitionKeyField(item)
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(item, &doc); err != nil {
+		return nil, err
+	}
+	rename(doc, defaultUserIDField, h.fields.UserID)
+	rename(doc, defaultMessagesField, h.fields.Messages)
+	if h.fields.SessionID != "" {
+		// chunk items belong to the session in chunkOf
+		if chunkOf, ok := doc["chunkOf"]; ok {
+			doc[h.fields.SessionID] = chunkOf
+		} else {
+			doc[h.fields.SessionID] = doc["id"]
+		}
+	}
+	for name, value := range h.fields.Extra {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal extra field %s: %w", name, err)
+		}
+		doc[name] = raw
+	}
+
+	mapped, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return h.withPartitionKeyField(mapped)
+}
+
+// unmapFields renames the mapped properties of a stored item back to the default names.
+func (h *CosmosDBChatMessageHistory) unmapFields(item []byte) ([]byte, error) {
+	if h.fields.UserID == "" && h.fields.Messages == "" {
+		return item, nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(item, &doc); err != nil {
+		return nil, err
+	}
+	rename(doc, h.fields.UserID, defaultUserIDField)
+	rename(doc, h.fields.Messages, defaultMessagesField)
+	return json.Marshal(doc)
+}
+
+// unmarshalItem decodes a stored history or chunk item with mapped property names.
+func (h *CosmosDBChatMessageHistory) unmarshalItem(item []byte) (History, error) {
+	item, err := h.unmapFields(item)
+	if err != nil {
+		return History{}, err
+	}
+	return unmarshalHistory(item)
+}
+
+// rename moves the property from to to, unless either name is empty.
+func rename(doc map[string]json.RawMessage, from, to string) {
+	if from == "" || to == "" {
+		return
+	}
+	if value, ok := doc[from]; ok {
+		delete(doc, from)
+		doc[to] = value
+	}
+}
@@ -0,0 +1,147 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// defaultTrainingMinMessages is the minimum number of messages of an exported session.
+const defaultTrainingMinMessages = 2
+
+// TrainingExportOptions selects the sessions written by WriteTrainingData and ExportTrainingData.
+type TrainingExportOptions struct {
+	// UserID limits the export to the sessions of the user. If empty, the sessions of all users are
+	// exported with a cross-partition query.
+	UserID string
+	// Tags limits the export to sessions having all of the tags.
+	Tags []string
+	// CreatedSince and CreatedBefore limit the export to sessions created in [CreatedSince, CreatedBefore).
+	// Zero values are ignored. Sessions created by earlier versions have no creation time and are excluded.
+	CreatedSince  time.Time
+	CreatedBefore time.Time
+	// SystemPrompt (optional) is prepended to every record that doesn't start with a system message.
+	SystemPrompt string
+	// MinMessages skips sessions with fewer messages, 2 by default.
+	MinMessages int
+}
+
+// TrainingExportResult reports what WriteTrainingData and ExportTrainingData wrote.
+type TrainingExportResult struct {
+	// Records is the number of sessions written, one record per session.
+	Records int
+	// Messages is the number of messages in the written records.
+	Messages int
+	// Skipped is the number of selected sessions that were not written because they have too few
+	// messages, no assistant message or a redacted message.
+	Skipped int
+}
+
+// TrainingRecord is a JSONL line written by WriteTrainingData, in the chat format of fine-tuning jobs
+// of Azure OpenAI and OpenAI.
+type TrainingRecord struct {
+	Messages []OpenAIMessage `json:"messages"`
+}
+
+// ExportTrainingData streams the selected sessions as JSONL training records (see WriteTrainingData)
+// to the block blob blobName in the container, e.g. as the training file of a fine-tuning job. The blob
+// is uploaded in blocks while the sessions are read, and replaced if it exists. opts may be nil.
+func (f *HistoryFactory) ExportTrainingData(ctx context.Context, client *container.Client, blobName string, opts *TrainingExportOptions) (TrainingExportResult, error) {
+	if client == nil {
+		return TrainingExportResult{}, fmt.Errorf("blob container client cannot be nil")
+	}
+	if blobName == "" {
+		return TrainingExportResult{}, fmt.Errorf("blob name is mandatory")
+	}
+
+	reader, writer := io.Pipe()
+	type written struct {
+		result TrainingExportResult
+		err    error
+	}
+	done := make(chan written, 1)
+	go func() {
+		result, err := f.WriteTrainingData(ctx, writer, opts)
+		writer.CloseWithError(err)
+		done <- written{result, err}
+	}()
+
+	_, err := client.NewBlockBlobClient(blobName).UploadStream(ctx, reader, nil)
+	// unblock the writer if the upload stopped reading
+	reader.CloseWithError(io.ErrClosedPipe)
+	w := <-done
+	if err != nil {
+		return w.result, fmt.Errorf("failed to upload training data to blob %s: %w", blobName, err)
+	}
+	return w.result, w.err
+}
+
+// WriteTrainingData writes the selected sessions to w as JSONL, one TrainingRecord per session in the
+// chat format of fine-tuning jobs (see ToOpenAIMessages). Sessions without an assistant message, with fewer
+// than MinMessages messages or with a redacted message are skipped. opts may be nil.
+func (f *HistoryFactory) WriteTrainingData(ctx context.Context, w io.Writer, opts *TrainingExportOptions) (TrainingExportResult, error) {
+	if opts == nil {
+		opts = &TrainingExportOptions{}
+	}
+	if opts.MinMessages < 0 {
+		return TrainingExportResult{}, fmt.Errorf("minimum number of messages cannot be negative")
+	}
+	minMessages := opts.MinMessages
+	if minMessages == 0 {
+		minMessages = defaultTrainingMinMessages
+	}
+
+	var result TrainingExportResult
+	encoder := json.NewEncoder(w)
+	selection := &ListSessionsOptions{Tags: opts.Tags, CreatedSince: opts.CreatedSince, CreatedBefore: opts.CreatedBefore}
+	err := f.forEachSession(ctx, opts.UserID, selection, func(h *CosmosDBChatMessageHistory) error {
+		messages, err := h.StoredMessages(ctx)
+		if err != nil {
+			return err
+		}
+
+		record, ok := trainingRecord(messages, opts.SystemPrompt, minMessages)
+		if !ok {
+			result.Skipped++
+			return nil
+		}
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("failed to write training record of session %s: %w", h.sessionID, err)
+		}
+		result.Records++
+		result.Messages += len(record.Messages)
+		return nil
+	})
+	return result, err
+}
+
+// trainingRecord converts the messages of a session to a training record, or reports false if the
+// session is not suitable for training.
+func trainingRecord(messages []Message, systemPrompt string, minMessages int) (TrainingRecord, bool) {
+	if len(messages) < minMessages {
+		return TrainingRecord{}, false
+	}
+
+	record := TrainingRecord{Messages: make([]OpenAIMessage, 0, len(messages)+1)}
+	if systemPrompt != "" && llms.ChatMessageType(messages[0].Type) != llms.ChatMessageTypeSystem {
+		record.Messages = append(record.Messages, OpenAIMessage{Role: "system", Content: systemPrompt})
+	}
+
+	assistant := false
+	for _, message := range messages {
+		if message.Redaction != nil {
+			return TrainingRecord{}, false
+		}
+		if llms.ChatMessageType(message.Type) == llms.ChatMessageTypeAI {
+			assistant = true
+		}
+		record.Messages = append(record.Messages, toOpenAIMessage(message.ToChatMessage()))
+	}
+
+	return record, assistant
+}
@@ -0,0 +1,153 @@
+package cosmosdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// MessagesIter returns an iterator over the messages of the conversation, oldest first.
+// Messages are decoded one at a time and chunk items are only read when the iteration reaches
+// them, so consumers can stop early (e.g. once a token budget is filled) without loading the
+// whole conversation. If an error occurs, it is yielded with a nil message and the iteration stops.
+// Unlike Messages, it doesn't update the in-memory cache.
+func (h *CosmosDBChatMessageHistory) MessagesIter(ctx context.Context) iter.Seq2[llms.ChatMessage, error] {
+	ctx = h.readContext(ctx)
+	return func(yield func(llms.ChatMessage, error) bool) {
+		if h.pinnedSystemMessage != "" && !yield(llms.SystemChatMessage{Content: h.pinnedSystemMessage}, nil) {
+			return
+		}
+
+		item, err := h.readContainer(ctx).ReadItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, h.readOptions(ctx))
+		err = h.recordCharge(OperationRead, item.RequestCharge, err)
+		if err != nil {
+			if !isNotFoundError(err) {
+				yield(nil, fmt.Errorf("failed to read item with sessionID %s: %w", h.sessionID, err))
+			}
+			return
+		}
+
+		var head struct {
+			Chunks []string `json:"chunks"`
+		}
+		if err := json.Unmarshal(item.Value, &head); err != nil {
+			yield(nil, fmt.Errorf("failed to unmarshal history data: %w", err))
+			return
+		}
+
+		yieldMessage := func(message Message) bool {
+			if err := h.loadOffloadedContent(ctx, []Message{message}); err != nil {
+				yield(nil, err)
+				return false
+			}
+			return yield(message.ToChatMessage(), nil)
+		}
+
+		for _, id := range head.Chunks {
+			chunk, err := h.readContainer(ctx).ReadItem(h.requestContext(ctx), h.partitionKey(), id, h.readOptions(ctx))
+			err = h.recordCharge(OperationRead, chunk.RequestCharge, err)
+			if err != nil {
+				if isNotFoundError(err) {
+					continue
+				}
+				yield(nil, fmt.Errorf("failed to read chat history chunk %s: %w", id, err))
+				return
+			}
+			if !h.iterateItemMessages(chunk.Value, yieldMessage, yield) {
+				return
+			}
+		}
+
+		h.iterateItemMessages(item.Value, yieldMessage, yield)
+	}
+}
+
+// iterateItemMessages decodes the (compressed and plain) messages of a history or chunk item one
+// by one. It returns false if the iteration was stopped or failed.
+func (h *CosmosDBChatMessageHistory) iterateItemMessages(data []byte, yieldMessage func(Message) bool, yield func(llms.ChatMessage, error) bool) bool {
+	data, err := h.unmapFields(data)
+	if err == nil {
+		data, err = upgradeDocument(data)
+	}
+	if err != nil {
+		yield(nil, fmt.Errorf("failed to unmarshal history data: %w", err))
+		return false
+	}
+
+	var item struct {
+		Compression        string          `json:"compression"`
+		CompressedMessages string          `json:"compressedMessages"`
+		Messages           json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(data, &item); err != nil {
+		yield(nil, fmt.Errorf("failed to unmarshal history data: %w", err))
+		return false
+	}
+
+	if item.Compression != "" {
+		if item.Compression != compressionGzip {
+			yield(nil, fmt.Errorf("unsupported message compression %q", item.Compression))
+			return false
+		}
+		zr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(item.CompressedMessages)))
+		if err != nil {
+			yield(nil, fmt.Errorf("failed to decompress messages: %w", err))
+			return false
+		}
+		defer zr.Close()
+
+		ok, err := decodeMessages(zr, yieldMessage)
+		if err != nil {
+			yield(nil, fmt.Errorf("failed to decompress messages: %w", err))
+			return false
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if len(item.Messages) == 0 || string(item.Messages) == "null" {
+		return true
+	}
+
+	ok, err := decodeMessages(bytes.NewReader(item.Messages), yieldMessage)
+	if err != nil {
+		yield(nil, fmt.Errorf("failed to unmarshal history data: %w", err))
+		return false
+	}
+	return ok
+}
+
+// decodeMessages decodes a JSON array of messages element by element.
+// It returns false if yieldMessage stopped the iteration.
+func decodeMessages(r io.Reader, yieldMessage func(Message) bool) (bool, error) {
+	dec := json.NewDecoder(r)
+
+	tok, err := dec.Token()
+	if err != nil {
+		return false, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return false, fmt.Errorf("expected messages array, got %v", tok)
+	}
+
+	for dec.More() {
+		var message Message
+		if err := dec.Decode(&message); err != nil {
+			return false, err
+		}
+		if !yieldMessage(message) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,212 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/google/uuid"
+)
+
+// lockIDSuffix is appended to the session ID to form the ID of its lease item. Session IDs ending in
+// it are rejected by newHistory, so that a lease can't collide with a session document.
+const lockIDSuffix = "_lock"
+
+// sessionLease is the item holding the lock of a session. It lives in the partition of the session.
+type sessionLease struct {
+	ID     string `json:"id"`
+	UserID string `json:"userid"`
+	// LockOf is the session the lease belongs to, it keeps the item out of session listings
+	LockOf    string    `json:"lockOf"`
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// TTL removes abandoned leases if TTL is enabled on the container
+	TTL int `json:"ttl"`
+}
+
+// SessionLock is a lease on a session acquired with AcquireSessionLock. It is renewed in the
+// background until it is released or the context passed to AcquireSessionLock is done, in which
+// case the lease expires after its TTL. If the lease is lost, e.g. because renewing failed until it
+// expired and another worker took it over, the channel returned by Lost is closed.
+type SessionLock struct {
+	h     *CosmosDBChatMessageHistory
+	id    string
+	owner string
+	ttl   time.Duration
+
+	mu   sync.Mutex
+	etag azcore.ETag
+	err  error
+
+	stop     chan struct{}
+	done     chan struct{}
+	lost     chan struct{}
+	stopOnce sync.Once
+}
+
+// AcquireSessionLock acquires an exclusive lease on the session for ttl, so that only one worker at a
+// time processes the conversation, e.g. agent runners consuming a queue. It returns ErrSessionLocked if
+// another worker holds an unexpired lease. The lease is stored in a separate item in the partition of
+// the session with a conditional write, and renewed every ttl/3 until Release is called or ctx is done.
+// Expiry is checked against the clock of the acquiring worker, so ttl should be well above the clock skew.
+func (h *CosmosDBChatMessageHistory) AcquireSessionLock(ctx context.Context, ttl time.Duration) (*SessionLock, error) {
+	if h.readOnly {
+		return nil, ErrReadOnly
+	}
+	if ttl < time.Second {
+		return nil, fmt.Errorf("lock TTL must be at least one second")
+	}
+
+	lock := &SessionLock{
+		h:     h,
+		id:    h.sessionID + lockIDSuffix,
+		owner: uuid.NewString(),
+		ttl:   ttl,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		lost:  make(chan struct{}),
+	}
+
+	item, err := lock.marshalLease()
+	if err != nil {
+		return nil, err
+	}
+
+	operation := OperationCreate
+	resp, err := h.container.CreateItem(h.requestContext(ctx), h.partitionKey(), item, h.writeOptions())
+	if isConflictError(err) {
+		// take over the lease if it expired
+		resp, err = h.container.ReadItem(h.requestContext(ctx), h.partitionKey(), lock.id, h.readOptions(ctx))
+		err = h.recordCharge(OperationRead, resp.RequestCharge, err)
+		if isNotFoundError(err) {
+			return nil, ErrSessionLocked
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read lock of session %s: %w", h.sessionID, err)
+		}
+
+		var current sessionLease
+		if err := json.Unmarshal(resp.Value, &current); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal session lock: %w", err)
+		}
+		if time.Now().Before(current.ExpiresAt) {
+			return nil, ErrSessionLocked
+		}
+
+		operation = OperationReplace
+		resp, err = h.container.ReplaceItem(h.requestContext(ctx), h.partitionKey(), lock.id, item, h.conditionalWriteOptions(resp.ETag))
+		if isConflictError(err) {
+			// another worker took it over first
+			return nil, ErrSessionLocked
+		}
+	}
+	if err = h.record(operation)(resp, err); err != nil {
+		return nil, fmt.Errorf("failed to acquire lock of session %s: %w", h.sessionID, err)
+	}
+
+	lock.etag = resp.ETag
+	go lock.renew(ctx)
+
+	return lock, nil
+}
+
+// Renew extends the lease by its TTL. It returns ErrSessionLocked if the lease was lost.
+// The lease is renewed automatically, so calling Renew is only needed after long pauses.
+func (l *SessionLock) Renew(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+
+	item, err := l.marshalLease()
+	if err != nil {
+		return err
+	}
+
+	resp, err := l.h.container.ReplaceItem(l.h.requestContext(ctx), l.h.partitionKey(), l.id, item, l.h.conditionalWriteOptions(l.etag))
+	if isConflictError(err) {
+		l.err = ErrSessionLocked
+		return l.err
+	}
+	if err = l.h.record(OperationReplace)(resp, err); err != nil {
+		return fmt.Errorf("failed to renew lock of session %s: %w", l.h.sessionID, err)
+	}
+
+	l.etag = resp.ETag
+	return nil
+}
+
+// Release stops the renewal and deletes the lease, so that another worker can acquire it right away.
+// Releasing a lease that was lost or already released is not an error.
+func (l *SessionLock) Release(ctx context.Context) error {
+	l.stopOnce.Do(func() { close(l.stop) })
+	<-l.done
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		return nil
+	}
+	l.err = ErrSessionLocked
+
+	err := l.h.record(OperationDelete)(l.h.container.DeleteItem(l.h.requestContext(ctx), l.h.partitionKey(), l.id, l.h.conditionalWriteOptions(l.etag)))
+	if err != nil && !isConflictError(err) {
+		return fmt.Errorf("failed to release lock of session %s: %w", l.h.sessionID, err)
+	}
+	return nil
+}
+
+// Lost returns a channel that is closed when the lease was taken over by another worker.
+// The worker should stop processing the session then.
+func (l *SessionLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// renew renews the lease every ttl/3 until it is released, ctx is done or the lease is lost.
+// Other errors are retried with the next renewal.
+func (l *SessionLock) renew(ctx context.Context) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Renew(ctx); errors.Is(err, ErrSessionLocked) {
+				close(l.lost)
+				return
+			}
+		}
+	}
+}
+
+// marshalLease serializes the lease item, valid for the TTL of the lock from now.
+func (l *SessionLock) marshalLease() ([]byte, error) {
+	lease := sessionLease{
+		ID:        l.id,
+		UserID:    l.h.userID,
+		LockOf:    l.h.sessionID,
+		Owner:     l.owner,
+		ExpiresAt: time.Now().Add(l.ttl).UTC(),
+		// keep abandoned leases a bit longer than their expiry
+		TTL: int(2 * l.ttl / time.Second),
+	}
+
+	item, err := json.Marshal(lease)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal session lock: %w", err)
+	}
+	return l.h.withPartitionKeyField(item)
+}
@@ -0,0 +1,167 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Exchange is a user message from a past session together with the replies to it.
+type Exchange struct {
+	SessionID string
+	Messages  []llms.ChatMessage
+	// CreatedAt is the time the user message was added, or the last modification of the
+	// session for messages written by earlier versions of this package.
+	CreatedAt time.Time
+	// Score is the number of distinct query terms found in the exchange (0 for recency search).
+	Score int
+}
+
+// RecallExchanges searches the other sessions of the user for past exchanges to inject into the
+// current conversation as long-term memory. With an empty query, the k most recent exchanges are
+// returned. Otherwise exchanges are ranked by the number of query terms they contain (ties are
+// broken by recency) and exchanges without any of the terms are skipped.
+// Only sessions in the partition of this history are searched, which by default are all sessions of the user.
+func (h *CosmosDBChatMessageHistory) RecallExchanges(ctx context.Context, query string, k int) ([]Exchange, error) {
+	if k <= 0 {
+		return []Exchange{}, nil
+	}
+
+	terms := queryTerms(query)
+
+	sqlQuery := "SELECT * FROM c WHERE c.userid = @userId AND c.id != @id AND NOT IS_DEFINED(c.chunkOf) AND NOT IS_DEFINED(c.lockOf)"
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{
+			{Name: "@userId", Value: h.userID},
+			{Name: "@id", Value: h.sessionID},
+		},
+	}
+
+	var exchanges []Exchange
+	pager := h.container.NewQueryItemsPager(h.mapQuery(sqlQuery), h.partitionKey(), h.withSessionToken(ctx, &queryOptions))
+	for pager.More() {
+		page, err := pager.NextPage(h.requestContext(ctx))
+		err = h.recordCharge(OperationQuery, page.RequestCharge, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query sessions of user %s: %w", h.userID, err)
+		}
+
+		for _, item := range page.Items {
+			sessionExchanges, err := h.itemExchanges(ctx, item)
+			if err != nil {
+				return nil, err
+			}
+			for _, exchange := range sessionExchanges {
+				if len(terms) > 0 {
+					exchange.Score = matchTerms(exchange.Messages, terms)
+					if exchange.Score == 0 {
+						continue
+					}
+				}
+				exchanges = append(exchanges, exchange)
+			}
+		}
+	}
+
+	sort.SliceStable(exchanges, func(i, j int) bool {
+		if exchanges[i].Score != exchanges[j].Score {
+			return exchanges[i].Score > exchanges[j].Score
+		}
+		return exchanges[i].CreatedAt.After(exchanges[j].CreatedAt)
+	})
+
+	if len(exchanges) > k {
+		exchanges = exchanges[:k]
+	}
+	return exchanges, nil
+}
+
+// itemExchanges splits the conversation of a history item into exchanges.
+func (h *CosmosDBChatMessageHistory) itemExchanges(ctx context.Context, item []byte) ([]Exchange, error) {
+	history, err := h.unmarshalItem(item)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal history data: %w", err)
+	}
+
+	var meta struct {
+		TS int64 `json:"_ts"`
+	}
+	if err := json.Unmarshal(item, &meta); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal history data: %w", err)
+	}
+	modified := time.Unix(meta.TS, 0).UTC()
+
+	messages := history.ChatMessages
+	if len(history.Chunks) > 0 {
+		older, err := h.readChunks(ctx, history.Chunks)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(older, messages...)
+	}
+
+	if err := h.loadOffloadedContent(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	var exchanges []Exchange
+	for _, message := range messages {
+		if llms.ChatMessageType(message.Type) == llms.ChatMessageTypeHuman {
+			createdAt := modified
+			if message.CreatedAt != nil {
+				createdAt = *message.CreatedAt
+			}
+			exchanges = append(exchanges, Exchange{SessionID: history.SessionId, CreatedAt: createdAt})
+		}
+		// messages before the first user message (e.g. a summary) don't belong to an exchange
+		if len(exchanges) == 0 {
+			continue
+		}
+		current := &exchanges[len(exchanges)-1]
+		current.Messages = append(current.Messages, message.ToChatMessage())
+	}
+
+	return exchanges, nil
+}
+
+// queryTerms returns the distinct lower case words of the query.
+func queryTerms(query string) []string {
+	seen := map[string]bool{}
+	var terms []string
+	for _, term := range strings.FieldsFunc(strings.ToLower(query), isTermSeparator) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// matchTerms counts the terms contained in the messages.
+func matchTerms(messages []llms.ChatMessage, terms []string) int {
+	words := map[string]bool{}
+	for _, message := range messages {
+		for _, word := range strings.FieldsFunc(strings.ToLower(message.GetContent()), isTermSeparator) {
+			words[word] = true
+		}
+	}
+
+	var score int
+	for _, term := range terms {
+		if words[term] {
+			score++
+		}
+	}
+	return score
+}
+
+func isTermSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
@@ -0,0 +1,177 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// defaultMarkdownTimeFormat is the layout of the timestamps in a rendered transcript.
+const defaultMarkdownTimeFormat = "2006-01-02 15:04:05 MST"
+
+// defaultMarkdownLabels are the speaker labels of a rendered transcript.
+var defaultMarkdownLabels = map[llms.ChatMessageType]string{
+	llms.ChatMessageTypeHuman:    "User",
+	llms.ChatMessageTypeAI:       "Assistant",
+	llms.ChatMessageTypeSystem:   "System",
+	llms.ChatMessageTypeTool:     "Tool",
+	llms.ChatMessageTypeFunction: "Function",
+}
+
+// MarkdownOptions controls the transcript rendered by RenderMarkdown.
+type MarkdownOptions struct {
+	// Title is the heading of the transcript, the session title by default. No heading is written if
+	// both are empty.
+	Title string
+	// Labels overrides the speaker labels per message type, "User" and "Assistant" by default. Generic
+	// messages are labeled with their role.
+	Labels map[llms.ChatMessageType]string
+	// Timestamps adds the creation time of each message next to the speaker label.
+	Timestamps bool
+	// TimeFormat is the layout of the timestamps, "2006-01-02 15:04:05 MST" by default.
+	TimeFormat string
+	// Location is the time zone of the timestamps, UTC by default.
+	Location *time.Location
+	// SkipSystemMessages leaves out system messages.
+	SkipSystemMessages bool
+	// SkipToolMessages leaves out tool calls, tool results and function messages.
+	SkipToolMessages bool
+}
+
+// RenderMarkdown returns the stored conversation as a Markdown transcript with a speaker label per
+// message, e.g. to share a conversation in a ticket or a document. Message contents are written as-is,
+// so Markdown formatting and fenced code blocks in them are preserved. Tool calls and tool results are
+// rendered as code blocks. The pinned system message is not included, since it isn't stored. opts may
+// be nil.
+func (h *CosmosDBChatMessageHistory) RenderMarkdown(ctx context.Context, opts *MarkdownOptions) (string, error) {
+	if opts == nil {
+		opts = &MarkdownOptions{}
+	}
+	timeFormat := opts.TimeFormat
+	if timeFormat == "" {
+		timeFormat = defaultMarkdownTimeFormat
+	}
+	location := opts.Location
+	if location == nil {
+		location = time.UTC
+	}
+
+	h.mu.Lock()
+	messages, err := h.loadMessages(ctx)
+	title := opts.Title
+	if title == "" && h.metadata != nil {
+		title = h.metadata.Title
+	}
+	h.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	if title != "" {
+		fmt.Fprintf(&sb, "# %s\n\n", title)
+	}
+	for _, message := range messages {
+		messageType := message.GetType()
+		if opts.SkipSystemMessages && messageType == llms.ChatMessageTypeSystem {
+			continue
+		}
+		if opts.SkipToolMessages && (messageType == llms.ChatMessageTypeTool || messageType == llms.ChatMessageTypeFunction) {
+			continue
+		}
+		cached, _ := message.(cachedMessage)
+		plain := plainMessages([]llms.ChatMessage{message})[0]
+		if ai, ok := plain.(llms.AIChatMessage); ok && opts.SkipToolMessages && ai.Content == "" {
+			// the message only calls tools
+			continue
+		}
+
+		fmt.Fprintf(&sb, "**%s**", markdownLabel(plain, opts.Labels))
+		if opts.Timestamps && cached.createdAt != nil {
+			fmt.Fprintf(&sb, " _(%s)_", cached.createdAt.In(location).Format(timeFormat))
+		}
+		sb.WriteString("\n\n")
+
+		switch m := plain.(type) {
+		case llms.ToolChatMessage:
+			writeMarkdownCode(&sb, m.Content)
+		case llms.FunctionChatMessage:
+			fmt.Fprintf(&sb, "`%s` returned:\n\n", m.Name)
+			writeMarkdownCode(&sb, m.Content)
+		case MultimodalMessage:
+			writeMarkdownParts(&sb, m.Parts)
+		default:
+			if content := plain.GetContent(); content != "" {
+				sb.WriteString(strings.TrimRight(content, "\n") + "\n\n")
+			}
+		}
+
+		if ai, ok := plain.(llms.AIChatMessage); ok && !opts.SkipToolMessages {
+			for _, call := range ai.ToolCalls {
+				if call.FunctionCall != nil {
+					fmt.Fprintf(&sb, "Called `%s`:\n\n", call.FunctionCall.Name)
+					writeMarkdownCode(&sb, call.FunctionCall.Arguments)
+				}
+			}
+			if ai.FunctionCall != nil {
+				fmt.Fprintf(&sb, "Called `%s`:\n\n", ai.FunctionCall.Name)
+				writeMarkdownCode(&sb, ai.FunctionCall.Arguments)
+			}
+		}
+		for _, attachment := range cached.attachments {
+			if attachment.URL != "" {
+				fmt.Fprintf(&sb, "Attachment: [%s](%s)\n\n", attachment.Name, attachment.URL)
+			} else {
+				fmt.Fprintf(&sb, "Attachment: %s\n\n", attachment.Name)
+			}
+		}
+	}
+
+	transcript := strings.TrimRight(sb.String(), "\n")
+	if transcript == "" {
+		return "", nil
+	}
+	return transcript + "\n", nil
+}
+
+// markdownLabel returns the speaker label of the message.
+func markdownLabel(message llms.ChatMessage, labels map[llms.ChatMessageType]string) string {
+	if label, ok := labels[message.GetType()]; ok {
+		return label
+	}
+	if generic, ok := message.(llms.GenericChatMessage); ok && generic.Role != "" {
+		return generic.Role
+	}
+	if label, ok := defaultMarkdownLabels[message.GetType()]; ok {
+		return label
+	}
+	return string(message.GetType())
+}
+
+// writeMarkdownCode writes content as a fenced code block, with a fence longer than any backtick run
+// in content.
+func writeMarkdownCode(sb *strings.Builder, content string) {
+	fence := "```"
+	for strings.Contains(content, fence) {
+		fence += "`"
+	}
+	fmt.Fprintf(sb, "%s\n%s\n%s\n\n", fence, strings.TrimRight(content, "\n"), fence)
+}
+
+// writeMarkdownParts writes the parts of a multimodal message. Images given by URL are embedded,
+// binary data is only named.
+func writeMarkdownParts(sb *strings.Builder, parts []llms.ContentPart) {
+	for _, part := range parts {
+		switch p := part.(type) {
+		case llms.TextContent:
+			sb.WriteString(strings.TrimRight(p.Text, "\n") + "\n\n")
+		case llms.ImageURLContent:
+			fmt.Fprintf(sb, "![image](%s)\n\n", p.URL)
+		case llms.BinaryContent:
+			fmt.Fprintf(sb, "_[%s, %d bytes]_\n\n", p.MIMEType, len(p.Data))
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package cosmosdb
+
+import "github.com/tmc/langchaingo/memory"
+
+// NewConversationBuffer returns a langchaingo memory backed by history, ready to be used with
+// chains.NewConversation. opts are applied after the chat history, e.g. memory.WithReturnMessages(true)
+// or memory.WithMemoryKey("chat_history").
+func NewConversationBuffer(history *CosmosDBChatMessageHistory, opts ...memory.ConversationBufferOption) *memory.ConversationBuffer {
+	return memory.NewConversationBuffer(append([]memory.ConversationBufferOption{memory.WithChatHistory(history)}, opts...)...)
+}
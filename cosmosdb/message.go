@@ -0,0 +1,264 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Message is the stored representation of a chat message. It embeds llms.ChatMessageModel,
+// so documents written by earlier versions of this package remain readable.
+type Message struct {
+	llms.ChatMessageModel
+	// ID identifies the message within the session, so that it can be referenced independent of its position.
+	// It is missing for messages written by earlier versions until the conversation is rewritten.
+	ID string `json:"id,omitempty"`
+	// ContentRef points to the message content if it was offloaded to a ContentStore.
+	ContentRef *ContentRef `json:"contentRef,omitempty"`
+	// CreatedAt is the time the message was added. It is missing for messages written by earlier versions.
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	// Metadata holds application data attached with AddMessageWithMetadata, e.g. the channel or a trace ID.
+	Metadata map[string]any `json:"metadata,omitempty"`
+	// Redaction is set if the content of the message was removed with RedactMessage.
+	Redaction *Redaction `json:"redaction,omitempty"`
+
+	// ToolCalls and FunctionCall are the calls requested by an AI message.
+	ToolCalls    []llms.ToolCall    `json:"toolCalls,omitempty"`
+	FunctionCall *llms.FunctionCall `json:"functionCall,omitempty"`
+	// ToolCallID is the ID of the tool call a tool message responds to.
+	ToolCallID string `json:"toolCallId,omitempty"`
+	// Name is the name of the function of a function message, or the speaker of a generic message.
+	Name string `json:"name,omitempty"`
+	// Role is the role of a generic message.
+	Role string `json:"role,omitempty"`
+	// Parts holds the content of a MultimodalMessage. Data.Content holds its text parts in addition.
+	Parts []StoredPart `json:"parts,omitempty"`
+	// GenerationInfo describes how an AI message was generated, if it was added with AddAIMessageWithGenerationInfo.
+	GenerationInfo *GenerationInfo `json:"generationInfo,omitempty"`
+	// Usage is the number of tokens used to generate the message, if it was added with AddMessageWithUsage.
+	Usage *TokenUsage `json:"usage,omitempty"`
+	// Attachments describes the files attached to the message with AddMessageWithAttachments.
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Embedding is the vector of the message content, if it was added with AddMessageWithEmbedding.
+	Embedding []float32 `json:"embedding,omitempty"`
+
+	// schema is the encoding the message is written in, see WithPythonCompatibility and WithSemanticKernelCompatibility
+	schema messageSchema
+}
+
+// GenerationInfo describes the model and configuration that produced an AI message.
+type GenerationInfo struct {
+	Model         string   `json:"model,omitempty"`
+	FinishReason  string   `json:"finishReason,omitempty"`
+	StopSequences []string `json:"stopSequences,omitempty"`
+	// Extra holds provider specific information, e.g. the token usage in llms.ContentChoice.GenerationInfo.
+	Extra map[string]any `json:"extra,omitempty"`
+}
+
+// cachedMessage is a chat message along with the ID, creation time and other properties it is stored with.
+// It is only used in the in-memory cache and unwrapped before messages are returned to callers.
+type cachedMessage struct {
+	llms.ChatMessage
+	id        string
+	createdAt *time.Time
+	metadata  map[string]any
+	redaction *Redaction
+
+	generationInfo *GenerationInfo
+	usage          *TokenUsage
+	attachments    []Attachment
+	embedding      []float32
+}
+
+// stampMessage assigns an ID and creation time to a message that doesn't have them yet, so that
+// they stay the same when the conversation is rewritten from the in-memory cache.
+func stampMessage(message llms.ChatMessage) cachedMessage {
+	cached, ok := message.(cachedMessage)
+	if !ok {
+		cached = cachedMessage{ChatMessage: message}
+	}
+	if cached.id == "" {
+		cached.id = uuid.NewString()
+	}
+	if cached.createdAt == nil {
+		createdAt := time.Now().UTC()
+		cached.createdAt = &createdAt
+	}
+	return cached
+}
+
+// MessageID returns the ID of a message passed to a MergeFunc (see StoredMessages), or an empty
+// string for other messages and messages written by earlier versions of this package.
+func MessageID(message llms.ChatMessage) string {
+	if cached, ok := message.(cachedMessage); ok {
+		return cached.id
+	}
+	return ""
+}
+
+// MessageCreatedAt returns the time a message passed to a MergeFunc was added. ok is false for
+// other messages and messages written by earlier versions of this package.
+func MessageCreatedAt(message llms.ChatMessage) (createdAt time.Time, ok bool) {
+	if cached, isCached := message.(cachedMessage); isCached && cached.createdAt != nil {
+		return *cached.createdAt, true
+	}
+	return time.Time{}, false
+}
+
+// stampMessages applies stampMessage to every message.
+func stampMessages(messages []llms.ChatMessage) []llms.ChatMessage {
+	stamped := make([]llms.ChatMessage, 0, len(messages))
+	for _, message := range messages {
+		if message == nil {
+			stamped = append(stamped, message)
+			continue
+		}
+		stamped = append(stamped, stampMessage(message))
+	}
+	return stamped
+}
+
+// newMessage converts a chat message to its stored representation.
+func (h *CosmosDBChatMessageHistory) newMessage(ctx context.Context, message llms.ChatMessage) (Message, error) {
+	if err := validateParts(message); err != nil {
+		return Message{}, err
+	}
+	stored := stampMessage(message).toMessage()
+	stored.schema = h.messageSchema
+	if err := h.offloadParts(ctx, stored.Parts); err != nil {
+		return Message{}, err
+	}
+
+	if h.contentStore != nil && len(stored.Data.Content) > h.offloadThreshold {
+		ref, err := h.offloadContent(ctx, stored.Data.Content)
+		if err != nil {
+			return Message{}, err
+		}
+		stored.Data.Content = ""
+		stored.ContentRef = ref
+	}
+
+	return stored, nil
+}
+
+// toMessage converts a chat message to its stored representation, without offloading its content.
+// Unlike llms.ConvertChatMessageToModel it keeps the tool calls, tool call IDs, names, roles and multimodal parts.
+func toMessage(message llms.ChatMessage) Message {
+	stored := Message{ChatMessageModel: llms.ConvertChatMessageToModel(message)}
+	switch m := message.(type) {
+	case llms.AIChatMessage:
+		stored.ToolCalls = m.ToolCalls
+		stored.FunctionCall = m.FunctionCall
+	case llms.ToolChatMessage:
+		stored.ToolCallID = m.ID
+	case llms.FunctionChatMessage:
+		stored.Name = m.Name
+	case llms.GenericChatMessage:
+		stored.Name = m.Name
+		stored.Role = m.Role
+	case MultimodalMessage:
+		stored.Parts = toStoredParts(m.Parts)
+	}
+	return stored
+}
+
+// toMessage converts the cached message to its stored representation, without offloading its content.
+func (c cachedMessage) toMessage() Message {
+	stored := toMessage(c.ChatMessage)
+	stored.ID = c.id
+	stored.CreatedAt = c.createdAt
+	stored.Metadata = c.metadata
+	stored.Redaction = c.redaction
+	stored.GenerationInfo = c.generationInfo
+	stored.Usage = c.usage
+	stored.Attachments = c.attachments
+	stored.Embedding = c.embedding
+	return stored
+}
+
+// ToChatMessage converts the stored message back to a chat message. Unlike
+// llms.ChatMessageModel.ToChatMessage it supports all chat message types and
+// restores tool calls, tool call IDs, names, roles and multimodal parts.
+func (m Message) ToChatMessage() llms.ChatMessage {
+	if len(m.Parts) > 0 {
+		return MultimodalMessage{Type: llms.ChatMessageType(m.Type), Parts: toContentParts(m.Parts)}
+	}
+
+	switch llms.ChatMessageType(m.Type) {
+	case llms.ChatMessageTypeAI:
+		return llms.AIChatMessage{Content: m.Data.Content, ToolCalls: m.ToolCalls, FunctionCall: m.FunctionCall}
+	case llms.ChatMessageTypeSystem:
+		return llms.SystemChatMessage{Content: m.Data.Content}
+	case llms.ChatMessageTypeGeneric:
+		return llms.GenericChatMessage{Content: m.Data.Content, Role: m.Role, Name: m.Name}
+	case llms.ChatMessageTypeFunction:
+		return llms.FunctionChatMessage{Content: m.Data.Content, Name: m.Name}
+	case llms.ChatMessageTypeTool:
+		return llms.ToolChatMessage{Content: m.Data.Content, ID: m.ToolCallID}
+	default:
+		return m.ChatMessageModel.ToChatMessage()
+	}
+}
+
+// toCachedMessage converts the stored message to a chat message that keeps the properties stored with it.
+func (m Message) toCachedMessage() llms.ChatMessage {
+	return cachedMessage{
+		ChatMessage:    m.ToChatMessage(),
+		id:             m.ID,
+		createdAt:      m.CreatedAt,
+		metadata:       m.Metadata,
+		redaction:      m.Redaction,
+		generationInfo: m.GenerationInfo,
+		usage:          m.Usage,
+		attachments:    m.Attachments,
+		embedding:      m.Embedding,
+	}
+}
+
+// StoredMessages returns the stored conversation with the ID, creation time and metadata of every
+// message, e.g. to attach feedback or citations to individual messages. Offloaded contents are loaded and
+// the pinned system message is not included, since it isn't stored. It updates the in-memory cache.
+func (h *CosmosDBChatMessageHistory) StoredMessages(ctx context.Context) ([]Message, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	messages, err := h.loadMessages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make([]Message, 0, len(messages))
+	for _, message := range messages {
+		cached, ok := message.(cachedMessage)
+		if !ok {
+			return nil, fmt.Errorf("unexpected message type %T in chat history", message)
+		}
+		stored = append(stored, cached.toMessage())
+	}
+
+	return stored, nil
+}
+
+// plainMessages unwraps cached messages, so that callers can type switch on the llms message types.
+func plainMessages(messages []llms.ChatMessage) []llms.ChatMessage {
+	plain := make([]llms.ChatMessage, 0, len(messages))
+	for _, message := range messages {
+		if cached, ok := message.(cachedMessage); ok {
+			message = cached.ChatMessage
+		}
+		plain = append(plain, message)
+	}
+	return plain
+}
+
+// toChatMessages converts stored messages back to chat messages.
+func toChatMessages(messages []Message) []llms.ChatMessage {
+	chatMessages := make([]llms.ChatMessage, 0, len(messages))
+	for _, message := range messages {
+		chatMessages = append(chatMessages, message.ToChatMessage())
+	}
+	return chatMessages
+}
@@ -0,0 +1,252 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// SessionMetadata is stored in the history document next to the messages, e.g. for chat UIs.
+type SessionMetadata struct {
+	Title string   `json:"title,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	// Status is the lifecycle status of the session, empty for active sessions. It is set with SetSessionStatus.
+	Status SessionStatus `json:"status,omitempty"`
+	// CreatedAt is set when the session is created. It is missing for sessions created by earlier versions.
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	// UpdatedAt is the time the session was last modified. It is not stored, but taken from the document timestamp.
+	UpdatedAt time.Time `json:"-"`
+}
+
+// storedMetadata is the metadata of a history document along with its system properties.
+type storedMetadata struct {
+	Metadata *SessionMetadata `json:"metadata"`
+	TS       int64            `json:"_ts"`
+	ETag     azcore.ETag      `json:"_etag"`
+}
+
+// GetSessionMetadata returns the metadata of the session. It is empty if the session doesn't exist.
+func (h *CosmosDBChatMessageHistory) GetSessionMetadata(ctx context.Context) (SessionMetadata, error) {
+	stored, err := h.readMetadata(ctx)
+	if err != nil {
+		return SessionMetadata{}, err
+	}
+	if stored == nil {
+		return SessionMetadata{}, nil
+	}
+
+	var metadata SessionMetadata
+	if stored.Metadata != nil {
+		metadata = *stored.Metadata
+	}
+	metadata.UpdatedAt = time.Unix(stored.TS, 0).UTC()
+
+	return metadata, nil
+}
+
+// SetSessionMetadata sets the title and tags of the session, the timestamps are maintained
+// automatically. Only the metadata is written, conditioned on the ETag of the read it is based on.
+// If the session doesn't exist yet, it is created without messages.
+func (h *CosmosDBChatMessageHistory) SetSessionMetadata(ctx context.Context, metadata SessionMetadata) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, finish := h.startOperation(ctx, HistoryWrite)
+	defer func() { finish(err) }()
+
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		stored, err := h.readMetadata(ctx)
+		if err != nil {
+			return err
+		}
+
+		if stored == nil {
+			err = h.createWithMetadata(ctx, SessionMetadata{Title: metadata.Title, Tags: metadata.Tags})
+		} else {
+			err = h.patchMetadata(ctx, stored, metadata)
+		}
+		if err == nil {
+			return nil
+		}
+		if !isConflictError(err) {
+			return fmt.Errorf("failed to set session metadata: %w", err)
+		}
+		if attempt >= h.maxConflictRetries {
+			return fmt.Errorf("%w: giving up after %d retries", ErrConflict, attempt)
+		}
+		countRetry(ctx)
+	}
+}
+
+// GetSessionTitle returns the title of the session. It is empty if the session has no title.
+func (h *CosmosDBChatMessageHistory) GetSessionTitle(ctx context.Context) (string, error) {
+	metadata, err := h.GetSessionMetadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	return metadata.Title, nil
+}
+
+// SetSessionTitle renames the session. Only the title is patched, so unlike SetSessionMetadata it
+// doesn't need to read the session first and doesn't conflict with concurrent writes.
+// If the session doesn't exist yet, it is created without messages.
+func (h *CosmosDBChatMessageHistory) SetSessionTitle(ctx context.Context, title string) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, finish := h.startOperation(ctx, HistoryWrite)
+	defer func() { finish(err) }()
+
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return err
+	}
+
+	err = h.setMetadataField(ctx, "title", title, func(m *SessionMetadata) { m.Title = title })
+	if err != nil {
+		return fmt.Errorf("failed to set session title: %w", err)
+	}
+	return nil
+}
+
+// setMetadataField patches a single field of the metadata block, creating the session
+// or the metadata block if needed. apply sets the field on the cached metadata.
+func (h *CosmosDBChatMessageHistory) setMetadataField(ctx context.Context, field string, value any, apply func(*SessionMetadata)) error {
+	for attempt := 0; ; attempt++ {
+		patch := azcosmos.PatchOperations{}
+		patch.AppendSet("/metadata/"+field, value)
+		if h.ttl != nil {
+			patch.AppendSet("/ttl", *h.ttl)
+		}
+		patch.SetCondition("FROM c WHERE IS_DEFINED(c.metadata)")
+
+		var initial SessionMetadata
+		apply(&initial)
+
+		err := h.record(OperationPatch)(h.container.PatchItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, patch, h.writeOptions()))
+		switch {
+		case isNotFoundError(err):
+			err = h.createWithMetadata(ctx, initial)
+		case isPreconditionFailedError(err):
+			// the session was created by an earlier version without metadata
+			err = h.patchMissingMetadata(ctx, initial)
+		case err == nil:
+			if h.metadata != nil {
+				metadata := *h.metadata
+				apply(&metadata)
+				h.metadata = &metadata
+			}
+			h.etag = ""
+		}
+		if err == nil || !isConflictError(err) {
+			return err
+		}
+		if attempt >= h.maxConflictRetries {
+			return fmt.Errorf("%w: giving up after %d retries", ErrConflict, attempt)
+		}
+		countRetry(ctx)
+	}
+}
+
+// patchMissingMetadata adds the metadata block to a history document that doesn't have one yet.
+func (h *CosmosDBChatMessageHistory) patchMissingMetadata(ctx context.Context, metadata SessionMetadata) error {
+	patch := azcosmos.PatchOperations{}
+	patch.AppendSet("/metadata", metadata)
+	if h.ttl != nil {
+		patch.AppendSet("/ttl", *h.ttl)
+	}
+	patch.SetCondition("FROM c WHERE NOT IS_DEFINED(c.metadata)")
+
+	err := h.record(OperationPatch)(h.container.PatchItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, patch, h.writeOptions()))
+	if err != nil {
+		return err
+	}
+
+	h.metadata = &metadata
+	h.etag = ""
+	return nil
+}
+
+// createWithMetadata creates the history document of a session without messages.
+func (h *CosmosDBChatMessageHistory) createWithMetadata(ctx context.Context, metadata SessionMetadata) error {
+	h.messages = make([]llms.ChatMessage, 0)
+	h.summary = ""
+	metadata.CreatedAt = nil
+	metadata.UpdatedAt = time.Time{}
+	h.metadata = &metadata
+	h.chunkIDs = nil
+
+	etag, chunkIDs, err := h.writeHistory(ctx, h.messages, "")
+	if err != nil {
+		h.metadata = nil
+		return err
+	}
+
+	h.etag = etag
+	h.chunkIDs = chunkIDs
+	return nil
+}
+
+// patchMetadata replaces the title and tags of an existing history document.
+func (h *CosmosDBChatMessageHistory) patchMetadata(ctx context.Context, stored *storedMetadata, metadata SessionMetadata) error {
+	updated := SessionMetadata{}
+	if stored.Metadata != nil {
+		updated = *stored.Metadata
+	}
+	updated.Title = metadata.Title
+	updated.Tags = metadata.Tags
+
+	patch := azcosmos.PatchOperations{}
+	patch.AppendSet("/metadata", updated)
+	if h.ttl != nil {
+		patch.AppendSet("/ttl", *h.ttl)
+	}
+
+	err := h.record(OperationPatch)(h.container.PatchItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, patch, h.conditionalWriteOptions(stored.ETag)))
+	if err != nil {
+		return err
+	}
+
+	h.metadata = &updated
+	// the cached messages may be older than the document
+	h.etag = ""
+	return nil
+}
+
+// readMetadata reads only the metadata of the history document. It returns nil if the session doesn't exist.
+func (h *CosmosDBChatMessageHistory) readMetadata(ctx context.Context) (*storedMetadata, error) {
+	query := "SELECT c.metadata, c._ts, c._etag FROM c WHERE c.id = @id"
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@id", Value: h.sessionID}},
+	}
+
+	pager := h.container.NewQueryItemsPager(h.mapQuery(query), h.partitionKey(), h.withSessionToken(ctx, &queryOptions))
+	for pager.More() {
+		page, err := pager.NextPage(h.requestContext(ctx))
+		err = h.recordCharge(OperationQuery, page.RequestCharge, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read metadata of sessionID %s: %w", h.sessionID, err)
+		}
+		if len(page.Items) > 0 {
+			var stored storedMetadata
+			if err := json.Unmarshal(page.Items[0], &stored); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal session metadata: %w", err)
+			}
+			return &stored, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,114 @@
+package cosmosdb
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// Metrics receives a measurement for every Cosmos DB request, e.g. to update Prometheus
+// collectors. Implementations must be safe for concurrent use.
+type Metrics interface {
+	ObserveRequest(RequestMetrics)
+}
+
+// Operation is the kind of a Cosmos DB request.
+type Operation string
+
+const (
+	// OperationRead requests read a single item.
+	OperationRead Operation = "read"
+	// OperationQuery requests return a page of query results.
+	OperationQuery Operation = "query"
+	// OperationCreate, OperationReplace, OperationUpsert, OperationPatch and OperationDelete requests write an item.
+	OperationCreate  Operation = "create"
+	OperationReplace Operation = "replace"
+	OperationUpsert  Operation = "upsert"
+	OperationPatch   Operation = "patch"
+	OperationDelete  Operation = "delete"
+	// OperationMetadata requests read account, database, container or partition metadata.
+	OperationMetadata Operation = "metadata"
+)
+
+// RequestMetrics describes a single Cosmos DB request.
+type RequestMetrics struct {
+	Operation Operation
+	// StatusCode is the HTTP status code of the response, 0 if no response was received.
+	StatusCode int
+	// RequestCharge is the number of request units consumed.
+	RequestCharge float64
+	// RequestBytes is the size of the request body, e.g. the written document or patch, 0 if none.
+	RequestBytes int64
+	// ResponseBytes is the size of the response body, e.g. the read document, or -1 if unknown.
+	ResponseBytes int64
+	Latency       time.Duration
+	// Err is set if the request failed without a response, e.g. because of a network error.
+	Err error
+}
+
+// NewMetricsPolicy returns an azcore pipeline policy reporting every Cosmos DB request to metrics.
+// Add it to the PerRetryPolicies of the azcosmos.ClientOptions (e.g. passed to NewHistoryFactoryWithKey
+// or set in Config.ClientOptions), so that throttled (429) attempts are reported as well. Throttled
+// attempts are also counted in the OperationMetrics of the history operation making the request.
+func NewMetricsPolicy(metrics Metrics) policy.Policy {
+	return metricsPolicy{metrics: metrics}
+}
+
+type metricsPolicy struct {
+	metrics Metrics
+}
+
+func (p metricsPolicy) Do(req *policy.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := req.Next()
+
+	raw := req.Raw()
+	observed := RequestMetrics{
+		Operation:     operationOf(raw),
+		RequestBytes:  raw.ContentLength,
+		ResponseBytes: -1,
+		Latency:       time.Since(start),
+		Err:           err,
+	}
+	if resp != nil {
+		observed.StatusCode = resp.StatusCode
+		observed.ResponseBytes = resp.ContentLength
+		observed.RequestCharge, _ = strconv.ParseFloat(resp.Header.Get("x-ms-request-charge"), 64)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			countThrottled(raw.Context())
+		}
+	}
+	p.metrics.ObserveRequest(observed)
+
+	return resp, err
+}
+
+// operationOf classifies a Cosmos DB request by its method, path and headers.
+func operationOf(req *http.Request) Operation {
+	if !strings.Contains(req.URL.Path, "/docs") {
+		return OperationMetadata
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		return OperationRead
+	case http.MethodPut:
+		return OperationReplace
+	case http.MethodPatch:
+		return OperationPatch
+	case http.MethodDelete:
+		return OperationDelete
+	case http.MethodPost:
+		switch {
+		case strings.EqualFold(req.Header.Get("x-ms-documentdb-isquery"), "true"):
+			return OperationQuery
+		case strings.EqualFold(req.Header.Get("x-ms-documentdb-is-upsert"), "true"):
+			return OperationUpsert
+		}
+		return OperationCreate
+	}
+	return OperationMetadata
+}
@@ -0,0 +1,127 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// MultimodalMessage is a chat message whose content consists of parts, e.g. a user message with
+// an attached image. Text (llms.TextContent), image URL (llms.ImageURLContent) and binary
+// (llms.BinaryContent) parts are supported. GetContent returns the text parts.
+type MultimodalMessage struct {
+	Type  llms.ChatMessageType
+	Parts []llms.ContentPart
+}
+
+var _ llms.ChatMessage = MultimodalMessage{}
+
+func (m MultimodalMessage) GetType() llms.ChatMessageType {
+	return m.Type
+}
+
+func (m MultimodalMessage) GetContent() string {
+	var texts []string
+	for _, part := range m.Parts {
+		if text, ok := part.(llms.TextContent); ok {
+			texts = append(texts, text.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// Part types of a StoredPart.
+const (
+	PartTypeText     = "text"
+	PartTypeImageURL = "image_url"
+	PartTypeBinary   = "binary"
+)
+
+// StoredPart is the stored representation of a part of a MultimodalMessage. Binary data larger than
+// the threshold of the content store (see WithContentStore) is offloaded and referenced by ContentRef,
+// smaller payloads are stored inline (base64 encoded).
+type StoredPart struct {
+	Type       string      `json:"type"`
+	Text       string      `json:"text,omitempty"`
+	URL        string      `json:"url,omitempty"`
+	Detail     string      `json:"detail,omitempty"`
+	MIMEType   string      `json:"mimeType,omitempty"`
+	Data       []byte      `json:"data,omitempty"`
+	ContentRef *ContentRef `json:"contentRef,omitempty"`
+}
+
+// AddMessageContent adds a message in the llms.MessageContent format used by llms.Model.GenerateContent,
+// e.g. a user prompt with an image. It is read back as a MultimodalMessage.
+func (h *CosmosDBChatMessageHistory) AddMessageContent(ctx context.Context, content llms.MessageContent) error {
+	return h.AddMessage(ctx, MultimodalMessage{Type: content.Role, Parts: content.Parts})
+}
+
+// toStoredParts converts content parts to their stored representation. Unsupported parts are skipped,
+// they are rejected by validateParts before a message is stored.
+func toStoredParts(parts []llms.ContentPart) []StoredPart {
+	stored := make([]StoredPart, 0, len(parts))
+	for _, part := range parts {
+		switch p := part.(type) {
+		case llms.TextContent:
+			stored = append(stored, StoredPart{Type: PartTypeText, Text: p.Text})
+		case llms.ImageURLContent:
+			stored = append(stored, StoredPart{Type: PartTypeImageURL, URL: p.URL, Detail: p.Detail})
+		case llms.BinaryContent:
+			stored = append(stored, StoredPart{Type: PartTypeBinary, MIMEType: p.MIMEType, Data: p.Data})
+		}
+	}
+	return stored
+}
+
+// validateParts returns an error if the message has parts that can't be stored.
+func validateParts(message llms.ChatMessage) error {
+	multimodal, ok := message.(MultimodalMessage)
+	if !ok {
+		return nil
+	}
+	for _, part := range multimodal.Parts {
+		switch part.(type) {
+		case llms.TextContent, llms.ImageURLContent, llms.BinaryContent:
+		default:
+			return fmt.Errorf("unsupported message content part %T", part)
+		}
+	}
+	return nil
+}
+
+// toContentParts converts stored parts back to content parts.
+func toContentParts(stored []StoredPart) []llms.ContentPart {
+	parts := make([]llms.ContentPart, 0, len(stored))
+	for _, part := range stored {
+		switch part.Type {
+		case PartTypeText:
+			parts = append(parts, llms.TextContent{Text: part.Text})
+		case PartTypeImageURL:
+			parts = append(parts, llms.ImageURLContent{URL: part.URL, Detail: part.Detail})
+		case PartTypeBinary:
+			parts = append(parts, llms.BinaryContent{MIMEType: part.MIMEType, Data: part.Data})
+		}
+	}
+	return parts
+}
+
+// offloadParts moves binary data larger than the offload threshold to the content store.
+func (h *CosmosDBChatMessageHistory) offloadParts(ctx context.Context, parts []StoredPart) error {
+	if h.contentStore == nil {
+		return nil
+	}
+	for i := range parts {
+		if parts[i].Type != PartTypeBinary || len(parts[i].Data) <= h.offloadThreshold {
+			continue
+		}
+		ref, err := h.offloadContent(ctx, string(parts[i].Data))
+		if err != nil {
+			return err
+		}
+		parts[i].Data = nil
+		parts[i].ContentRef = ref
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package cosmosdb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// ContentStore stores message contents that are too large to be kept in the Cosmos DB item.
+type ContentStore interface {
+	// Put stores the content under key and returns a reference that can be passed to Get.
+	Put(ctx context.Context, key string, content []byte) (string, error)
+	// Get returns the content stored for the reference.
+	Get(ctx context.Context, ref string) ([]byte, error)
+	// Delete removes the content stored for the reference.
+	Delete(ctx context.Context, ref string) error
+}
+
+// ContentRef is persisted instead of the content of an offloaded message.
+type ContentRef struct {
+	Ref    string `json:"ref"`
+	SHA256 string `json:"sha256"`
+	Size   int    `json:"size"`
+}
+
+const defaultOffloadThreshold = 64 * 1024
+
+// offloadContent writes the content to the content store. The key is derived from the session and
+// the content hash, so rewriting the conversation doesn't upload the same content again.
+func (h *CosmosDBChatMessageHistory) offloadContent(ctx context.Context, content string) (*ContentRef, error) {
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+
+	if ref, ok := h.offloadedRef(hash); ok {
+		return ref, nil
+	}
+
+	key := fmt.Sprintf("%s/%s/%s", h.partitionKeyValue, h.sessionID, hash)
+	stored, err := h.contentStore.Put(ctx, key, []byte(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to offload message content: %w", err)
+	}
+
+	ref := &ContentRef{Ref: stored, SHA256: hash, Size: len(content)}
+	h.rememberOffloaded(ref)
+
+	return ref, nil
+}
+
+// loadOffloadedContent fetches the content (and binary parts) of offloaded messages from the
+// content store and verifies it against the stored hash.
+func (h *CosmosDBChatMessageHistory) loadOffloadedContent(ctx context.Context, messages []Message) error {
+	for i := range messages {
+		if ref := messages[i].ContentRef; ref != nil {
+			content, err := h.fetchContent(ctx, ref)
+			if err != nil {
+				return err
+			}
+			messages[i].Data.Content = string(content)
+		}
+
+		for j := range messages[i].Parts {
+			if ref := messages[i].Parts[j].ContentRef; ref != nil {
+				data, err := h.fetchContent(ctx, ref)
+				if err != nil {
+					return err
+				}
+				messages[i].Parts[j].Data = data
+			}
+		}
+	}
+
+	return nil
+}
+
+// fetchContent reads offloaded content from the content store and verifies it against the stored hash.
+func (h *CosmosDBChatMessageHistory) fetchContent(ctx context.Context, ref *ContentRef) ([]byte, error) {
+	if h.contentStore == nil {
+		return nil, fmt.Errorf("message content was offloaded to %s but no content store is configured", ref.Ref)
+	}
+
+	content, err := h.contentStore.Get(ctx, ref.Ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load offloaded message content %s: %w", ref.Ref, err)
+	}
+
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) != ref.SHA256 {
+		return nil, fmt.Errorf("offloaded message content %s doesn't match its hash", ref.Ref)
+	}
+
+	h.rememberOffloaded(ref)
+	return content, nil
+}
+
+// offloadedRef returns the reference of content already in the content store by its hash.
+func (h *CosmosDBChatMessageHistory) offloadedRef(hash string) (*ContentRef, bool) {
+	h.offloadMu.Lock()
+	defer h.offloadMu.Unlock()
+
+	ref, ok := h.offloaded[hash]
+	return ref, ok
+}
+
+// rememberOffloaded records that the content of ref is in the content store.
+func (h *CosmosDBChatMessageHistory) rememberOffloaded(ref *ContentRef) {
+	h.offloadMu.Lock()
+	defer h.offloadMu.Unlock()
+
+	h.offloaded[ref.SHA256] = ref
+}
+
+// BlobContentStore is a ContentStore backed by an Azure Blob Storage container.
+type BlobContentStore struct {
+	client *container.Client
+}
+
+var _ ContentStore = &BlobContentStore{}
+
+// NewBlobContentStore creates a content store that writes one blob per offloaded message content
+// into the given container. The container must exist.
+func NewBlobContentStore(client *container.Client) (*BlobContentStore, error) {
+	if client == nil {
+		return nil, fmt.Errorf("blob container client cannot be nil")
+	}
+	return &BlobContentStore{client: client}, nil
+}
+
+func (s *BlobContentStore) Put(ctx context.Context, key string, content []byte) (string, error) {
+	_, err := s.client.NewBlockBlobClient(key).UploadBuffer(ctx, content, nil)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func (s *BlobContentStore) Get(ctx context.Context, ref string) ([]byte, error) {
+	resp, err := s.client.NewBlobClient(ref).DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+func (s *BlobContentStore) Delete(ctx context.Context, ref string) error {
+	_, err := s.client.NewBlobClient(ref).Delete(ctx, nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// OpenAIMessage is a message in the format of the messages array of the OpenAI (and Azure OpenAI) chat
+// completions API.
+type OpenAIMessage struct {
+	Role string
+	// Content is the text content of the message. It is serialized as "content" unless Parts is set.
+	Content string
+	// Parts is the content of a multimodal message, serialized as the "content" array.
+	Parts        []OpenAIContentPart
+	Name         string
+	ToolCalls    []llms.ToolCall
+	ToolCallID   string
+	FunctionCall *llms.FunctionCall
+}
+
+// OpenAIContentPart is a part of the content of a multimodal OpenAIMessage.
+type OpenAIContentPart struct {
+	// Type is "text", "image_url" or "file".
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *OpenAIImageURL `json:"image_url,omitempty"`
+	File     *OpenAIFile     `json:"file,omitempty"`
+}
+
+// OpenAIImageURL is the image of an "image_url" content part, a URL or a base64 data URL.
+type OpenAIImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// OpenAIFile is the file of a "file" content part, as a base64 data URL.
+type OpenAIFile struct {
+	FileData string `json:"file_data"`
+}
+
+// openAIMessageJSON is the wire format of OpenAIMessage.
+type openAIMessageJSON struct {
+	Role         string             `json:"role"`
+	Content      json.RawMessage    `json:"content"`
+	Name         string             `json:"name,omitempty"`
+	ToolCalls    []llms.ToolCall    `json:"tool_calls,omitempty"`
+	ToolCallID   string             `json:"tool_call_id,omitempty"`
+	FunctionCall *llms.FunctionCall `json:"function_call,omitempty"`
+}
+
+func (m OpenAIMessage) MarshalJSON() ([]byte, error) {
+	var content any = m.Content
+	if len(m.Parts) > 0 {
+		content = m.Parts
+	}
+	raw, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(openAIMessageJSON{
+		Role:         m.Role,
+		Content:      raw,
+		Name:         m.Name,
+		ToolCalls:    m.ToolCalls,
+		ToolCallID:   m.ToolCallID,
+		FunctionCall: m.FunctionCall,
+	})
+}
+
+func (m *OpenAIMessage) UnmarshalJSON(data []byte) error {
+	var wire openAIMessageJSON
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+	*m = OpenAIMessage{
+		Role:         wire.Role,
+		Name:         wire.Name,
+		ToolCalls:    wire.ToolCalls,
+		ToolCallID:   wire.ToolCallID,
+		FunctionCall: wire.FunctionCall,
+	}
+	// the content is a string, an array of parts or null
+	if len(wire.Content) > 0 && wire.Content[0] == '[' {
+		return json.Unmarshal(wire.Content, &m.Parts)
+	}
+	if len(wire.Content) > 0 && string(wire.Content) != "null" {
+		return json.Unmarshal(wire.Content, &m.Content)
+	}
+	return nil
+}
+
+// ToOpenAIMessages returns the conversation returned by Messages, including the pinned system message,
+// as the messages array of the OpenAI chat completions API, for callers that call the model without
+// langchaingo. Human messages become "user" messages and AI messages "assistant" messages with their
+// tool calls. Binary parts of multimodal messages are inlined as base64 data URLs.
+func (h *CosmosDBChatMessageHistory) ToOpenAIMessages(ctx context.Context) ([]OpenAIMessage, error) {
+	messages, err := h.Messages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	converted := make([]OpenAIMessage, 0, len(messages))
+	for _, message := range messages {
+		converted = append(converted, toOpenAIMessage(message))
+	}
+	return converted, nil
+}
+
+// toOpenAIMessage converts a chat message to the OpenAI format.
+func toOpenAIMessage(message llms.ChatMessage) OpenAIMessage {
+	converted := OpenAIMessage{Role: openAIRole(message.GetType()), Content: message.GetContent()}
+	switch m := message.(type) {
+	case llms.AIChatMessage:
+		converted.ToolCalls = m.ToolCalls
+		converted.FunctionCall = m.FunctionCall
+	case llms.ToolChatMessage:
+		converted.ToolCallID = m.ID
+	case llms.FunctionChatMessage:
+		converted.Name = m.Name
+	case llms.GenericChatMessage:
+		converted.Role = m.Role
+		converted.Name = m.Name
+	case MultimodalMessage:
+		converted.Parts = toOpenAIParts(m.Parts)
+	}
+	return converted
+}
+
+// openAIRole maps a chat message type to the role of the OpenAI format.
+func openAIRole(messageType llms.ChatMessageType) string {
+	switch messageType {
+	case llms.ChatMessageTypeHuman:
+		return "user"
+	case llms.ChatMessageTypeAI:
+		return "assistant"
+	default:
+		// system, tool and function match the OpenAI roles
+		return string(messageType)
+	}
+}
+
+// toOpenAIParts converts the parts of a multimodal message to OpenAI content parts.
+func toOpenAIParts(parts []llms.ContentPart) []OpenAIContentPart {
+	converted := make([]OpenAIContentPart, 0, len(parts))
+	for _, part := range parts {
+		switch p := part.(type) {
+		case llms.TextContent:
+			converted = append(converted, OpenAIContentPart{Type: "text", Text: p.Text})
+		case llms.ImageURLContent:
+			converted = append(converted, OpenAIContentPart{Type: "image_url", ImageURL: &OpenAIImageURL{URL: p.URL, Detail: p.Detail}})
+		case llms.BinaryContent:
+			dataURL := "data:" + p.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(p.Data)
+			if strings.HasPrefix(p.MIMEType, "image/") {
+				converted = append(converted, OpenAIContentPart{Type: "image_url", ImageURL: &OpenAIImageURL{URL: dataURL}})
+			} else {
+				converted = append(converted, OpenAIContentPart{Type: "file", File: &OpenAIFile{FileData: dataURL}})
+			}
+		}
+	}
+	return converted
+}
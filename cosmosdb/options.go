@@ -0,0 +1,451 @@
+package cosmosdb
+
+import (
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Option configures optional behaviour of a CosmosDBChatMessageHistory.
+type Option func(*CosmosDBChatMessageHistory)
+
+// WithPartitionKey configures the partition key path of the container (for example "/tenantId"
+// or "/sessionId") and the value stored in that property for this session.
+// By default the container is expected to be partitioned on /userid with the userID as value.
+// Only top-level properties are supported.
+func WithPartitionKey(path, value string) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.partitionKeyPath = path
+		h.partitionKeyValue = value
+	}
+}
+
+// WithSessionTTL sets a time to live (in seconds) on the history document so that each
+// conversation expires independently of the others. Use -1 for a session that never expires.
+// TTL must be enabled on the container (DefaultTimeToLive set, -1 is fine) for the value to take effect.
+func WithSessionTTL(seconds int) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.ttl = &seconds
+	}
+}
+
+// WithReadOnly makes the history read-only: AddMessage, SetMessages and Clear return ErrReadOnly
+// without touching Cosmos DB, while Messages keeps working.
+func WithReadOnly() Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.readOnly = true
+	}
+}
+
+// WithMaxConflictRetries sets how many times a full document write (e.g. SetMessages) is retried
+// after the ETag check detected a concurrent modification. Defaults to 3.
+func WithMaxConflictRetries(n int) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.maxConflictRetries = n
+	}
+}
+
+// WithMergeFunc replaces the merge applied when a full document write (e.g. SetMessages or a trim)
+// detects that another writer modified the session since it was read. By default, messages appended
+// by the other writer are kept after ours, and ours win if the other writer rewrote the conversation.
+func WithMergeFunc(merge MergeFunc) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.mergeFunc = merge
+	}
+}
+
+// WithChunking splits the conversation across multiple items once the messages stored in the
+// session document exceed maxChunkBytes, so that long conversations don't hit the 2 MB item size limit.
+// Chunks are reassembled transparently by Messages. A value of 0 uses the default of 1 MB.
+func WithChunking(maxChunkBytes int) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		if maxChunkBytes == 0 {
+			maxChunkBytes = defaultMaxChunkBytes
+		}
+		h.maxChunkBytes = maxChunkBytes
+	}
+}
+
+// WithCompression stores the messages gzip compressed (and base64 encoded) to reduce the document
+// size and RU charges of verbose transcripts. Documents are decompressed transparently on read and
+// uncompressed documents keep loading. Adding a message rewrites the whole document in this mode.
+func WithCompression() Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.compression = true
+	}
+}
+
+// WithContentStore offloads message contents larger than threshold bytes to the content store
+// (e.g. a BlobContentStore) and keeps only a reference and a hash in Cosmos DB. Offloaded contents
+// are loaded transparently by Messages. A threshold of 0 uses the default of 64 KB.
+// Offloaded contents are not deleted by Clear; use a lifecycle policy on the store to remove them.
+func WithContentStore(store ContentStore, threshold int) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		if threshold == 0 {
+			threshold = defaultOffloadThreshold
+		}
+		h.contentStore = store
+		h.offloadThreshold = threshold
+	}
+}
+
+// WithSessionToken sets the Cosmos DB session token to read with, e.g. the token returned by
+// SessionToken of the instance that handled the previous request. With session consistency, reads
+// then see the writes the token was issued for, even if they are served by another replica.
+// An empty token is ignored.
+func WithSessionToken(token string) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		if token != "" {
+			h.sessionToken.Store(&token)
+		}
+	}
+}
+
+// WithRequestChargeCallback sets a function that is called with the request units (RU) consumed by each
+// Cosmos DB request of the history, e.g. to aggregate the cost of a conversation for capacity planning.
+// It may be called concurrently.
+func WithRequestChargeCallback(fn RequestChargeFunc) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.onRequestCharge = fn
+	}
+}
+
+// WithRUBudget charges the request units consumed by the history to budget. Once the user or session
+// (depending on the scope of the budget) spent its limit within the window, the writes (AddMessage and
+// the Add* helpers, AddMessageIfLast, SetMessages, SetSystemMessage, ImportSession, the edits, redactions
+// and trims, the metadata and status setters, CloneSession) and the message reads (Messages, MessagesTail,
+// MessagesDesc, MessagesSince, MessagesByType, SearchMessages) return ErrBudgetExceeded, unless the budget
+// has an OnExceeded callback. The other reads are charged but not rejected, and neither are Clear and
+// HistoryFactory.DeleteUserData, so that data can always be erased. Pass it to NewHistoryFactory to share
+// the budget between the histories created by the factory.
+func WithRUBudget(budget *RUBudget) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.budget = budget
+	}
+}
+
+// WithOperationObserver sets an observer receiving the latency and retry counts of the read, write and
+// clear operations of the history, see OperationMetrics.
+func WithOperationObserver(observer OperationObserver) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.operationObserver = observer
+	}
+}
+
+// WithSizeWarnings calls fn when a write makes the history document of the session grow beyond one of
+// the thresholds (in bytes, 512 KiB and 1 MiB by default), giving operators early notice before the
+// conversation hits the 2 MB item size limit. Sizes are tracked from the last read or full write of the
+// document, so a warning is reported once when the threshold is crossed, not on every later write.
+func WithSizeWarnings(fn SizeWarningFunc, thresholds ...int) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		if len(thresholds) == 0 {
+			thresholds = defaultSizeWarningThresholds
+		}
+		h.onSizeWarning = fn
+		h.sizeWarningThresholds = thresholds
+	}
+}
+
+// WithCorrelationID sends id as the activity ID of the Cosmos DB requests of the history, e.g. the ID of
+// the incoming request for a history created per request, so that failing chat operations can be
+// correlated with the service logs. An ID set on the context with ContextWithCorrelationID takes precedence.
+func WithCorrelationID(id uuid.UUID) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.correlationID = id
+	}
+}
+
+// WithAuditLog records every modification of the session (adding, setting, editing, trimming and
+// clearing messages) in log once it is stored, with actor as the one who made it, e.g. the operator
+// or service acting on behalf of the user. If recording fails, the modifying method returns an error
+// although the modification was stored.
+func WithAuditLog(log AuditLog, actor string) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.auditLog = log
+		h.auditActor = actor
+	}
+}
+
+// WithThrottlingRetry retries requests rejected with 429 (too many requests), and other transient errors,
+// up to maxRetries times, waiting for the delay requested by Cosmos DB. maxRetryDelay caps each wait, and
+// with it the total time of the retries: a request for which Cosmos DB asks for a longer delay fails right
+// away. It is a shorthand for WithRetryPolicy and overrides the retry options of the client. When the
+// retries are exhausted, the operation returns a *ThrottledError matching ErrThrottled.
+func WithThrottlingRetry(maxRetries int, maxRetryDelay time.Duration) Option {
+	return WithRetryPolicy(RetryPolicy{MaxAttempts: maxRetries + 1, MaxDelay: maxRetryDelay})
+}
+
+// WithRetryPolicy sets the backoff of the retries of transient failures (408, 429, 5xx and network errors)
+// for all Cosmos DB requests of the history, overriding the retry options of the client.
+func WithRetryPolicy(retryPolicy RetryPolicy) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.retryPolicy = &retryPolicy
+	}
+}
+
+// WithWriteBuffer keeps up to maxMessages messages in memory when adding them fails because Cosmos DB is
+// unavailable or throttles (network errors, timeouts, 408, 429 and 5xx responses), so that the chat
+// doesn't fail because persistence hiccuped. AddMessage returns nil for a buffered message and Messages
+// includes the buffered messages, falling back to the last known conversation while Cosmos DB is
+// unavailable. The buffer is flushed in order before the next message is added or the conversation is
+// read, or with Flush. onRisk (optional) is called whenever a message is buffered, and when the buffer is
+// full and AddMessage returns the error. Buffered messages are lost if the process exits before they
+// are flushed, and other instances of the session don't see them.
+func WithWriteBuffer(maxMessages int, onRisk BufferRiskFunc) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.bufferSize = maxMessages
+		h.onBufferRisk = onRisk
+	}
+}
+
+// WithWriteBehind makes AddMessage queue messages in memory and return right away, while a background
+// worker writes them. The messages added while a write is in flight are coalesced into the next one,
+// appending up to 10 messages with a single patch request (or one rewrite of a compressed or token
+// limited document). Once maxQueued messages are queued, AddMessage writes them itself before returning.
+// Reading the conversation writes the queued messages first. onError (optional) is called with the
+// errors of the background writes, which are also returned by the next Flush or Close. Call Close to
+// write the queued messages before the process exits.
+func WithWriteBehind(maxQueued int, onError func(error)) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.queueSize = maxQueued
+		h.onWriteBehindError = onError
+	}
+}
+
+// WithDeadLetter hands the messages of AddMessage and SetMessages calls that failed after the retries
+// (because Cosmos DB is unavailable, throttles, or the session kept being modified concurrently) to
+// deadLetter, so that they can be replayed later instead of being lost. Messages buffered with
+// WithWriteBuffer are only dead-lettered if the buffer is full. The failed method still returns its error.
+func WithDeadLetter(deadLetter DeadLetter) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.deadLetterSink = deadLetter
+	}
+}
+
+// WithReadConsistency sets the consistency level of the read methods (Messages, MessagesIter,
+// MessagesTail, MessageCount, etc.), e.g. azcosmos.ConsistencyLevelEventual to trade seeing the latest
+// messages for lower read latency and cost. Only levels weaker than the account default are accepted
+// by Cosmos DB. The session token (see SessionToken) is not sent with eventual and consistent prefix
+// reads. Writes and the reads they make, e.g. to resolve conflicts, keep the account default. Use
+// ContextWithReadConsistency to set the level of a single call.
+func WithReadConsistency(level azcosmos.ConsistencyLevel) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.readConsistency = level
+	}
+}
+
+// WithReadClient routes the reads of the read methods (Messages, MessagesIter, MessagesTail,
+// MessageCount, etc.) to client, while writes go through the client the history was created with.
+// Create client with the nearby read region first in its PreferredRegions, so that users far from the
+// write region load their history with low latency. With session consistency, a read the region can't
+// serve yet because it didn't replicate the session's last write is retried in the write region.
+func WithReadClient(client *azcosmos.Client) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.readClient = client
+	}
+}
+
+// WithFullTextSearch makes SearchMessages use Cosmos DB full-text search (FullTextContainsAll), which
+// matches words with stemming instead of substrings. The container needs a full-text policy and a
+// full-text index on /messages/[]/data/content.
+func WithFullTextSearch() Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.fullTextSearch = true
+	}
+}
+
+// WithVectorSearch sets the number of dimensions of the embeddings added with AddMessageWithEmbedding,
+// which are validated, and the distance function SimilarMessages compares them with. Use the same
+// values as the vector embedding policy of the container (see MessageVectorEmbeddingPolicy).
+func WithVectorSearch(dimensions int, distance VectorDistanceFunction) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.vectorDimensions = dimensions
+		h.vectorDistance = distance
+	}
+}
+
+// WithEmbedder sets the embedder of the vector features, e.g. an embeddings.Embedder of langchaingo.
+// Messages added with AddMessage and its variants are embedded with it, unless they were added with
+// AddMessageWithEmbedding or have no text content, and RelevantMessages embeds its query with it.
+// SetMessages and the BulkWriter don't embed messages.
+func WithEmbedder(embedder Embedder) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.embedder = embedder
+	}
+}
+
+// WithEmbeddingPipeline embeds added messages in the background with the embedder set with
+// WithEmbedder instead of in AddMessage, so that adding a message doesn't wait for the embeddings
+// model. Messages are searchable by SimilarMessages and RelevantMessages once they are embedded;
+// call Wait on the pipeline to wait for it, e.g. before shutting down.
+func WithEmbeddingPipeline(pipeline *EmbeddingPipeline) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.embeddingPipeline = pipeline
+	}
+}
+
+// WithSearchIndex mirrors the messages into an external search index, e.g. an AzureSearchIndex, for
+// deployments that standardize on Azure AI Search for retrieval. Added messages are uploaded after they
+// were written (with their embedding, see WithEmbedder), and the documents of the session are replaced
+// by SetMessages, DeleteMessage, UpdateMessage, RedactMessage and the trims, and removed by Clear and
+// HistoryFactory.DeleteUserData. Search the index with SearchIndexedMessages. Appends of the BulkWriter
+// and items expired by TTL are not mirrored.
+func WithSearchIndex(index SearchIndex) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.searchIndex = index
+	}
+}
+
+// WithPythonCompatibility stores the session like LangChain Python's CosmosDBChatMessageHistory, so
+// that Go and Python services can share sessions: the container is partitioned on /user_id (unless
+// WithPartitionKey is applied afterwards), and generic messages, tool calls and tool call IDs are
+// written into the data object of each message, where Python reads them. Messages written by Python
+// are read regardless of this option. Python rewrites the whole document on every message, dropping
+// the properties it doesn't know, e.g. message IDs, session metadata and the userid property that
+// factory queries like ListSessions filter on. It cannot be combined with WithCompression,
+// WithChunking or WithContentStore.
+func WithPythonCompatibility() Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.messageSchema = schemaPython
+		h.partitionKeyPath = pythonPartitionKeyPath
+		h.partitionKeyValue = h.userID
+	}
+}
+
+// WithSemanticKernelCompatibility writes the messages like Semantic Kernel serializes a
+// ChatMessageContent with the default System.Text.Json options ({"Role": {"Label": "user"}, "Items":
+// [{"$type": "TextContent", "Text": "..."}]}), so that the messages array of a session deserializes into
+// a ChatHistory in .NET and Go and .NET services can share a container during a migration. Tool calls
+// and results are written as FunctionCallContent and FunctionResultContent items. Messages written by
+// Semantic Kernel are read regardless of this option. Queries that filter on message contents server side,
+// e.g. SearchMessages and SearchSessions, don't match messages in this encoding. It cannot be combined
+// with WithCompression, WithChunking or WithContentStore.
+func WithSemanticKernelCompatibility() Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.messageSchema = schemaSemanticKernel
+	}
+}
+
+// WithHybridSearch makes RelevantMessages combine the vector ranking with a keyword ranking of the
+// messages containing words of the query, using reciprocal rank fusion, so that messages with exact
+// identifiers the user refers to, e.g. order numbers or error codes, are found even if their
+// embeddings aren't close. Messages without an embedding are found by keyword. The keyword search
+// uses full-text search if the history was created with WithFullTextSearch.
+func WithHybridSearch() Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.hybridSearch = true
+	}
+}
+
+// WithContentResponseOnWrite controls whether Cosmos DB returns the written document in the response
+// of write operations. It is disabled by default (regardless of the client options), since the
+// response body is never used and returning it costs bandwidth and latency.
+func WithContentResponseOnWrite(enabled bool) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.contentResponseOnWrite = enabled
+	}
+}
+
+// WithPinnedSystemMessage pins a system message at position 0 of the conversation. It is returned
+// first by Messages (and the other read methods) but is not stored with the messages, so window
+// trimming, summarization and Clear never remove it and it doesn't count towards the windows.
+// SetMessages ignores a leading system message with the same content.
+func WithPinnedSystemMessage(content string) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.pinnedSystemMessage = content
+	}
+}
+
+// WithTitleGeneration generates a short title for the session with model once the first user/AI
+// exchange is complete and stores it in the session metadata. Sessions that already have a title
+// (e.g. set with SetSessionMetadata) are left as they are.
+func WithTitleGeneration(model llms.Model) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.titleModel = model
+	}
+}
+
+// WithDedupeConsecutive drops a message if it has the same type and content as the last stored
+// message and that message was added less than window ago, e.g. when a client retries a request
+// whose response was lost. Checking for a duplicate costs an additional query per AddMessage.
+func WithDedupeConsecutive(window time.Duration) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.dedupeWindow = window
+	}
+}
+
+// WithMaxMessages keeps only the most recent n messages of the conversation. Older messages are
+// removed as part of every write, so the stored document never grows beyond the window.
+func WithMaxMessages(n int) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.maxMessages = n
+	}
+}
+
+// WithMaxTokens keeps only as many trailing messages as fit into limit tokens, as counted by
+// counter (e.g. NewModelTokenCounter("gpt-4o")). The most recent message is always kept.
+// Adding a message rewrites the whole document in this mode.
+func WithMaxTokens(limit int, counter TokenCounter) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.maxTokens = limit
+		h.tokenCounter = counter
+	}
+}
+
+// WithSummarization enables automatic compaction: once the conversation has more than threshold
+// messages, all but the keep most recent messages are summarized by model and replaced by a single
+// system message starting with SummaryPrefix. Earlier summaries are extended progressively.
+// The compaction is written conditionally on the ETag, so concurrent appends are not lost. The
+// threshold applies to the stored conversation, which a history that hasn't read it yet (e.g. one
+// created per request) reads once on its first added message.
+func WithSummarization(model llms.Model, threshold, keep int) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.summarizer = model
+		h.summarizationThreshold = threshold
+		h.summarizationKeep = keep
+	}
+}
+
+// WithSummaryBuffer keeps a rolling summary alongside the most recent messages, like LangChain's
+// ConversationSummaryBufferMemory. Once the raw messages exceed maxTokens, as counted by counter,
+// the oldest messages are folded into the summary by model until the rest fits again.
+// The summary is stored in the session document and returned by SummaryAndMessages. Like the
+// threshold of WithSummarization, the budget applies to the stored conversation.
+func WithSummaryBuffer(model llms.Model, maxTokens int, counter TokenCounter) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.summarizer = model
+		h.summaryMaxTokens = maxTokens
+		h.summaryTokenCounter = counter
+	}
+}
+
+// WithFieldMapping writes the session documents with the given property names, e.g. to store sessions in
+// a container that has an established schema or is shared with other services. If the user ID property is
+// renamed and the partition key path was not changed with WithPartitionKey, the container is expected to be
+// partitioned on the renamed property. Documents written without the mapping are not read by a history using
+// it (and vice versa), and queries passed to QueryHistories must use the mapped names. WithVectorSearch
+// cannot be combined with a renamed messages property.
+func WithFieldMapping(mapping FieldMapping) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.fields = mapping
+		if mapping.UserID != "" && h.partitionKeyPath == defaultPartitionKeyPath {
+			h.partitionKeyPath = "/" + mapping.UserID
+			h.partitionKeyValue = h.userID
+		}
+	}
+}
+
+// WithDualWrite writes every modification of the session to a second container as well, e.g. to migrate
+// to a new container, account or document layout without downtime: enable dual writes, copy the existing
+// sessions, switch the reads to the new container and finally drop the option. Added messages are
+// appended to the target, other modifications (SetMessages, Clear, edits, trims) copy the conversation.
+// Session metadata is not mirrored; DeleteUserData purges the target as well if the option is passed to
+// the factory. A target write that fails with DualWriteBestEffort
+// is repaired by copying the conversation on the next write of the session.
+func WithDualWrite(target DualWriteTarget) Option {
+	return func(h *CosmosDBChatMessageHistory) {
+		h.dualWrite = &target
+	}
+}
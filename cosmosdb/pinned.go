@@ -0,0 +1,25 @@
+package cosmosdb
+
+import "github.com/tmc/langchaingo/llms"
+
+// withPinned returns messages preceded by the pinned system message, if one is configured.
+func (h *CosmosDBChatMessageHistory) withPinned(messages []llms.ChatMessage) []llms.ChatMessage {
+	if h.pinnedSystemMessage == "" {
+		return messages
+	}
+
+	pinned := make([]llms.ChatMessage, 0, len(messages)+1)
+	pinned = append(pinned, llms.SystemChatMessage{Content: h.pinnedSystemMessage})
+	return append(pinned, messages...)
+}
+
+// withoutPinned removes the pinned system message from the start of messages.
+func (h *CosmosDBChatMessageHistory) withoutPinned(messages []llms.ChatMessage) []llms.ChatMessage {
+	if h.pinnedSystemMessage == "" || len(messages) == 0 || messages[0] == nil {
+		return messages
+	}
+	if messages[0].GetType() == llms.ChatMessageTypeSystem && messages[0].GetContent() == h.pinnedSystemMessage {
+		return messages[1:]
+	}
+	return messages
+}
@@ -0,0 +1,97 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// MessageContentOptions controls which part of the conversation ToMessageContent returns.
+type MessageContentOptions struct {
+	// LastN limits the conversation to the last n messages. 0 returns all messages.
+	LastN int
+	// MaxTokens limits the conversation to the most recent messages fitting into the budget, as counted
+	// by TokenCounter. The pinned system message and the summary count towards the budget. 0 disables it.
+	MaxTokens    int
+	TokenCounter TokenCounter
+	// IncludeSummary adds the rolling summary maintained with WithSummaryBuffer as a system message
+	// (starting with SummaryPrefix) after the pinned system message.
+	IncludeSummary bool
+}
+
+// ToMessageContent returns the conversation as the []llms.MessageContent expected by
+// llms.Model.GenerateContent, starting with the pinned system message. Generic messages are sent
+// with the human role. Like Messages, it updates the in-memory cache.
+func (h *CosmosDBChatMessageHistory) ToMessageContent(ctx context.Context, opts MessageContentOptions) ([]llms.MessageContent, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if opts.MaxTokens > 0 && opts.TokenCounter == nil {
+		return nil, fmt.Errorf("a token counter is required with max tokens")
+	}
+
+	messages, err := h.loadMessages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefix []llms.ChatMessage
+	if opts.IncludeSummary && h.summary != "" {
+		prefix = append(prefix, llms.SystemChatMessage{Content: SummaryPrefix + h.summary})
+	}
+	prefix = h.withPinned(prefix)
+
+	if opts.LastN > 0 && len(messages) > opts.LastN {
+		messages = messages[len(messages)-opts.LastN:]
+	}
+	if opts.MaxTokens > 0 {
+		budget := opts.MaxTokens
+		for _, message := range prefix {
+			budget -= opts.TokenCounter.CountTokens(message.GetContent())
+		}
+		messages = fitTokens(messages, budget, opts.TokenCounter)
+	}
+
+	contents := make([]llms.MessageContent, 0, len(prefix)+len(messages))
+	for _, message := range append(prefix, plainMessages(messages)...) {
+		if message == nil {
+			continue
+		}
+		contents = append(contents, toMessageContent(message))
+	}
+
+	return contents, nil
+}
+
+// toMessageContent maps a chat message to the role and parts of a model request.
+func toMessageContent(message llms.ChatMessage) llms.MessageContent {
+	switch m := message.(type) {
+	case llms.AIChatMessage:
+		content := llms.MessageContent{Role: llms.ChatMessageTypeAI}
+		if m.Content != "" || len(m.ToolCalls) == 0 {
+			content.Parts = append(content.Parts, llms.TextPart(m.Content))
+		}
+		for _, call := range m.ToolCalls {
+			content.Parts = append(content.Parts, call)
+		}
+		return content
+	case llms.ToolChatMessage:
+		return llms.MessageContent{
+			Role:  llms.ChatMessageTypeTool,
+			Parts: []llms.ContentPart{llms.ToolCallResponse{ToolCallID: m.ID, Content: m.Content}},
+		}
+	case MultimodalMessage:
+		role := m.Type
+		if role == llms.ChatMessageTypeGeneric {
+			role = llms.ChatMessageTypeHuman
+		}
+		return llms.MessageContent{Role: role, Parts: m.Parts}
+	}
+
+	role := message.GetType()
+	if role == llms.ChatMessageTypeGeneric {
+		role = llms.ChatMessageTypeHuman
+	}
+	return llms.TextParts(role, message.GetContent())
+}
@@ -0,0 +1,128 @@
+package cosmosdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// pythonPartitionKeyPath is the partition key path of the containers created by LangChain Python's
+// CosmosDBChatMessageHistory.
+const pythonPartitionKeyPath = "/user_id"
+
+// pythonChatType is the type of LangChain Python's ChatMessage, the equivalent of a generic message.
+const pythonChatType = "chat"
+
+// pythonMessageData is the "data" object of a message serialized with messages_to_dict by LangChain
+// Python. Only the properties with an equivalent in Message are kept.
+type pythonMessageData struct {
+	// Content is a string, or a list of strings and content blocks
+	Content    json.RawMessage  `json:"content"`
+	Type       string           `json:"type"`
+	Role       string           `json:"role,omitempty"`
+	Name       *string          `json:"name,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+	ToolCalls  []pythonToolCall `json:"tool_calls,omitempty"`
+}
+
+// pythonToolCall is a tool call of a LangChain Python AI message.
+type pythonToolCall struct {
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args"`
+	ID   string          `json:"id"`
+	Type string          `json:"type,omitempty"`
+}
+
+// marshalPython writes the message in the encoding of LangChain Python.
+func marshalPython(m Message) ([]byte, error) {
+	content, err := json.Marshal(m.Data.Content)
+	if err != nil {
+		return nil, err
+	}
+	data := pythonMessageData{Content: content, Type: m.Type, ToolCallID: m.ToolCallID}
+	stored := messageJSON(m)
+	if llms.ChatMessageType(m.Type) == llms.ChatMessageTypeGeneric {
+		stored.Type = pythonChatType
+		data.Type = pythonChatType
+		data.Role = m.Role
+	}
+	if m.Name != "" {
+		data.Name = &m.Name
+	}
+	for _, call := range m.ToolCalls {
+		if call.FunctionCall == nil {
+			continue
+		}
+		// Python expects the arguments as an object
+		args := json.RawMessage(call.FunctionCall.Arguments)
+		if !json.Valid(args) || !bytes.HasPrefix(bytes.TrimSpace(args), []byte("{")) {
+			args = json.RawMessage("{}")
+		}
+		data.ToolCalls = append(data.ToolCalls, pythonToolCall{Name: call.FunctionCall.Name, Args: args, ID: call.ID, Type: "tool_call"})
+	}
+
+	return json.Marshal(struct {
+		messageJSON
+		Data pythonMessageData `json:"data"`
+	}{stored, data})
+}
+
+// applyPythonData sets the properties LangChain Python stores in the data object of a message. The
+// data objects written by this package only hold the content and type.
+func (m *Message) applyPythonData(data pythonMessageData) {
+	m.Data = llms.ChatMessageModelData{Content: pythonContent(data.Content), Type: data.Type}
+	if m.Type == pythonChatType {
+		m.Type = string(llms.ChatMessageTypeGeneric)
+		m.Data.Type = m.Type
+	}
+	if m.Role == "" {
+		m.Role = data.Role
+	}
+	if m.Name == "" && data.Name != nil {
+		m.Name = *data.Name
+	}
+	if m.ToolCallID == "" {
+		m.ToolCallID = data.ToolCallID
+	}
+	if len(m.ToolCalls) == 0 {
+		for _, call := range data.ToolCalls {
+			m.ToolCalls = append(m.ToolCalls, llms.ToolCall{
+				ID:           call.ID,
+				Type:         "function",
+				FunctionCall: &llms.FunctionCall{Name: call.Name, Arguments: string(call.Args)},
+			})
+		}
+	}
+}
+
+// pythonContent returns the text of a message content, which LangChain Python stores as a string or
+// as a list of strings and content blocks.
+func pythonContent(raw json.RawMessage) string {
+	var content string
+	if err := json.Unmarshal(raw, &content); err == nil {
+		return content
+	}
+
+	var blocks []json.RawMessage
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return ""
+	}
+	var texts []string
+	for _, block := range blocks {
+		var text string
+		if err := json.Unmarshal(block, &text); err == nil {
+			texts = append(texts, text)
+			continue
+		}
+		var part struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(block, &part); err == nil && part.Type == PartTypeText {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
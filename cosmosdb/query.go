@@ -0,0 +1,56 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// QueryHistories runs a custom SQL query against the container and decodes the returned items as
+// History documents, e.g. "SELECT * FROM c WHERE ARRAY_LENGTH(c.messages) > @n" to find long sessions.
+// Queries returning a projection must keep the property names of the documents. partitionKey limits
+// the query to a partition, e.g. azcosmos.NewPartitionKeyString(userID); azcosmos.NewPartitionKey()
+// queries all partitions, which only supports queries the gateway can serve (no ORDER BY, aggregates,
+// etc. across partitions).
+//
+// Compressed messages are decompressed. Chunked sessions only contain the messages of the history
+// item, and Chunks lists the ids of the items holding the older messages. Offloaded contents are not
+// fetched (see Message.ContentRef). The chunk and lock items of sessions are skipped.
+func (f *HistoryFactory) QueryHistories(ctx context.Context, sqlQuery string, params []azcosmos.QueryParameter, partitionKey azcosmos.PartitionKey) ([]History, error) {
+	if sqlQuery == "" {
+		return nil, fmt.Errorf("query cannot be empty")
+	}
+
+	queryOptions := azcosmos.QueryOptions{QueryParameters: params}
+	histories := []History{}
+	pager := f.container.NewQueryItemsPager(sqlQuery, partitionKey, &queryOptions)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query histories: %w", err)
+		}
+
+		for _, item := range page.Items {
+			var kind struct {
+				ChunkOf string `json:"chunkOf"`
+				LockOf  string `json:"lockOf"`
+			}
+			if err := json.Unmarshal(item, &kind); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal history data: %w", err)
+			}
+			if kind.ChunkOf != "" || kind.LockOf != "" {
+				continue
+			}
+
+			history, err := f.userSettings("").unmarshalItem(item)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal history data: %w", err)
+			}
+			histories = append(histories, history)
+		}
+	}
+
+	return histories, nil
+}
@@ -0,0 +1,18 @@
+package cosmosdb
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+type readMethodKey struct{}
+
+// readContainer returns the container client for a read made with ctx: the one of the client set with
+// WithReadClient for the reads of the read methods, and the history's container otherwise.
+func (h *CosmosDBChatMessageHistory) readContainer(ctx context.Context) *azcosmos.ContainerClient {
+	if h.readReplica != nil && ctx.Value(readMethodKey{}) != nil {
+		return h.readReplica
+	}
+	return h.container
+}
@@ -0,0 +1,127 @@
+package cosmosdb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// RedactedContent replaces the content of messages removed with RedactMessage.
+const RedactedContent = "[redacted]"
+
+// Redaction records who removed the content of a message and when.
+type Redaction struct {
+	RedactedBy string    `json:"redactedBy,omitempty"`
+	RedactedAt time.Time `json:"redactedAt"`
+}
+
+// RedactMessage replaces the content of the message with the given ID (see StoredMessages) with
+// RedactedContent and drops its metadata, embedding, tool call arguments and multimodal parts, e.g.
+// to scrub PII. Unlike DeleteMessage, the message stays in the conversation with its ID, type and
+// creation time, and records the redaction for auditing. Offloaded content of the message is deleted
+// from the content store.
+// It returns ErrMessageNotFound if the session doesn't contain the message.
+func (h *CosmosDBChatMessageHistory) RedactMessage(ctx context.Context, messageID, redactedBy string) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, finish := h.startOperation(ctx, HistoryWrite)
+	defer func() { finish(err) }()
+
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return err
+	}
+
+	var original Message
+	err = h.editMessage(ctx, messageID, func(message cachedMessage) cachedMessage {
+		original = toMessage(message.ChatMessage)
+
+		stored := toMessage(message.ChatMessage)
+		stored.Data.Content = RedactedContent
+		stored.Parts = nil
+		redactCalls(&stored)
+		message.ChatMessage = stored.ToChatMessage()
+		message.metadata = nil
+		message.embedding = nil
+		message.redaction = &Redaction{RedactedBy: redactedBy, RedactedAt: time.Now().UTC()}
+		return message
+	})
+	if err != nil {
+		return fmt.Errorf("failed to redact message in chat history: %w", err)
+	}
+	// the search index and the dual write target must not keep the redacted content
+	if err := h.afterModify(ctx); err != nil {
+		return err
+	}
+
+	if err := h.deleteOffloadedContent(ctx, original.Data.Content); err != nil {
+		return err
+	}
+	for _, part := range original.Parts {
+		if part.Type == PartTypeBinary {
+			if err := h.deleteOffloadedContent(ctx, string(part.Data)); err != nil {
+				return err
+			}
+		}
+	}
+	return h.audit(ctx, AuditRedact, messageID)
+}
+
+// deleteOffloadedContent removes content from the content store, unless another message of the
+// session still has the same content.
+func (h *CosmosDBChatMessageHistory) deleteOffloadedContent(ctx context.Context, content string) error {
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+
+	ref, ok := h.offloadedRef(hash)
+	if !ok || h.contentStore == nil {
+		return nil
+	}
+	for _, message := range plainMessages(h.messages) {
+		if message == nil {
+			continue
+		}
+		if message.GetContent() == content {
+			return nil
+		}
+		if multimodal, ok := message.(MultimodalMessage); ok {
+			for _, part := range multimodal.Parts {
+				if binary, ok := part.(llms.BinaryContent); ok && string(binary.Data) == content {
+					return nil
+				}
+			}
+		}
+	}
+
+	if err := h.contentStore.Delete(ctx, ref.Ref); err != nil {
+		return fmt.Errorf("message was redacted but deleting its offloaded content %s failed: %w", ref.Ref, err)
+	}
+	h.offloadMu.Lock()
+	delete(h.offloaded, hash)
+	h.offloadMu.Unlock()
+	return nil
+}
+
+// redactCalls removes the arguments of the calls requested by an AI message. The tool call IDs and
+// function names are kept, so that the tool messages still match the calls they respond to.
+func redactCalls(stored *Message) {
+	toolCalls := make([]llms.ToolCall, 0, len(stored.ToolCalls))
+	for _, toolCall := range stored.ToolCalls {
+		if toolCall.FunctionCall != nil {
+			toolCall.FunctionCall = &llms.FunctionCall{Name: toolCall.FunctionCall.Name, Arguments: "{}"}
+		}
+		toolCalls = append(toolCalls, toolCall)
+	}
+	if len(toolCalls) > 0 {
+		stored.ToolCalls = toolCalls
+	}
+	if stored.FunctionCall != nil {
+		stored.FunctionCall = &llms.FunctionCall{Name: stored.FunctionCall.Name, Arguments: "{}"}
+	}
+}
@@ -0,0 +1,284 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// MessagesTail returns the last n messages of the conversation. The slicing happens server side,
+// so only the requested messages are transferred. Compressed documents, sessions stored in another
+// encoding (e.g. WithPythonCompatibility) or with a field mapping, and conversations where the tail
+// spans multiple chunks, are read in full and sliced client side.
+// The pinned system message, if any, is returned in addition to the n messages.
+// Unlike Messages, it doesn't update the in-memory cache.
+func (h *CosmosDBChatMessageHistory) MessagesTail(ctx context.Context, n int) (_ []llms.ChatMessage, err error) {
+	ctx, finish := h.startOperation(ctx, HistoryRead)
+	defer func() { finish(err) }()
+	ctx = h.readContext(ctx)
+	if err := h.checkBudget(); err != nil {
+		return nil, err
+	}
+
+	if n <= 0 {
+		return h.withPinned([]llms.ChatMessage{}), nil
+	}
+
+	query := "SELECT ARRAY_SLICE(c.messages, ARRAY_LENGTH(c.messages) > @n ? ARRAY_LENGTH(c.messages) - @n : 0) AS messages, " +
+		"ARRAY_LENGTH(c.messages) AS count, c.chunks, c.compression FROM c WHERE c.id = @id"
+	parameters := []azcosmos.QueryParameter{{Name: "@n", Value: n}}
+
+	messages, err := h.queryMessages(ctx, "last messages", query, parameters,
+		func(tail messageSlice) bool { return tail.Count < n && len(tail.Chunks) > 0 },
+		func(messages []Message) []Message { return messages[max(len(messages)-n, 0):] })
+	if err != nil {
+		return nil, err
+	}
+	return h.withPinned(toChatMessages(messages)), nil
+}
+
+// messageSlice is the result of a query selecting some of the stored messages server side.
+type messageSlice struct {
+	Messages []Message `json:"messages"`
+	// Count is the number of messages in the head document, if selected by the query
+	Count       int      `json:"count"`
+	Chunks      []string `json:"chunks"`
+	Compression string   `json:"compression"`
+}
+
+// queryMessages runs query, which selects some of the messages of the session as a messageSlice, and
+// returns the selected messages with their offloaded content, or none if the session doesn't exist.
+// The query gets the session ID as @id in addition to the parameters. The conversation is read in
+// full and the messages are selected client side by selectAll instead if the query can't select them:
+// the document is compressed, the messages are not stored in the default encoding, field names are
+// mapped, or incomplete reports that the selection reaches into the chunks.
+func (h *CosmosDBChatMessageHistory) queryMessages(ctx context.Context, selection, query string, parameters []azcosmos.QueryParameter, incomplete func(messageSlice) bool, selectAll func([]Message) []Message) ([]Message, error) {
+	if h.messageSchema != schemaDefault || h.fields.configured() {
+		return h.selectAllMessages(ctx, selectAll)
+	}
+
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: append(slices.Clip(parameters), azcosmos.QueryParameter{Name: "@id", Value: h.sessionID}),
+	}
+
+	var slice *messageSlice
+	pager := h.readContainer(ctx).NewQueryItemsPager(h.mapQuery(query), h.partitionKey(), h.withSessionToken(ctx, &queryOptions))
+	for pager.More() && slice == nil {
+		page, err := pager.NextPage(h.requestContext(ctx))
+		err = h.recordCharge(OperationQuery, page.RequestCharge, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query %s of sessionID %s: %w", selection, h.sessionID, err)
+		}
+		if len(page.Items) > 0 {
+			if err := json.Unmarshal(page.Items[0], &slice); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal history data: %w", err)
+			}
+		}
+	}
+
+	if slice == nil {
+		return nil, nil
+	}
+	if slice.Compression != "" || incomplete(*slice) {
+		return h.selectAllMessages(ctx, selectAll)
+	}
+
+	if err := h.loadOffloadedContent(ctx, slice.Messages); err != nil {
+		return nil, err
+	}
+	return slice.Messages, nil
+}
+
+// selectAllMessages reads the whole conversation and returns the messages chosen by selectAll.
+func (h *CosmosDBChatMessageHistory) selectAllMessages(ctx context.Context, selectAll func([]Message) []Message) ([]Message, error) {
+	history, _, err := h.readHistory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if history == nil {
+		return nil, nil
+	}
+	return selectAll(history.ChatMessages), nil
+}
+
+// MessagesWithinBudget returns the longest suffix of the conversation whose content fits into
+// maxTokens, as counted by counter. The pinned system message, if any, is always included and its
+// tokens count towards the budget. Like Messages, it updates the in-memory cache.
+func (h *CosmosDBChatMessageHistory) MessagesWithinBudget(ctx context.Context, maxTokens int, counter TokenCounter) ([]llms.ChatMessage, error) {
+	ctx = h.readContext(ctx)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if counter == nil {
+		return nil, fmt.Errorf("token counter cannot be nil")
+	}
+
+	messages, err := h.loadMessages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	budget := maxTokens
+	if h.pinnedSystemMessage != "" {
+		budget -= counter.CountTokens(h.pinnedSystemMessage)
+	}
+
+	return h.withPinned(plainMessages(fitTokens(messages, budget, counter))), nil
+}
+
+// fitTokens returns the longest suffix of messages whose content fits into budget tokens.
+// Unlike tokenSuffix, the result is empty if not even the last message fits.
+func fitTokens(messages []llms.ChatMessage, budget int, counter TokenCounter) []llms.ChatMessage {
+	start := len(messages)
+	for ; start > 0; start-- {
+		var tokens int
+		if messages[start-1] != nil {
+			tokens = counter.CountTokens(messages[start-1].GetContent())
+		}
+		if tokens > budget {
+			break
+		}
+		budget -= tokens
+	}
+	return messages[start:]
+}
+
+// MessagesDesc returns up to limit messages, most recent first, after skipping the offset most
+// recent messages, e.g. for a chat UI that loads older messages while scrolling up. Like
+// MessagesTail, the slicing happens server side unless the document is compressed or the page
+// reaches into the chunks. The pinned system message is not returned, since it isn't part of the
+// stored conversation. Unlike Messages, it doesn't update the in-memory cache.
+func (h *CosmosDBChatMessageHistory) MessagesDesc(ctx context.Context, offset, limit int) (_ []llms.ChatMessage, err error) {
+	ctx, finish := h.startOperation(ctx, HistoryRead)
+	defer func() { finish(err) }()
+	ctx = h.readContext(ctx)
+	if err := h.checkBudget(); err != nil {
+		return nil, err
+	}
+
+	if offset < 0 {
+		return nil, fmt.Errorf("offset cannot be negative")
+	}
+	if limit <= 0 {
+		return []llms.ChatMessage{}, nil
+	}
+
+	// pageEnd is the exclusive end of the page in the stored messages, start its first message
+	const pageEnd = "(ARRAY_LENGTH(c.messages) > @offset ? ARRAY_LENGTH(c.messages) - @offset : 0)"
+	query := "SELECT ARRAY_SLICE(c.messages, " + pageEnd + " > @limit ? " + pageEnd + " - @limit : 0, " + pageEnd + " > @limit ? @limit : " + pageEnd + ") AS messages, " +
+		"ARRAY_LENGTH(c.messages) AS count, c.chunks, c.compression FROM c WHERE c.id = @id"
+	parameters := []azcosmos.QueryParameter{
+		{Name: "@offset", Value: offset},
+		{Name: "@limit", Value: limit},
+	}
+
+	messages, err := h.queryMessages(ctx, "messages", query, parameters,
+		func(page messageSlice) bool { return page.Count < offset+limit && len(page.Chunks) > 0 },
+		func(messages []Message) []Message {
+			end := max(len(messages)-offset, 0)
+			return messages[max(end-limit, 0):end]
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	desc := toChatMessages(messages)
+	slices.Reverse(desc)
+	return desc, nil
+}
+
+// MessagesSince returns the messages added after t, oldest first, e.g. for clients polling for new
+// messages. The messages are filtered server side unless the document is compressed or the result
+// reaches into the chunks. Messages written by earlier versions of this package have no creation
+// time and are never returned. The pinned system message is not returned either.
+// Unlike Messages, it doesn't update the in-memory cache.
+func (h *CosmosDBChatMessageHistory) MessagesSince(ctx context.Context, t time.Time) (_ []llms.ChatMessage, err error) {
+	ctx, finish := h.startOperation(ctx, HistoryRead)
+	defer func() { finish(err) }()
+	ctx = h.readContext(ctx)
+	if err := h.checkBudget(); err != nil {
+		return nil, err
+	}
+
+	// creation times have varying precision, so the query selects the messages of the same second
+	// as well and the exact comparison happens below
+	query := "SELECT ARRAY(SELECT VALUE m FROM m IN c.messages WHERE m.createdAt >= @since) AS messages, " +
+		"ARRAY_LENGTH(c.messages) AS count, c.chunks, c.compression FROM c WHERE c.id = @id"
+	parameters := []azcosmos.QueryParameter{{Name: "@since", Value: t.UTC().Format("2006-01-02T15:04:05")}}
+
+	messages, err := h.queryMessages(ctx, "new messages", query, parameters,
+		func(since messageSlice) bool { return len(since.Messages) == since.Count && len(since.Chunks) > 0 },
+		func(messages []Message) []Message { return messages })
+	if err != nil {
+		return nil, err
+	}
+	return toChatMessages(addedAfter(messages, t)), nil
+}
+
+// addedAfter returns the messages with a creation time after t.
+func addedAfter(messages []Message, t time.Time) []Message {
+	var added []Message
+	for _, message := range messages {
+		if message.CreatedAt != nil && message.CreatedAt.After(t) {
+			added = append(added, message)
+		}
+	}
+	return added
+}
+
+// MessagesByType returns the messages of the given types, oldest first, e.g. only the human and AI
+// turns for a prompt, or only the tool messages for an audit view. The messages are filtered server
+// side unless the document is compressed or chunked. The pinned system message is included if
+// llms.ChatMessageTypeSystem is requested. Unlike Messages, it doesn't update the in-memory cache.
+func (h *CosmosDBChatMessageHistory) MessagesByType(ctx context.Context, types ...llms.ChatMessageType) (_ []llms.ChatMessage, err error) {
+	ctx, finish := h.startOperation(ctx, HistoryRead)
+	defer func() { finish(err) }()
+	ctx = h.readContext(ctx)
+	if err := h.checkBudget(); err != nil {
+		return nil, err
+	}
+
+	if len(types) == 0 {
+		return []llms.ChatMessage{}, nil
+	}
+
+	var (
+		pinned   bool
+		typeList = make([]string, 0, len(types))
+	)
+	for _, messageType := range types {
+		pinned = pinned || messageType == llms.ChatMessageTypeSystem
+		typeList = append(typeList, string(messageType))
+	}
+	withPinned := func(messages []llms.ChatMessage) []llms.ChatMessage {
+		if pinned {
+			return h.withPinned(messages)
+		}
+		return messages
+	}
+
+	query := "SELECT ARRAY(SELECT VALUE m FROM m IN c.messages WHERE ARRAY_CONTAINS(@types, m.type)) AS messages, " +
+		"c.chunks, c.compression FROM c WHERE c.id = @id"
+	parameters := []azcosmos.QueryParameter{{Name: "@types", Value: typeList}}
+
+	messages, err := h.queryMessages(ctx, "messages", query, parameters,
+		func(filtered messageSlice) bool { return len(filtered.Chunks) > 0 },
+		func(messages []Message) []Message {
+			var filtered []Message
+			for _, message := range messages {
+				if slices.Contains(typeList, message.Type) {
+					filtered = append(filtered, message)
+				}
+			}
+			return filtered
+		})
+	if err != nil {
+		return nil, err
+	}
+	return withPinned(toChatMessages(messages)), nil
+}
@@ -0,0 +1,106 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// RetrieverScope selects the conversations a HistoryRetriever searches.
+type RetrieverScope string
+
+const (
+	// RetrieverScopeSession searches the messages of the session of the history.
+	RetrieverScopeSession RetrieverScope = "session"
+	// RetrieverScopeUser searches the sessions in the partition of the history, which by default are
+	// all sessions of the user.
+	RetrieverScopeUser RetrieverScope = "user"
+)
+
+// HistoryRetriever is a schema.Retriever returning relevant past messages as documents, e.g. to add
+// snippets of earlier conversations to the context of a RAG chain. With an embedder (see WithEmbedder),
+// each document is a message found by vector search (SimilarMessages, or RelevantMessages for the
+// session scope). Otherwise the session scope returns the most recent messages containing all words of
+// the query (see SearchMessages), and the user scope returns exchanges of the other sessions of the
+// user (see RecallExchanges).
+//
+// The documents carry the "sessionId" and "type" metadata (the message type, or "exchange"), and the
+// "messageId" and "createdAt" of messages found by vector search.
+type HistoryRetriever struct {
+	history *CosmosDBChatMessageHistory
+	scope   RetrieverScope
+	k       int
+}
+
+var _ schema.Retriever = &HistoryRetriever{}
+
+// Retriever returns a retriever returning up to k documents from the given scope.
+func (h *CosmosDBChatMessageHistory) Retriever(scope RetrieverScope, k int) (*HistoryRetriever, error) {
+	if scope != RetrieverScopeSession && scope != RetrieverScopeUser {
+		return nil, fmt.Errorf("unsupported retriever scope %q", scope)
+	}
+	if k <= 0 {
+		return nil, fmt.Errorf("number of retrieved documents must be positive")
+	}
+	return &HistoryRetriever{history: h, scope: scope, k: k}, nil
+}
+
+// GetRelevantDocuments returns the documents relevant to query, most relevant first.
+func (r *HistoryRetriever) GetRelevantDocuments(ctx context.Context, query string) ([]schema.Document, error) {
+	h := r.history
+	if h.embedder != nil {
+		similar, err := h.relevantMessages(h.readContext(ctx), query, r.k, r.scope == RetrieverScopeSession)
+		if err != nil {
+			return nil, err
+		}
+		documents := make([]schema.Document, 0, len(similar))
+		for _, message := range similar {
+			documents = append(documents, messageDocument(message.SessionID, message.Message, float32(message.Score)))
+		}
+		return documents, nil
+	}
+
+	if r.scope == RetrieverScopeSession {
+		results, err := h.SearchMessages(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		documents := make([]schema.Document, 0, min(len(results), r.k))
+		for i := len(results) - 1; i >= 0 && len(documents) < r.k; i-- {
+			documents = append(documents, messageDocument(h.sessionID, results[i].Message, float32(len(results[i].Matches))))
+		}
+		return documents, nil
+	}
+
+	exchanges, err := h.RecallExchanges(ctx, query, r.k)
+	if err != nil {
+		return nil, err
+	}
+	documents := make([]schema.Document, 0, len(exchanges))
+	for _, exchange := range exchanges {
+		content, err := llms.GetBufferString(plainMessages(exchange.Messages), "Human", "AI")
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, schema.Document{
+			PageContent: content,
+			Metadata:    map[string]any{"sessionId": exchange.SessionID, "type": "exchange", "createdAt": exchange.CreatedAt},
+			Score:       float32(exchange.Score),
+		})
+	}
+	return documents, nil
+}
+
+// messageDocument converts a message of the session to a document.
+func messageDocument(sessionID string, message llms.ChatMessage, score float32) schema.Document {
+	metadata := map[string]any{"sessionId": sessionID, "type": string(message.GetType())}
+	if id := MessageID(message); id != "" {
+		metadata["messageId"] = id
+	}
+	if createdAt, ok := MessageCreatedAt(message); ok {
+		metadata["createdAt"] = createdAt
+	}
+	return schema.Document{PageContent: message.GetContent(), Metadata: metadata, Score: score}
+}
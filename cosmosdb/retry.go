@@ -0,0 +1,93 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// defaultRetryDelay is the base delay of the SDK retry policy, used for jitter if RetryPolicy.BaseDelay is not set.
+const defaultRetryDelay = 800 * time.Millisecond
+
+// transientStatusCodes are the status codes of the responses retried by a RetryPolicy. Network
+// errors are retried as well.
+var transientStatusCodes = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryPolicy configures the retries of transient failures with exponential backoff.
+// Zero values select the defaults of the SDK.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of a request, including the first one.
+	// 0 selects the SDK default of 4 attempts, 1 disables retries.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubled with every further retry.
+	BaseDelay time.Duration
+	// MaxDelay caps each delay. A throttled request for which Cosmos DB asks for a longer delay is not retried.
+	MaxDelay time.Duration
+	// Jitter randomizes the base delay of each request by up to this fraction (0 to 1) in either
+	// direction, so that clients throttled at the same time don't retry in lockstep. The SDK adds a
+	// small randomization of its own.
+	Jitter float64
+}
+
+// validate checks the ranges of the fields.
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("retry policy max attempts cannot be negative")
+	}
+	if p.BaseDelay < 0 || p.MaxDelay < 0 {
+		return fmt.Errorf("retry policy delays cannot be negative")
+	}
+	if p.MaxDelay > 0 && p.BaseDelay > p.MaxDelay {
+		return fmt.Errorf("retry policy base delay cannot exceed the max delay")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("retry policy jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+// retryOptions returns the SDK retry options for a request, with the jitter applied to the base delay.
+func (p RetryPolicy) retryOptions() policy.RetryOptions {
+	options := policy.RetryOptions{
+		RetryDelay:    p.BaseDelay,
+		MaxRetryDelay: p.MaxDelay,
+		StatusCodes:   transientStatusCodes,
+	}
+	switch p.MaxAttempts {
+	case 0:
+		// the SDK default
+	case 1:
+		// a negative value disables the retries
+		options.MaxRetries = -1
+	default:
+		options.MaxRetries = int32(p.MaxAttempts - 1)
+	}
+
+	if p.Jitter > 0 {
+		base := p.BaseDelay
+		if base == 0 {
+			base = defaultRetryDelay
+		}
+		options.RetryDelay = time.Duration(float64(base) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+	return options
+}
+
+// withRetryOptions returns ctx with the retry policy set with WithRetryPolicy or WithThrottlingRetry, if any.
+func (h *CosmosDBChatMessageHistory) withRetryOptions(ctx context.Context) context.Context {
+	if h.retryPolicy == nil {
+		return ctx
+	}
+	return policy.WithRetryOptions(ctx, h.retryPolicy.retryOptions())
+}
@@ -0,0 +1,56 @@
+package cosmosdb
+
+import "encoding/json"
+
+// messageSchema is the JSON encoding of the stored messages.
+type messageSchema string
+
+const (
+	// schemaDefault is the encoding of this package, based on llms.ChatMessageModel.
+	schemaDefault messageSchema = ""
+	// schemaPython is the encoding of LangChain Python's messages_to_dict.
+	schemaPython messageSchema = "python"
+	// schemaSemanticKernel is the encoding of Semantic Kernel's ChatMessageContent.
+	schemaSemanticKernel messageSchema = "semantic kernel"
+)
+
+// messageJSON is the default JSON encoding of Message.
+type messageJSON Message
+
+// MarshalJSON writes the message in the default encoding, or in the encoding set with
+// WithPythonCompatibility or WithSemanticKernelCompatibility.
+func (m Message) MarshalJSON() ([]byte, error) {
+	switch m.schema {
+	case schemaPython:
+		return marshalPython(m)
+	case schemaSemanticKernel:
+		return marshalSemanticKernel(m)
+	default:
+		return json.Marshal(messageJSON(m))
+	}
+}
+
+// UnmarshalJSON reads messages in all encodings, regardless of the schema the history was created
+// with, so that sessions written by other services are readable.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	aux := struct {
+		*messageJSON
+		Data pythonMessageData `json:"data"`
+		// the properties of Semantic Kernel messages, matched exactly before the lower case properties
+		// of this package
+		Role       *semanticKernelRole  `json:"Role"`
+		Items      []semanticKernelItem `json:"Items"`
+		AuthorName string               `json:"AuthorName"`
+		ModelID    string               `json:"ModelId"`
+	}{messageJSON: (*messageJSON)(m)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	if aux.Role != nil {
+		m.applySemanticKernel(*aux.Role, aux.Items, aux.AuthorName, aux.ModelID)
+		return nil
+	}
+	m.applyPythonData(aux.Data)
+	return nil
+}
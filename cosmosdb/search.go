@@ -0,0 +1,321 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// SearchResult is a message matching the query of SearchMessages.
+type SearchResult struct {
+	Message llms.ChatMessage
+	// Position is the index of the message in the conversation returned by Messages, not counting the
+	// pinned system message.
+	Position int
+	// Matches are the occurrences of the query terms in the message content, in order.
+	Matches []SearchMatch
+}
+
+// SearchMatch is an occurrence of a query term in a message content, e.g. to highlight it.
+type SearchMatch struct {
+	// Start and End are the byte offsets of the occurrence in the content.
+	Start int
+	End   int
+}
+
+// SearchMessages returns the messages of the session whose content contains all words of query,
+// ignoring case, in conversation order, e.g. for a "search in this conversation" box. The messages are
+// filtered server side with CONTAINS, or with FullTextContainsAll if the history was created with
+// WithFullTextSearch, unless the document is compressed or chunked or message contents were
+// offloaded. Unlike Messages, it doesn't update the in-memory cache.
+func (h *CosmosDBChatMessageHistory) SearchMessages(ctx context.Context, query string) (_ []SearchResult, err error) {
+	ctx, finish := h.startOperation(ctx, HistoryRead)
+	defer func() { finish(err) }()
+	ctx = h.readContext(ctx)
+	if err := h.checkBudget(); err != nil {
+		return nil, err
+	}
+
+	terms := queryTerms(query)
+	if len(terms) == 0 {
+		return []SearchResult{}, nil
+	}
+
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@id", Value: h.sessionID}},
+	}
+	names := make([]string, 0, len(terms))
+	for i, term := range terms {
+		name := fmt.Sprintf("@term%d", i)
+		names = append(names, name)
+		queryOptions.QueryParameters = append(queryOptions.QueryParameters, azcosmos.QueryParameter{Name: name, Value: term})
+	}
+	var condition string
+	if h.fullTextSearch {
+		condition = "FullTextContainsAll(m.data.content, " + strings.Join(names, ", ") + ")"
+	} else {
+		conditions := make([]string, 0, len(names))
+		for _, name := range names {
+			conditions = append(conditions, "CONTAINS(m.data.content, "+name+", true)")
+		}
+		condition = strings.Join(conditions, " AND ")
+	}
+
+	// the IDs give the positions of the matching messages
+	sqlQuery := "SELECT ARRAY(SELECT VALUE m FROM m IN c.messages WHERE " + condition + ") AS messages, " +
+		"ARRAY(SELECT VALUE m.id FROM m IN c.messages) AS ids, ARRAY_LENGTH(c.messages) AS count, " +
+		"ARRAY_LENGTH(ARRAY(SELECT VALUE 1 FROM m IN c.messages WHERE IS_DEFINED(m.contentRef))) AS offloaded, " +
+		"c.chunks, c.compression FROM c WHERE c.id = @id"
+
+	var found *struct {
+		Messages    []Message `json:"messages"`
+		IDs         []string  `json:"ids"`
+		Count       int       `json:"count"`
+		Offloaded   int       `json:"offloaded"`
+		Chunks      []string  `json:"chunks"`
+		Compression string    `json:"compression"`
+	}
+
+	pager := h.readContainer(ctx).NewQueryItemsPager(h.mapQuery(sqlQuery), h.partitionKey(), h.withSessionToken(ctx, &queryOptions))
+	for pager.More() && found == nil {
+		page, err := pager.NextPage(h.requestContext(ctx))
+		err = h.recordCharge(OperationQuery, page.RequestCharge, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search messages of sessionID %s: %w", h.sessionID, err)
+		}
+		if len(page.Items) > 0 {
+			if err := json.Unmarshal(page.Items[0], &found); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal history data: %w", err)
+			}
+		}
+	}
+
+	if found == nil {
+		return []SearchResult{}, nil
+	}
+
+	// Search the whole conversation client side if the server can't see all contents, or the
+	// positions can't be determined because messages written by earlier versions have no ID
+	patterns := termPatterns(terms)
+	if found.Compression != "" || len(found.Chunks) > 0 || found.Offloaded > 0 || len(found.IDs) < found.Count {
+		return h.searchHistory(ctx, patterns)
+	}
+
+	positions := make(map[string]int, len(found.IDs))
+	for i, id := range found.IDs {
+		positions[id] = i
+	}
+	results := make([]SearchResult, 0, len(found.Messages))
+	for _, message := range found.Messages {
+		results = append(results, SearchResult{
+			Message:  message.ToChatMessage(),
+			Position: positions[message.ID],
+			Matches:  searchContent(message.Data.Content, patterns),
+		})
+	}
+	return results, nil
+}
+
+// searchHistory reads the whole conversation, including its chunks, and searches it client side.
+func (h *CosmosDBChatMessageHistory) searchHistory(ctx context.Context, patterns []*regexp.Regexp) ([]SearchResult, error) {
+	history, _, err := h.readHistory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	results := []SearchResult{}
+	if history == nil {
+		return results, nil
+	}
+	for i, message := range history.ChatMessages {
+		if matches := searchContent(message.Data.Content, patterns); matches != nil {
+			results = append(results, SearchResult{Message: message.ToChatMessage(), Position: i, Matches: matches})
+		}
+	}
+	return results, nil
+}
+
+// termPatterns compiles the query terms into patterns ignoring case, once per query.
+func termPatterns(terms []string) []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, 0, len(terms))
+	for _, term := range terms {
+		patterns = append(patterns, regexp.MustCompile("(?i)"+regexp.QuoteMeta(term)))
+	}
+	return patterns
+}
+
+// searchContent returns the occurrences of the term patterns in content, or nil unless all terms
+// occur.
+func searchContent(content string, patterns []*regexp.Regexp) []SearchMatch {
+	var matches []SearchMatch
+	for _, pattern := range patterns {
+		occurrences := pattern.FindAllStringIndex(content, -1)
+		if len(occurrences) == 0 {
+			return nil
+		}
+		for _, occurrence := range occurrences {
+			matches = append(matches, SearchMatch{Start: occurrence[0], End: occurrence[1]})
+		}
+	}
+	slices.SortFunc(matches, func(a, b SearchMatch) int { return a.Start - b.Start })
+	return matches
+}
+
+// maxSessionSnippets is the number of snippets SearchSessions returns per session.
+const maxSessionSnippets = 3
+
+// snippetContext is the number of bytes of content kept around a match in a snippet.
+const snippetContext = 40
+
+// SessionSearchResult is a session matching the query of SearchSessions.
+type SessionSearchResult struct {
+	SessionID string
+	Title     string
+	// TitleMatch is set if the title contains all words of the query.
+	TitleMatch bool
+	// MessageMatches is the number of messages containing all words of the query.
+	MessageMatches int
+	// Snippets are excerpts of the first matching messages around their first match, oldest first.
+	Snippets []string
+	// LastActivity is the time the session was last modified.
+	LastActivity time.Time
+}
+
+// SearchSessions returns the sessions of the user whose title or messages contain all words of query,
+// ignoring case, most recently active first, with snippets of the matching messages, e.g. for a
+// "search your chats" box. The sessions are filtered server side within the user partition; compressed
+// and chunked sessions are searched client side. Offloaded contents are not searched.
+//
+// Searching client side costs an additional read of the whole document and its chunks for every
+// compressed or chunked session of the user, whether it matches or not, so the cost grows with the
+// number of such sessions. The request charges of the query and the reads are reported to the callback
+// set with WithRequestChargeCallback in the factory options.
+func (f *HistoryFactory) SearchSessions(ctx context.Context, userID, query string) ([]SessionSearchResult, error) {
+	if userID == "" {
+		return nil, fmt.Errorf("userID is mandatory")
+	}
+	terms := queryTerms(query)
+	if len(terms) == 0 {
+		return []SessionSearchResult{}, nil
+	}
+
+	parameters := []azcosmos.QueryParameter{{Name: "@userId", Value: userID}}
+	names := make([]string, 0, len(terms))
+	for i, term := range terms {
+		name := fmt.Sprintf("@term%d", i)
+		names = append(names, name)
+		parameters = append(parameters, azcosmos.QueryParameter{Name: name, Value: term})
+	}
+	contains := func(property string) string {
+		conditions := make([]string, 0, len(names))
+		for _, name := range names {
+			conditions = append(conditions, "CONTAINS("+property+", "+name+", true)")
+		}
+		return "(" + strings.Join(conditions, " AND ") + ")"
+	}
+
+	sqlQuery := "SELECT c.id, c.metadata.title, c._ts, " +
+		"ARRAY(SELECT VALUE m.data.content FROM m IN c.messages WHERE " + contains("m.data.content") + ") AS matches, " +
+		"(IS_DEFINED(c.compression) OR IS_DEFINED(c.chunks)) AS partial " +
+		"FROM c WHERE c.userid = @userId AND NOT IS_DEFINED(c.chunkOf) AND NOT IS_DEFINED(c.lockOf) AND (" +
+		contains("c.metadata.title") + " OR EXISTS(SELECT VALUE m FROM m IN c.messages WHERE " + contains("m.data.content") + ") " +
+		"OR IS_DEFINED(c.compression) OR IS_DEFINED(c.chunks)) ORDER BY c._ts DESC"
+	queryOptions := azcosmos.QueryOptions{QueryParameters: parameters}
+	patterns := termPatterns(terms)
+
+	settings := f.userSettings(userID)
+	results := []SessionSearchResult{}
+	pager := f.container.NewQueryItemsPager(settings.mapQuery(sqlQuery), settings.partitionKey(), &queryOptions)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search sessions of user %s: %w", userID, err)
+		}
+		if settings.onRequestCharge != nil {
+			settings.onRequestCharge(OperationQuery, float64(page.RequestCharge))
+		}
+
+		for _, item := range page.Items {
+			var session struct {
+				ID      string   `json:"id"`
+				Title   string   `json:"title"`
+				TS      int64    `json:"_ts"`
+				Matches []string `json:"matches"`
+				Partial bool     `json:"partial"`
+			}
+			if err := json.Unmarshal(item, &session); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal session: %w", err)
+			}
+
+			matches := session.Matches
+			if session.Partial {
+				// the messages of compressed and chunked sessions are not visible to the query, read
+				// them directly instead of querying the session again
+				h, err := f.New(session.ID, userID)
+				if err != nil {
+					return nil, err
+				}
+				if err := h.checkBudget(); err != nil {
+					return nil, err
+				}
+				found, err := h.searchHistory(h.readContext(ctx), patterns)
+				if err != nil {
+					return nil, err
+				}
+				matches = matches[:0]
+				for _, result := range found {
+					matches = append(matches, result.Message.GetContent())
+				}
+			}
+
+			result := SessionSearchResult{
+				SessionID:      session.ID,
+				Title:          session.Title,
+				TitleMatch:     searchContent(session.Title, patterns) != nil,
+				MessageMatches: len(matches),
+				LastActivity:   time.Unix(session.TS, 0).UTC(),
+			}
+			if !result.TitleMatch && result.MessageMatches == 0 {
+				continue
+			}
+			for _, content := range matches[:min(len(matches), maxSessionSnippets)] {
+				result.Snippets = append(result.Snippets, snippet(content, searchContent(content, patterns)))
+			}
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+// snippet returns the part of content around the first match, with an ellipsis where content was cut.
+func snippet(content string, matches []SearchMatch) string {
+	if len(matches) == 0 {
+		return content
+	}
+	start := max(0, matches[0].Start-snippetContext)
+	end := min(len(content), matches[0].End+snippetContext)
+	// don't cut multi-byte characters
+	for start > 0 && !utf8.RuneStart(content[start]) {
+		start--
+	}
+	for end < len(content) && !utf8.RuneStart(content[end]) {
+		end++
+	}
+
+	excerpt := content[start:end]
+	if start > 0 {
+		excerpt = "…" + excerpt
+	}
+	if end < len(content) {
+		excerpt += "…"
+	}
+	return excerpt
+}
@@ -0,0 +1,253 @@
+package cosmosdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Semantic Kernel author roles.
+const (
+	semanticKernelUser      = "user"
+	semanticKernelAssistant = "assistant"
+	semanticKernelSystem    = "system"
+	semanticKernelDeveloper = "developer"
+	semanticKernelTool      = "tool"
+)
+
+// Semantic Kernel content item types, the "$type" discriminator of the items.
+const (
+	semanticKernelText           = "TextContent"
+	semanticKernelImage          = "ImageContent"
+	semanticKernelBinary         = "BinaryContent"
+	semanticKernelFunctionCall   = "FunctionCallContent"
+	semanticKernelFunctionResult = "FunctionResultContent"
+)
+
+// semanticKernelRole is the AuthorRole of a Semantic Kernel ChatMessageContent.
+type semanticKernelRole struct {
+	Label string `json:"Label"`
+}
+
+// UnmarshalJSON reads the role as an object, or as a plain string written by custom converters.
+func (r *semanticKernelRole) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &r.Label); err == nil {
+		return nil
+	}
+	var role struct {
+		Label string `json:"Label"`
+	}
+	if err := json.Unmarshal(data, &role); err != nil {
+		return err
+	}
+	r.Label = role.Label
+	return nil
+}
+
+// semanticKernelItem is an item of a Semantic Kernel ChatMessageContent. The discriminator must be the
+// first property for System.Text.Json.
+type semanticKernelItem struct {
+	Type         string          `json:"$type"`
+	Text         string          `json:"Text,omitempty"`
+	URI          string          `json:"Uri,omitempty"`
+	Data         []byte          `json:"Data,omitempty"`
+	MimeType     string          `json:"MimeType,omitempty"`
+	ID           string          `json:"Id,omitempty"`
+	CallID       string          `json:"CallId,omitempty"`
+	PluginName   string          `json:"PluginName,omitempty"`
+	FunctionName string          `json:"FunctionName,omitempty"`
+	Arguments    json.RawMessage `json:"Arguments,omitempty"`
+	Result       json.RawMessage `json:"Result,omitempty"`
+}
+
+// semanticKernelMessage is a message serialized like a Semantic Kernel ChatMessageContent with the
+// default System.Text.Json options, along with the properties of this package that have no equivalent.
+// .NET ignores the latter, since property names are matched case-sensitively.
+type semanticKernelMessage struct {
+	Role       semanticKernelRole   `json:"Role"`
+	Items      []semanticKernelItem `json:"Items"`
+	AuthorName string               `json:"AuthorName,omitempty"`
+	ModelID    string               `json:"ModelId,omitempty"`
+
+	ID             string          `json:"id,omitempty"`
+	CreatedAt      *time.Time      `json:"createdAt,omitempty"`
+	Metadata       map[string]any  `json:"metadata,omitempty"`
+	Redaction      *Redaction      `json:"redaction,omitempty"`
+	GenerationInfo *GenerationInfo `json:"generationInfo,omitempty"`
+	Usage          *TokenUsage     `json:"usage,omitempty"`
+	Attachments    []Attachment    `json:"attachments,omitempty"`
+	Embedding      []float32       `json:"embedding,omitempty"`
+}
+
+// marshalSemanticKernel writes the message in the encoding of Semantic Kernel.
+func marshalSemanticKernel(m Message) ([]byte, error) {
+	stored := semanticKernelMessage{
+		ID:             m.ID,
+		CreatedAt:      m.CreatedAt,
+		Metadata:       m.Metadata,
+		Redaction:      m.Redaction,
+		GenerationInfo: m.GenerationInfo,
+		Usage:          m.Usage,
+		Attachments:    m.Attachments,
+		Embedding:      m.Embedding,
+		Items:          []semanticKernelItem{},
+	}
+	if m.GenerationInfo != nil {
+		stored.ModelID = m.GenerationInfo.Model
+	}
+
+	content := m.Data.Content
+	switch llms.ChatMessageType(m.Type) {
+	case llms.ChatMessageTypeHuman:
+		stored.Role.Label = semanticKernelUser
+	case llms.ChatMessageTypeAI:
+		stored.Role.Label = semanticKernelAssistant
+	case llms.ChatMessageTypeSystem:
+		stored.Role.Label = semanticKernelSystem
+	case llms.ChatMessageTypeTool, llms.ChatMessageTypeFunction:
+		stored.Role.Label = semanticKernelTool
+		result, err := json.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		item := semanticKernelItem{Type: semanticKernelFunctionResult, CallID: m.ToolCallID, Result: result}
+		if llms.ChatMessageType(m.Type) == llms.ChatMessageTypeFunction {
+			item.FunctionName = m.Name
+		}
+		stored.Items = append(stored.Items, item)
+		content = ""
+	default:
+		stored.Role.Label = m.Role
+		stored.AuthorName = m.Name
+	}
+
+	if len(m.Parts) > 0 {
+		for _, part := range m.Parts {
+			switch part.Type {
+			case PartTypeText:
+				stored.Items = append(stored.Items, semanticKernelItem{Type: semanticKernelText, Text: part.Text})
+			case PartTypeImageURL:
+				stored.Items = append(stored.Items, semanticKernelItem{Type: semanticKernelImage, URI: part.URL})
+			case PartTypeBinary:
+				itemType := semanticKernelBinary
+				if strings.HasPrefix(part.MIMEType, "image/") {
+					itemType = semanticKernelImage
+				}
+				stored.Items = append(stored.Items, semanticKernelItem{Type: itemType, Data: part.Data, MimeType: part.MIMEType})
+			}
+		}
+	} else if content != "" {
+		stored.Items = append(stored.Items, semanticKernelItem{Type: semanticKernelText, Text: content})
+	}
+
+	calls := append([]llms.ToolCall{}, m.ToolCalls...)
+	if m.FunctionCall != nil {
+		calls = append(calls, llms.ToolCall{FunctionCall: m.FunctionCall})
+	}
+	for _, call := range calls {
+		if call.FunctionCall == nil {
+			continue
+		}
+		item := semanticKernelItem{Type: semanticKernelFunctionCall, ID: call.ID, FunctionName: call.FunctionCall.Name}
+		// Semantic Kernel expects the arguments as an object
+		args := json.RawMessage(call.FunctionCall.Arguments)
+		if json.Valid(args) && bytes.HasPrefix(bytes.TrimSpace(args), []byte("{")) {
+			item.Arguments = args
+		}
+		stored.Items = append(stored.Items, item)
+	}
+
+	return json.Marshal(stored)
+}
+
+// applySemanticKernel sets the type, content, parts and calls of a message written by Semantic Kernel.
+func (m *Message) applySemanticKernel(role semanticKernelRole, items []semanticKernelItem, authorName, modelID string) {
+	var (
+		texts    []string
+		parts    []StoredPart
+		multi    bool
+		result   *semanticKernelItem
+		hasCalls bool
+	)
+	for i, item := range items {
+		switch item.Type {
+		case semanticKernelText:
+			texts = append(texts, item.Text)
+			parts = append(parts, StoredPart{Type: PartTypeText, Text: item.Text})
+		case semanticKernelImage, semanticKernelBinary:
+			multi = true
+			if item.URI != "" && len(item.Data) == 0 {
+				parts = append(parts, StoredPart{Type: PartTypeImageURL, URL: item.URI})
+			} else {
+				parts = append(parts, StoredPart{Type: PartTypeBinary, MIMEType: item.MimeType, Data: item.Data})
+			}
+		case semanticKernelFunctionCall:
+			hasCalls = true
+			name := item.FunctionName
+			if item.PluginName != "" {
+				// the fully qualified name used by the OpenAI connector
+				name = item.PluginName + "-" + name
+			}
+			args := string(item.Arguments)
+			if len(item.Arguments) == 0 || string(item.Arguments) == "null" {
+				args = "{}"
+			}
+			m.ToolCalls = append(m.ToolCalls, llms.ToolCall{ID: item.ID, Type: "function", FunctionCall: &llms.FunctionCall{Name: name, Arguments: args}})
+		case semanticKernelFunctionResult:
+			if result == nil {
+				result = &items[i]
+			}
+		}
+	}
+
+	messageType := llms.ChatMessageTypeGeneric
+	switch role.Label {
+	case semanticKernelUser:
+		messageType = llms.ChatMessageTypeHuman
+	case semanticKernelAssistant:
+		messageType = llms.ChatMessageTypeAI
+	case semanticKernelSystem, semanticKernelDeveloper:
+		messageType = llms.ChatMessageTypeSystem
+	case semanticKernelTool:
+		messageType = llms.ChatMessageTypeTool
+		if result != nil && result.CallID == "" && result.FunctionName != "" {
+			messageType = llms.ChatMessageTypeFunction
+			m.Name = result.FunctionName
+		}
+	default:
+		m.Role = role.Label
+		m.Name = authorName
+	}
+	if hasCalls && messageType != llms.ChatMessageTypeAI {
+		// only AI messages carry tool calls
+		m.ToolCalls = nil
+	}
+
+	content := strings.Join(texts, "\n")
+	if result != nil && (messageType == llms.ChatMessageTypeTool || messageType == llms.ChatMessageTypeFunction) {
+		m.ToolCallID = result.CallID
+		content = semanticKernelResult(result.Result)
+	} else if multi {
+		m.Parts = parts
+	}
+	m.Type = string(messageType)
+	m.Data = llms.ChatMessageModelData{Content: content, Type: m.Type}
+	if m.GenerationInfo == nil && modelID != "" {
+		m.GenerationInfo = &GenerationInfo{Model: modelID}
+	}
+}
+
+// semanticKernelResult returns the result of a function as text: strings as-is, other values as JSON.
+func semanticKernelResult(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	var result string
+	if err := json.Unmarshal(raw, &result); err == nil {
+		return result
+	}
+	return string(raw)
+}
@@ -0,0 +1,353 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// SessionInfo describes a stored conversation.
+type SessionInfo struct {
+	SessionID string
+	// MessageCount is the number of messages in the session, or -1 if it can't be determined
+	// without reading the whole session (compressed or chunked sessions).
+	MessageCount int
+	// LastActivity is the time the session was last modified.
+	LastActivity time.Time
+	// Metadata holds the title, tags and creation time of the session.
+	Metadata SessionMetadata
+}
+
+// SessionSort is the order in which ListSessions returns the sessions.
+type SessionSort string
+
+const (
+	// SortByLastActivity sorts the sessions by the time they were last modified.
+	SortByLastActivity SessionSort = "lastActivity"
+	// SortByCreatedAt sorts the sessions by their creation time.
+	SortByCreatedAt SessionSort = "createdAt"
+	// SortByTitle sorts the sessions by their title.
+	SortByTitle SessionSort = "title"
+)
+
+// sessionSortFields maps the sort orders to the document properties.
+var sessionSortFields = map[SessionSort]string{
+	SortByLastActivity: "c._ts",
+	SortByCreatedAt:    "c.metadata.createdAt",
+	SortByTitle:        "c.metadata.title",
+}
+
+// ListSessionsOptions controls the order and paging of ListSessions.
+type ListSessionsOptions struct {
+	// SortBy is the sort order, SortByLastActivity by default.
+	SortBy SessionSort
+	// Ascending sorts in ascending order instead of the default descending order.
+	Ascending bool
+	// SessionIDs limits the listing to the given sessions.
+	SessionIDs []string
+	// Tags limits the listing to sessions having all of the tags.
+	Tags []string
+	// CreatedSince and CreatedBefore limit the listing to sessions created in [CreatedSince, CreatedBefore).
+	// Zero values are ignored. Sessions created by earlier versions have no creation time and are excluded.
+	CreatedSince  time.Time
+	CreatedBefore time.Time
+	// ActiveSince and ActiveBefore limit the listing to sessions last modified in [ActiveSince, ActiveBefore).
+	// Zero values are ignored.
+	ActiveSince  time.Time
+	ActiveBefore time.Time
+	// PageSize is the maximum number of sessions returned per page. 0 uses the service default.
+	PageSize int
+	// ContinuationToken continues the listing after a previous page.
+	ContinuationToken string
+}
+
+// SessionPage is a page of sessions returned by ListSessions.
+type SessionPage struct {
+	Sessions []SessionInfo
+	// ContinuationToken is passed to the next ListSessions call to get the next page. It is empty on the last page.
+	ContinuationToken string
+}
+
+// ListSessions returns the sessions of the user, most recently active first unless another order is
+// set in opts, e.g. for a chat history sidebar. Pass the ContinuationToken of the returned page in opts
+// (with the same sort order and filters) to get the next page. opts may be nil.
+func (f *HistoryFactory) ListSessions(ctx context.Context, userID string, opts *ListSessionsOptions) (*SessionPage, error) {
+	if userID == "" {
+		return nil, fmt.Errorf("userID is mandatory")
+	}
+	if opts == nil {
+		opts = &ListSessionsOptions{}
+	}
+	if opts.PageSize < 0 {
+		return nil, fmt.Errorf("page size cannot be negative")
+	}
+
+	sortBy := opts.SortBy
+	if sortBy == "" {
+		sortBy = SortByLastActivity
+	}
+	sortField, ok := sessionSortFields[sortBy]
+	if !ok {
+		return nil, fmt.Errorf("unsupported session sort order %q", sortBy)
+	}
+	direction := "DESC"
+	if opts.Ascending {
+		direction = "ASC"
+	}
+
+	filter, parameters := sessionFilter(opts)
+	parameters = append(parameters, azcosmos.QueryParameter{Name: "@userId", Value: userID})
+
+	query := "SELECT c.id, ARRAY_LENGTH(c.messages) AS count, (IS_DEFINED(c.compression) OR IS_DEFINED(c.chunks)) AS partial, c.metadata, c._ts " +
+		"FROM c WHERE c.userid = @userId AND NOT IS_DEFINED(c.chunkOf) AND NOT IS_DEFINED(c.lockOf)" + filter + " ORDER BY " + sortField + " " + direction
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: parameters,
+		PageSizeHint:    int32(opts.PageSize),
+	}
+	if opts.ContinuationToken != "" {
+		queryOptions.ContinuationToken = &opts.ContinuationToken
+	}
+
+	pager := f.container.NewQueryItemsPager(f.userSettings(userID).mapQuery(query), f.partitionKey(userID), &queryOptions)
+	page, err := pager.NextPage(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions of user %s: %w", userID, err)
+	}
+
+	sessions := &SessionPage{Sessions: make([]SessionInfo, 0, len(page.Items))}
+	for _, item := range page.Items {
+		var session struct {
+			ID       string           `json:"id"`
+			Count    int              `json:"count"`
+			Partial  bool             `json:"partial"`
+			Metadata *SessionMetadata `json:"metadata"`
+			TS       int64            `json:"_ts"`
+		}
+		if err := json.Unmarshal(item, &session); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal session: %w", err)
+		}
+
+		info := SessionInfo{
+			SessionID:    session.ID,
+			MessageCount: session.Count,
+			LastActivity: time.Unix(session.TS, 0).UTC(),
+		}
+		if session.Partial {
+			info.MessageCount = -1
+		}
+		if session.Metadata != nil {
+			info.Metadata = *session.Metadata
+		}
+		info.Metadata.UpdatedAt = info.LastActivity
+		sessions.Sessions = append(sessions.Sessions, info)
+	}
+	if page.ContinuationToken != nil {
+		sessions.ContinuationToken = *page.ContinuationToken
+	}
+
+	return sessions, nil
+}
+
+// sessionFilter returns the query conditions (starting with AND) and parameters for the filters in opts.
+func sessionFilter(opts *ListSessionsOptions) (string, []azcosmos.QueryParameter) {
+	var (
+		filter     strings.Builder
+		parameters []azcosmos.QueryParameter
+	)
+	add := func(condition, name string, value any) {
+		filter.WriteString(" AND " + fmt.Sprintf(condition, name))
+		parameters = append(parameters, azcosmos.QueryParameter{Name: name, Value: value})
+	}
+
+	if len(opts.SessionIDs) > 0 {
+		add("ARRAY_CONTAINS(%s, c.id)", "@sessionIds", opts.SessionIDs)
+	}
+	for i, tag := range opts.Tags {
+		add("ARRAY_CONTAINS(c.metadata.tags, %s)", fmt.Sprintf("@tag%d", i), tag)
+	}
+	// creation times are stored in UTC with second precision, see writeHistory
+	if !opts.CreatedSince.IsZero() {
+		add("c.metadata.createdAt >= %s", "@createdSince", opts.CreatedSince.UTC().Format(time.RFC3339))
+	}
+	if !opts.CreatedBefore.IsZero() {
+		add("c.metadata.createdAt < %s", "@createdBefore", opts.CreatedBefore.UTC().Format(time.RFC3339))
+	}
+	if !opts.ActiveSince.IsZero() {
+		add("c._ts >= %s", "@activeSince", opts.ActiveSince.Unix())
+	}
+	if !opts.ActiveBefore.IsZero() {
+		add("c._ts < %s", "@activeBefore", opts.ActiveBefore.Unix())
+	}
+
+	return filter.String(), parameters
+}
+
+// forEachSession calls fn with a history for every session of the user matching the filters in opts,
+// or for the sessions of all users with a cross-partition query if userID is empty. The sessions are
+// read by fn one by one, so that compressed, chunked and offloaded sessions are complete.
+func (f *HistoryFactory) forEachSession(ctx context.Context, userID string, opts *ListSessionsOptions, fn func(h *CosmosDBChatMessageHistory) error) error {
+	return f.forEachSessionPage(ctx, userID, opts, "", fn, nil)
+}
+
+// forEachSessionPage is forEachSession starting at the continuation token of an earlier query (empty to
+// start at the beginning). pageDone (optional) is called once fn returned for every session of a page,
+// with the continuation token of the next page, which is empty after the last page.
+func (f *HistoryFactory) forEachSessionPage(ctx context.Context, userID string, opts *ListSessionsOptions, continuation string, fn func(h *CosmosDBChatMessageHistory) error, pageDone func(continuation string) error) error {
+	filter, parameters := sessionFilter(opts)
+	partitionKey := azcosmos.NewPartitionKey()
+	if userID != "" {
+		filter += " AND c.userid = @userId"
+		parameters = append(parameters, azcosmos.QueryParameter{Name: "@userId", Value: userID})
+		partitionKey = f.partitionKey(userID)
+	}
+	query := "SELECT c.id, c.userid AS userid FROM c WHERE NOT IS_DEFINED(c.chunkOf) AND NOT IS_DEFINED(c.lockOf)" + filter
+
+	queryOptions := azcosmos.QueryOptions{QueryParameters: parameters}
+	if continuation != "" {
+		queryOptions.ContinuationToken = &continuation
+	}
+	pager := f.container.NewQueryItemsPager(f.userSettings(userID).mapQuery(query), partitionKey, &queryOptions)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to query sessions: %w", err)
+		}
+
+		for _, item := range page.Items {
+			var session struct {
+				ID     string `json:"id"`
+				UserID string `json:"userid"`
+			}
+			if err := json.Unmarshal(item, &session); err != nil {
+				return fmt.Errorf("failed to unmarshal session: %w", err)
+			}
+
+			h, err := f.New(session.ID, session.UserID)
+			if err != nil {
+				return err
+			}
+			if err := fn(h); err != nil {
+				return err
+			}
+		}
+
+		if pageDone != nil {
+			var next string
+			if page.ContinuationToken != nil {
+				next = *page.ContinuationToken
+			}
+			if err := pageDone(next); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// DeleteUserData deletes every session of the user, including chunk items, e.g. to fulfil a
+// right-to-erasure request. The offloaded message contents are deleted from a content store configured
+// in the factory options, the messages are removed from a search index, the sessions are deleted from a
+// dual write target (see WithDualWrite) according to its policy, and an audit log records the purge. Deleting the same user again is not an error.
+func (f *HistoryFactory) DeleteUserData(ctx context.Context, userID string) error {
+	if userID == "" {
+		return fmt.Errorf("userID is mandatory")
+	}
+
+	h := f.userSettings(userID)
+
+	// the target is purged first, so that a failed purge is repeated when the call is retried
+	if h.dualWrite != nil {
+		if err := f.purgeDualWriteTarget(ctx, userID, h.dualWrite); err != nil {
+			return err
+		}
+	}
+
+	query := "SELECT * FROM c WHERE c.userid = @userId"
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@userId", Value: userID}},
+	}
+
+	var (
+		ids      []string
+		sessions []string
+		refs     = map[string]bool{}
+	)
+	pager := f.container.NewQueryItemsPager(h.mapQuery(query), h.partitionKey(), &queryOptions)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to query items of user %s: %w", userID, err)
+		}
+		for _, item := range page.Items {
+			history, err := h.unmarshalItem(item)
+			if err != nil {
+				return fmt.Errorf("failed to unmarshal history data: %w", err)
+			}
+			ids = append(ids, history.SessionId)
+			if history.ChunkOf == "" {
+				sessions = append(sessions, history.SessionId)
+			}
+			for _, message := range history.ChatMessages {
+				if message.ContentRef != nil {
+					refs[message.ContentRef.Ref] = true
+				}
+				for _, part := range message.Parts {
+					if part.ContentRef != nil {
+						refs[part.ContentRef.Ref] = true
+					}
+				}
+			}
+		}
+	}
+
+	if h.contentStore != nil {
+		for ref := range refs {
+			if err := h.contentStore.Delete(ctx, ref); err != nil {
+				return fmt.Errorf("failed to delete offloaded message content %s: %w", ref, err)
+			}
+		}
+	}
+
+	// the index is cleaned up before the items, so that a failed purge still finds the sessions when retried
+	if h.searchIndex != nil {
+		for _, sessionID := range sessions {
+			if err := h.searchIndex.DeleteSession(ctx, userID, sessionID); err != nil {
+				return fmt.Errorf("failed to remove session %s of user %s from the search index: %w", sessionID, userID, err)
+			}
+		}
+	}
+
+	for _, id := range ids {
+		_, err := f.container.DeleteItem(ctx, h.partitionKey(), id, h.writeOptions())
+		if err != nil && !isNotFoundError(err) {
+			return fmt.Errorf("failed to delete item %s of user %s: %w", id, userID, err)
+		}
+	}
+
+	return h.audit(ctx, AuditPurge)
+}
+
+// partitionKey returns the partition key of the sessions of the user, taking a
+// partition key configured with WithPartitionKey in the factory options into account.
+func (f *HistoryFactory) partitionKey(userID string) azcosmos.PartitionKey {
+	return f.userSettings(userID).partitionKey()
+}
+
+// userSettings returns a history that is not bound to a session, with the factory options
+// applied, to access the user level settings like the partition key and the content store.
+func (f *HistoryFactory) userSettings(userID string) *CosmosDBChatMessageHistory {
+	h := &CosmosDBChatMessageHistory{
+		userID:            userID,
+		partitionKeyPath:  defaultPartitionKeyPath,
+		partitionKeyValue: userID,
+	}
+	for _, opt := range f.opts {
+		opt(h)
+	}
+	return h
+}
@@ -0,0 +1,43 @@
+package cosmosdb
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// SessionToken returns the Cosmos DB session token of the last write of this instance, or the token
+// set with WithSessionToken if it didn't write yet. It is empty if neither is known.
+// In a load-balanced deployment with session consistency, pass it to the instance handling the next
+// request of the session (e.g. in a header or cookie), so that its reads see the writes of this one.
+func (h *CosmosDBChatMessageHistory) SessionToken() string {
+	if token := h.sessionToken.Load(); token != nil {
+		return *token
+	}
+	return ""
+}
+
+// readOptions returns the options for point reads, with the read consistency level of ctx and the
+// session token if one is known.
+func (h *CosmosDBChatMessageHistory) readOptions(ctx context.Context) *azcosmos.ItemOptions {
+	o := &azcosmos.ItemOptions{}
+	if level, ok := readConsistencyFromContext(ctx); ok {
+		o.ConsistencyLevel = level.ToPtr()
+	}
+	if token := h.sessionToken.Load(); token != nil && usesSessionToken(o.ConsistencyLevel) {
+		o.SessionToken = token
+	}
+	return o
+}
+
+// withSessionToken sets the read consistency level of ctx and the session token, if one is known, on
+// the query options.
+func (h *CosmosDBChatMessageHistory) withSessionToken(ctx context.Context, o *azcosmos.QueryOptions) *azcosmos.QueryOptions {
+	if level, ok := readConsistencyFromContext(ctx); ok {
+		o.ConsistencyLevel = level.ToPtr()
+	}
+	if token := h.sessionToken.Load(); token != nil && usesSessionToken(o.ConsistencyLevel) {
+		o.SessionToken = token
+	}
+	return o
+}
@@ -0,0 +1,105 @@
+package cosmosdb
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// maxDocumentBytes is the Cosmos DB item size limit.
+const maxDocumentBytes = 2 * 1024 * 1024
+
+// defaultSizeWarningThresholds are the thresholds used by WithSizeWarnings if none are given.
+var defaultSizeWarningThresholds = []int{512 * 1024, 1024 * 1024}
+
+// SizeWarning is reported when the history document of a session grows beyond a threshold
+// configured with WithSizeWarnings.
+type SizeWarning struct {
+	SessionID string
+	UserID    string
+	// Size is the size of the history document in bytes after the write.
+	Size int
+	// Threshold is the crossed threshold in bytes.
+	Threshold int
+	// Limit is the item size limit in bytes.
+	Limit int
+}
+
+// SizeWarningFunc is called with a SizeWarning, e.g. to log it or update a metric.
+type SizeWarningFunc func(SizeWarning)
+
+// setDocumentSize records the size of the history document after a write and reports the
+// thresholds crossed since the last known size. Nothing is reported if the previous size is unknown.
+func (h *CosmosDBChatMessageHistory) setDocumentSize(size int) {
+	previous := h.documentSize
+	h.documentSize = size
+	if h.onSizeWarning == nil || previous < 0 {
+		return
+	}
+
+	for _, threshold := range h.sizeWarningThresholds {
+		if previous < threshold && size >= threshold {
+			h.onSizeWarning(SizeWarning{
+				SessionID: h.sessionID,
+				UserID:    h.userID,
+				Size:      size,
+				Threshold: threshold,
+				Limit:     maxDocumentBytes,
+			})
+		}
+	}
+}
+
+// checkDocumentSize returns a *DocumentTooLargeError if an item of the given serialized size
+// exceeds the item size limit, so that it isn't rejected by Cosmos DB with an opaque 413.
+func (h *CosmosDBChatMessageHistory) checkDocumentSize(size int) error {
+	if size <= maxDocumentBytes {
+		return nil
+	}
+	return h.documentTooLarge(size)
+}
+
+// documentTooLarge returns the error for a document of the given size, suggesting the options
+// that are not configured yet.
+func (h *CosmosDBChatMessageHistory) documentTooLarge(size int) error {
+	var options []string
+	if h.maxChunkBytes == 0 {
+		options = append(options, "WithChunking to split the conversation across items")
+	}
+	if h.contentStore == nil {
+		options = append(options, "WithContentStore to offload large message contents")
+	}
+
+	err := &DocumentTooLargeError{Size: size, Limit: maxDocumentBytes}
+	if len(options) > 0 {
+		err.Suggestion = "use " + strings.Join(options, " or ")
+	}
+	return err
+}
+
+// estimatedSize estimates the serialized size of the cached messages, ignoring offloaded contents.
+func (h *CosmosDBChatMessageHistory) estimatedSize() int {
+	var size int
+	for _, message := range h.messages {
+		if message == nil {
+			continue
+		}
+		var stored Message
+		if cached, ok := message.(cachedMessage); ok {
+			stored = cached.toMessage()
+		} else {
+			stored = toMessage(message)
+		}
+		n, _ := messageSize(stored)
+		size += n
+	}
+	return size
+}
+
+// isTooLargeError reports whether Cosmos DB rejected a write because the item exceeds the size limit.
+func isTooLargeError(err error) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusRequestEntityTooLarge
+}
@@ -0,0 +1,71 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+)
+
+// SessionStatus is the lifecycle status of a session.
+type SessionStatus string
+
+const (
+	// SessionActive sessions accept new messages. Sessions without a status are active.
+	SessionActive SessionStatus = "active"
+	// SessionClosed sessions reject new messages, e.g. a resolved support ticket.
+	SessionClosed SessionStatus = "closed"
+	// SessionArchived sessions reject new messages and are typically hidden from listings.
+	SessionArchived SessionStatus = "archived"
+)
+
+// activeCondition is the patch condition matching sessions that accept new messages.
+const activeCondition = `(NOT IS_DEFINED(c.metadata.status) OR c.metadata.status = "active")`
+
+// SetSessionStatus sets the lifecycle status of the session. Once the session is closed or archived,
+// AddMessage, SetMessages and the trim methods return ErrSessionClosed; the check is part of the
+// conditional writes, so no message added concurrently lands afterwards. Setting the status back to
+// SessionActive reopens the session. Only the status is patched.
+func (h *CosmosDBChatMessageHistory) SetSessionStatus(ctx context.Context, status SessionStatus) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, finish := h.startOperation(ctx, HistoryWrite)
+	defer func() { finish(err) }()
+
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return err
+	}
+	switch status {
+	case SessionActive, SessionClosed, SessionArchived:
+	default:
+		return fmt.Errorf("invalid session status %q", status)
+	}
+
+	err = h.setMetadataField(ctx, "status", status, func(m *SessionMetadata) { m.Status = status })
+	if err != nil {
+		return fmt.Errorf("failed to set session status: %w", err)
+	}
+	return nil
+}
+
+// GetSessionStatus returns the lifecycle status of the session.
+func (h *CosmosDBChatMessageHistory) GetSessionStatus(ctx context.Context) (SessionStatus, error) {
+	metadata, err := h.GetSessionMetadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	if metadata.Status == "" {
+		return SessionActive, nil
+	}
+	return metadata.Status, nil
+}
+
+// checkActive returns ErrSessionClosed if the cached metadata shows that the session doesn't accept new messages.
+// The cache must correspond to the version that is written, e.g. through the ETag of a conditional write.
+func (h *CosmosDBChatMessageHistory) checkActive() error {
+	if h.metadata != nil && h.metadata.Status != "" && h.metadata.Status != SessionActive {
+		return ErrSessionClosed
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// SummaryPrefix starts the content of the system message that replaces summarized messages.
+const SummaryPrefix = "Summary of the earlier conversation: "
+
+const summarizationPrompt = `Progressively summarize the lines of conversation provided, adding onto the previous summary and returning a new summary.
+
+Current summary:
+%s
+
+New lines of conversation:
+%s
+
+New summary:`
+
+// compact replaces all but the most recent messages with a summary generated by the configured model.
+// The result is written with the ETag of the read it is based on, messages appended concurrently are kept.
+func (h *CosmosDBChatMessageHistory) compact(ctx context.Context) error {
+	messages, err := h.loadMessages(ctx)
+	if err != nil {
+		return err
+	}
+	if len(messages) <= h.summarizationThreshold {
+		return nil
+	}
+
+	older := messages[:len(messages)-h.summarizationKeep]
+	recent := messages[len(messages)-h.summarizationKeep:]
+
+	var previous string
+	if summary, ok := summaryOf(older[0]); ok {
+		previous = summary
+		older = older[1:]
+	}
+
+	summary, err := h.summarize(ctx, previous, older)
+	if err != nil {
+		return err
+	}
+
+	compacted := make([]llms.ChatMessage, 0, len(recent)+1)
+	compacted = append(compacted, llms.SystemChatMessage{Content: SummaryPrefix + summary})
+	compacted = append(compacted, recent...)
+
+	return h.replaceMessages(ctx, compacted)
+}
+
+// compactBuffer folds the oldest messages into the rolling summary until the remaining messages
+// fit into the summary buffer token budget. The write is conditioned on the ETag of the read it is
+// based on; if the session was modified concurrently, the compaction is retried on the new version.
+// Like replaceMessages, it doesn't rewrite a closed session and applies the message window.
+func (h *CosmosDBChatMessageHistory) compactBuffer(ctx context.Context) error {
+	for attempt := 0; ; attempt++ {
+		messages, err := h.loadMessages(ctx)
+		if err != nil {
+			return err
+		}
+		if err := h.checkActive(); err != nil {
+			return err
+		}
+
+		recent := tokenSuffix(messages, h.summaryMaxTokens, h.summaryTokenCounter)
+		if len(recent) == len(messages) {
+			return nil
+		}
+
+		summary, err := h.summarize(ctx, h.summary, messages[:len(messages)-len(recent)])
+		if err != nil {
+			return err
+		}
+
+		recent = h.applyWindow(recent)
+		previous := h.summary
+		h.summary = summary
+		etag, chunkIDs, err := h.writeHistory(ctx, recent, h.etag)
+		if err == nil {
+			h.messages = recent
+			h.etag = etag
+			h.chunkIDs = chunkIDs
+			return nil
+		}
+		h.summary = previous
+		if !isConflictError(err) {
+			return err
+		}
+		if attempt >= h.maxConflictRetries {
+			return fmt.Errorf("%w: giving up after %d retries", ErrConflict, attempt)
+		}
+		countRetry(ctx)
+	}
+}
+
+// SummaryAndMessages returns the rolling summary maintained with WithSummaryBuffer together with
+// the messages that have not been summarized yet. The summary is empty until the first compaction.
+func (h *CosmosDBChatMessageHistory) SummaryAndMessages(ctx context.Context) (string, []llms.ChatMessage, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	messages, err := h.loadMessages(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	return h.summary, h.withPinned(plainMessages(messages)), nil
+}
+
+// summarize asks the model to fold messages into a summary, extending the previous summary.
+func (h *CosmosDBChatMessageHistory) summarize(ctx context.Context, previous string, messages []llms.ChatMessage) (string, error) {
+	lines, err := llms.GetBufferString(plainMessages(messages), "Human", "AI")
+	if err != nil {
+		return "", fmt.Errorf("failed to format messages for summarization: %w", err)
+	}
+
+	summary, err := llms.GenerateFromSinglePrompt(ctx, h.summarizer, fmt.Sprintf(summarizationPrompt, previous, lines))
+	if err != nil {
+		return "", fmt.Errorf("failed to generate summary: %w", err)
+	}
+
+	return strings.TrimSpace(summary), nil
+}
+
+// summaryOf returns the summary text if message is a summary produced by compaction.
+func summaryOf(message llms.ChatMessage) (string, bool) {
+	if message == nil || message.GetType() != llms.ChatMessageTypeSystem || !strings.HasPrefix(message.GetContent(), SummaryPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(message.GetContent(), SummaryPrefix), true
+}
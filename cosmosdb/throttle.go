@@ -0,0 +1,30 @@
+package cosmosdb
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// retryAfterHeader is the delay in milliseconds Cosmos DB asks a throttled client to wait.
+const retryAfterHeader = "x-ms-retry-after-ms"
+
+// throttled returns err as a *ThrottledError if Cosmos DB rejected the request with 429 after the
+// retries were exhausted, and err unchanged otherwise.
+func throttled(err error) error {
+	var responseErr *azcore.ResponseError
+	if !errors.As(err, &responseErr) || responseErr.StatusCode != http.StatusTooManyRequests {
+		return err
+	}
+
+	throttledErr := &ThrottledError{Err: err}
+	if responseErr.RawResponse != nil {
+		if ms, perr := strconv.ParseFloat(responseErr.RawResponse.Header.Get(retryAfterHeader), 64); perr == nil {
+			throttledErr.RetryAfter = time.Duration(ms * float64(time.Millisecond))
+		}
+	}
+	return throttledErr
+}
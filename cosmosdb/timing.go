@@ -0,0 +1,92 @@
+package cosmosdb
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// HistoryOperation is a chat history operation timed by an OperationObserver.
+type HistoryOperation string
+
+const (
+	// HistoryRead is a Messages call, or a partial read: MessagesTail, MessagesDesc, MessagesSince,
+	// MessagesByType or SearchMessages.
+	HistoryRead HistoryOperation = "read"
+	// HistoryWrite is an AddMessage (including the Add* helpers), AddMessageIfLast, SetMessages or SetSystemMessage call,
+	// an edit (DeleteMessage, UpdateMessage, RedactMessage, TrimToLastN, TrimBefore) or a metadata write
+	// (SetSessionMetadata, SetSessionTitle, SetSessionStatus).
+	HistoryWrite HistoryOperation = "write"
+	// HistoryClear is a Clear call.
+	HistoryClear HistoryOperation = "clear"
+)
+
+// OperationMetrics describes a chat history operation, which may consist of several Cosmos DB requests.
+type OperationMetrics struct {
+	Operation HistoryOperation
+	SessionID string
+	UserID    string
+	// Latency is the duration of the operation, not including the time waiting for other operations
+	// of the same history to finish.
+	Latency time.Duration
+	// ConflictRetries is the number of times the operation was retried because the session was
+	// modified concurrently.
+	ConflictRetries int
+	// ThrottledRetries is the number of requests retried because they were throttled (429). It is only
+	// counted if the policy returned by NewMetricsPolicy is part of the client pipeline.
+	ThrottledRetries int
+	// Err is the error returned by the operation, nil if it succeeded.
+	Err error
+}
+
+// OperationObserver receives the timing of every read, write and clear operation of a history,
+// e.g. to attribute slow partitions or throttling to specific sessions. Implementations must be
+// safe for concurrent use.
+type OperationObserver interface {
+	ObserveOperation(OperationMetrics)
+}
+
+// operationTracker counts the retries of the operation in progress. It is passed in the context.
+type operationTracker struct {
+	conflictRetries  atomic.Int32
+	throttledRetries atomic.Int32
+}
+
+type operationTrackerKey struct{}
+
+// startOperation starts timing an operation if an OperationObserver is set. Requests made with
+// the returned context are attributed to the operation, the returned function reports it.
+func (h *CosmosDBChatMessageHistory) startOperation(ctx context.Context, operation HistoryOperation) (context.Context, func(error)) {
+	if h.operationObserver == nil {
+		return ctx, func(error) {}
+	}
+
+	start := time.Now()
+	tracker := &operationTracker{}
+	finish := func(err error) {
+		h.operationObserver.ObserveOperation(OperationMetrics{
+			Operation:        operation,
+			SessionID:        h.sessionID,
+			UserID:           h.userID,
+			Latency:          time.Since(start),
+			ConflictRetries:  int(tracker.conflictRetries.Load()),
+			ThrottledRetries: int(tracker.throttledRetries.Load()),
+			Err:              err,
+		})
+	}
+	return context.WithValue(ctx, operationTrackerKey{}, tracker), finish
+}
+
+// countRetry counts a conflict retry of the operation timed in ctx, if any.
+func countRetry(ctx context.Context) {
+	if tracker, ok := ctx.Value(operationTrackerKey{}).(*operationTracker); ok {
+		tracker.conflictRetries.Add(1)
+	}
+}
+
+// countThrottled counts a throttled request of the operation timed in ctx, if any.
+func countThrottled(ctx context.Context) {
+	if tracker, ok := ctx.Value(operationTrackerKey{}).(*operationTracker); ok {
+		tracker.throttledRetries.Add(1)
+	}
+}
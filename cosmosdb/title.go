@@ -0,0 +1,89 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+const titlePrompt = `Write a short title (at most 6 words) for the conversation below. Reply with the title only, without quotes.
+
+%s
+
+Title:`
+
+// generateTitle asks the title model for a title based on the first exchange of the conversation,
+// unless the session already has a title.
+func (h *CosmosDBChatMessageHistory) generateTitle(ctx context.Context) error {
+	if h.metadata != nil && h.metadata.Title != "" {
+		return nil
+	}
+
+	stored, err := h.readMetadata(ctx)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return nil
+	}
+	if stored.Metadata != nil && stored.Metadata.Title != "" {
+		h.metadata = stored.Metadata
+		return nil
+	}
+
+	messages, err := h.loadMessages(ctx)
+	if err != nil {
+		return err
+	}
+	exchange := firstExchange(plainMessages(messages))
+	if exchange == nil {
+		return nil
+	}
+
+	lines, err := llms.GetBufferString(exchange, "Human", "AI")
+	if err != nil {
+		return fmt.Errorf("failed to format messages for title generation: %w", err)
+	}
+
+	title, err := llms.GenerateFromSinglePrompt(ctx, h.titleModel, fmt.Sprintf(titlePrompt, lines))
+	if err != nil {
+		return fmt.Errorf("failed to generate title: %w", err)
+	}
+	title = strings.Trim(strings.TrimSpace(title), `"'`)
+	if title == "" {
+		return nil
+	}
+
+	err = h.setMetadataField(ctx, "title", title, func(m *SessionMetadata) { m.Title = title })
+	if err != nil {
+		return fmt.Errorf("failed to set session title: %w", err)
+	}
+	return nil
+}
+
+// firstExchange returns the first user message(s) and the AI replies to them,
+// or nil if the conversation has no complete exchange yet.
+func firstExchange(messages []llms.ChatMessage) []llms.ChatMessage {
+	start, reply := -1, -1
+	for i, message := range messages {
+		switch message.GetType() {
+		case llms.ChatMessageTypeHuman:
+			if reply >= 0 {
+				return messages[start:i]
+			}
+			if start < 0 {
+				start = i
+			}
+		case llms.ChatMessageTypeAI:
+			if start >= 0 && reply < 0 {
+				reply = i
+			}
+		}
+	}
+	if reply < 0 {
+		return nil
+	}
+	return messages[start:]
+}
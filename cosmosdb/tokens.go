@@ -0,0 +1,40 @@
+package cosmosdb
+
+import "github.com/tmc/langchaingo/llms"
+
+// TokenCounter counts the tokens of a message content, typically with the tokenizer of the model
+// the conversation is sent to.
+type TokenCounter interface {
+	CountTokens(text string) int
+}
+
+// TokenCounterFunc adapts a function to the TokenCounter interface.
+type TokenCounterFunc func(text string) int
+
+// CountTokens calls f(text).
+func (f TokenCounterFunc) CountTokens(text string) int {
+	return f(text)
+}
+
+// NewModelTokenCounter returns a TokenCounter using the tiktoken encoding of the given model
+// (see llms.CountTokens), falling back to an approximation for unknown models.
+func NewModelTokenCounter(model string) TokenCounter {
+	return TokenCounterFunc(func(text string) int {
+		return llms.CountTokens(model, text)
+	})
+}
+
+// tokenSuffix returns the longest suffix of messages whose content fits into maxTokens.
+// The last message is always kept, even if it doesn't fit on its own.
+func tokenSuffix(messages []llms.ChatMessage, maxTokens int, counter TokenCounter) []llms.ChatMessage {
+	total := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i] != nil {
+			total += counter.CountTokens(messages[i].GetContent())
+		}
+		if total > maxTokens && i < len(messages)-1 {
+			return messages[i+1:]
+		}
+	}
+	return messages
+}
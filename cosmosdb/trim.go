@@ -0,0 +1,95 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// TrimToLastN removes all but the last n messages from the stored conversation. The write is
+// conditioned on the ETag of the read, messages appended concurrently are kept.
+func (h *CosmosDBChatMessageHistory) TrimToLastN(ctx context.Context, n int) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, finish := h.startOperation(ctx, HistoryWrite)
+	defer func() { finish(err) }()
+
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return err
+	}
+	if n < 0 {
+		return fmt.Errorf("number of messages to keep cannot be negative")
+	}
+
+	messages, err := h.loadMessages(ctx)
+	if err != nil {
+		return err
+	}
+	if len(messages) <= n {
+		return nil
+	}
+
+	return h.trim(ctx, messages[:len(messages)-n], messages[len(messages)-n:])
+}
+
+// TrimBefore removes the messages added before t from the stored conversation. Messages written by
+// earlier versions of this package have no creation time; they are removed only if a later message
+// was added before t. The write is conditioned on the ETag of the read, messages appended
+// concurrently are kept.
+func (h *CosmosDBChatMessageHistory) TrimBefore(ctx context.Context, t time.Time) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, finish := h.startOperation(ctx, HistoryWrite)
+	defer func() { finish(err) }()
+
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return err
+	}
+
+	messages, err := h.loadMessages(ctx)
+	if err != nil {
+		return err
+	}
+
+	cut := 0
+	for i, message := range messages {
+		if cached, ok := message.(cachedMessage); ok && cached.createdAt != nil && cached.createdAt.Before(t) {
+			cut = i + 1
+		}
+	}
+	if cut == 0 {
+		return nil
+	}
+
+	return h.trim(ctx, messages[:cut], messages[cut:])
+}
+
+// trim replaces the stored conversation with the remaining messages, deleting the document if none
+// remain, and records the removed messages in the audit log.
+func (h *CosmosDBChatMessageHistory) trim(ctx context.Context, removed, remaining []llms.ChatMessage) error {
+	if err := h.checkActive(); err != nil {
+		return err
+	}
+
+	var err error
+	if len(remaining) == 0 {
+		err = h.clear(ctx)
+	} else {
+		err = h.replaceMessages(ctx, remaining)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to trim chat history: %w", err)
+	}
+	if err := h.afterModify(ctx); err != nil {
+		return err
+	}
+	return h.audit(ctx, AuditTrim, messageIDs(removed)...)
+}
@@ -0,0 +1,143 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// TokenUsage is the number of tokens used by a model call.
+type TokenUsage struct {
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+	TotalTokens      int `json:"totalTokens"`
+}
+
+func (u *TokenUsage) add(other TokenUsage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+}
+
+// AddMessageWithUsage adds a message along with the number of tokens used to generate it (e.g. as
+// reported by the model or a callbacks handler). The usage is returned by StoredMessages and summed
+// up by SessionTokenUsage. TotalTokens defaults to the sum of the prompt and completion tokens.
+func (h *CosmosDBChatMessageHistory) AddMessageWithUsage(ctx context.Context, message llms.ChatMessage, usage TokenUsage) error {
+	if message == nil {
+		return fmt.Errorf("cannot add nil message")
+	}
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	return h.AddMessage(ctx, cachedMessage{ChatMessage: message, usage: &usage})
+}
+
+// SessionTokenUsage returns the token usage of the session, summed up over the messages stored with
+// a usage, e.g. for cost dashboards. The usages are selected server side unless the document is
+// compressed or chunked. Usage of messages removed by windows, trimming or summarization is not included.
+func (h *CosmosDBChatMessageHistory) SessionTokenUsage(ctx context.Context) (TokenUsage, error) {
+	usages, err := h.messageUsages(ctx)
+	if err != nil {
+		return TokenUsage{}, err
+	}
+
+	var total TokenUsage
+	for _, usage := range usages {
+		total.add(usage.Usage)
+	}
+	return total, nil
+}
+
+// messageUsage is the token usage of a message along with the model that generated it.
+type messageUsage struct {
+	Usage TokenUsage `json:"usage"`
+	Model string     `json:"model"`
+}
+
+// messageUsages returns the usages of the stored messages that have one.
+func (h *CosmosDBChatMessageHistory) messageUsages(ctx context.Context) ([]messageUsage, error) {
+	query := "SELECT ARRAY(SELECT m.usage, m.generationInfo.model FROM m IN c.messages WHERE IS_DEFINED(m.usage)) AS usages, " +
+		"c.chunks, c.compression FROM c WHERE c.id = @id"
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@id", Value: h.sessionID}},
+	}
+
+	var session *struct {
+		Usages      []messageUsage `json:"usages"`
+		Chunks      []string       `json:"chunks"`
+		Compression string         `json:"compression"`
+	}
+
+	pager := h.container.NewQueryItemsPager(h.mapQuery(query), h.partitionKey(), h.withSessionToken(ctx, &queryOptions))
+	for pager.More() && session == nil {
+		page, err := pager.NextPage(h.requestContext(ctx))
+		err = h.recordCharge(OperationQuery, page.RequestCharge, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query token usage of sessionID %s: %w", h.sessionID, err)
+		}
+		if len(page.Items) > 0 {
+			if err := json.Unmarshal(page.Items[0], &session); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal token usage: %w", err)
+			}
+		}
+	}
+
+	if session == nil {
+		return nil, nil
+	}
+	if session.Compression == "" && len(session.Chunks) == 0 {
+		return session.Usages, nil
+	}
+
+	history, _, err := h.readHistory(ctx)
+	if err != nil || history == nil {
+		return nil, err
+	}
+	var usages []messageUsage
+	for _, message := range history.ChatMessages {
+		if message.Usage == nil {
+			continue
+		}
+		usage := messageUsage{Usage: *message.Usage}
+		if message.GenerationInfo != nil {
+			usage.Model = message.GenerationInfo.Model
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+// usageFromGenerationInfo extracts the token usage from the generation info of a content choice.
+// Providers report it under different keys, e.g. PromptTokens (OpenAI) or InputTokens (Anthropic).
+// It returns nil if the generation info doesn't contain a token count.
+func usageFromGenerationInfo(info map[string]any) *TokenUsage {
+	count := func(keys ...string) (int, bool) {
+		for _, key := range keys {
+			switch v := info[key].(type) {
+			case int:
+				return v, true
+			case int32:
+				return int(v), true
+			case int64:
+				return int(v), true
+			case float64:
+				return int(v), true
+			}
+		}
+		return 0, false
+	}
+
+	prompt, hasPrompt := count("PromptTokens", "InputTokens")
+	completion, hasCompletion := count("CompletionTokens", "OutputTokens")
+	total, hasTotal := count("TotalTokens")
+	if !hasPrompt && !hasCompletion && !hasTotal {
+		return nil
+	}
+	if !hasTotal {
+		total = prompt + completion
+	}
+	return &TokenUsage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: total}
+}
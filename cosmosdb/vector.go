@@ -0,0 +1,477 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// VectorDistanceFunction is the metric used to compare message embeddings.
+type VectorDistanceFunction string
+
+const (
+	// VectorDistanceCosine compares the angle of the vectors, from -1 (opposite) to 1 (most similar).
+	VectorDistanceCosine VectorDistanceFunction = "cosine"
+	// VectorDistanceDotProduct compares the dot product of the vectors, higher is more similar.
+	VectorDistanceDotProduct VectorDistanceFunction = "dotproduct"
+	// VectorDistanceEuclidean compares the distance of the vectors, lower is more similar.
+	VectorDistanceEuclidean VectorDistanceFunction = "euclidean"
+)
+
+// rrfK is the rank constant of reciprocal rank fusion, which dampens the weight of the top ranks.
+const rrfK = 60
+
+// embeddingPath is the path of the message embeddings in the history documents.
+const embeddingPath = "/messages/[]/embedding"
+
+// Embedder computes embedding vectors, e.g. with Azure OpenAI, a local model or a mock in tests. It has
+// the method set of embeddings.Embedder of langchaingo, so langchaingo embedders can be used directly.
+// Message contents are embedded with EmbedDocuments and queries with EmbedQuery, since some models
+// embed them differently.
+type Embedder interface {
+	EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error)
+	EmbedQuery(ctx context.Context, text string) ([]float32, error)
+}
+
+// EmbedderFunc adapts a function to the Embedder interface, embedding documents and queries alike.
+type EmbedderFunc func(ctx context.Context, text string) ([]float32, error)
+
+// EmbedDocuments calls f for every text.
+func (f EmbedderFunc) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, 0, len(texts))
+	for _, text := range texts {
+		embedding, err := f(ctx, text)
+		if err != nil {
+			return nil, err
+		}
+		embeddings = append(embeddings, embedding)
+	}
+	return embeddings, nil
+}
+
+// EmbedQuery calls f(ctx, text).
+func (f EmbedderFunc) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	return f(ctx, text)
+}
+
+// SimilarMessage is a message returned by SimilarMessages.
+type SimilarMessage struct {
+	SessionID string
+	MessageID string
+	Message   llms.ChatMessage
+	// Score is the result of VectorDistance for the message embedding and the query vector.
+	Score float64
+}
+
+// VectorEmbeddingPolicy is the vector embedding policy of a container, in the format of the Cosmos DB
+// REST API, ARM templates and the Azure CLI (--vector-embeddings).
+type VectorEmbeddingPolicy struct {
+	VectorEmbeddings []VectorEmbedding `json:"vectorEmbeddings"`
+}
+
+// VectorEmbedding describes the vectors stored at a path of the documents.
+type VectorEmbedding struct {
+	Path             string                 `json:"path"`
+	DataType         string                 `json:"dataType"`
+	Dimensions       int                    `json:"dimensions"`
+	DistanceFunction VectorDistanceFunction `json:"distanceFunction"`
+}
+
+// MessageVectorEmbeddingPolicy returns the vector embedding policy for the message embeddings added with
+// AddMessageWithEmbedding. The azcosmos SDK can't set vector policies, so apply it when creating the
+// container with the Azure CLI, Bicep or the portal, e.g. json.Marshal it for --vector-embeddings.
+func MessageVectorEmbeddingPolicy(dimensions int, distance VectorDistanceFunction) VectorEmbeddingPolicy {
+	return VectorEmbeddingPolicy{VectorEmbeddings: []VectorEmbedding{{
+		Path:             embeddingPath,
+		DataType:         "float32",
+		Dimensions:       dimensions,
+		DistanceFunction: distance,
+	}}}
+}
+
+// MessageVectorIndexingPolicy returns policy with the message embeddings excluded from the range
+// index. Indexing every vector component makes writes of messages with an embedding expensive, and
+// SimilarMessages doesn't use the range index. Use it for the IndexingPolicy of the container
+// properties when creating or replacing the container; a nil policy gets the default consistent
+// indexing of all other paths.
+func MessageVectorIndexingPolicy(policy *azcosmos.IndexingPolicy) *azcosmos.IndexingPolicy {
+	if policy == nil {
+		policy = &azcosmos.IndexingPolicy{
+			Automatic:     true,
+			IndexingMode:  azcosmos.IndexingModeConsistent,
+			IncludedPaths: []azcosmos.IncludedPath{{Path: "/*"}},
+		}
+	}
+	excluded := azcosmos.ExcludedPath{Path: embeddingPath + "/*"}
+	if !slices.Contains(policy.ExcludedPaths, excluded) {
+		policy.ExcludedPaths = append(policy.ExcludedPaths, excluded)
+	}
+	return policy
+}
+
+// AddMessageWithEmbedding adds a message along with an embedding vector of its content, e.g. computed
+// with an embeddings model, so that it can be found with SimilarMessages. If the history was created
+// with WithVectorSearch, the embedding must have the configured number of dimensions. Embeddings are
+// stored in the history document and count towards its size.
+func (h *CosmosDBChatMessageHistory) AddMessageWithEmbedding(ctx context.Context, message llms.ChatMessage, embedding []float32) error {
+	if message == nil {
+		return fmt.Errorf("cannot add nil message")
+	}
+	if err := h.validateEmbedding(embedding); err != nil {
+		return err
+	}
+	return h.AddMessage(ctx, cachedMessage{ChatMessage: message, embedding: embedding})
+}
+
+// SimilarMessages returns the k messages of the user whose embedding is closest to vector, most similar
+// first, e.g. to recall related context from past conversations as semantic memory. All sessions in
+// the partition of this history are searched, which by default are all sessions of the user, using
+// VectorDistance with the distance function set with WithVectorSearch (cosine by default). Messages
+// added without an embedding and compressed documents are not searched.
+func (h *CosmosDBChatMessageHistory) SimilarMessages(ctx context.Context, vector []float32, k int) ([]SimilarMessage, error) {
+	return h.similarMessages(h.readContext(ctx), vector, k, false)
+}
+
+// RelevantMessages embeds queryText with the embedder set with WithEmbedder and returns the k messages
+// of this session whose embedding is closest to it, in conversation order, e.g. to build the prompt
+// from the relevant parts of a long conversation instead of the last N messages. Only messages with an
+// embedding (see WithEmbedder) are considered, unless the history was created with WithHybridSearch.
+// Use SimilarMessages for the scores or other sessions.
+func (h *CosmosDBChatMessageHistory) RelevantMessages(ctx context.Context, queryText string, k int) ([]llms.ChatMessage, error) {
+	ctx = h.readContext(ctx)
+	if h.embedder == nil {
+		return nil, fmt.Errorf("relevant messages require an embedder, see WithEmbedder")
+	}
+	if k <= 0 {
+		return []llms.ChatMessage{}, nil
+	}
+
+	similar, err := h.relevantMessages(ctx, queryText, k, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// messages with an embedding always have a creation time
+	sort.SliceStable(similar, func(i, j int) bool {
+		createdAt, _ := MessageCreatedAt(similar[i].Message)
+		other, _ := MessageCreatedAt(similar[j].Message)
+		return createdAt.Before(other)
+	})
+	messages := make([]llms.ChatMessage, 0, len(similar))
+	for _, message := range similar {
+		messages = append(messages, message.Message)
+	}
+	return messages, nil
+}
+
+// relevantMessages embeds queryText and returns the k most relevant messages, most relevant first, in
+// the session of the history (fusing a keyword ranking with WithHybridSearch) or in its partition.
+func (h *CosmosDBChatMessageHistory) relevantMessages(ctx context.Context, queryText string, k int, sessionOnly bool) ([]SimilarMessage, error) {
+	vector, err := h.embedder.EmbedQuery(ctx, queryText)
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed query: %w", err)
+	}
+	if h.hybridSearch && sessionOnly {
+		return h.hybridMessages(ctx, queryText, vector, k)
+	}
+	return h.similarMessages(ctx, vector, k, sessionOnly)
+}
+
+// similarMessages returns the k messages whose embedding is closest to vector, in the partition of
+// the history or only in its session.
+func (h *CosmosDBChatMessageHistory) similarMessages(ctx context.Context, vector []float32, k int, sessionOnly bool) ([]SimilarMessage, error) {
+	if k <= 0 {
+		return []SimilarMessage{}, nil
+	}
+	scores, err := h.vectorScores(ctx, vector, sessionOnly)
+	if err != nil {
+		return nil, err
+	}
+	if len(scores) > k {
+		scores = scores[:k]
+	}
+	return h.loadScored(ctx, scores)
+}
+
+// vectorScores returns the IDs of the messages with an embedding along with its distance to vector,
+// most similar first, in the partition of the history or only in its session.
+func (h *CosmosDBChatMessageHistory) vectorScores(ctx context.Context, vector []float32, sessionOnly bool) ([]SimilarMessage, error) {
+	if err := h.validateEmbedding(vector); err != nil {
+		return nil, err
+	}
+
+	distance := h.vectorDistance
+	if distance == "" {
+		distance = VectorDistanceCosine
+	}
+
+	// Score the messages server side without returning their embeddings, then read the k best ones.
+	// The embeddings inside the messages array can't use a vector index, so they are compared by brute force.
+	sqlQuery := "SELECT IIF(IS_DEFINED(c.chunkOf), c.chunkOf, c.id) AS sessionId, m.id, " +
+		"VectorDistance(m.embedding, @vector, true, {'distanceFunction': '" + string(distance) + "', 'dataType': 'float32'}) AS score " +
+		"FROM c JOIN m IN c.messages WHERE c.userid = @userId AND NOT IS_DEFINED(c.lockOf) AND IS_DEFINED(m.embedding)"
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{
+			{Name: "@userId", Value: h.userID},
+			{Name: "@vector", Value: vector},
+		},
+	}
+	if sessionOnly {
+		sqlQuery += " AND (c.id = @id OR c.chunkOf = @id)"
+		queryOptions.QueryParameters = append(queryOptions.QueryParameters, azcosmos.QueryParameter{Name: "@id", Value: h.sessionID})
+	}
+
+	var scores []SimilarMessage
+	pager := h.readContainer(ctx).NewQueryItemsPager(h.mapQuery(sqlQuery), h.partitionKey(), h.withSessionToken(ctx, &queryOptions))
+	for pager.More() {
+		page, err := pager.NextPage(h.requestContext(ctx))
+		err = h.recordCharge(OperationQuery, page.RequestCharge, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query message embeddings of user %s: %w", h.userID, err)
+		}
+
+		for _, item := range page.Items {
+			var score struct {
+				SessionID string  `json:"sessionId"`
+				ID        string  `json:"id"`
+				Score     float64 `json:"score"`
+			}
+			if err := json.Unmarshal(item, &score); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal message score: %w", err)
+			}
+			scores = append(scores, SimilarMessage{SessionID: score.SessionID, MessageID: score.ID, Score: score.Score})
+		}
+	}
+
+	// Euclidean distances are lower for similar vectors, the other functions are higher
+	sort.SliceStable(scores, func(i, j int) bool {
+		if distance == VectorDistanceEuclidean {
+			return scores[i].Score < scores[j].Score
+		}
+		return scores[i].Score > scores[j].Score
+	})
+	return scores, nil
+}
+
+// hybridMessages returns the k messages of the session ranked best by reciprocal rank fusion of their
+// keyword and vector rankings.
+func (h *CosmosDBChatMessageHistory) hybridMessages(ctx context.Context, queryText string, vector []float32, k int) ([]SimilarMessage, error) {
+	vectorRanking, err := h.vectorScores(ctx, vector, true)
+	if err != nil {
+		return nil, err
+	}
+	keywordRanking, err := h.keywordScores(ctx, queryTerms(queryText))
+	if err != nil {
+		return nil, err
+	}
+
+	fused := fuseRankings(vectorRanking, keywordRanking)
+	if len(fused) > k {
+		fused = fused[:k]
+	}
+	return h.loadScored(ctx, fused)
+}
+
+// keywordScores returns the IDs of the messages of the session containing query terms along with the
+// number of distinct terms they contain as whole words, best first. The messages are selected server
+// side with CONTAINS, or with FullTextContainsAny if the history was created with WithFullTextSearch.
+func (h *CosmosDBChatMessageHistory) keywordScores(ctx context.Context, terms []string) ([]SimilarMessage, error) {
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{
+			{Name: "@userId", Value: h.userID},
+			{Name: "@id", Value: h.sessionID},
+		},
+	}
+	names := make([]string, 0, len(terms))
+	for i, term := range terms {
+		name := fmt.Sprintf("@term%d", i)
+		names = append(names, name)
+		queryOptions.QueryParameters = append(queryOptions.QueryParameters, azcosmos.QueryParameter{Name: name, Value: term})
+	}
+	var condition string
+	if h.fullTextSearch {
+		condition = "FullTextContainsAny(m.data.content, " + strings.Join(names, ", ") + ")"
+	} else {
+		conditions := make([]string, 0, len(names))
+		for _, name := range names {
+			conditions = append(conditions, "CONTAINS(m.data.content, "+name+", true)")
+		}
+		condition = strings.Join(conditions, " OR ")
+	}
+
+	sqlQuery := "SELECT IIF(IS_DEFINED(c.chunkOf), c.chunkOf, c.id) AS sessionId, m.id, m.data.content " +
+		"FROM c JOIN m IN c.messages WHERE c.userid = @userId AND NOT IS_DEFINED(c.lockOf) " +
+		"AND (c.id = @id OR c.chunkOf = @id) AND IS_DEFINED(m.id) AND (" + condition + ")"
+
+	var scores []SimilarMessage
+	pager := h.readContainer(ctx).NewQueryItemsPager(h.mapQuery(sqlQuery), h.partitionKey(), h.withSessionToken(ctx, &queryOptions))
+	for pager.More() {
+		page, err := pager.NextPage(h.requestContext(ctx))
+		err = h.recordCharge(OperationQuery, page.RequestCharge, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search messages of sessionID %s: %w", h.sessionID, err)
+		}
+
+		for _, item := range page.Items {
+			var match struct {
+				SessionID string `json:"sessionId"`
+				ID        string `json:"id"`
+				Content   string `json:"content"`
+			}
+			if err := json.Unmarshal(item, &match); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+			}
+			// CONTAINS also matches terms within other words, e.g. "order" in "reorder"
+			score := matchTerms([]llms.ChatMessage{llms.GenericChatMessage{Content: match.Content}}, terms)
+			if score > 0 {
+				scores = append(scores, SimilarMessage{SessionID: match.SessionID, MessageID: match.ID, Score: float64(score)})
+			}
+		}
+	}
+
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].Score > scores[j].Score })
+	return scores, nil
+}
+
+// fuseRankings combines rankings with reciprocal rank fusion: the score of a message is the sum of
+// 1/(rrfK+rank) over the rankings it appears in, so that messages ranked well by several rankings come
+// first without comparing scores of different scales.
+func fuseRankings(rankings ...[]SimilarMessage) []SimilarMessage {
+	var fused []SimilarMessage
+	index := make(map[string]int)
+	for _, ranking := range rankings {
+		for rank, scored := range ranking {
+			i, ok := index[scored.MessageID]
+			if !ok {
+				i = len(fused)
+				index[scored.MessageID] = i
+				fused = append(fused, SimilarMessage{SessionID: scored.SessionID, MessageID: scored.MessageID})
+			}
+			fused[i].Score += 1 / float64(rrfK+rank+1)
+		}
+	}
+	sort.SliceStable(fused, func(i, j int) bool { return fused[i].Score > fused[j].Score })
+	return fused
+}
+
+// loadScored reads the scored messages and returns them in the same order.
+func (h *CosmosDBChatMessageHistory) loadScored(ctx context.Context, scores []SimilarMessage) ([]SimilarMessage, error) {
+	if len(scores) == 0 {
+		return []SimilarMessage{}, nil
+	}
+
+	messages, err := h.messagesByID(ctx, scores)
+	if err != nil {
+		return nil, err
+	}
+	similar := make([]SimilarMessage, 0, len(scores))
+	for _, score := range scores {
+		// skip messages removed since they were scored
+		if message, ok := messages[score.MessageID]; ok {
+			score.Message = message.toCachedMessage()
+			similar = append(similar, score)
+		}
+	}
+	return similar, nil
+}
+
+// messagesByID reads the scored messages, with their offloaded contents, keyed by message ID.
+func (h *CosmosDBChatMessageHistory) messagesByID(ctx context.Context, scores []SimilarMessage) (map[string]Message, error) {
+	ids := make([]string, 0, len(scores))
+	for _, score := range scores {
+		ids = append(ids, score.MessageID)
+	}
+
+	sqlQuery := "SELECT VALUE m FROM c JOIN m IN c.messages " +
+		"WHERE c.userid = @userId AND NOT IS_DEFINED(c.lockOf) AND ARRAY_CONTAINS(@ids, m.id)"
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{
+			{Name: "@userId", Value: h.userID},
+			{Name: "@ids", Value: ids},
+		},
+	}
+
+	var messages []Message
+	pager := h.readContainer(ctx).NewQueryItemsPager(h.mapQuery(sqlQuery), h.partitionKey(), h.withSessionToken(ctx, &queryOptions))
+	for pager.More() {
+		page, err := pager.NextPage(h.requestContext(ctx))
+		err = h.recordCharge(OperationQuery, page.RequestCharge, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read similar messages of user %s: %w", h.userID, err)
+		}
+
+		for _, item := range page.Items {
+			var message Message
+			if err := json.Unmarshal(item, &message); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+			}
+			messages = append(messages, message)
+		}
+	}
+
+	if err := h.loadOffloadedContent(ctx, messages); err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Message, len(messages))
+	for _, message := range messages {
+		byID[message.ID] = message
+	}
+	return byID, nil
+}
+
+// embedMessage returns message along with the embedding of its content computed by the embedder set
+// with WithEmbedder, unless it has an embedding already or no text content.
+func (h *CosmosDBChatMessageHistory) embedMessage(ctx context.Context, message llms.ChatMessage) (llms.ChatMessage, error) {
+	// embedded after it was written by the pipeline set with WithEmbeddingPipeline
+	if h.embedder == nil || h.embeddingPipeline != nil || message.GetContent() == "" {
+		return message, nil
+	}
+	cached := stampMessage(message)
+	if cached.embedding != nil {
+		return cached, nil
+	}
+
+	embeddings, err := h.embedder.EmbedDocuments(ctx, []string{message.GetContent()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed message: %w", err)
+	}
+	if len(embeddings) != 1 {
+		return nil, fmt.Errorf("embedder returned %d embeddings for 1 message", len(embeddings))
+	}
+	if err := h.validateEmbedding(embeddings[0]); err != nil {
+		return nil, err
+	}
+	cached.embedding = embeddings[0]
+	return cached, nil
+}
+
+// validateEmbedding checks that an embedding or query vector has the dimensions set with WithVectorSearch.
+func (h *CosmosDBChatMessageHistory) validateEmbedding(vector []float32) error {
+	if len(vector) == 0 {
+		return fmt.Errorf("embedding cannot be empty")
+	}
+	if h.vectorDimensions > 0 && len(vector) != h.vectorDimensions {
+		return fmt.Errorf("embedding has %d dimensions, expected %d", len(vector), h.vectorDimensions)
+	}
+	return nil
+}
+
+// validateVectorDistance checks that distance is one of the distance functions supported by Cosmos DB.
+func validateVectorDistance(distance VectorDistanceFunction) error {
+	switch distance {
+	case VectorDistanceCosine, VectorDistanceDotProduct, VectorDistanceEuclidean:
+		return nil
+	default:
+		return fmt.Errorf("unsupported vector distance function %q", distance)
+	}
+}
@@ -0,0 +1,66 @@
+package cosmosdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// SchemaVersion is the version of the history document layout written by this package. It is stored
+// in the schemaVersion property of session and chunk documents. Documents written by earlier versions of
+// the package don't have the property and are version 0.
+//
+// Documents of an older version are upgraded in memory when they are read, and stored in the current
+// version the next time they are rewritten as a whole (e.g. by SetMessages). Writes that patch a document,
+// such as AddMessage, keep its version.
+//
+// The schemaVersion property is reserved since the version was introduced: a FieldMapping whose Extra
+// properties contain it, which was accepted before, is now rejected by NewCosmosDBChatMessageHistory.
+const SchemaVersion = 1
+
+// schemaUpgraders upgrade a document from the version of its index to the next one. A change of the
+// document layout adds an upgrader and increments SchemaVersion.
+var schemaUpgraders = []func(doc map[string]json.RawMessage) error{
+	upgradeSchemaV0,
+}
+
+// upgradeDocument upgrades a serialized history or chunk item to SchemaVersion. Documents of the
+// current version are returned as they are.
+func upgradeDocument(data []byte) ([]byte, error) {
+	var header struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+
+	version := header.SchemaVersion
+	if version == SchemaVersion {
+		return data, nil
+	}
+	if version < 0 || version > SchemaVersion {
+		return nil, fmt.Errorf("%w: document version %d, supported up to %d", ErrUnsupportedSchemaVersion, version, SchemaVersion)
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	for ; version < SchemaVersion; version++ {
+		if err := schemaUpgraders[version](doc); err != nil {
+			return nil, fmt.Errorf("failed to upgrade document from version %d: %w", version, err)
+		}
+	}
+	doc["schemaVersion"] = json.RawMessage(strconv.Itoa(SchemaVersion))
+
+	return json.Marshal(doc)
+}
+
+// upgradeSchemaV0 upgrades documents written before the schema was versioned. Their messages may be
+// null or missing (e.g. sessions created by other clients), version 1 always has an array.
+func upgradeSchemaV0(doc map[string]json.RawMessage) error {
+	if messages, ok := doc["messages"]; !ok || string(messages) == "null" {
+		doc["messages"] = json.RawMessage("[]")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// errWindowExceeded signals that the stored conversation is longer than the configured
+// window and has to be trimmed by rewriting the document.
+var errWindowExceeded = errors.New("stored conversation exceeds the max messages window")
+
+// applyWindow returns the messages that are kept with the configured max messages
+// and max tokens windows.
+func (h *CosmosDBChatMessageHistory) applyWindow(messages []llms.ChatMessage) []llms.ChatMessage {
+	if h.maxMessages > 0 && len(messages) > h.maxMessages {
+		messages = messages[len(messages)-h.maxMessages:]
+	}
+	if h.maxTokens > 0 {
+		messages = tokenSuffix(messages, h.maxTokens, h.tokenCounter)
+	}
+	return messages
+}
+
+// appendMessageWindowed appends the message with a single patch request, removing the oldest
+// message in the same request once the window is full. The array length is checked server side,
+// the cached messages are only used to guess which of the two patches applies.
+func (h *CosmosDBChatMessageHistory) appendMessageWindowed(ctx context.Context, message Message) error {
+	// the cache already contains the new message
+	atCapacity := len(h.messages) > h.maxMessages
+
+	for attempt := 0; attempt < 2; attempt++ {
+		patch := h.newAppendPatch(message)
+		if atCapacity {
+			patch.AppendRemove(h.messagesPath("/0"))
+			patch.SetCondition(h.mapQuery(fmt.Sprintf("FROM c WHERE %s AND ARRAY_LENGTH(c.messages) = %d", activeCondition, h.maxMessages)))
+		} else {
+			patch.SetCondition(h.mapQuery(fmt.Sprintf("FROM c WHERE %s AND ARRAY_LENGTH(c.messages) < %d", activeCondition, h.maxMessages)))
+		}
+
+		err := h.record(OperationPatch)(h.container.PatchItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, patch, h.writeOptions()))
+		if err == nil {
+			h.messages = h.applyWindow(h.messages)
+			return nil
+		}
+		if !isPreconditionFailedError(err) {
+			return err
+		}
+		atCapacity = !atCapacity
+	}
+
+	return errWindowExceeded
+}
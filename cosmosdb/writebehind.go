@@ -0,0 +1,301 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// maxPatchOperations is the number of operations Cosmos DB accepts in a single patch request.
+const maxPatchOperations = 10
+
+// Close writes the messages queued by WithWriteBehind and buffered by WithWriteBuffer, and returns
+// the error of the first write that failed since the last Flush. Messages added to a history
+// created with WithWriteBehind afterwards are rejected with ErrHistoryClosed.
+func (h *CosmosDBChatMessageHistory) Close(ctx context.Context) error {
+	h.queueMu.Lock()
+	h.closed = true
+	h.queueMu.Unlock()
+
+	return h.Flush(ctx)
+}
+
+// enqueue queues message for the write-behind worker, starting it if it isn't running. Once the
+// queue is full, the caller writes the queued messages itself before returning.
+func (h *CosmosDBChatMessageHistory) enqueue(ctx context.Context, message llms.ChatMessage) error {
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	if err := h.checkBudget(); err != nil {
+		return err
+	}
+	if message == nil {
+		return fmt.Errorf("cannot add nil message")
+	}
+	// embedded by the caller, so that a failing embedder is reported by AddMessage
+	message, err := h.embedMessage(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	h.queueMu.Lock()
+	if h.closed {
+		h.queueMu.Unlock()
+		return ErrHistoryClosed
+	}
+	h.queue = append(h.queue, stampMessage(message))
+	full := len(h.queue) >= h.queueSize
+	start := !h.writing
+	h.writing = true
+	h.queueMu.Unlock()
+
+	if start {
+		go h.writeBehind()
+	}
+	if !full {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.drain(ctx)
+}
+
+// writeBehind writes the queued messages until the queue is empty or a write failed. The messages
+// added while a batch is written are written together with the next one.
+func (h *CosmosDBChatMessageHistory) writeBehind() {
+	for {
+		h.mu.Lock()
+		// reported to the error callback and by Flush
+		err := h.drain(context.Background())
+		h.mu.Unlock()
+
+		h.queueMu.Lock()
+		if err != nil || len(h.queue) == 0 {
+			h.writing = false
+			h.queueMu.Unlock()
+			return
+		}
+		h.queueMu.Unlock()
+	}
+}
+
+// dequeue removes and returns the queued messages.
+func (h *CosmosDBChatMessageHistory) dequeue() []llms.ChatMessage {
+	h.queueMu.Lock()
+	defer h.queueMu.Unlock()
+
+	queued := h.queue
+	h.queue = nil
+	return queued
+}
+
+// drain writes the queued messages in the order they were added. Messages that could not be written
+// are buffered (see WithWriteBuffer) or handed to the dead letter, and the error is reported to the
+// callback set with WithWriteBehind and returned by the next Flush. The caller must hold h.mu.
+func (h *CosmosDBChatMessageHistory) drain(ctx context.Context) error {
+	// the writes may read the conversation, which drains the queue
+	if h.draining {
+		return nil
+	}
+	h.draining = true
+	defer func() { h.draining = false }()
+
+	for {
+		batch := h.dequeue()
+		if len(batch) == 0 {
+			return nil
+		}
+
+		// Messages buffered during an outage are written first to keep the order
+		if len(h.pending) > 0 {
+			if err := h.flush(ctx); err != nil {
+				return h.writeBehindFailed(ctx, batch, err)
+			}
+		}
+
+		batch, err := h.dropDuplicates(ctx, batch)
+		if err != nil && (h.bufferSize == 0 || !isTransientError(err)) {
+			return h.writeBehindFailed(ctx, batch, err)
+		}
+
+		written, err := h.addMessages(ctx, batch)
+		if written > 0 {
+			if err := h.audit(ctx, AuditAdd, messageIDs(batch[:written])...); err != nil {
+				return h.reportWriteBehind(err)
+			}
+			for _, message := range batch[:written] {
+				if err := h.afterAdd(ctx, message); err != nil {
+					return h.reportWriteBehind(err)
+				}
+			}
+		}
+		if err != nil {
+			return h.writeBehindFailed(ctx, batch[written:], err)
+		}
+	}
+}
+
+// writeBehindFailed buffers the messages of a failed write if possible, and dead-letters the others.
+func (h *CosmosDBChatMessageHistory) writeBehindFailed(ctx context.Context, messages []llms.ChatMessage, err error) error {
+	var lost []llms.ChatMessage
+	for _, message := range messages {
+		if h.buffer(message, err) != nil {
+			lost = append(lost, message)
+		}
+	}
+	if len(lost) == 0 {
+		// reported to the BufferRiskFunc instead
+		return nil
+	}
+
+	err = fmt.Errorf("failed to write %d queued messages: %w", len(lost), err)
+	return h.reportWriteBehind(h.deadLetter(ctx, err, false, lost...))
+}
+
+// reportWriteBehind passes err to the callback set with WithWriteBehind and keeps it for Flush.
+func (h *CosmosDBChatMessageHistory) reportWriteBehind(err error) error {
+	if h.writeBehindErr == nil {
+		h.writeBehindErr = err
+	}
+	if h.onWriteBehindError != nil {
+		h.onWriteBehindError(err)
+	}
+	return err
+}
+
+// dropDuplicates removes the messages that repeat the message before them within the dedupe window.
+// Only the first message is compared with the stored conversation.
+func (h *CosmosDBChatMessageHistory) dropDuplicates(ctx context.Context, messages []llms.ChatMessage) ([]llms.ChatMessage, error) {
+	if h.dedupeWindow == 0 {
+		return messages, nil
+	}
+
+	duplicate, err := h.isDuplicate(ctx, messages[0])
+	kept := make([]llms.ChatMessage, 0, len(messages))
+	if !duplicate {
+		kept = append(kept, messages[0])
+	}
+	for i := 1; i < len(messages); i++ {
+		if !h.repeats(stampMessage(messages[i-1]).toMessage(), messages[i]) {
+			kept = append(kept, messages[i])
+		}
+	}
+	return kept, err
+}
+
+// discardQueue drops the queued messages, e.g. when the conversation is replaced.
+func (h *CosmosDBChatMessageHistory) discardQueue() {
+	h.queueMu.Lock()
+	defer h.queueMu.Unlock()
+	h.queue = nil
+}
+
+// addMessages persists messages in order and returns the number of messages written. Unless the
+// storage mode requires rewriting the document, up to maxPatchOperations messages are appended with a
+// single patch request. A compressed or token limited document is rewritten once for all messages.
+func (h *CosmosDBChatMessageHistory) addMessages(ctx context.Context, messages []llms.ChatMessage) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
+	}
+	if h.rewriteOnAdd() {
+		if err := h.rewriteWithMessages(ctx, messages...); err != nil {
+			return 0, fmt.Errorf("failed to add messages to chat history in Cosmos DB: %w", err)
+		}
+		return len(messages), nil
+	}
+
+	// A chunked or windowed append may roll over or remove messages, so append one at a time
+	batchSize := maxPatchOperations
+	if h.maxChunkBytes > 0 || h.maxMessages > 0 {
+		batchSize = 1
+	} else if h.ttl != nil {
+		batchSize--
+	}
+
+	written := 0
+	for written < len(messages) {
+		batch := messages[written:min(written+batchSize, len(messages))]
+		var err error
+		if len(batch) == 1 {
+			err = h.addMessage(ctx, batch[0])
+		} else {
+			err = h.appendMessages(ctx, batch)
+		}
+		if err != nil {
+			return written, err
+		}
+		written += len(batch)
+	}
+	return written, nil
+}
+
+// appendMessages appends messages to the stored document with a single patch request, creating the
+// document if it doesn't exist. Either all messages are added to the in-memory cache or none.
+func (h *CosmosDBChatMessageHistory) appendMessages(ctx context.Context, messages []llms.ChatMessage) error {
+	patch := azcosmos.PatchOperations{}
+	cached := make([]llms.ChatMessage, 0, len(messages))
+	var size int
+	for _, message := range messages {
+		stamped := stampMessage(message)
+		stored, err := h.newMessage(ctx, stamped)
+		if err != nil {
+			return err
+		}
+		n, _ := messageSize(stored)
+		if n > maxDocumentBytes {
+			return h.documentTooLarge(n)
+		}
+		size += n
+		patch.AppendAdd(h.messagesPath("/-"), stored)
+		cached = append(cached, stamped)
+	}
+	if h.ttl != nil {
+		patch.AppendSet("/ttl", *h.ttl)
+	}
+	patch.SetCondition("FROM c WHERE " + activeCondition)
+
+	previous := len(h.messages)
+	h.messages = append(h.messages, cached...)
+
+	err := h.record(OperationPatch)(h.container.PatchItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, patch, h.writeOptions()))
+	if isNotFoundError(err) {
+		// The document doesn't exist yet, create it with the full conversation
+		etag, chunkIDs, werr := h.writeHistory(ctx, h.messages, "")
+		if werr == nil {
+			h.etag = etag
+			h.chunkIDs = chunkIDs
+			return nil
+		}
+		if !isConflictError(werr) {
+			h.messages = h.messages[:previous]
+			return fmt.Errorf("failed to create chat history in Cosmos DB: %w", werr)
+		}
+
+		// Another writer created the document in the meantime, append to it instead
+		err = h.record(OperationPatch)(h.container.PatchItem(h.requestContext(ctx), h.partitionKey(), h.sessionID, patch, h.writeOptions()))
+	}
+	if isPreconditionFailedError(err) {
+		err = ErrSessionClosed
+	}
+	if isTooLargeError(err) {
+		err = h.documentTooLarge(h.estimatedSize())
+	}
+	if err != nil {
+		h.messages = h.messages[:previous]
+		if errors.Is(err, ErrSessionClosed) || errors.Is(err, ErrDocumentTooLarge) {
+			return err
+		}
+		return fmt.Errorf("failed to append messages to chat history in Cosmos DB: %w", err)
+	}
+
+	if h.documentSize >= 0 {
+		h.setDocumentSize(h.documentSize + size)
+	}
+	// The document may contain messages from other writers that are not in the cache
+	h.etag = ""
+	return nil
+}